@@ -14,37 +14,215 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/gambol99/config-fs/store"
-	"github.com/golang/glog"
+	"github.com/gambol99/config-fs/store/logging"
 )
 
+/* the log of the process */
+var logger = logging.For(logging.SUBSYSTEM_MAIN)
+
 func main() {
-	/* step: parse the command line options */
+	/* step: bind the configuration of the store to the command line options and parse them */
+	config := store.DefaultConfig()
+	store.RegisterFlags(flag.CommandLine, &config)
 	flag.Parse()
+	/* step: the logging of the subsystems, as text via glog or json */
+	if err := config.ConfigureLogging(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration, error: %s\n", err)
+		os.Exit(1)
+	}
+	/* step: the context is cancelled on a shutdown signal */
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+	/* step: check for any commands */
+	if flag.NArg() > 0 {
+		code := RunCommand(ctx, config, flag.Arg(0), flag.Args()[1:])
+		stop()
+		os.Exit(code)
+	}
+	/* step: when observing, we only report the drift and never write */
+	if config.IsObserving() {
+		err := store.ObserveMountPoint(ctx, config)
+		if config.IsOnetime() {
+			os.Exit(OnetimeExitCode(err))
+		}
+		if err != nil {
+			logger.Errorf("Failed to observe the mount point, error: %s", err)
+			logger.Flush()
+			os.Exit(1)
+		}
+		logger.Flush()
+		return
+	}
 	/* step: create the configuration store */
-	storefs, err := store.NewConfigurationStore()
+	storefs, err := store.New(config)
 	if err != nil {
-		glog.Errorf("Failed to initialize a configuration fs, error: %s", err)
+		logger.Errorf("Failed to initialize a configuration fs, error: %s", err)
+		os.Exit(1)
+	}
+
+	/* step: serve the health endpoints, if requested, ahead of the initial sync */
+	if err := store.ServeHealth(ctx, config, storefs, Version); err != nil {
+		logger.Errorf("Failed to serve the health endpoints, error: %s", err)
+		storefs.Close()
+		logger.Flush()
 		os.Exit(1)
 	}
-	glog.Infof("Starting the config synchronization")
-	if err := storefs.Synchronize(); err != nil {
-		glog.Errorf("Failed to the synchronize the configuration, error: %s", err)
+
+	/* step: serve the admin api, if requested */
+	if err := store.ServeAdmin(ctx, config, storefs); err != nil {
+		logger.Errorf("Failed to serve the admin api, error: %s", err)
+		storefs.Close()
+		logger.Flush()
 		os.Exit(1)
 	}
-	glog.Infof("Waiting for signal to quit")
-	/* step: setup the channel for shutdown signals */
-	signalChannel := make(chan os.Signal)
-	/* step: register the signals */
-	signal.Notify(signalChannel, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	/* step: push the metrics to statsd, if requested */
+	if err := config.PushMetrics(ctx); err != nil {
+		logger.Errorf("Failed to push the metrics, error: %s", err)
+		storefs.Close()
+		logger.Flush()
+		os.Exit(1)
+	}
+
+	logger.Infof("Starting the config synchronization")
+	err = storefs.Synchronize(ctx)
+	/* step: with -onetime we exit once the mount point has been synchronized */
+	if config.IsOnetime() {
+		os.Exit(OnetimeExitCode(err))
+	}
+	if err != nil {
+		logger.Errorf("Failed to the synchronize the configuration, error: %s", err)
+		/* step: release the watches, tmpfs and, if requested, the mount point */
+		storefs.Close()
+		logger.Flush()
+		os.Exit(1)
+	}
+	/* step: the synchronization can be paused, resumed and reconciled by a signal */
+	HandleSignals(ctx, storefs)
+	logger.Infof("Waiting for signal to quit")
 	/* step: wait on the signal */
-	<-signalChannel
+	<-ctx.Done()
 
-	glog.Infof("Recieved a kill signal, exitting")
+	logger.Infof("Recieved a kill signal, exitting")
+	/* step: wait for the changes in flight to be applied */
 	storefs.Close()
+	logger.Flush()
+}
+
+/*
+	The exit code of a onetime sync; 0 if synchronized, 1 if any files couldn't be written (or when observing, any
+	have drifted) and 2 if the sync failed
+*/
+func OnetimeExitCode(err error) int {
+	defer logger.Flush()
+	if err == nil {
+		logger.Infof("The mount point has been synchronized")
+		return 0
+	}
+	if _, found := err.(store.FailedFilesErr); found {
+		logger.Errorf("The mount point has been synchronized, but some of the files couldn't be written, error: %s", err)
+		return 1
+	}
+	if _, found := err.(store.DriftedFilesErr); found {
+		logger.Errorf("The mount point has drifted from the store, error: %s", err)
+		return 1
+	}
+	logger.Errorf("Failed to synchronize the mount point, error: %s", err)
+	return 2
+}
+
+/* Run a one-off command rather than the daemon, returning the exit code */
+func RunCommand(ctx context.Context, config store.Config, command string, arguments []string) int {
+	switch command {
+	case "decrypt":
+		/* step: print the plain text content of the files */
+		if len(arguments) <= 0 {
+			fmt.Fprintf(os.Stderr, "usage: config-fs -encryption_key=KEY decrypt FILE [FILE...]\n")
+			return 1
+		}
+		for _, path := range arguments {
+			content, err := store.DecryptFile(config, path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to decrypt the file: %s, error: %s\n", path, err)
+				return 1
+			}
+			fmt.Print(content)
+		}
+		return 0
+	case "archive":
+		/* step: write a tarball of the rendered tree under the mount point */
+		if len(arguments) != 1 {
+			fmt.Fprintf(os.Stderr, "usage: config-fs -mount=DIRECTORY archive FILE\n")
+			return 1
+		}
+		if err := store.ArchiveMountPoint(config, arguments[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to archive the mount point, error: %s\n", err)
+			return 1
+		}
+		return 0
+	case "snapshots":
+		/* step: list the snapshots of the mount point */
+		if err := store.PrintSnapshots(config, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list the snapshots, error: %s\n", err)
+			return 1
+		}
+		return 0
+	case "rollback":
+		/* step: pin the mount point to a snapshot, the latest if none is given */
+		if len(arguments) > 1 {
+			fmt.Fprintf(os.Stderr, "usage: config-fs -snapshot_dir=DIRECTORY rollback [SNAPSHOT]\n")
+			return 1
+		}
+		name := ""
+		if len(arguments) > 0 {
+			name = arguments[0]
+		}
+		name, err := store.RollbackMountPoint(config, name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to roll back the mount point, error: %s\n", err)
+			return 1
+		}
+		fmt.Printf("Pinned the mount point to the snapshot: %s, the synchronization is suspended until released\n", name)
+		return 0
+	case "release":
+		/* step: release the pin, the synchronization resumes */
+		if err := store.ReleaseMountPoint(config); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to release the pin on the mount point, error: %s\n", err)
+			return 1
+		}
+		return 0
+	case "diff":
+		/* step: compare the mount point against the store, exitting non-zero on any drift */
+		drifted, err := store.DiffMountPoint(ctx, config, os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to compare the mount point against the store, error: %s\n", err)
+			return 2
+		}
+		if drifted {
+			return 1
+		}
+		return 0
+	case "state":
+		/* step: print the sync state of the files, exitting non-zero if any aren't up to date */
+		healthy, err := store.PrintSyncState(config, os.Stdout, arguments)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read the sync state, error: %s\n", err)
+			return 2
+		}
+		if !healthy {
+			return 1
+		}
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
+		return 1
+	}
 }
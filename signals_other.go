@@ -0,0 +1,54 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gambol99/config-fs/store"
+)
+
+/*
+	Pauses the synchronization on a SIGUSR1, resumes it on a SIGUSR2 and reconciles the mount point against the
+	store on a SIGHUP, until the context is cancelled
+*/
+func HandleSignals(ctx context.Context, storefs store.Store) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case received := <-signals:
+				logger.Infof("Recieved the signal: %s", received)
+				switch received {
+				case syscall.SIGUSR1:
+					storefs.Pause()
+				case syscall.SIGUSR2:
+					storefs.Resume()
+				case syscall.SIGHUP:
+					storefs.Resync()
+				}
+			}
+		}
+	}()
+}
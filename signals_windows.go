@@ -0,0 +1,26 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	"github.com/gambol99/config-fs/store"
+)
+
+/* There are no user signals on windows, the synchronization can't be paused or reconciled by a signal */
+func HandleSignals(ctx context.Context, storefs store.Store) {}
@@ -0,0 +1,328 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	With -admin_address an http api is served for inspecting and controlling the process on the box; the files
+	managed and their state, the templates and their rendered content, and requests to reconcile the keys beneath a
+	prefix, pause and resume. Every request must carry the token read from -admin_token_file as a bearer token, so
+	the api should be bound to the loopback, i.e. 127.0.0.1:8081
+
+		GET  /v1/files?prefix=/prod/app     the files managed, those of the keys beneath the prefix if given
+		GET  /v1/templates                  the templates, their destinations and errors
+		GET  /v1/template?key=/prod/app.tpl the content last rendered by the template
+		GET  /v1/history?since=14:30        the last events handled, filtered by since, until, type, prefix and limit
+		POST /v1/resync?prefix=/prod/app    reconcile the keys beneath the prefix, or everything if none is given
+		POST /v1/pause, /v1/resume          pause or resume the synchronization, as with SIGUSR1 and SIGUSR2
+*/
+const (
+	ADMIN_FILES_PATH     = "/v1/files"
+	ADMIN_TEMPLATES_PATH = "/v1/templates"
+	ADMIN_TEMPLATE_PATH  = "/v1/template"
+	ADMIN_HISTORY_PATH   = "/v1/history"
+	ADMIN_RESYNC_PATH    = "/v1/resync"
+	ADMIN_PAUSE_PATH     = "/v1/pause"
+	ADMIN_RESUME_PATH    = "/v1/resume"
+)
+
+var (
+	InvalidAdminTokenErr = errors.New("The admin api requires a token, the -admin_token_file must exist and not be empty")
+	UnknownPrefixErr     = errors.New("None of the keys of the mount points are beneath the prefix")
+	TemplateNotFoundErr  = errors.New("The key isn't a template of any of the mount points")
+	InvalidHistoryErr    = errors.New("Invalid history query, the times must be RFC3339, a time of day (15:04) or a duration ago (10m), and the limit a number")
+)
+
+/* a file managed, as answered by the admin api */
+type FileStatus struct {
+	/* the mount point the file is under */
+	Mount string `json:"mount"`
+	/* the path of the file, as seen under the mount point */
+	Path string `json:"path"`
+	/* set if the file is rendered by a template */
+	Template bool `json:"template"`
+	/* the key, revision and outcome of the last write */
+	SyncState
+}
+
+/* a template, as answered by the admin api */
+type TemplateStatus struct {
+	/* the mount point the template is rendered under */
+	Mount string `json:"mount"`
+	/* the key of the template, and the path of the file it's rendered to, if written */
+	Key  string `json:"key"`
+	Path string `json:"path,omitempty"`
+	/* the size of the content last rendered */
+	Size int `json:"size"`
+	/* the keys of the files computed by the template */
+	Destinations []string `json:"destinations,omitempty"`
+	/* the error of the last render, if it failed */
+	Error string `json:"error,omitempty"`
+}
+
+/* The files managed under the mount point, those of the keys beneath the prefix if given, sorted by path */
+func (r *ConfigurationStore) Files(prefix string) []FileStatus {
+	if prefix != "" {
+		prefix = CleanKey(prefix)
+	}
+	list := make([]FileStatus, 0)
+	for path, state := range states.Snapshot() {
+		if !IsBeneath(r.options.cfg_directory, path) {
+			continue
+		}
+		if prefix != "" && state.Key != prefix && !IsBeneathKey(prefix, state.Key) {
+			continue
+		}
+		_, template := r.dynamic.IsDynamic(state.Key)
+		list = append(list, FileStatus{Mount: r.options.cfg_directory, Path: path, Template: template, SyncState: state})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list
+}
+
+/* The templates of the mount point, including those which failed to be created, sorted by key */
+func (r *ConfigurationStore) Templates() []TemplateStatus {
+	/* note: the paths are taken from the state, as the generation of the atomic swap is the event loop's */
+	paths := make(map[string]string, 0)
+	for path, state := range states.Snapshot() {
+		if IsBeneath(r.options.cfg_directory, path) {
+			paths[state.Key] = path
+		}
+	}
+	failed := r.dynamic.Errors()
+	list := make([]TemplateStatus, 0)
+	for key, resource := range r.dynamic.List() {
+		template := TemplateStatus{
+			Mount: r.options.cfg_directory,
+			Key:   key,
+			Path:  paths[key],
+			Size:  len(resource.Rendered()),
+			Error: failed[key],
+		}
+		for destination, _ := range resource.Destinations() {
+			template.Destinations = append(template.Destinations, destination)
+		}
+		sort.Strings(template.Destinations)
+		list = append(list, template)
+		delete(failed, key)
+	}
+	for key, message := range failed {
+		list = append(list, TemplateStatus{Mount: r.options.cfg_directory, Key: key, Path: paths[key], Error: message})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+/* The content last rendered by the template of the key */
+func (r *ConfigurationStore) Template(key string) (string, error) {
+	if resource, found := r.dynamic.IsDynamic(CleanKey(key)); found {
+		return resource.Rendered(), nil
+	}
+	return "", TemplateNotFoundErr
+}
+
+/* The handler of the admin api, every request authenticated by the token */
+func AdminHandler(store Store, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ADMIN_FILES_PATH, func(writer http.ResponseWriter, request *http.Request) {
+		if AllowMethod(writer, request, http.MethodGet) {
+			WriteJSON(writer, http.StatusOK, store.Files(request.URL.Query().Get("prefix")))
+		}
+	})
+	mux.HandleFunc(ADMIN_TEMPLATES_PATH, func(writer http.ResponseWriter, request *http.Request) {
+		if AllowMethod(writer, request, http.MethodGet) {
+			WriteJSON(writer, http.StatusOK, store.Templates())
+		}
+	})
+	mux.HandleFunc(ADMIN_TEMPLATE_PATH, func(writer http.ResponseWriter, request *http.Request) {
+		if !AllowMethod(writer, request, http.MethodGet) {
+			return
+		}
+		content, err := store.Template(request.URL.Query().Get("key"))
+		if err != nil {
+			WriteError(writer, http.StatusNotFound, err)
+			return
+		}
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(writer, content)
+	})
+	mux.HandleFunc(ADMIN_HISTORY_PATH, func(writer http.ResponseWriter, request *http.Request) {
+		if !AllowMethod(writer, request, http.MethodGet) {
+			return
+		}
+		query, err := ParseHistoryQuery(request.URL.Query(), time.Now())
+		if err != nil {
+			WriteError(writer, http.StatusBadRequest, err)
+			return
+		}
+		WriteJSON(writer, http.StatusOK, store.History(query))
+	})
+	mux.HandleFunc(ADMIN_RESYNC_PATH, func(writer http.ResponseWriter, request *http.Request) {
+		if !AllowMethod(writer, request, http.MethodPost) {
+			return
+		}
+		prefix := request.URL.Query().Get("prefix")
+		logger.Infof("Reconciliation requested via the admin api, prefix: %q, from: %s", prefix, request.RemoteAddr)
+		if prefix == "" {
+			store.Resync()
+		} else if err := store.ResyncPrefix(prefix); err != nil {
+			WriteError(writer, http.StatusNotFound, err)
+			return
+		}
+		WriteJSON(writer, http.StatusAccepted, map[string]string{"resync": CleanKey(prefix)})
+	})
+	mux.HandleFunc(ADMIN_PAUSE_PATH, func(writer http.ResponseWriter, request *http.Request) {
+		if AllowMethod(writer, request, http.MethodPost) {
+			logger.Infof("Pausing the synchronization, as requested via the admin api from: %s", request.RemoteAddr)
+			store.Pause()
+			WriteJSON(writer, http.StatusAccepted, map[string]bool{"paused": true})
+		}
+	})
+	mux.HandleFunc(ADMIN_RESUME_PATH, func(writer http.ResponseWriter, request *http.Request) {
+		if AllowMethod(writer, request, http.MethodPost) {
+			logger.Infof("Resuming the synchronization, as requested via the admin api from: %s", request.RemoteAddr)
+			store.Resume()
+			WriteJSON(writer, http.StatusAccepted, map[string]bool{"paused": false})
+		}
+	})
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		/* check: the scheme must be given, and an empty token never matches a request without one */
+		scheme, given := "", ""
+		if fields := strings.SplitN(request.Header.Get("Authorization"), " ", 2); len(fields) == 2 {
+			scheme, given = fields[0], fields[1]
+		}
+		if !strings.EqualFold(scheme, "Bearer") || token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writer.Header().Set("WWW-Authenticate", `Bearer realm="config-fs"`)
+			WriteError(writer, http.StatusUnauthorized, errors.New("a valid bearer token is required"))
+			return
+		}
+		mux.ServeHTTP(writer, request)
+	})
+}
+
+/* The query of the history from the parameters of the request, the times relative to now */
+func ParseHistoryQuery(values url.Values, now time.Time) (HistoryQuery, error) {
+	query := HistoryQuery{Type: values.Get("type"), Prefix: values.Get("prefix")}
+	var err error
+	if query.Since, err = ParseHistoryTime(values.Get("since"), now); err != nil {
+		return query, err
+	}
+	if query.Until, err = ParseHistoryTime(values.Get("until"), now); err != nil {
+		return query, err
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 0 {
+			return query, InvalidHistoryErr
+		}
+	}
+	return query, nil
+}
+
+/*
+	Parses the time of a history query; RFC3339, a time of day (15:04 or 15:04:05, today in the local time zone) or
+	a duration before now (10m); an empty value is the zero time
+*/
+func ParseHistoryTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if parsed, err := time.ParseInLocation(layout, value, now.Location()); err == nil {
+			return time.Date(now.Year(), now.Month(), now.Day(), parsed.Hour(), parsed.Minute(), parsed.Second(), 0, now.Location()), nil
+		}
+	}
+	if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+		return now.Add(-duration), nil
+	}
+	return time.Time{}, InvalidHistoryErr
+}
+
+/* Checks the method of the request is the one allowed, answering with a 405 if not */
+func AllowMethod(writer http.ResponseWriter, request *http.Request, method string) bool {
+	if request.Method != method {
+		writer.Header().Set("Allow", method)
+		WriteError(writer, http.StatusMethodNotAllowed, fmt.Errorf("the method must be %s", method))
+		return false
+	}
+	return true
+}
+
+/* Answer with the value encoded as JSON */
+func WriteJSON(writer http.ResponseWriter, code int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(code)
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+/* Answer with the error, as JSON */
+func WriteError(writer http.ResponseWriter, code int, err error) {
+	WriteJSON(writer, code, map[string]string{"error": err.Error()})
+}
+
+/*
+	Serve the admin api on the -admin_address, if given, until the context is cancelled; the token is read and the
+	address bound before returning, so either failing is reported to the caller
+*/
+func ServeAdmin(ctx context.Context, settings Config, store Store) error {
+	if settings.admin_address == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(settings.admin_token_file)
+	if err != nil || strings.TrimSpace(string(content)) == "" {
+		logger.Errorf("Failed to read the token of the admin api from: %q, error: %v", settings.admin_token_file, err)
+		return InvalidAdminTokenErr
+	}
+	listener, err := net.Listen("tcp", settings.admin_address)
+	if err != nil {
+		logger.Errorf("Failed to listen on the admin address: %s, error: %s", settings.admin_address, err)
+		return err
+	}
+	server := &http.Server{
+		Handler:           AdminHandler(store, strings.TrimSpace(string(content))),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	logger.Infof("Serving the admin api on: %s", listener.Addr())
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("The admin server has failed, error: %s", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/* a store recording the requests of the admin api, the remaining methods left unimplemented */
+type fakeAdminStore struct {
+	Store
+	paused  bool
+	resumed bool
+	resyncs []string
+}
+
+func (r *fakeAdminStore) Files(prefix string) []FileStatus { return []FileStatus{} }
+
+func (r *fakeAdminStore) Pause() { r.paused = true }
+
+func (r *fakeAdminStore) Resume() { r.resumed = true }
+
+func (r *fakeAdminStore) Resync() { r.resyncs = append(r.resyncs, "/") }
+
+func (r *fakeAdminStore) ResyncPrefix(prefix string) error {
+	r.resyncs = append(r.resyncs, prefix)
+	return nil
+}
+
+func adminRequest(handler http.Handler, method, path, authorization string) int {
+	request := httptest.NewRequest(method, path, nil)
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	tests := []struct {
+		method        string
+		path          string
+		authorization string
+	}{
+		{"GET", ADMIN_FILES_PATH, ""},
+		{"GET", ADMIN_FILES_PATH, "Bearer"},
+		{"GET", ADMIN_FILES_PATH, "Bearer "},
+		{"GET", ADMIN_FILES_PATH, "Bearer wrong"},
+		{"GET", ADMIN_FILES_PATH, "Bearer secret "},
+		{"GET", ADMIN_FILES_PATH, "Bearer secretsecret"},
+		{"GET", ADMIN_FILES_PATH, "Bearer secre"},
+		{"GET", ADMIN_FILES_PATH, "secret"},
+		{"GET", ADMIN_FILES_PATH, "Basic secret"},
+		{"POST", ADMIN_PAUSE_PATH, ""},
+		{"POST", ADMIN_RESUME_PATH, "Bearer wrong"},
+		{"POST", ADMIN_RESYNC_PATH + "?prefix=/prod", "Bearer wrong"},
+		/* note: the token is checked ahead of the method and the path */
+		{"DELETE", ADMIN_FILES_PATH, "Bearer wrong"},
+		{"GET", "/v1/unknown", ""},
+	}
+	store := new(fakeAdminStore)
+	handler := AdminHandler(store, "secret")
+	for _, test := range tests {
+		if code := adminRequest(handler, test.method, test.path, test.authorization); code != http.StatusUnauthorized {
+			t.Errorf("the request: %s %s, authorization: %q, expected: 401, got: %d", test.method, test.path, test.authorization, code)
+		}
+	}
+	if store.paused || store.resumed || len(store.resyncs) > 0 {
+		t.Errorf("the store should not have been touched by an unauthorized request")
+	}
+	/* step: an empty token never matches, whatever the request */
+	for _, authorization := range []string{"", "Bearer ", "Bearer"} {
+		if code := adminRequest(AdminHandler(store, ""), "GET", ADMIN_FILES_PATH, authorization); code != http.StatusUnauthorized {
+			t.Errorf("the authorization: %q with an empty token, expected: 401, got: %d", authorization, code)
+		}
+	}
+}
+
+func TestAdminAuthorized(t *testing.T) {
+	tests := []struct {
+		method        string
+		path          string
+		authorization string
+		code          int
+	}{
+		{"GET", ADMIN_FILES_PATH, "Bearer secret", http.StatusOK},
+		{"GET", ADMIN_FILES_PATH, "bearer secret", http.StatusOK},
+		{"POST", ADMIN_FILES_PATH, "Bearer secret", http.StatusMethodNotAllowed},
+		{"POST", ADMIN_PAUSE_PATH, "Bearer secret", http.StatusAccepted},
+		{"POST", ADMIN_RESUME_PATH, "Bearer secret", http.StatusAccepted},
+		{"POST", ADMIN_RESYNC_PATH + "?prefix=/prod", "Bearer secret", http.StatusAccepted},
+		{"GET", "/v1/unknown", "Bearer secret", http.StatusNotFound},
+	}
+	store := new(fakeAdminStore)
+	handler := AdminHandler(store, "secret")
+	for _, test := range tests {
+		if code := adminRequest(handler, test.method, test.path, test.authorization); code != test.code {
+			t.Errorf("the request: %s %s, expected: %d, got: %d", test.method, test.path, test.code, code)
+		}
+	}
+	if !store.paused || !store.resumed || len(store.resyncs) != 1 || store.resyncs[0] != "/prod" {
+		t.Errorf("expected the store to have been paused, resumed and resynced, got: %v", store.resyncs)
+	}
+}
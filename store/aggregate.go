@@ -0,0 +1,233 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gambol99/config-fs/store/kv"
+)
+
+/*
+	An aggregated directory is materialized as a single file at the path of the directory, rather than a file
+	per key, i.e. /app/env with the keys /app/env/HOST and /app/env/PORT becomes the file /config/app/env
+
+	HOST=db.local
+	PORT=5432
+
+	The file is regenerated from a listing of the directory whenever any of the keys beneath it changes. The env
+	format takes only the keys immediately beneath the directory, the properties and ini formats take the keys of
+	the subdirectories as well (see EncodeProperties and EncodeINI)
+*/
+const (
+	/* a KEY=value line per key */
+	AGGREGATE_ENV = "env"
+	/* a java properties file, the keys of the subdirectories named with dots, i.e. db.host */
+	AGGREGATE_PROPERTIES = "properties"
+	/* an ini file, a section per subdirectory */
+	AGGREGATE_INI = "ini"
+)
+
+/* the directories aggregated into a single file, directory => format, a flag value which can be given multiple times */
+type AggregateDirectories map[string]string
+
+func (r *AggregateDirectories) String() string {
+	items := make([]string, 0)
+	for directory, format := range *r {
+		items = append(items, fmt.Sprintf("%s=%s", directory, format))
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (r *AggregateDirectories) Set(value string) error {
+	if *r == nil {
+		*r = make(AggregateDirectories, 0)
+	}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		directory, format := item, AGGREGATE_ENV
+		if items := strings.SplitN(item, "=", 2); len(items) == 2 {
+			directory, format = items[0], items[1]
+		}
+		if err := ValidateKey(directory); err != nil {
+			return err
+		}
+		if CleanKey(directory) == "/" {
+			return errors.New("the root can't be aggregated into a file")
+		}
+		switch format {
+		case AGGREGATE_ENV, AGGREGATE_PROPERTIES, AGGREGATE_INI:
+		default:
+			return fmt.Errorf("invalid aggregate format: %s, must be %s, %s or %s", format,
+				AGGREGATE_ENV, AGGREGATE_PROPERTIES, AGGREGATE_INI)
+		}
+		(*r)[CleanKey(directory)] = format
+	}
+	return nil
+}
+
+/* Find the aggregated directory the key is, or is beneath; the outermost wins, as everything beneath is in its file */
+func (r *ConfigurationStore) AggregateOf(key string) (string, bool) {
+	key = CleanKey(key)
+	aggregate, found := "", false
+	for directory, _ := range r.options.aggregates {
+		if key == directory || strings.HasPrefix(key, directory+"/") {
+			if !found || len(directory) < len(aggregate) {
+				aggregate, found = directory, true
+			}
+		}
+	}
+	return aggregate, found
+}
+
+/* Checks if the directory is aggregated into a single file */
+func (r *ConfigurationStore) IsAggregate(directory string) bool {
+	_, found := r.options.aggregates[CleanKey(directory)]
+	return found
+}
+
+/* Handle a change to the aggregated directory, or any of the keys beneath it */
+func (r *ConfigurationStore) HandleAggregateEvent(ctx context.Context, directory string, event kv.NodeChange) {
+	if event.Node.Path == directory && event.Operation == kv.DELETED {
+		full_path := r.FullPath(directory)
+		logger.V(VERBOSE_INFO).Infof("The aggregated directory: %s has been deleted, removing the file: %s", directory, full_path)
+		if err := r.RemoveStoreConfigFile(directory, full_path); err == nil {
+			r.PruneDirectory(r.fs.Dirname(full_path))
+		}
+		return
+	}
+	r.UpdateAggregate(ctx, directory)
+}
+
+/* Regenerates the file of the aggregated directory from a listing of the keys beneath it */
+func (r *ConfigurationStore) UpdateAggregate(ctx context.Context, directory string) (err error) {
+	full_path := r.FilePath(directory)
+	defer func() {
+		r.SetSyncState(directory, full_path, err)
+	}()
+	listing, err := r.kv.List(ctx, directory)
+	if err != nil {
+		logger.Errorf("Failed to get listing from the aggregated directory: %s, error: %s", directory, err)
+		return err
+	}
+	/* step: the metadata of the directory provides the attributes of the file */
+	metadata := ""
+	for _, node := range listing {
+		if node.IsFile() && IsMetadataKey(node.Path) {
+			metadata = node.Value
+		}
+	}
+	r.SetMetadata(directory, metadata)
+	values := make(map[string]string, 0)
+	var index uint64
+	format := r.options.aggregates[directory]
+	if err := r.ListAggregate(ctx, directory, "", listing, format != AGGREGATE_ENV, values, &index); err != nil {
+		return err
+	}
+	content, err := EncodeAggregate(format, values)
+	if err != nil {
+		logger.Errorf("Failed to encode the aggregated directory: %s, error: %s", directory, err)
+		return err
+	}
+	/* check: the directory was materialized before it was aggregated */
+	if r.fs.Exists(full_path) && !r.fs.IsSymlink(full_path) && r.fs.IsDirectory(full_path) {
+		logger.Warningf("The directory: %s is now aggregated, removing the directory: %s", directory, full_path)
+		if err := r.RemovePath(full_path, true); err != nil {
+			return err
+		}
+	}
+	attributes, _ := r.ParseAttributes(directory, "")
+	attributes.Source, attributes.Index = directory, index
+	r.SetAttributes(directory, attributes)
+	logger.V(VERBOSE_INFO).Infof("Updating the aggregated file: %s from %d keys", full_path, len(values))
+	if err := r.WriteFile(full_path, content, attributes); err != nil {
+		logger.Errorf("Failed to write the aggregated file: %s, error: %s", full_path, err)
+		return err
+	}
+	return nil
+}
+
+/*
+	Gathers the values of the keys in the listing, keyed by the path relative to the aggregated directory, i.e.
+	db/host; the subdirectories are descended into when recursive, else skipped
+*/
+func (r *ConfigurationStore) ListAggregate(ctx context.Context, directory, relative string, listing []*kv.Node, recursive bool, values map[string]string, index *uint64) error {
+	for _, node := range listing {
+		name := path.Join(relative, path.Base(node.Path))
+		switch {
+		case IsMetadataKey(node.Path):
+			continue
+		case node.IsDir() && !recursive:
+			logger.V(VERBOSE_LEVEL).Infof("Skipping the directory: %s, only the keys of the aggregated directory: %s are included", node.Path, directory)
+			continue
+		case ValidateKey(node.Path) != nil || !r.filter.IsIncluded(node.Path):
+			continue
+		case node.IsDir():
+			children, err := r.kv.List(ctx, node.Path)
+			if err != nil {
+				logger.Errorf("Failed to get listing from the directory: %s, error: %s", node.Path, err)
+				return err
+			}
+			if err := r.ListAggregate(ctx, directory, name, children, recursive, values, index); err != nil {
+				return err
+			}
+			continue
+		}
+		/* step: the attributes headers of the keys don't apply, the file takes those of the directory */
+		_, values[name] = r.ParseAttributes(node.Path, node.Value)
+		if node.Index > *index {
+			*index = node.Index
+		}
+	}
+	return nil
+}
+
+/* Encodes the values of the keys, name => value, in the format; the keys are sorted by name */
+func EncodeAggregate(format string, values map[string]string) (string, error) {
+	names := make([]string, 0)
+	for name, _ := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	content := ""
+	switch format {
+	case AGGREGATE_ENV:
+		for _, name := range names {
+			if strings.ContainsAny(name, "= \t") {
+				logger.Errorf("Skipping the key: %q, the name can't be used in an %s file", name, format)
+				continue
+			}
+			/* step: a value spanning lines is quoted, the line breaks escaped */
+			value := values[name]
+			if strings.ContainsAny(value, "\r\n") {
+				value = strconv.Quote(value)
+			}
+			content += fmt.Sprintf("%s=%s\n", name, value)
+		}
+	case AGGREGATE_PROPERTIES:
+		content = EncodeProperties(values)
+	case AGGREGATE_INI:
+		content = EncodeINI(values)
+	}
+	return content, nil
+}
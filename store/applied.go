@@ -0,0 +1,81 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gambol99/config-fs/store/fs"
+	"github.com/gambol99/config-fs/store/kv"
+)
+
+/* the value of a key last applied to its file, and the file as we left it */
+type AppliedValue struct {
+	/* the digest of the value of the key */
+	Digest string
+	/* the attributes the file was written with, including the index of the revision */
+	Attributes fs.Attributes
+	/* the size and modification time of the file once written */
+	Size    int64
+	ModTime int64
+}
+
+/* The digest of the value of a key */
+func ValueDigest(value string) string {
+	hasher := md5.New()
+	io.WriteString(hasher, value)
+	return fmt.Sprintf("%x", hasher.Sum(nil))
+}
+
+/*
+	Checks if the value of the node has already been applied to the file, i.e. the echo of a change we've made or
+	seen; the value and attributes must be those last applied and the file untouched since, so a local change is
+	still corrected. The file of a template is maintained by the template itself, so the value alone must match
+*/
+func (r *ConfigurationStore) IsApplied(node *kv.Node, full_path string) bool {
+	attributes, _ := r.ParseAttributes(node.Path, node.Value)
+	attributes.Source, attributes.Index = node.Path, node.Index
+	r.RLock()
+	applied, found := r.applied[node.Path]
+	r.RUnlock()
+	if !found || applied.Attributes != attributes || applied.Digest != ValueDigest(node.Value) {
+		return false
+	}
+	if _, found := r.dynamic.IsDynamic(node.Path); found {
+		return true
+	}
+	info, err := os.Lstat(full_path)
+	return err == nil && info.Size() == applied.Size && info.ModTime().UnixNano() == applied.ModTime
+}
+
+/* Record the value of the node as applied to the file */
+func (r *ConfigurationStore) SetApplied(node *kv.Node, full_path string) {
+	info, err := os.Lstat(full_path)
+	r.Lock()
+	defer r.Unlock()
+	r.SaveKeyState(node.Path)
+	if err != nil || r.options.dry_run {
+		delete(r.applied, node.Path)
+		return
+	}
+	r.applied[node.Path] = AppliedValue{
+		Digest:     ValueDigest(node.Value),
+		Attributes: r.attributes[node.Path],
+		Size:       info.Size(),
+		ModTime:    info.ModTime().UnixNano(),
+	}
+}
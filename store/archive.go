@@ -0,0 +1,164 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Maintains a tarball of the rendered tree under the mount point, i.e. for shipping the config into containers;
+	the archive is rewritten once a change has been applied (if the content has changed), and compressed if the
+	path ends in .gz or .tgz
+*/
+func (r *ConfigurationStore) UpdateArchive() {
+	if r.options.archive == "" {
+		return
+	}
+	r.archiveLock.Lock()
+	defer r.archiveLock.Unlock()
+	digest, err := WriteArchive(r.BasePath(), r.options.archive, r.archived)
+	if err != nil {
+		logger.Errorf("Failed to write the archive: %s, error: %s", r.options.archive, err)
+		return
+	}
+	if digest != r.archived {
+		logger.V(VERBOSE_INFO).Infof("Updated the archive: %s of the mount point", r.options.archive)
+	}
+	r.archived = digest
+}
+
+/* Writes the archive of the mount point on demand, i.e. from the command line */
+func ArchiveMountPoint(settings Config, path string) error {
+	directory := settings.cfg_directory
+	/* step: with the atomic swap we archive the published generation */
+	if target, err := os.Readlink(filepath.Join(directory, DATA_LINK)); err == nil {
+		directory = filepath.Join(directory, target)
+	}
+	_, err := WriteArchive(directory, path, "")
+	return err
+}
+
+/*
+	Writes a tarball of the directory to the path, via a temporary file renamed into place; the digest of the
+	archive is returned, and if it matches the previous the archive is left untouched
+*/
+func WriteArchive(directory, path, previous string) (string, error) {
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	/* step: the archive carries the content of the files, so we keep it private */
+	if err := file.Chmod(0600); err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	var writer io.Writer = io.MultiWriter(file, hash)
+	var compressed *gzip.Writer
+	if strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz") {
+		compressed = gzip.NewWriter(writer)
+		writer = compressed
+	}
+	archive := tar.NewWriter(writer)
+	if err := AddArchiveEntries(archive, directory); err != nil {
+		return "", err
+	}
+	if err := archive.Close(); err != nil {
+		return "", err
+	}
+	if compressed != nil {
+		if err := compressed.Close(); err != nil {
+			return "", err
+		}
+	}
+	digest := fmt.Sprintf("%x", hash.Sum(nil))
+	if digest == previous {
+		return digest, nil
+	}
+	if err := file.Sync(); err != nil {
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return digest, os.Rename(file.Name(), path)
+}
+
+/* Adds the directories, files and links beneath the directory to the archive, skipping any backups or temporary files */
+func AddArchiveEntries(archive *tar.Writer, directory string) error {
+	return filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			/* step: the file may have been removed by a change as we walked */
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if path == directory {
+			return nil
+		}
+		if IsInternalPath(directory, path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		/* note: the content is read ahead of the header, as the file may be replaced by a change as we walk */
+		var content []byte
+		if info.Mode().IsRegular() {
+			if content, err = ioutil.ReadFile(path); err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relative)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if info.Mode().IsRegular() {
+			header.Size = int64(len(content))
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err = archive.Write(content)
+		return err
+	})
+}
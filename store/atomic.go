@@ -0,0 +1,784 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gambol99/config-fs/store/fs"
+
+	"github.com/go-fsnotify/fsnotify"
+)
+
+/*
+	With the atomic swap the tree is materialized into a timestamped directory under the mount point, i.e.
+	/config/..2015_01_02_15_04_05.000000000, and the /config/..data link is flipped to it once the change is
+	applied; the top level entries of the mount are links via ..data, so readers never observe a half updated
+	directory (the same layout as a kubernetes configmap volume)
+*/
+const (
+	/* the link to the current generation */
+	DATA_LINK = "..data"
+	/* the prefix of the generation directories */
+	GENERATION_PREFIX = ".."
+	/* the timestamp format of the generation directories */
+	GENERATION_TIMESTAMP = "2006_01_02_15_04_05.000000000"
+	/* the suffix of the generation of an atomic directory kept to stage the next change in */
+	GENERATION_PREVIOUS = "_previous"
+)
+
+/*
+	Checks if the name is that of a generation or the link to the current, i.e. ..data, ..2015_01_02_15_04_05.000000000,
+	or those of an atomic directory, ..app_2015_01_02_15_04_05.000000000 and ..app_previous
+*/
+func IsGenerationName(name string) bool {
+	if name == DATA_LINK {
+		return true
+	}
+	if !strings.HasPrefix(name, GENERATION_PREFIX) {
+		return false
+	}
+	name = name[len(GENERATION_PREFIX):]
+	if strings.HasSuffix(name, GENERATION_PREVIOUS) {
+		return len(name) > len(GENERATION_PREVIOUS)
+	}
+	if len(name) < len(GENERATION_TIMESTAMP) {
+		return false
+	}
+	stamp := name[len(name)-len(GENERATION_TIMESTAMP):]
+	if _, err := time.Parse(GENERATION_TIMESTAMP, stamp); err != nil {
+		return false
+	}
+	return len(name) == len(stamp) || strings.HasSuffix(name[:len(name)-len(stamp)], "_")
+}
+
+/*
+	Checks if the name of an entry beneath the mount point is one of our own rather than that of a key, i.e. a
+	generation, a temporary or a lock file; the keys may well be hidden, so a leading dot is not enough
+*/
+func IsInternalName(name string) bool {
+	return IsGenerationName(name) || fs.IsTemporaryName(name)
+}
+
+/*
+	Applies the change to the configuration directory; with the atomic swap the change is applied to the previous
+	generation, first brought in line with the current in the directories where they differ, and published if
+	anything has changed. Either way the generation which isn't published is kept to stage the next change in, so a
+	change only costs the directories it touches rather than a copy of the tree. Returns false should the changes
+	have been rejected, i.e. by the validation
+*/
+func (r *ConfigurationStore) Transaction(apply func()) bool {
+	/* step: the templates failing are reported whatever becomes of the transaction, i.e. a generation discarded */
+	defer r.NotifyTemplateErrors()
+	if !r.options.atomic_swap {
+		published := r.StageTransaction(apply)
+		r.NotifyChanges()
+		r.UpdateArchive()
+		r.UpdateStatus()
+		return published
+	}
+	r.swap.Lock()
+	defer r.swap.Unlock()
+
+	previous := r.Generation()
+	generation, written, err := r.StageGeneration(previous)
+	if err != nil {
+		logger.Errorf("Failed to create a new generation of the configuration directory, error: %s", err)
+		return false
+	}
+	r.staged.Modified()
+	r.SetGeneration(generation)
+	state := r.SaveState()
+	defer r.EndState()
+	apply()
+	modified := r.StagedDirectories(generation)
+	/* step: should nothing have changed, or the validation fail, the generation is kept to stage the next change in */
+	discard := func() {
+		r.DiscardChanges()
+		r.spare, r.stale = generation, modified
+		r.SetGeneration(previous)
+		r.LinkGeneration(previous)
+	}
+	if r.IsSameDirectories(previous, generation, modified) {
+		logger.V(VERBOSE_LEVEL).Infof("Nothing changed in the generation: %s, discarding", generation)
+		discard()
+		return true
+	}
+	/* step: the generation is only published if the validation passes, the state otherwise restored */
+	if err := r.ValidateStaged(generation); err != nil {
+		discard()
+		r.RestoreState(state)
+		return false
+	}
+	for directory, recursive := range modified {
+		written[directory] = written[directory] || recursive
+	}
+	if err := r.PublishGeneration(generation, previous, written); err != nil {
+		logger.Errorf("Failed to publish the generation: %s, error: %s", generation, err)
+		discard()
+		r.RestoreState(state)
+		return false
+	}
+	r.spare, r.stale = previous, modified
+	r.NotifyChanges()
+	r.UpdateArchive()
+	r.UpdateStatus()
+	return true
+}
+
+/* The generation directory the changes are applied to; it's read outside the transactions, i.e. by the workers */
+func (r *ConfigurationStore) Generation() string {
+	generation, _ := r.generation.Load().(string)
+	return generation
+}
+
+/* Sets the generation directory the changes are applied to */
+func (r *ConfigurationStore) SetGeneration(generation string) {
+	r.generation.Store(generation)
+}
+
+/* The generation the ..data link points to */
+func (r *ConfigurationStore) Published() string {
+	published, _ := r.published.Load().(string)
+	return published
+}
+
+/*
+	Prepares the generation the next change is applied to: the generation kept from the last change, brought in
+	line with the previous in the directories where they differ (those changed since, or edited locally), or failing
+	that a copy of the previous in full. Returns the generation and the directories written, relative to it
+*/
+func (r *ConfigurationStore) StageGeneration(previous string) (string, map[string]bool, error) {
+	spare, directories := r.spare, r.stale
+	r.spare, r.stale = "", nil
+	for path, recursive := range r.drifted.Modified() {
+		for _, generation := range []string{previous, spare} {
+			if generation != "" && (path == generation || IsBeneath(generation, path)) {
+				if directories == nil {
+					directories = make(map[string]bool, 0)
+				}
+				relative := path[len(generation):]
+				directories[relative] = directories[relative] || recursive
+			}
+		}
+	}
+	if spare != "" && previous != "" && r.fs.IsDirectory(spare) {
+		logger.V(VERBOSE_LEVEL).Infof("Staging the generation: %s from: %s, %d directories differ", spare, previous, len(directories))
+		if err := r.SyncGeneration(previous, spare, directories); err == nil {
+			return spare, directories, nil
+		} else {
+			logger.Errorf("Failed to bring the generation: %s in line with: %s, error: %s", spare, previous, err)
+		}
+	}
+	if spare != "" {
+		os.RemoveAll(spare)
+	}
+	generation, err := r.CloneGeneration(previous)
+	if err != nil {
+		return "", nil, err
+	}
+	return generation, map[string]bool{"": true}, nil
+}
+
+/*
+	The directories modified beneath the generation since last asked, relative to it, and whether their content
+	was replaced in full (i.e. a directory moved into place)
+*/
+func (r *ConfigurationStore) StagedDirectories(generation string) map[string]bool {
+	directories := make(map[string]bool, 0)
+	for path, recursive := range r.staged.Modified() {
+		if path == generation || IsBeneath(generation, path) {
+			relative := path[len(generation):]
+			directories[relative] = directories[relative] || recursive
+		}
+	}
+	return directories
+}
+
+/*
+	Filters the events of the watcher beneath the generations of the atomic swap; those beneath a generation other
+	than the published (i.e. our own writes to the generation being staged) are dropped, while a change beneath the
+	published generation (i.e. a local edit) is noted, so the directory is brought in line when the other generation
+	is next staged
+*/
+func (r *ConfigurationStore) FilterGenerationEvent(event *fsnotify.Event) bool {
+	full_path := event.Name
+	/* step: the entries at the top of the mount point are the generations and the links to them */
+	if !r.options.atomic_swap || filepath.Dir(full_path) == r.options.cfg_directory || !IsBeneath(r.options.cfg_directory, full_path) {
+		return true
+	}
+	published := r.Published()
+	if published == "" || !IsBeneath(published, full_path) {
+		return false
+	}
+	/* note: a directory created, or moved in, is copied in full; otherwise the parent suffices */
+	r.drifted.Add(filepath.Dir(full_path), false)
+	if event.Op&fsnotify.Create != 0 {
+		r.drifted.Add(full_path, true)
+	}
+	return true
+}
+
+/* Find the generation the ..data link currently points to, if any */
+func (r *ConfigurationStore) CurrentGeneration() string {
+	target, err := os.Readlink(filepath.Join(r.options.cfg_directory, DATA_LINK))
+	if err != nil {
+		return ""
+	}
+	generation := filepath.Join(r.options.cfg_directory, target)
+	if !r.fs.IsDirectory(generation) {
+		return ""
+	}
+	return generation
+}
+
+/* Creates a new generation directory, copying the previous generation via hard links */
+func (r *ConfigurationStore) CloneGeneration(previous string) (string, error) {
+	generation := filepath.Join(r.options.cfg_directory, GENERATION_PREFIX+time.Now().UTC().Format(GENERATION_TIMESTAMP))
+	logger.V(VERBOSE_LEVEL).Infof("Creating the generation: %s from: %s", generation, previous)
+	if err := r.MakeDirectory(generation); err != nil {
+		return "", err
+	}
+	if previous == "" {
+		return generation, nil
+	}
+	if err := r.CopyGeneration(previous, generation); err != nil {
+		logger.Errorf("Failed to copy the generation: %s to %s, error: %s", previous, generation, err)
+		os.RemoveAll(generation)
+		return "", err
+	}
+	return generation, nil
+}
+
+/* Copies the previous generation into the new one via hard links, the directories, links and permissions preserved */
+func (r *ConfigurationStore) CopyGeneration(previous, generation string) error {
+	return filepath.Walk(previous, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative := strings.TrimPrefix(path, previous)
+		if relative == "" {
+			return nil
+		}
+		destination := generation + relative
+		switch {
+		case info.IsDir():
+			if err := os.Mkdir(destination, info.Mode().Perm()); err != nil {
+				return err
+			}
+			os.Chmod(destination, info.Mode().Perm())
+			if uid, gid, found := fs.FileOwner(info); found {
+				os.Lchown(destination, uid, gid)
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, destination)
+		case IsInternalName(info.Name()):
+			/* step: skip any temporary or lock files */
+		default:
+			/* step: the files are replaced via a rename, so a hard link leaves the previous generation intact */
+			return os.Link(path, destination)
+		}
+		return nil
+	})
+}
+
+/*
+	Brings the directories of the generation in line with those of the source, the entries beneath being hard
+	linked; a directory is replaced in full if so marked, or should it not yet exist, otherwise its entries are
+	compared and those differing replaced, the subdirectories being left to their own entry if any
+*/
+func (r *ConfigurationStore) SyncGeneration(source, generation string, directories map[string]bool) error {
+	relatives := make([]string, 0, len(directories))
+	for relative, _ := range directories {
+		relatives = append(relatives, relative)
+	}
+	/* step: the parents are brought in line before their children */
+	sort.Strings(relatives)
+	replaced := ""
+	for _, relative := range relatives {
+		if replaced != "" && IsBeneath(replaced, generation+relative) {
+			continue
+		}
+		from, to := source+relative, generation+relative
+		info, err := os.Lstat(from)
+		switch {
+		case os.IsNotExist(err):
+			if relative != "" {
+				os.RemoveAll(to)
+			}
+			continue
+		case err != nil:
+			return err
+		case !info.IsDir():
+			/* step: the entry is brought in line along with its parent */
+			continue
+		}
+		if current, err := os.Lstat(to); directories[relative] || err != nil || !current.IsDir() {
+			if relative == "" {
+				return errors.New("the generation can't be replaced in full")
+			}
+			if err := r.CopyDirectory(from, to, info); err != nil {
+				return err
+			}
+			replaced = to
+			continue
+		}
+		if err := r.SyncEntries(from, to, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Brings the entries of the directory in line with those of the source, the subdirectories created copied in full */
+func (r *ConfigurationStore) SyncEntries(source, directory string, info os.FileInfo) error {
+	current, err := os.Lstat(directory)
+	if err != nil {
+		return err
+	}
+	if current.Mode().Perm() != info.Mode().Perm() {
+		os.Chmod(directory, info.Mode().Perm())
+	}
+	if uid, gid, found := fs.FileOwner(info); found {
+		if cuid, cgid, _ := fs.FileOwner(current); cuid != uid || cgid != gid {
+			os.Lchown(directory, uid, gid)
+		}
+	}
+	wanted, err := DirectoryEntries(source)
+	if err != nil {
+		return err
+	}
+	entries, err := DirectoryEntries(directory)
+	if err != nil {
+		return err
+	}
+	for name, _ := range entries {
+		if _, found := wanted[name]; !found {
+			if err := os.RemoveAll(filepath.Join(directory, name)); err != nil {
+				return err
+			}
+		}
+	}
+	for name, entry := range wanted {
+		from, to := filepath.Join(source, name), filepath.Join(directory, name)
+		existing, found := entries[name]
+		switch {
+		case entry.IsDir():
+			if found && existing.IsDir() {
+				continue
+			}
+			os.RemoveAll(to)
+			if err := r.CopyDirectory(from, to, entry); err != nil {
+				return err
+			}
+		case entry.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(from)
+			if err != nil {
+				return err
+			}
+			if found && existing.Mode()&os.ModeSymlink != 0 {
+				if current, _ := os.Readlink(to); current == target {
+					continue
+				}
+			}
+			os.RemoveAll(to)
+			if err := os.Symlink(target, to); err != nil {
+				return err
+			}
+		default:
+			if found && os.SameFile(entry, existing) {
+				continue
+			}
+			os.RemoveAll(to)
+			if err := os.Link(from, to); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/* Copies the directory in full, the files beneath hard linked */
+func (r *ConfigurationStore) CopyDirectory(source, directory string, info os.FileInfo) error {
+	os.RemoveAll(directory)
+	if err := os.Mkdir(directory, info.Mode().Perm()); err != nil {
+		return err
+	}
+	os.Chmod(directory, info.Mode().Perm())
+	if uid, gid, found := fs.FileOwner(info); found {
+		os.Lchown(directory, uid, gid)
+	}
+	return r.CopyGeneration(source, directory)
+}
+
+/* The entries of the directory by name, less our own, i.e. the temporary files */
+func DirectoryEntries(directory string) (map[string]os.FileInfo, error) {
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	items := make(map[string]os.FileInfo, len(entries))
+	for _, entry := range entries {
+		if !IsInternalName(entry.Name()) {
+			items[entry.Name()] = entry
+		}
+	}
+	return items, nil
+}
+
+/*
+	Checks if the directories (relative to each) are identical in the two generations, the directory itself and
+	its entries, or everything beneath it if so marked; the other directories are known to be the same
+*/
+func (r *ConfigurationStore) IsSameDirectories(previous, generation string, directories map[string]bool) bool {
+	if previous == "" {
+		entries, _ := ioutil.ReadDir(generation)
+		return len(entries) == 0
+	}
+	for relative, recursive := range directories {
+		before, missing := os.Lstat(previous + relative)
+		after, removed := os.Lstat(generation + relative)
+		switch {
+		case missing != nil && removed != nil:
+			continue
+		case missing != nil || removed != nil || before.IsDir() != after.IsDir():
+			return false
+		case !after.IsDir():
+			/* step: the entry is compared along with its parent */
+			continue
+		case before.Mode() != after.Mode():
+			return false
+		}
+		if owner, group, found := fs.FileOwner(before); found {
+			if uid, gid, _ := fs.FileOwner(after); uid != owner || gid != group {
+				return false
+			}
+		}
+		if recursive {
+			if !r.IsSameGeneration(previous+relative, generation+relative) {
+				return false
+			}
+			continue
+		}
+		wanted, err := DirectoryEntries(previous + relative)
+		if err != nil {
+			return false
+		}
+		current, err := DirectoryEntries(generation + relative)
+		if err != nil || len(wanted) != len(current) {
+			return false
+		}
+		for name, info := range current {
+			original, found := wanted[name]
+			if !found || !IsSameEntry(filepath.Join(previous+relative, name), original, filepath.Join(generation+relative, name), info) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/* Checks if the two entries are the same, i.e. the same inode, link or directory, with the same permissions */
+func IsSameEntry(previous string, original os.FileInfo, path string, info os.FileInfo) bool {
+	if original.Mode() != info.Mode() {
+		return false
+	}
+	switch {
+	case info.IsDir():
+	case info.Mode()&os.ModeSymlink != 0:
+		source, _ := os.Readlink(previous)
+		target, _ := os.Readlink(path)
+		return source == target
+	default:
+		return os.SameFile(original, info)
+	}
+	return true
+}
+
+/* Checks if the two generations are identical, i.e. the same files, links and directories */
+func (r *ConfigurationStore) IsSameGeneration(previous, generation string) bool {
+	if previous == "" {
+		entries, _ := ioutil.ReadDir(generation)
+		return len(entries) == 0
+	}
+	listing := func(directory string) map[string]os.FileInfo {
+		items := make(map[string]os.FileInfo, 0)
+		filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+			if err == nil && path != directory && !IsInternalName(info.Name()) {
+				items[strings.TrimPrefix(path, directory)] = info
+			}
+			return nil
+		})
+		return items
+	}
+	before, after := listing(previous), listing(generation)
+	if len(before) != len(after) {
+		return false
+	}
+	for path, info := range after {
+		original, found := before[path]
+		if !found || !IsSameEntry(previous+path, original, generation+path, info) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	Flips the ..data link to the generation, links the top level entries and removes the older generations, bar the
+	previous which is kept to stage the next change in; the directories written (relative to the generation, and
+	whether in full) are synced beforehand
+*/
+func (r *ConfigurationStore) PublishGeneration(generation, previous string, written map[string]bool) error {
+	logger.V(VERBOSE_INFO).Infof("Publishing the generation: %s", generation)
+	/* step: the generation must be on disk before the link is flipped to it */
+	for relative, recursive := range written {
+		if !recursive {
+			if info, err := os.Lstat(generation + relative); err == nil && info.IsDir() {
+				r.fs.SyncDirectory(generation + relative)
+			}
+			continue
+		}
+		filepath.Walk(generation+relative, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				r.fs.SyncDirectory(path)
+			}
+			return nil
+		})
+	}
+	if err := r.fs.Symlink(filepath.Base(generation), filepath.Join(r.options.cfg_directory, DATA_LINK)); err != nil {
+		return err
+	}
+	r.published.Store(generation)
+	r.LinkGeneration(generation)
+	/* step: both generations are watched, so the local edits to either are noted; a watch is only added once */
+	if err := r.watcher.AddDirectoryWatch(generation); err != nil {
+		logger.Errorf("Failed to add a watch on the generation: %s, error: %s", generation, err)
+	}
+	/* step: remove the older generations */
+	entries, err := ioutil.ReadDir(r.options.cfg_directory)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(r.options.cfg_directory, entry.Name())
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), GENERATION_PREFIX) && path != generation && path != previous {
+			logger.V(VERBOSE_LEVEL).Infof("Removing the older generation: %s", path)
+			r.watcher.RemoveDirectoryWatch(path)
+			if err := os.RemoveAll(path); err != nil {
+				logger.Errorf("Failed to remove the older generation: %s, error: %s", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+/* Ensure the top level entries of the mount point are links to the entries of the generation via ..data */
+func (r *ConfigurationStore) LinkGeneration(generation string) {
+	if generation == "" {
+		return
+	}
+	current := make(map[string]bool, 0)
+	if entries, err := ioutil.ReadDir(generation); err == nil {
+		for _, entry := range entries {
+			if IsInternalName(entry.Name()) {
+				continue
+			}
+			current[entry.Name()] = true
+			path := filepath.Join(r.options.cfg_directory, entry.Name())
+			if r.fs.Exists(path) && !r.fs.IsSymlink(path) {
+				logger.Errorf("Failed to link: %s, the path already exists and is not a link", path)
+				continue
+			}
+			r.fs.Symlink(filepath.Join(DATA_LINK, entry.Name()), path)
+		}
+	}
+	/* step: remove any links to entries which no longer exist */
+	if entries, err := ioutil.ReadDir(r.options.cfg_directory); err == nil {
+		for _, entry := range entries {
+			path := filepath.Join(r.options.cfg_directory, entry.Name())
+			if entry.Mode()&os.ModeSymlink == 0 || current[entry.Name()] {
+				continue
+			}
+			if target, err := os.Readlink(path); err == nil && strings.HasPrefix(target, DATA_LINK+string(filepath.Separator)) {
+				logger.V(VERBOSE_LEVEL).Infof("Removing the link: %s, the entry no longer exists", path)
+				os.Remove(path)
+			}
+		}
+	}
+}
+
+/*
+	Converts the full path of a file event to the key, handing back false if it's not one of ours; with the
+	atomic swap the events are from the published generation, or the links at the top of the mount point
+*/
+func (r *ConfigurationStore) KeyPath(full_path string) (string, bool) {
+	if r.IsInternalFile(full_path) {
+		return "", false
+	}
+	full_path = r.UnstagedPath(full_path)
+	base := r.options.cfg_directory
+	if r.options.atomic_swap {
+		base = r.Published()
+		if filepath.Dir(full_path) == r.options.cfg_directory {
+			base = r.options.cfg_directory
+		}
+	}
+	if full_path == base {
+		return "", false
+	}
+	path, found := DiskKey(base, full_path)
+	if !found {
+		return "", false
+	}
+	/* step: the destinations computed by the templates are not mapped */
+	if _, owned := r.DestinationOwner(path); owned {
+		return path, true
+	}
+	return r.mapping.Key(path), true
+}
+
+/* The directories modified, and whether everything beneath them was replaced */
+type ModifiedDirectories struct {
+	sync.Mutex
+	/* the directories, path => replaced in full */
+	directories map[string]bool
+}
+
+/* Record the directory as modified, or replaced in full */
+func (r *ModifiedDirectories) Add(path string, recursive bool) {
+	r.Lock()
+	defer r.Unlock()
+	if r.directories == nil {
+		r.directories = make(map[string]bool, 0)
+	}
+	r.directories[path] = r.directories[path] || recursive
+}
+
+/* Take the directories modified since last taken */
+func (r *ModifiedDirectories) Modified() map[string]bool {
+	r.Lock()
+	defer r.Unlock()
+	directories := r.directories
+	r.directories = nil
+	return directories
+}
+
+/*
+	Wraps the file store with the atomic swap, recording the directories modified by the writes; only those are
+	compared against the published generation, and brought in line when the generation is next staged
+*/
+type GenerationFS struct {
+	fs.FileStore
+	ModifiedDirectories
+}
+
+/* Wrap the file store, recording the directories modified */
+func NewGenerationFS(store fs.FileStore) *GenerationFS {
+	return &GenerationFS{FileStore: store}
+}
+
+/* Record the directory of the path and, if a directory, the path itself */
+func (r *GenerationFS) Changed(path string) {
+	r.Add(filepath.Dir(path), false)
+	if info, err := os.Lstat(path); err == nil && info.IsDir() {
+		r.Add(path, false)
+	}
+}
+
+/* Record the path and each of its parents, i.e. the directories created or removed */
+func (r *GenerationFS) ChangedTree(path string) {
+	for ; filepath.Dir(path) != path; path = filepath.Dir(path) {
+		r.Add(path, false)
+	}
+}
+
+func (r *GenerationFS) Create(path string, value string, attributes fs.Attributes) error {
+	defer r.Changed(path)
+	return r.FileStore.Create(path, value, attributes)
+}
+
+func (r *GenerationFS) Update(path string, value string, attributes fs.Attributes) error {
+	defer r.Changed(path)
+	return r.FileStore.Update(path, value, attributes)
+}
+
+func (r *GenerationFS) Stream(path string, reader io.Reader, attributes fs.Attributes) error {
+	defer r.Changed(path)
+	return r.FileStore.Stream(path, reader, attributes)
+}
+
+func (r *GenerationFS) Delete(path string) error {
+	defer r.Changed(path)
+	return r.FileStore.Delete(path)
+}
+
+func (r *GenerationFS) Mkdir(path string) error {
+	defer r.Changed(path)
+	return r.FileStore.Mkdir(path)
+}
+
+func (r *GenerationFS) Mkdirp(path string, attributes fs.Attributes) error {
+	defer r.ChangedTree(path)
+	return r.FileStore.Mkdirp(path, attributes)
+}
+
+func (r *GenerationFS) Rmdir(path string) error {
+	defer r.Changed(path)
+	return r.FileStore.Rmdir(path)
+}
+
+func (r *GenerationFS) Rmdirp(path, base string) error {
+	defer r.ChangedTree(path)
+	return r.FileStore.Rmdirp(path, base)
+}
+
+func (r *GenerationFS) Move(path, destination string) error {
+	defer r.Add(destination, true)
+	defer r.Changed(destination)
+	defer r.Changed(path)
+	return r.FileStore.Move(path, destination)
+}
+
+func (r *GenerationFS) Touch(path string) error {
+	defer r.Changed(path)
+	return r.FileStore.Touch(path)
+}
+
+func (r *GenerationFS) Chown(path string, uid, gid int) error {
+	defer r.Changed(path)
+	return r.FileStore.Chown(path, uid, gid)
+}
+
+func (r *GenerationFS) Symlink(target, path string) error {
+	defer r.Changed(path)
+	return r.FileStore.Symlink(target, path)
+}
+
+func (r *GenerationFS) Chmod(path string, mode os.FileMode) error {
+	defer r.Changed(path)
+	return r.FileStore.Chmod(path, mode)
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsInternalName(t *testing.T) {
+	tests := map[string]bool{
+		"..data":                              true,
+		"..2015_01_02_15_04_05.000000000":     true,
+		"..app_2015_01_02_15_04_05.000000000": true,
+		"..app_previous":                      true,
+		".config.lock":                        true,
+		".config.1234567":                     true,
+		"..":                                  false,
+		"..previous":                          false,
+		"..app":                               false,
+		".htpasswd":                           false,
+		".env":                                false,
+		".lock":                               false,
+		".config.yaml":                        false,
+		"config.1234":                         false,
+		"config":                              false,
+	}
+	for name, expected := range tests {
+		if internal := IsInternalName(name); internal != expected {
+			t.Errorf("the name: %s, expected internal: %t, got: %t", name, expected, internal)
+		}
+	}
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("failed to create the directory of: %s, error: %s", path, err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write the file: %s, error: %s", path, err)
+	}
+}
+
+func readTestFile(t *testing.T, path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the file: %s, error: %s", path, err)
+	}
+	return string(content)
+}
+
+/* a source generation, and a copy of it as the generation to stage the next change in */
+func createTestGenerations(t *testing.T, store *ConfigurationStore) (string, string, func()) {
+	directory, err := ioutil.TempDir("", "generations")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory, error: %s", err)
+	}
+	source, generation := filepath.Join(directory, "source"), filepath.Join(directory, "generation")
+	writeTestFile(t, source+"/app/config", "config")
+	writeTestFile(t, source+"/app/.htpasswd", "user:password")
+	writeTestFile(t, source+"/app/.config.lock", "")
+	writeTestFile(t, source+"/app/.config.1234567", "partial")
+	writeTestFile(t, source+"/app/nested/file", "nested")
+	if err := os.Mkdir(generation, 0755); err != nil {
+		t.Fatalf("failed to create the generation, error: %s", err)
+	}
+	if err := store.CopyGeneration(source, generation); err != nil {
+		t.Fatalf("failed to copy the generation, error: %s", err)
+	}
+	return source, generation, func() { os.RemoveAll(directory) }
+}
+
+func TestCopyGeneration(t *testing.T) {
+	store := new(ConfigurationStore)
+	source, generation, cleanup := createTestGenerations(t, store)
+	defer cleanup()
+	if content := readTestFile(t, generation+"/app/.htpasswd"); content != "user:password" {
+		t.Errorf("expected the hidden file to be copied, got: %s", content)
+	}
+	for _, name := range []string{".config.lock", ".config.1234567"} {
+		if _, err := os.Lstat(generation + "/app/" + name); !os.IsNotExist(err) {
+			t.Errorf("the file: %s should not have been copied", name)
+		}
+	}
+	if !store.IsSameDirectories(source, generation, map[string]bool{"/app": false}) {
+		t.Errorf("the copy should be the same as the source")
+	}
+	if !store.IsSameGeneration(source, generation) {
+		t.Errorf("the copy should be the same generation as the source")
+	}
+}
+
+func TestIsSameDirectoriesDotFiles(t *testing.T) {
+	store := new(ConfigurationStore)
+	source, generation, cleanup := createTestGenerations(t, store)
+	defer cleanup()
+	/* step: the temporary and lock files are ignored */
+	writeTestFile(t, generation+"/app/.config.7654321", "partial")
+	writeTestFile(t, generation+"/app/.other.lock", "")
+	if !store.IsSameDirectories(source, generation, map[string]bool{"/app": false}) {
+		t.Errorf("the temporary and lock files should be ignored")
+	}
+	/* step: a hidden file is a key like any other */
+	os.Remove(generation + "/app/.htpasswd")
+	writeTestFile(t, generation+"/app/.htpasswd", "user:changed")
+	if store.IsSameDirectories(source, generation, map[string]bool{"/app": false}) {
+		t.Errorf("a changed hidden file should make the directories differ")
+	}
+	os.Remove(generation + "/app/.htpasswd")
+	if store.IsSameDirectories(source, generation, map[string]bool{"/app": false}) {
+		t.Errorf("a removed hidden file should make the directories differ")
+	}
+}
+
+func TestIsSameDirectoriesRecursive(t *testing.T) {
+	store := new(ConfigurationStore)
+	source, generation, cleanup := createTestGenerations(t, store)
+	defer cleanup()
+	os.Remove(generation + "/app/nested/file")
+	writeTestFile(t, generation+"/app/nested/file", "changed")
+	/* step: only the entries of the directory are compared, unless marked recursive */
+	if !store.IsSameDirectories(source, generation, map[string]bool{"/app": false}) {
+		t.Errorf("the subdirectory should be left to its own entry")
+	}
+	if store.IsSameDirectories(source, generation, map[string]bool{"/app": true}) {
+		t.Errorf("the change beneath the directory should make it differ")
+	}
+	if store.IsSameDirectories(source, generation, map[string]bool{"/app/nested": false}) {
+		t.Errorf("the change to the subdirectory should make it differ")
+	}
+}
+
+func TestSyncGeneration(t *testing.T) {
+	store := new(ConfigurationStore)
+	source, generation, cleanup := createTestGenerations(t, store)
+	defer cleanup()
+	/* step: change the source, the hidden files included */
+	os.Remove(source + "/app/.htpasswd")
+	writeTestFile(t, source+"/app/.htpasswd", "user:changed")
+	writeTestFile(t, source+"/app/.env", "env")
+	os.Remove(source + "/app/config")
+	os.Symlink("nested/file", source+"/app/link")
+	writeTestFile(t, source+"/other/file", "other")
+	writeTestFile(t, generation+"/app/.config.7654321", "partial")
+	directories := map[string]bool{"/app": false, "/other": false}
+	if store.IsSameDirectories(source, generation, directories) {
+		t.Fatalf("the generations should differ before the sync")
+	}
+	if err := store.SyncGeneration(source, generation, directories); err != nil {
+		t.Fatalf("failed to sync the generation, error: %s", err)
+	}
+	if !store.IsSameDirectories(source, generation, directories) {
+		t.Errorf("the generations should be the same after the sync")
+	}
+	if content := readTestFile(t, generation+"/app/.htpasswd"); content != "user:changed" {
+		t.Errorf("expected the hidden file to be replaced, got: %s", content)
+	}
+	if content := readTestFile(t, generation+"/app/.env"); content != "env" {
+		t.Errorf("expected the hidden file to be created, got: %s", content)
+	}
+	if _, err := os.Lstat(generation + "/app/config"); !os.IsNotExist(err) {
+		t.Errorf("expected the file removed from the source to be removed")
+	}
+	if target, err := os.Readlink(generation + "/app/link"); err != nil || target != "nested/file" {
+		t.Errorf("expected the link to be created, got: %s, error: %v", target, err)
+	}
+	if content := readTestFile(t, generation+"/other/file"); content != "other" {
+		t.Errorf("expected the new directory to be copied, got: %s", content)
+	}
+	if _, err := os.Lstat(generation + "/app/.config.7654321"); err != nil {
+		t.Errorf("the temporary file in the generation should be left alone")
+	}
+	/* step: a directory removed from the source is removed from the generation */
+	os.RemoveAll(source + "/other")
+	if err := store.SyncGeneration(source, generation, map[string]bool{"/other": false}); err != nil {
+		t.Fatalf("failed to sync the generation, error: %s", err)
+	}
+	if _, err := os.Lstat(generation + "/other"); !os.IsNotExist(err) {
+		t.Errorf("expected the directory removed from the source to be removed")
+	}
+	if !store.IsSameGeneration(source, generation) {
+		t.Errorf("the generations should be the same")
+	}
+}
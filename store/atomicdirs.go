@@ -0,0 +1,269 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+	An atomic directory is materialized into a generation alongside it, i.e. /config/..app_2015_01_02_15_04_05.000000000,
+	and /config/app is a link to it; the changes beneath the directory within a transaction (a batch of events, see
+	-coalesce) are staged in a copy of the current generation and published together by flipping the link, so the
+	readers never observe a mix of old and new files from the one change
+*/
+
+/* the coalescing window used when none has been given, so the changes of a batch are staged together */
+const DEFAULT_ATOMIC_WINDOW = 100 * time.Millisecond
+
+var InvalidAtomicDirErr = errors.New("The atomic directories can't be used with the atomic swap, which already covers the whole mount point")
+
+/* the directories applied atomically, a flag value which can be given multiple times */
+type AtomicDirectories []string
+
+func (r *AtomicDirectories) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *AtomicDirectories) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if err := ValidateKey(item); err != nil {
+			return err
+		}
+		if CleanKey(item) == "/" {
+			return errors.New("the root can't be an atomic directory, use -atomic_swap instead")
+		}
+		*r = append(*r, CleanKey(item))
+	}
+	return nil
+}
+
+/* a generation of an atomic directory being staged */
+type StagedDirectory struct {
+	/* the key of the directory */
+	Key string
+	/* the generation the link pointed to when staging began, or the directory itself if not yet a link */
+	Previous string
+	/* the generation the changes are applied to */
+	Generation string
+}
+
+/* The links of the atomic directories under the mount point, link => key */
+func (r *ConfigurationStore) AtomicLinks() map[string]string {
+	links := make(map[string]string, 0)
+	for _, key := range r.options.atomic_dirs {
+		links[DiskPath(r.options.cfg_directory, r.mapping.Map(key, false))] = key
+	}
+	return links
+}
+
+/* Checks if the path is the link of an atomic directory */
+func (r *ConfigurationStore) IsAtomicLink(full_path string) bool {
+	_, found := r.AtomicLinks()[full_path]
+	return found
+}
+
+/* Checks if the directory is a generation of the atomic directory at the link */
+func IsLinkGeneration(link, directory string) bool {
+	return filepath.Dir(directory) == filepath.Dir(link) &&
+		strings.HasPrefix(filepath.Base(directory), GENERATION_PREFIX+filepath.Base(link)+"_")
+}
+
+/*
+	Applies the change, staging the changes beneath the atomic directories and publishing each of them once the
+	change has been applied; the transactions are serialized, as they share the staged generations. Returns false
+	should any of the directories have been rejected
+*/
+func (r *ConfigurationStore) StageTransaction(apply func()) bool {
+	if len(r.options.atomic_dirs) <= 0 || r.options.dry_run {
+		apply()
+		return true
+	}
+	r.swap.Lock()
+	defer r.swap.Unlock()
+	r.atomicLock.Lock()
+	r.staging = make(map[string]*StagedDirectory, 0)
+	r.atomicLock.Unlock()
+
+	state := r.SaveState()
+	defer r.EndState()
+	apply()
+
+	r.atomicLock.Lock()
+	staged := r.staging
+	r.staging = nil
+	r.atomicLock.Unlock()
+	published := true
+	for link, directory := range staged {
+		if err := r.PublishStaged(link, directory); err != nil {
+			logger.Errorf("Failed to publish the atomic directory: %s, error: %s", link, err)
+			os.RemoveAll(directory.Generation)
+			published = false
+		}
+	}
+	/* note: should any of the directories be rejected the state is restored in full, the directories published
+	are brought in line again by the next reconciliation */
+	if !published {
+		r.RestoreState(state)
+	}
+	return published
+}
+
+/*
+	Maps the path beneath an atomic directory onto the generation being staged, the generation being created
+	(a copy of the current) on the first change beneath the directory; outside a transaction the path is unchanged
+*/
+func (r *ConfigurationStore) StagedPath(full_path string) string {
+	r.atomicLock.Lock()
+	defer r.atomicLock.Unlock()
+	if r.staging == nil {
+		return full_path
+	}
+	for link, key := range r.AtomicLinks() {
+		if full_path != link && !IsBeneath(link, full_path) {
+			continue
+		}
+		directory, found := r.staging[link]
+		if !found {
+			var err error
+			if directory, err = r.StageDirectory(link, key); err != nil {
+				logger.Errorf("Failed to stage the atomic directory: %s, error: %s", link, err)
+				return full_path
+			}
+			r.staging[link] = directory
+		}
+		return directory.Generation + full_path[len(link):]
+	}
+	return full_path
+}
+
+/* Creates a new generation of the atomic directory, a copy of the current via hard links */
+func (r *ConfigurationStore) StageDirectory(link, key string) (*StagedDirectory, error) {
+	directory := &StagedDirectory{
+		Key:        key,
+		Generation: filepath.Join(filepath.Dir(link), GENERATION_PREFIX+filepath.Base(link)+"_"+time.Now().UTC().Format(GENERATION_TIMESTAMP)),
+	}
+	switch {
+	case r.fs.IsSymlink(link):
+		if target, err := os.Readlink(link); err == nil {
+			directory.Previous = filepath.Join(filepath.Dir(link), target)
+		}
+	case r.fs.Exists(link) && r.fs.IsDirectory(link):
+		directory.Previous = link
+	}
+	logger.V(VERBOSE_LEVEL).Infof("Staging the atomic directory: %s in: %s", link, directory.Generation)
+	if err := r.fs.Mkdirp(filepath.Dir(link), r.DirectoryAttributes(path.Dir(key))); err != nil {
+		return nil, err
+	}
+	if err := r.fs.Mkdirp(directory.Generation, r.DirectoryAttributes(key)); err != nil {
+		return nil, err
+	}
+	if directory.Previous != "" && r.fs.IsDirectory(directory.Previous) {
+		if err := r.CopyGeneration(directory.Previous, directory.Generation); err != nil {
+			os.RemoveAll(directory.Generation)
+			return nil, err
+		}
+	}
+	return directory, nil
+}
+
+/*
+	Publishes the staged generation by flipping the link to it, unless nothing has changed; the directory having
+	been removed by the change, the link is removed. The previous generations are removed once published
+*/
+func (r *ConfigurationStore) PublishStaged(link string, directory *StagedDirectory) error {
+	switch {
+	case !r.fs.IsDirectory(directory.Generation):
+		logger.V(VERBOSE_INFO).Infof("The atomic directory: %s has been removed", link)
+		if r.fs.IsSymlink(link) {
+			if err := os.Remove(link); err != nil {
+				return err
+			}
+		}
+	case directory.Previous != "" && r.IsSameGeneration(directory.Previous, directory.Generation):
+		logger.V(VERBOSE_LEVEL).Infof("Nothing changed in the atomic directory: %s, discarding: %s", link, directory.Generation)
+		return os.RemoveAll(directory.Generation)
+	default:
+		if err := r.ValidateStaged(directory.Generation); err != nil {
+			return err
+		}
+		logger.V(VERBOSE_INFO).Infof("Publishing the atomic directory: %s, generation: %s", link, directory.Generation)
+		/* step: the generation must be on disk before the link is flipped to it */
+		filepath.Walk(directory.Generation, func(full_path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				r.fs.SyncDirectory(full_path)
+			}
+			return nil
+		})
+		/* step: the directory predates the atomic apply, it's moved aside as a previous generation */
+		if directory.Previous == link {
+			previous := filepath.Join(filepath.Dir(link), GENERATION_PREFIX+filepath.Base(link)+GENERATION_PREVIOUS)
+			r.watcher.RemoveDirectoryWatch(link)
+			if err := os.Rename(link, previous); err != nil {
+				return err
+			}
+		}
+		if err := r.fs.Symlink(filepath.Base(directory.Generation), link); err != nil {
+			return err
+		}
+		if r.options.read_only {
+			if err := r.watcher.AddDirectoryWatch(directory.Generation); err != nil {
+				logger.Errorf("Failed to add a watch on the generation: %s, error: %s", directory.Generation, err)
+			}
+		}
+	}
+	/* step: remove the previous generations */
+	entries, err := ioutil.ReadDir(filepath.Dir(link))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		generation := filepath.Join(filepath.Dir(link), entry.Name())
+		if entry.IsDir() && IsLinkGeneration(link, generation) && generation != directory.Generation {
+			logger.V(VERBOSE_LEVEL).Infof("Removing the previous generation: %s", generation)
+			r.watcher.RemoveDirectoryWatch(generation)
+			if err := os.RemoveAll(generation); err != nil {
+				logger.Errorf("Failed to remove the previous generation: %s, error: %s", generation, err)
+			}
+		}
+	}
+	return nil
+}
+
+/* Maps a path within a generation of an atomic directory back to the path via its link, i.e. as the readers see it */
+func (r *ConfigurationStore) UnstagedPath(full_path string) string {
+	if len(r.options.atomic_dirs) <= 0 {
+		return full_path
+	}
+	for link, _ := range r.AtomicLinks() {
+		if !IsBeneath(filepath.Dir(link), full_path) {
+			continue
+		}
+		relative := full_path[len(filepath.Dir(link)):]
+		name := strings.SplitN(strings.TrimPrefix(relative, string(filepath.Separator)), string(filepath.Separator), 2)
+		if generation := filepath.Join(filepath.Dir(link), name[0]); IsLinkGeneration(link, generation) {
+			return link + full_path[len(generation):]
+		}
+	}
+	return full_path
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/gambol99/config-fs/store/fs"
+)
+
+/*
+	A value can carry a front-matter line of attributes which are applied to the file
+	materialized from it, the line is removed from the content written, i.e.
+
+	$ATTRIBUTES$ mode=0600 owner=nginx group=nginx context=system_u:object_r:httpd_config_t:s0
+	the actual content of the file
+*/
+const ATTRIBUTES_PREFIX = "$ATTRIBUTES$"
+
+/* a flag value for a file mode given in octal */
+type FileMode os.FileMode
+
+func (r *FileMode) String() string {
+	return fmt.Sprintf("%#o", *r)
+}
+
+func (r *FileMode) Set(value string) error {
+	mode, err := ParseFileMode(value)
+	if err != nil {
+		return err
+	}
+	*r = FileMode(mode)
+	return nil
+}
+
+/* Parses a file mode in octal, i.e. 0644 */
+func ParseFileMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	return os.FileMode(mode), nil
+}
+
+/* Resolves a user name or numeric id into a uid */
+func LookupUser(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	account, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(account.Uid)
+}
+
+/* Resolves a group name or numeric id into a gid */
+func LookupGroup(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(group.Gid)
+}
+
+/* The default attributes for the files, taken from the command line options and the metadata of the directories */
+func (r *ConfigurationStore) DefaultAttributes(path string) fs.Attributes {
+	attributes := fs.Attributes{
+		Mode:    r.ProtectMode(os.FileMode(r.options.file_mode)),
+		UID:     r.uid,
+		GID:     r.gid,
+		Context: r.SelinuxContext(path),
+	}
+	for _, fields := range r.Metadata(path) {
+		r.ApplyAttributes(path, fields, &attributes, false)
+	}
+	return attributes
+}
+
+/* Extracts the attributes from the value, returning them along with the remaining content */
+func (r *ConfigurationStore) ParseAttributes(path, value string) (fs.Attributes, string) {
+	attributes := r.DefaultAttributes(path)
+	if !strings.HasPrefix(value, ATTRIBUTES_PREFIX) {
+		return attributes, value
+	}
+	/* step: split the front-matter line from the content */
+	header, content := value[len(ATTRIBUTES_PREFIX):], ""
+	if index := strings.Index(header, "\n"); index >= 0 {
+		header, content = header[:index], header[index+1:]
+	}
+	r.ApplyAttributes(path, header, &attributes, false)
+	return attributes, content
+}
+
+/* Applies the attribute fields, i.e. mode=0600 owner=nginx, to the attributes of a file or directory */
+func (r *ConfigurationStore) ApplyAttributes(path, header string, attributes *fs.Attributes, directory bool) {
+	for _, field := range strings.Fields(header) {
+		items := strings.SplitN(field, "=", 2)
+		if len(items) != 2 {
+			logger.Errorf("Invalid attribute: %s in key: %s, skipping", field, path)
+			continue
+		}
+		switch items[0] {
+		case "mode":
+			if mode, err := ParseFileMode(items[1]); err != nil {
+				logger.Errorf("Invalid file mode: %s in key: %s, error: %s", items[1], path, err)
+			} else if !directory {
+				attributes.Mode = r.ProtectMode(mode)
+			}
+		case "dir_mode":
+			if mode, err := ParseFileMode(items[1]); err != nil {
+				logger.Errorf("Invalid directory mode: %s in key: %s, error: %s", items[1], path, err)
+			} else if directory {
+				attributes.Mode = mode
+			}
+		case "owner":
+			if uid, err := LookupUser(items[1]); err != nil {
+				logger.Errorf("Invalid owner: %s in key: %s, error: %s", items[1], path, err)
+			} else {
+				attributes.UID = uid
+			}
+		case "group":
+			if gid, err := LookupGroup(items[1]); err != nil {
+				logger.Errorf("Invalid group: %s in key: %s, error: %s", items[1], path, err)
+			} else {
+				attributes.GID = gid
+			}
+		case "context":
+			attributes.Context = items[1]
+		default:
+			logger.Errorf("Unknown attribute: %s in key: %s, skipping", items[0], path)
+		}
+	}
+}
+
+/* In read only mode we strip the write permissions from the files */
+func (r *ConfigurationStore) ProtectMode(mode os.FileMode) os.FileMode {
+	if r.options.read_only {
+		return mode &^ 0222
+	}
+	return mode
+}
+
+/* Record the attributes for a path, so updates to templated content are applied with them */
+func (r *ConfigurationStore) SetAttributes(path string, attributes fs.Attributes) {
+	r.Lock()
+	defer r.Unlock()
+	r.SaveKeyState(path)
+	r.attributes[path] = attributes
+}
+
+/* Retrieve the attributes for a path, or the defaults if none have been recorded */
+func (r *ConfigurationStore) GetAttributes(path string) fs.Attributes {
+	r.RLock()
+	defer r.RUnlock()
+	if attributes, found := r.attributes[path]; found {
+		return attributes
+	}
+	return r.DefaultAttributes(path)
+}
+
+/* Checks if the attributes for a path have been recorded, i.e. the key has been materialized */
+func (r *ConfigurationStore) HasAttributes(path string) bool {
+	r.RLock()
+	defer r.RUnlock()
+	_, found := r.attributes[path]
+	return found
+}
+
+/* The attributes for the directories, taken from the command line options and the metadata of the directories */
+func (r *ConfigurationStore) DirectoryAttributes(path string) fs.Attributes {
+	attributes := fs.Attributes{
+		Mode:    os.FileMode(r.options.dir_mode),
+		UID:     r.uid,
+		GID:     r.gid,
+		Context: r.SelinuxContext(path),
+	}
+	for _, fields := range r.Metadata(path) {
+		r.ApplyAttributes(path, fields, &attributes, true)
+	}
+	return attributes
+}
+
+/*
+	Create the directory structure, applying the directory mode and ownership to any directories created; each
+	level beneath the mount point is created in turn, as the selinux context depends on the directory
+*/
+func (r *ConfigurationStore) MakeDirectory(full_path string) error {
+	base := r.FullPath("")
+	key, found := DiskKey(base, r.UnstagedPath(full_path))
+	if !found || key == "/" {
+		return r.fs.Mkdirp(full_path, r.DirectoryAttributes("/"))
+	}
+	if err := r.fs.Mkdirp(base, r.DirectoryAttributes("/")); err != nil {
+		return err
+	}
+	path := ""
+	for _, name := range strings.Split(strings.TrimPrefix(key, "/"), "/") {
+		path += "/" + name
+		key, level := r.mapping.Key(path), r.StagedPath(DiskPath(base, path))
+		/* check: has the key changed from a file to a directory, i.e. while we weren't watching */
+		file_path := level
+		if r.mapping.IsFile(key) {
+			file_path = r.FullPath(key)
+		}
+		if file_path != level || (r.fs.Exists(level) && ((r.fs.IsSymlink(level) && !r.IsAtomicLink(level)) || !r.fs.IsDirectory(level))) {
+			logger.Warningf("The key: %s has changed from a file to a directory, removing the file: %s", key, file_path)
+			if err := r.RemoveStoreConfigFile(key, file_path); err != nil {
+				return err
+			}
+		}
+		if err := r.fs.Mkdirp(level, r.DirectoryAttributes(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Remove the attributes for the path and anything beneath it */
+func (r *ConfigurationStore) DeleteAttributes(path string) {
+	r.Lock()
+	defer r.Unlock()
+	for item, _ := range r.attributes {
+		if item == path || strings.HasPrefix(item, path+"/") {
+			r.SaveKeyState(item)
+			delete(r.attributes, item)
+		}
+	}
+	/* step: along with the values applied, and the content written for the writeback */
+	for item, _ := range r.applied {
+		if item == path || strings.HasPrefix(item, path+"/") {
+			r.SaveKeyState(item)
+			delete(r.applied, item)
+		}
+	}
+	for item, _ := range r.written {
+		if item == path || strings.HasPrefix(item, path+"/") {
+			r.SaveKeyState(item)
+			delete(r.written, item)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* the longest we wait between the attempts to build the directories which failed */
+const MAX_SYNC_BACKOFF = time.Minute
+
+/*
+	What becomes of the initial sync when the store can't be reached, i.e. a host rebooted during an outage of the
+	backend; the policies being
+
+	- fail: the process exits at once, rather than retrying
+	- retry: the directories which failed are retried -sync_retries times, the process exiting once exhausted
+	- block: the directories which failed are retried until the store can be reached, or -startup_timeout passes
+	- snapshot: the mount point is restored from the last snapshot (or the files in place are left as they are)
+	  and the sync retried in the background, the mount point being reconciled once the store can be reached
+*/
+const (
+	STARTUP_FAIL     = "fail"
+	STARTUP_RETRY    = "retry"
+	STARTUP_BLOCK    = "block"
+	STARTUP_SNAPSHOT = "snapshot"
+)
+
+var InvalidStartupPolicyErr = errors.New("Invalid startup policy, must be fail, retry, block or snapshot")
+
+/* Checks the startup policy is one we know of */
+func ValidateStartupPolicy(policy string) error {
+	switch policy {
+	case STARTUP_FAIL, STARTUP_RETRY, STARTUP_BLOCK, STARTUP_SNAPSHOT:
+		return nil
+	}
+	return InvalidStartupPolicyErr
+}
+
+/*
+	The directories of the store which couldn't be listed while building the mount point, directory => error;
+	everything else has been built, so only these need to be retried
+*/
+type BuildErr map[string]error
+
+func (r BuildErr) Error() string {
+	list := make([]string, 0)
+	for directory, err := range r {
+		list = append(list, fmt.Sprintf("%s: %s", directory, err))
+	}
+	sort.Strings(list)
+	return "failed to list the directories: " + strings.Join(list, ", ")
+}
+
+/* Merges the failures of a directory into the failures of its parent, returning the failures */
+func (r BuildErr) Add(err error) BuildErr {
+	if failures, ok := err.(BuildErr); ok {
+		if r == nil {
+			r = make(BuildErr, 0)
+		}
+		for directory, failed := range failures {
+			r[directory] = failed
+		}
+	}
+	return r
+}
+
+/*
+	Builds the mount point from the store, retrying the directories which couldn't be listed (i.e. a hiccup in
+	the backend mid listing) with an exponential backoff; the progress made is kept, so only the failures are
+	retried, and an error is returned once the retries are exhausted or the context is cancelled
+*/
+func (r *ConfigurationStore) BuildWithRetry(ctx context.Context) error {
+	pending := []string{r.options.root_key}
+	backoff := r.options.sync_backoff
+	var deadline time.Time
+	if r.options.startup_policy == STARTUP_BLOCK && r.options.startup_timeout > 0 {
+		deadline = time.Now().Add(r.options.startup_timeout)
+	}
+	for attempt := 0; ; attempt++ {
+		failures := make(BuildErr, 0)
+		for _, directory := range pending {
+			if err := r.BuildDirectory(ctx, directory); err != nil {
+				failures.Add(err)
+			}
+		}
+		/* check: the build was cancelled, there's no retrying */
+		if err := ctx.Err(); err != nil {
+			logger.Errorf("The build of the mount point: %s was cancelled, error: %s", r.options.cfg_directory, err)
+			return err
+		}
+		if len(failures) <= 0 {
+			if attempt > 0 {
+				logger.Infof("Built the mount point: %s from the store after %d retries", r.options.cfg_directory, attempt)
+			}
+			return nil
+		}
+		if !r.CanRetryBuild(attempt, deadline) {
+			logger.Errorf("Failed to build the mount point: %s from the store after %d retries, error: %s", r.options.cfg_directory, attempt, failures)
+			return failures
+		}
+		if r.options.startup_policy == STARTUP_BLOCK {
+			/* note: the last wait is cut short by the deadline */
+			if !deadline.IsZero() && time.Until(deadline) < backoff {
+				backoff = time.Until(deadline)
+			}
+			logger.Warningf("Failed to build %d directories of the store, blocking until it can be reached, retrying in %s (attempt %d), error: %s",
+				len(failures), backoff, attempt+1, failures)
+		} else {
+			logger.Warningf("Failed to build %d directories of the store, retrying in %s (%d of %d), error: %s",
+				len(failures), backoff, attempt+1, r.options.sync_retries, failures)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > MAX_SYNC_BACKOFF {
+			backoff = MAX_SYNC_BACKOFF
+		}
+		pending = make([]string, 0)
+		for directory, _ := range failures {
+			pending = append(pending, directory)
+		}
+		sort.Strings(pending)
+	}
+}
+
+/* Checks if the build may be retried once more, per the startup policy */
+func (r *ConfigurationStore) CanRetryBuild(attempt int, deadline time.Time) bool {
+	switch r.options.startup_policy {
+	case STARTUP_FAIL, STARTUP_SNAPSHOT:
+		return false
+	case STARTUP_BLOCK:
+		return deadline.IsZero() || time.Now().Before(deadline)
+	}
+	return attempt < r.options.sync_retries
+}
+
+/*
+	Serves the last snapshot of the mount point while the store can't be reached; without a snapshot the files in
+	place (if any) are left as they are
+*/
+func (r *ConfigurationStore) ServeSnapshot() {
+	snapshots, err := ListSnapshots(r.options.snapshot_dir)
+	if r.options.snapshot_dir == "" || err != nil || len(snapshots) <= 0 {
+		logger.Warningf("The store can't be reached and there's no snapshot to serve, leaving the files under the mount point: %s as they are",
+			r.options.cfg_directory)
+		return
+	}
+	latest := snapshots[len(snapshots)-1]
+	logger.Warningf("The store can't be reached, serving the snapshot: %s until it can", latest)
+	if err := r.RestoreSnapshot(latest); err != nil {
+		logger.Errorf("Failed to restore the snapshot: %s, error: %s", latest, err)
+	}
+	/* note: the mount point isn't pinned to the snapshot, it's replaced by the sync */
+	r.pinned = ""
+}
+
+/* Retries the initial sync (as a full reconciliation) with the backoff, until it succeeds or the context is cancelled */
+func (r *ConfigurationStore) RetryStartup(ctx context.Context) {
+	backoff := r.options.sync_backoff
+	for attempt := 1; ; attempt++ {
+		logger.Warningf("Retrying the sync of the mount point: %s in %s (attempt %d), serving the snapshot until then", r.options.cfg_directory, backoff, attempt)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if r.HandleTimerEvent(ctx) {
+			logger.Infof("The store can be reached again, the mount point: %s has been synchronized", r.options.cfg_directory)
+			return
+		}
+		if backoff *= 2; backoff > MAX_SYNC_BACKOFF {
+			backoff = MAX_SYNC_BACKOFF
+		}
+	}
+}
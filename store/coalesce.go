@@ -0,0 +1,126 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"github.com/gambol99/config-fs/store/kv"
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+/*
+	The events received within the coalescing window, applied together; only the latest event for each key is
+	kept, in the order of its latest occurrence (so a directory deleted and a key recreated beneath it are applied
+	in that order), and each template is rendered the once
+*/
+type EventBatch struct {
+	/* the node events, nil where superseded by a later event for the same key */
+	nodes []*kv.NodeChange
+	/* the position of the latest event for each key */
+	keys map[string]int
+	/* the sequence in the journal of the latest event for each key, if journaled */
+	sequences map[string]uint64
+	/* the templates which have changed, in the order received */
+	templates []string
+	/* the templates already in the batch */
+	rendered map[string]bool
+	/* the number of events received */
+	received int
+}
+
+/* Create an empty batch */
+func NewEventBatch() *EventBatch {
+	return &EventBatch{
+		nodes:     make([]*kv.NodeChange, 0),
+		keys:      make(map[string]int, 0),
+		sequences: make(map[string]uint64, 0),
+		templates: make([]string, 0),
+		rendered:  make(map[string]bool, 0),
+	}
+}
+
+/* Add a change to the store, superseding any earlier event for the key; the sequence is that in the journal */
+func (r *EventBatch) AddNode(event kv.NodeChange, sequence uint64) {
+	r.received++
+	if index, found := r.keys[event.Node.Path]; found {
+		r.nodes[index] = nil
+	}
+	r.keys[event.Node.Path] = len(r.nodes)
+	r.sequences[event.Node.Path] = sequence
+	r.nodes = append(r.nodes, &event)
+}
+
+/* Add a change to a template */
+func (r *EventBatch) AddTemplate(path string) {
+	r.received++
+	if !r.rendered[path] {
+		r.rendered[path] = true
+		r.templates = append(r.templates, path)
+	}
+}
+
+/* Checks if the batch has any events */
+func (r *EventBatch) IsEmpty() bool {
+	return r.received <= 0
+}
+
+/* The number of changes to apply, i.e. after coalescing */
+func (r *EventBatch) Size() int {
+	return len(r.keys) + len(r.templates)
+}
+
+/* Apply the events of the batch, the changes to the store (by priority) before the templates */
+func (r *EventBatch) Apply(ctx context.Context, store *ConfigurationStore) {
+	applied := r.Size()
+	logger.V(VERBOSE_INFO).Infof("Applying a batch of %d events, coalesced from: %d", applied, r.received)
+	metrics.Add(metrics.EVENTS_COALESCED, int64(r.received-applied))
+	/* step: the latest event for each key, the higher priorities first */
+	events := make([]kv.NodeChange, 0, len(r.keys))
+	for _, event := range r.nodes {
+		if event != nil {
+			events = append(events, *event)
+		}
+	}
+	for _, event := range store.options.priorities.Order(events) {
+		store.HandleNodeEvent(ctx, event)
+	}
+	/* step: a template may have been removed by a change in the batch */
+	for _, path := range r.templates {
+		if _, found := store.dynamic.IsDynamic(path); found {
+			store.HandleTemplateEvent(path)
+		}
+	}
+}
+
+/* Mark the changes of the batch to the store as applied in the journal, once published */
+func (r *EventBatch) Complete(journal *WriteJournal) {
+	for path, sequence := range r.sequences {
+		journal.Complete(path, sequence)
+	}
+}
+
+/* Apply the batch in the background, returning a channel closed once it has been applied */
+func (r *ConfigurationStore) ApplyBatch(ctx context.Context, batch *EventBatch) chan struct{} {
+	applied := make(chan struct{})
+	r.Dispatch(func() {
+		defer close(applied)
+		if batch.Size() >= SNAPSHOT_BULK_CHANGES {
+			r.TakeSnapshot("bulk")
+		}
+		if r.Transaction(func() { batch.Apply(ctx, r) }) {
+			batch.Complete(r.journal)
+		}
+	})
+	return applied
+}
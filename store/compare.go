@@ -0,0 +1,99 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gambol99/config-fs/store/fs"
+)
+
+/*
+	Renders the desired state of the mount point (or each of the mounts) from the store, templates included, and
+	writes the differences from what is presently on disk; a line per file, A the file is missing, M the content
+	differs, T the permissions or file type differ and D the file isn't produced by any of the keys, followed by
+	the unified diff of the content. Returns true if the mount point has drifted from the store
+*/
+func DiffMountPoint(ctx context.Context, settings Config, writer io.Writer) (bool, error) {
+	drifted := false
+	for _, mounted := range MountOptions(settings) {
+		changes, err := DiffMount(ctx, mounted)
+		if err != nil {
+			return false, err
+		}
+		for _, change := range changes {
+			fmt.Fprintf(writer, "%c %s\n%s", change.Action, change.Path, change.Diff)
+		}
+		drifted = drifted || len(changes) > 0
+	}
+	return drifted, nil
+}
+
+/* Plans the changes a synchronization would make to the mount point, along with the files none of the keys produce */
+func DiffMount(ctx context.Context, settings Config) ([]PlannedChange, error) {
+	/* step: with the atomic swap we compare against the published generation */
+	settings.cfg_directory = filepath.Clean(settings.cfg_directory)
+	if target, err := os.Readlink(filepath.Join(settings.cfg_directory, DATA_LINK)); err == nil {
+		settings.cfg_directory = filepath.Join(settings.cfg_directory, target)
+	}
+	settings.dry_run, settings.atomic_swap, settings.tmpfs, settings.archive, settings.writeback = true, false, false, "", ""
+	store, err := NewMountStore(settings, nil)
+	if err != nil {
+		return nil, err
+	}
+	r := store.(*ConfigurationStore)
+	defer func() { <-r.CloseSources() }()
+	if err := r.BuildDirectory(ctx, settings.root_key); err != nil {
+		return nil, err
+	}
+	r.ConvergeTemplates()
+	planned := r.planned
+	changes := planned.Changes()
+	if !r.fs.IsDirectory(settings.cfg_directory) {
+		return changes, nil
+	}
+	files, err := r.fs.Files(settings.cfg_directory)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, 0)
+	for _, file := range files {
+		/* step: the files of the atomic directories are found in each of their generations */
+		if file = r.UnstagedPath(file); seen[file] || r.IsAtomicLink(file) {
+			continue
+		}
+		seen[file] = true
+		/* step: our temporary files, the trash and the backups aren't produced by a key */
+		if _, found := r.KeyPath(file); !found || strings.Contains(filepath.Base(file), fs.BACKUP_SUFFIX) {
+			continue
+		}
+		if planned.IsDesired(file) {
+			continue
+		}
+		diff := ""
+		if r.fs.IsFile(file) && !r.fs.IsSymlink(file) {
+			content, _ := r.fs.Read(file)
+			diff = DryRunDiff(file, content, "")
+		}
+		changes = append(changes, PlannedChange{Action: 'D', Path: file, Diff: diff})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gambol99/config-fs/store/kv"
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+const (
+	/* the file is overwritten with the value in the store */
+	CONFLICT_STORE_WINS = "store-wins"
+	/* the local copy is kept, and written back to the store if the key is included in the writeback */
+	CONFLICT_LOCAL_WINS = "local-wins"
+	/* the update is refused and the conflict logged as an error */
+	CONFLICT_ABORT = "abort"
+)
+
+var (
+	ConflictErr      = errors.New("The file has been changed locally and differs from the store, refusing to overwrite it")
+	LocalCopyKeptErr = errors.New("The file has been changed locally, the local copy was kept over the store")
+)
+
+/*
+	A flag value for the policies applied when a file has been changed locally and differs from the store; the
+	flag can be given multiple times, either as a policy for everything or as PREFIX=POLICY, i.e.
+
+	-conflict_policy=abort -conflict_policy=/app/local=local-wins
+*/
+type ConflictPolicies map[string]string
+
+func (r *ConflictPolicies) String() string {
+	items := make([]string, 0)
+	for prefix, policy := range *r {
+		items = append(items, fmt.Sprintf("%s=%s", prefix, policy))
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (r *ConflictPolicies) Set(value string) error {
+	if *r == nil {
+		*r = make(ConflictPolicies, 0)
+	}
+	prefix, policy := "/", value
+	if strings.HasPrefix(value, "/") {
+		items := strings.SplitN(value, "=", 2)
+		if len(items) != 2 {
+			return fmt.Errorf("invalid conflict policy: %s, should be POLICY or PREFIX=POLICY", value)
+		}
+		prefix, policy = filepath.Clean(items[0]), items[1]
+	}
+	switch policy {
+	case CONFLICT_STORE_WINS, CONFLICT_LOCAL_WINS, CONFLICT_ABORT:
+	default:
+		return fmt.Errorf("invalid conflict policy: %s, must be either %s, %s or %s", policy,
+			CONFLICT_STORE_WINS, CONFLICT_LOCAL_WINS, CONFLICT_ABORT)
+	}
+	(*r)[prefix] = policy
+	return nil
+}
+
+/* Checks if any of the policies require the conflicts to be detected */
+func (r ConflictPolicies) IsDetecting() bool {
+	for _, policy := range r {
+		if policy != CONFLICT_STORE_WINS {
+			return true
+		}
+	}
+	return false
+}
+
+/* Resolves the conflict policy for the key, the policy of the longest matching prefix wins */
+func (r *ConfigurationStore) ConflictPolicy(path string) string {
+	policy, matched := CONFLICT_STORE_WINS, -1
+	for prefix, item := range r.options.conflict_policies {
+		if prefix == "/" || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			if len(prefix) > matched {
+				policy, matched = item, len(prefix)
+			}
+		}
+	}
+	return policy
+}
+
+/*
+	Checks if the file of the key has been changed locally and differs from the value in the store, i.e. the file
+	no longer holds the content we last wrote (or, having not written it, any difference at all), and resolves it
+	by the policy of the key; returns true if the file should be overwritten with the value, or LocalCopyKeptErr if
+	the local copy was kept and differs from the store
+*/
+func (r *ConfigurationStore) ResolveConflict(ctx context.Context, node *kv.Node, full_path, value string) (bool, error) {
+	policy := r.ConflictPolicy(node.Path)
+	if policy == CONFLICT_STORE_WINS || !r.fs.IsFile(full_path) || r.fs.IsSymlink(full_path) {
+		return true, nil
+	}
+	content, err := r.fs.Read(full_path)
+	if err != nil || content == value {
+		return true, nil
+	}
+	/* check: the file holds what we last wrote, the store has changed rather than the file */
+	if written, found := r.Written(node.Path); found && written.Hash == ContentHash(content) {
+		return true, nil
+	}
+	metrics.Increment(metrics.SYNC_CONFLICTS)
+	if policy == CONFLICT_ABORT {
+		logger.Errorf("Conflict on the file: %s, it has been changed locally and differs from revision: %d of key: %s, refusing to overwrite it",
+			full_path, node.Index, node.Path)
+		return false, ConflictErr
+	}
+	logger.Warningf("Conflict on the file: %s, it has been changed locally, keeping the local copy over revision: %d of key: %s",
+		full_path, node.Index, node.Path)
+	if r.writeback != nil && r.writeback.IsIncluded(node.Path) && r.WriteBackConflict(ctx, node, value, content) {
+		return false, nil
+	}
+	return false, LocalCopyKeptErr
+}
+
+/* Writes the local copy kept over the revision back to the store, provided the key hasn't changed since */
+func (r *ConfigurationStore) WriteBackConflict(ctx context.Context, node *kv.Node, value, content string) bool {
+	r.writebackLock.Lock()
+	defer r.writebackLock.Unlock()
+	header := strings.TrimSuffix(node.Value, value)
+	updated, err := r.kv.CompareAndSwap(ctx, node.Path, header+content, node.Index)
+	if err != nil {
+		logger.Errorf("Failed to write back the local copy of: %s, the store may have changed, error: %s", node.Path, err)
+		metrics.Increment(metrics.WRITEBACK_CONFLICTS)
+		return false
+	}
+	logger.Infof("Wrote back the local copy of: %s, revision: %d", node.Path, updated.Index)
+	metrics.Increment(metrics.WRITEBACK_APPLIED)
+	r.SetWritten(node.Path, header, content, updated.Index)
+	return true
+}
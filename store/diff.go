@@ -0,0 +1,172 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	/* the lines of context around each change */
+	DIFF_CONTEXT = 3
+	/* above this (lines x lines) we don't compute the changes, the whole content is replaced */
+	DIFF_MAX_MATRIX = 4 * 1024 * 1024
+)
+
+/* an edit in the diff; ' ' unchanged, '-' removed or '+' added */
+type DiffEdit struct {
+	Op   byte
+	Line string
+}
+
+/* Produces a unified diff between the two contents, an empty string if they're the same */
+func UnifiedDiff(from_name, to_name, from, to string) string {
+	if from == to {
+		return ""
+	}
+	var diff bytes.Buffer
+	fmt.Fprintf(&diff, "--- %s\n+++ %s\n", from_name, to_name)
+	if strings.IndexByte(from, 0) >= 0 || strings.IndexByte(to, 0) >= 0 {
+		fmt.Fprintf(&diff, "Binary files %s and %s differ\n", from_name, to_name)
+		return diff.String()
+	}
+	edits := DiffLines(SplitLines(from), SplitLines(to))
+	/* step: group the edits into hunks, with the context either side */
+	for start := 0; start < len(edits); {
+		if edits[start].Op == ' ' {
+			start++
+			continue
+		}
+		first := start - DIFF_CONTEXT
+		if first < 0 {
+			first = 0
+		}
+		last, unchanged := start, 0
+		for last < len(edits) && unchanged <= 2*DIFF_CONTEXT {
+			if edits[last].Op == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+			last++
+		}
+		/* step: trim the trailing context */
+		if unchanged > DIFF_CONTEXT {
+			last -= unchanged - DIFF_CONTEXT
+		}
+		/* step: work out the line numbers of the hunk */
+		from_line, to_line := 1, 1
+		for _, edit := range edits[:first] {
+			if edit.Op != '+' {
+				from_line++
+			}
+			if edit.Op != '-' {
+				to_line++
+			}
+		}
+		from_count, to_count := 0, 0
+		for _, edit := range edits[first:last] {
+			if edit.Op != '+' {
+				from_count++
+			}
+			if edit.Op != '-' {
+				to_count++
+			}
+		}
+		if from_count == 0 {
+			from_line--
+		}
+		if to_count == 0 {
+			to_line--
+		}
+		fmt.Fprintf(&diff, "@@ -%d,%d +%d,%d @@\n", from_line, from_count, to_line, to_count)
+		for _, edit := range edits[first:last] {
+			fmt.Fprintf(&diff, "%c%s\n", edit.Op, edit.Line)
+		}
+		start = last
+	}
+	return diff.String()
+}
+
+/* Splits the content into lines, a trailing newline doesn't produce an empty line */
+func SplitLines(content string) []string {
+	if content == "" {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+/* Computes the edits to turn a into b, using the longest common subsequence of the lines */
+func DiffLines(a, b []string) []DiffEdit {
+	edits := make([]DiffEdit, 0)
+	/* step: strip the common prefix and suffix, which is usually most of a config file */
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	for _, line := range a[:prefix] {
+		edits = append(edits, DiffEdit{' ', line})
+	}
+	middle_a, middle_b := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(middle_a)*len(middle_b) > DIFF_MAX_MATRIX {
+		for _, line := range middle_a {
+			edits = append(edits, DiffEdit{'-', line})
+		}
+		for _, line := range middle_b {
+			edits = append(edits, DiffEdit{'+', line})
+		}
+	} else {
+		/* step: lengths[i][j] is the length of the lcs of middle_a[i:] and middle_b[j:] */
+		lengths := make([][]int, len(middle_a)+1)
+		for i := range lengths {
+			lengths[i] = make([]int, len(middle_b)+1)
+		}
+		for i := len(middle_a) - 1; i >= 0; i-- {
+			for j := len(middle_b) - 1; j >= 0; j-- {
+				if middle_a[i] == middle_b[j] {
+					lengths[i][j] = lengths[i+1][j+1] + 1
+				} else if lengths[i+1][j] >= lengths[i][j+1] {
+					lengths[i][j] = lengths[i+1][j]
+				} else {
+					lengths[i][j] = lengths[i][j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(middle_a) || j < len(middle_b) {
+			switch {
+			case i < len(middle_a) && j < len(middle_b) && middle_a[i] == middle_b[j]:
+				edits = append(edits, DiffEdit{' ', middle_a[i]})
+				i++
+				j++
+			case j >= len(middle_b) || (i < len(middle_a) && lengths[i+1][j] >= lengths[i][j+1]):
+				edits = append(edits, DiffEdit{'-', middle_a[i]})
+				i++
+			default:
+				edits = append(edits, DiffEdit{'+', middle_b[j]})
+				j++
+			}
+		}
+	}
+	for _, line := range a[len(a)-suffix:] {
+		edits = append(edits, DiffEdit{' ', line})
+	}
+	return edits
+}
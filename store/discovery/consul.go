@@ -20,7 +20,6 @@ import (
 	"time"
 
 	consulapi "github.com/armon/consul-api"
-	"github.com/golang/glog"
 )
 
 const DEFAULT_WAIT_TIME = 10
@@ -38,13 +37,13 @@ type ConsulServiceAgent struct {
 }
 
 func NewConsulServiceAgent(uri *url.URL, channel ServiceUpdateChannel) (Discovery, error) {
-	glog.V(3).Infof("Creating a Consul Discovery Agent, url: %s", uri.String())
+	logger.V(3).Infof("Creating a Consul Discovery Agent, url: %s", uri.String())
 	/* step: parse the url */
 	config := consulapi.DefaultConfig()
 	config.Address = uri.Host
 	client, err := consulapi.NewClient(config)
 	if err != nil {
-		glog.Errorf("Failed to create the Consul Client, error: %s", err)
+		logger.Errorf("Failed to create the Consul Client, error: %s", err)
 		return nil, err
 	}
 	agent := new(ConsulServiceAgent)
@@ -59,16 +58,16 @@ func (r *ConsulServiceAgent) Close() error {
 	defer r.Unlock()
 	/* step: we iterate the watches and send a shutdown signal to end the goroutine */
 	for service, channel := range r.watchedServices {
-		glog.V(VERBOSE_LEVEL).Infof("Closing the watch on service: %s", service)
+		logger.V(VERBOSE_LEVEL).Infof("Closing the watch on service: %s", service)
 		channel <- true
 	}
 	return nil
 }
 
 func (r *ConsulServiceAgent) Service(name string) (Service,error) {
-	glog.V(VERBOSE_LEVEL).Infof("Service() service: %s", name)
+	logger.V(VERBOSE_LEVEL).Infof("Service() service: %s", name)
 	if services, err := r.Services(); err != nil {
-		glog.Errorf("Service() failed to find services for service: %s, error: %s", name, err)
+		logger.Errorf("Service() failed to find services for service: %s, error: %s", name, err)
 		return Service{}, err
 	} else {
 		for _, service := range services {
@@ -81,10 +80,10 @@ func (r *ConsulServiceAgent) Service(name string) (Service,error) {
 }
 
 func (r *ConsulServiceAgent) Services() ([]Service, error) {
-	glog.V(VERBOSE_LEVEL).Infof("Services()")
+	logger.V(VERBOSE_LEVEL).Infof("Services()")
 	catalog := r.client.Catalog()
 	if list, _, err := catalog.Services(&consulapi.QueryOptions{}); err != nil {
-		glog.Errorf("Services() failed to find services error: %s", err)
+		logger.Errorf("Services() failed to find services error: %s", err)
 		/* step: just return an empty list */
 		return make([]Service, 0), nil
 	} else {
@@ -97,17 +96,17 @@ func (r *ConsulServiceAgent) Services() ([]Service, error) {
 }
 
 func (r *ConsulServiceAgent) Endpoints(service string) ([]Endpoint, error) {
-	glog.V(VERBOSE_LEVEL).Infof("Endpoints() filter: %s", service)
+	logger.V(VERBOSE_LEVEL).Infof("Endpoints() filter: %s", service)
 	catalog := r.client.Catalog()
 	if services, _, err := catalog.Service(service, "", &consulapi.QueryOptions{}); err != nil {
-		glog.Errorf("Endpoints() failed to find services for service: %s, error: %s", service, err)
+		logger.Errorf("Endpoints() failed to find services for service: %s, error: %s", service, err)
 		return nil, err
 	} else {
 		endpoints := make([]Endpoint, 0)
 		for _, service := range services {
 			endpoints = append(endpoints, r.GetEndpoint(service))
 		}
-		glog.V(VERBOSE_LEVEL).Infof("Endpoints() service: %s, list: %v", service, endpoints)
+		logger.V(VERBOSE_LEVEL).Infof("Endpoints() service: %s, list: %v", service, endpoints)
 		return endpoints, nil
 	}
 }
@@ -118,11 +117,11 @@ func (r *ConsulServiceAgent) Watch(service string) error {
 
 	/* step: check if the resource is already being monitored */
 	if _, found := r.watchedServices[service]; found {
-		glog.V(VERBOSE_LEVEL).Infof("Watch() the service %s is already being watched by this agent, skipping", service)
+		logger.V(VERBOSE_LEVEL).Infof("Watch() the service %s is already being watched by this agent, skipping", service)
 		return nil
 	}
 
-	glog.V(VERBOSE_LEVEL).Infof("Watch() adding a watch for changes to service: %s", service)
+	logger.V(VERBOSE_LEVEL).Infof("Watch() adding a watch for changes to service: %s", service)
 
 	/* step: we create a stop channel which is used by the goroutine below */
 	shutdownChannel := make(chan bool)
@@ -139,14 +138,14 @@ func (r *ConsulServiceAgent) Watch(service string) error {
 		}()
 		for {
 			if killOff {
-				glog.V(3).Infof("Watch() shutting down watch on service: %s", service)
+				logger.V(3).Infof("Watch() shutting down watch on service: %s", service)
 				break
 			}
 			if r.waitIndex == 0 {
 				/* step: lets get the wait index */
 				_, meta, err := catalog.Service(service, "", &consulapi.QueryOptions{})
 				if err != nil {
-					glog.Errorf("Watch() failed to grab the service: %s fron consul, error: %s", service, err)
+					logger.Errorf("Watch() failed to grab the service: %s fron consul, error: %s", service, err)
 					time.Sleep(5 * time.Second)
 				} else {
 					/* update the wait index for this service */
@@ -159,7 +158,7 @@ func (r *ConsulServiceAgent) Watch(service string) error {
 			/* step: making a blocking watch call for changes on the service */
 			_, meta, err := catalog.Service(service, "", queryOptions)
 			if err != nil {
-				glog.Errorf("Failed to wait for service to change, error: %s", err)
+				logger.Errorf("Failed to wait for service to change, error: %s", err)
 				r.waitIndex = uint64(0)
 				time.Sleep(5 * time.Second)
 			} else {
@@ -173,7 +172,7 @@ func (r *ConsulServiceAgent) Watch(service string) error {
 				/* step: update the index */
 				r.waitIndex = meta.LastIndex
 				/* step: send the update upstream */
-				glog.V(VERBOSE_LEVEL).Infof("Watch() service: %s changes; sending upstream", service)
+				logger.V(VERBOSE_LEVEL).Infof("Watch() service: %s changes; sending upstream", service)
 				r.updateChannel <- service
 			}
 		}
@@ -184,8 +183,10 @@ func (r *ConsulServiceAgent) Watch(service string) error {
 func (r *ConsulServiceAgent) GetEndpoint(svc *consulapi.CatalogService) Endpoint {
 	var endpoint Endpoint
 	endpoint.ID = svc.ServiceID
+	endpoint.Node = svc.Node
 	endpoint.Name = svc.ServiceName
 	endpoint.Address = svc.Address
 	endpoint.Port = svc.ServicePort
+	endpoint.Tags = svc.ServiceTags
 	return endpoint
 }
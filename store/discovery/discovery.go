@@ -18,18 +18,53 @@ import (
 	"flag"
 	"net/url"
 
-	"github.com/golang/glog"
+	"github.com/gambol99/config-fs/store/logging"
 )
 
 var (
 	InvalidProviderErr = errors.New("Invalid provider name, does not exist")
-	discovery_url      *string
 )
 
+/* the log of the service discovery */
+var logger = logging.For(logging.SUBSYSTEM_DISCOVERY)
+
 const VERBOSE_LEVEL = 6
 
-func init() {
-	discovery_url = flag.String("discovery", "", "the service discovery backend being used")
+/* The configuration of the service discovery, the defaults given by DefaultConfig */
+type Config struct {
+	/* the url of the discovery backend, i.e. consul://localhost:8500, none disables */
+	url string
+}
+
+/* An option applied to the configuration of the discovery */
+type Option func(*Config) error
+
+/* The default configuration, without any discovery backend */
+func DefaultConfig() Config {
+	return Config{}
+}
+
+/* Binds the configuration to the flags, the current values being the defaults; the caller parses them */
+func RegisterFlags(flags *flag.FlagSet, config *Config) {
+	flags.StringVar(&config.url, "discovery", config.url, "the service discovery backend being used")
+}
+
+/* Applies the options to the configuration, in order */
+func (r *Config) Apply(options ...Option) error {
+	for _, option := range options {
+		if err := option(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* The url of the discovery backend, i.e. consul://localhost:8500 */
+func WithURL(location string) Option {
+	return func(config *Config) error {
+		config.url = location
+		return nil
+	}
 }
 
 type ServiceUpdateChannel chan string
@@ -49,13 +84,13 @@ type Discovery interface {
 	Close() error
 }
 
-func NewDiscovery(channel ServiceUpdateChannel) (Discovery, error) {
+func NewDiscovery(config Config, channel ServiceUpdateChannel) (Discovery, error) {
 	/* step: if the discovery url is not set, we can return a dummy provider */
-	if *discovery_url == "" {
+	if config.url == "" {
 		return nil, nil
 	} else {
-		if uri, err := url.Parse(*discovery_url); err != nil {
-			glog.Errorf("Failed to parse the discovery url: %s, error: %s", *discovery_url, err)
+		if uri, err := url.Parse(config.url); err != nil {
+			logger.Errorf("Failed to parse the discovery url: %s, error: %s", config.url, err)
 			return nil, err
 		} else {
 			switch uri.Scheme {
@@ -68,5 +103,5 @@ func NewDiscovery(channel ServiceUpdateChannel) (Discovery, error) {
 			}
 		}
 	}
-	return nil, errors.New("Failed to create discovery agent for: " + *discovery_url)
+	return nil, errors.New("Failed to create discovery agent for: " + config.url)
 }
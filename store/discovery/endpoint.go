@@ -19,12 +19,16 @@ import (
 
 type Endpoint struct {
 	ID string
+	/* the node the service is running on */
+	Node string
 	/* the name of the service */
 	Name string
 	/* the ip address of the service */
 	Address string
 	/* the port the service is running on */
 	Port int
+	/* the tags associated to the service */
+	Tags []string
 }
 
 func (s Endpoint) String() string {
@@ -0,0 +1,188 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/gambol99/config-fs/store/kv"
+)
+
+/*
+	A document directory is additionally materialized as <directory>.json, the whole of its subtree as a single
+	JSON document, the subdirectories as objects and the keys as strings, i.e. /app/db with the keys /app/db/host
+	and /app/db/replica/host becomes, alongside the files of the keys, the file /config/app/db.json
+
+	{
+	  "host": "db.local",
+	  "replica": {
+	    "host": "db-replica.local"
+	  }
+	}
+
+	The document is regenerated from a listing of the directory whenever any of the keys beneath it changes, and
+	removed along with the directory
+*/
+const DOCUMENT_SUFFIX = ".json"
+
+var InvalidDocumentErr = errors.New("A document directory can't be beneath a directory aggregated into a single file")
+
+/* the directories materialized as a JSON document as well, a flag value which can be given multiple times */
+type DocumentDirectories []string
+
+func (r *DocumentDirectories) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *DocumentDirectories) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if err := ValidateKey(item); err != nil {
+			return err
+		}
+		if CleanKey(item) == "/" {
+			return errors.New("the root can't be materialized as a document")
+		}
+		*r = append(*r, CleanKey(item))
+	}
+	return nil
+}
+
+/* The key of the document of the directory, i.e. /app/db.json */
+func DocumentKey(directory string) string {
+	return directory + DOCUMENT_SUFFIX
+}
+
+/* Checks if the directory is materialized as a document */
+func (r *ConfigurationStore) IsDocument(directory string) bool {
+	directory = CleanKey(directory)
+	for _, document := range r.options.documents {
+		if document == directory {
+			return true
+		}
+	}
+	return false
+}
+
+/* Find the document directory the key is the document of, i.e. /app/db for /app/db.json */
+func (r *ConfigurationStore) DocumentOf(key string) (string, bool) {
+	key = CleanKey(key)
+	if !strings.HasSuffix(key, DOCUMENT_SUFFIX) {
+		return "", false
+	}
+	directory := strings.TrimSuffix(key, DOCUMENT_SUFFIX)
+	return directory, r.IsDocument(directory)
+}
+
+/*
+	Handle a change to a key, regenerating the documents of the directories it's beneath; the documents of the
+	directory itself, or of those beneath it, are removed when it's deleted
+*/
+func (r *ConfigurationStore) HandleDocumentEvent(ctx context.Context, event kv.NodeChange) {
+	key := CleanKey(event.Node.Path)
+	for _, directory := range r.options.documents {
+		switch {
+		case strings.HasPrefix(key, directory+"/"):
+			r.UpdateDocument(ctx, directory)
+		case event.Operation == kv.DELETED && (key == directory || strings.HasPrefix(directory, key+"/")):
+			r.RemoveDocument(directory)
+		case key == directory:
+			r.UpdateDocument(ctx, directory)
+		}
+	}
+}
+
+/* Remove the document of the directory, i.e. the directory has been deleted */
+func (r *ConfigurationStore) RemoveDocument(directory string) {
+	key := DocumentKey(directory)
+	full_path := r.FilePath(key)
+	logger.V(VERBOSE_INFO).Infof("The document directory: %s has been deleted, removing the file: %s", directory, full_path)
+	if err := r.RemoveStoreConfigFile(key, full_path); err == nil {
+		r.PruneDirectory(r.fs.Dirname(full_path))
+	}
+}
+
+/* Regenerates the document of the directory from a listing of the keys beneath it */
+func (r *ConfigurationStore) UpdateDocument(ctx context.Context, directory string) (err error) {
+	key := DocumentKey(directory)
+	full_path := r.FilePath(key)
+	if !r.filter.IsTraversable(directory) {
+		return nil
+	}
+	defer func() {
+		r.SetSyncState(key, full_path, err)
+	}()
+	listing, err := r.kv.List(ctx, directory)
+	if err != nil {
+		logger.Errorf("Failed to get listing from the document directory: %s, error: %s", directory, err)
+		return err
+	}
+	var index uint64
+	document, err := r.ListDocument(ctx, listing, &index)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		logger.Errorf("Failed to encode the document of the directory: %s, error: %s", directory, err)
+		return err
+	}
+	/* step: the document sits beside the directory, so takes the attributes of its parent */
+	attributes, _ := r.ParseAttributes(key, "")
+	attributes.Source, attributes.Index = directory, index
+	r.SetAttributes(key, attributes)
+	logger.V(VERBOSE_INFO).Infof("Updating the document: %s of the directory: %s", full_path, directory)
+	if err := r.WriteFile(full_path, string(encoded)+"\n", attributes); err != nil {
+		logger.Errorf("Failed to write the document: %s, error: %s", full_path, err)
+		return err
+	}
+	return nil
+}
+
+/* Builds the document of the keys in the listing, descending into the subdirectories; the filtered keys are left out */
+func (r *ConfigurationStore) ListDocument(ctx context.Context, listing []*kv.Node, index *uint64) (map[string]interface{}, error) {
+	document := make(map[string]interface{}, 0)
+	for _, node := range listing {
+		name := path.Base(node.Path)
+		switch {
+		case IsMetadataKey(node.Path) || ValidateKey(node.Path) != nil:
+			continue
+		case node.IsDir():
+			if !r.filter.IsTraversable(node.Path) {
+				continue
+			}
+			children, err := r.kv.List(ctx, node.Path)
+			if err != nil {
+				logger.Errorf("Failed to get listing from the directory: %s, error: %s", node.Path, err)
+				return nil, err
+			}
+			if document[name], err = r.ListDocument(ctx, children, index); err != nil {
+				return nil, err
+			}
+		case r.filter.IsIncluded(node.Path):
+			/* step: the attributes headers of the keys don't apply, the document takes those of its directory */
+			_, document[name] = r.ParseAttributes(node.Path, node.Value)
+			if node.Index > *index {
+				*index = node.Index
+			}
+		}
+	}
+	return document, nil
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/gambol99/config-fs/store/fs"
+	"github.com/gambol99/config-fs/store/kv"
+)
+
+var InvalidDryRunErr = errors.New("The dry run can't be used with the atomic swap, tmpfs, archive or writeback, as they write regardless")
+
+/*
+	Wraps the file store for a dry run; the changes which would be made under the mount point are logged, with a
+	diff of the content for the files created or updated, but nothing is written. The reads are passed through,
+	so the changes are planned against what is presently on disk
+*/
+type DryRunFS struct {
+	fs.FileStore
+	/* a lock for the changes */
+	sync.Mutex
+	/* the files which would be written, whether or not they'd change */
+	desired map[string]bool
+	/* the changes which would be made, path => change */
+	changes map[string]PlannedChange
+}
+
+/* a change which would be made under the mount point */
+type PlannedChange struct {
+	/* A the file would be created, M its content updated, T its permissions or type changed, D deleted */
+	Action byte
+	/* the path of the file */
+	Path string
+	/* the unified diff of the content, if any */
+	Diff string
+}
+
+/* Wrap the file store for a dry run */
+func NewDryRunFS(store fs.FileStore) *DryRunFS {
+	return &DryRunFS{
+		FileStore: store,
+		desired:   make(map[string]bool, 0),
+		changes:   make(map[string]PlannedChange, 0),
+	}
+}
+
+/* Record the change which would be made to the path, a file is desired unless it would be deleted */
+func (r *DryRunFS) Plan(action byte, path, diff string) {
+	r.Lock()
+	defer r.Unlock()
+	r.desired[path] = action != 'D'
+	if action != ' ' {
+		r.changes[path] = PlannedChange{Action: action, Path: path, Diff: diff}
+	}
+}
+
+/* Checks if the file would be written */
+func (r *DryRunFS) IsDesired(path string) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.desired[path]
+}
+
+/* The changes which would be made, sorted by path */
+func (r *DryRunFS) Changes() []PlannedChange {
+	r.Lock()
+	defer r.Unlock()
+	list := make([]PlannedChange, 0)
+	for _, change := range r.changes {
+		list = append(list, change)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list
+}
+
+/* Log the file which would be created or updated, along with a diff of the content */
+func (r *DryRunFS) Create(path string, value string, attributes fs.Attributes) error {
+	current := ""
+	if r.IsFile(path) && !r.IsSymlink(path) {
+		current, _ = r.Read(path)
+		if current == value {
+			if stat, err := r.Stat(path); err == nil && stat.Mode().Perm() != attributes.Mode.Perm() {
+				logger.Infof("[dry-run] would change the permissions of the file: %s, from: %s to: %s", path, stat.Mode().Perm(), attributes.Mode.Perm())
+				r.Plan('T', path, "")
+				return nil
+			}
+			r.Plan(' ', path, "")
+			return nil
+		}
+		diff := DryRunDiff(path, current, value)
+		logger.Infof("[dry-run] would update the file: %s\n%s", path, diff)
+		r.Plan('M', path, diff)
+		return nil
+	}
+	diff := DryRunDiff(path, current, value)
+	logger.Infof("[dry-run] would create the file: %s, mode: %s\n%s", path, attributes.Mode.Perm(), diff)
+	r.Plan(DryRunAction(r.Exists(path)), path, diff)
+	return nil
+}
+
+func (r *DryRunFS) Update(path string, value string, attributes fs.Attributes) error {
+	return r.Create(path, value, attributes)
+}
+
+/* Log the file which would be written from the encoded content, the content being binary no diff is given */
+func (r *DryRunFS) Stream(path string, reader io.Reader, attributes fs.Attributes) error {
+	size, err := io.Copy(ioutil.Discard, reader)
+	if err != nil {
+		return err
+	}
+	logger.Infof("[dry-run] would write the file: %s, mode: %s, from the encoded content (%d bytes)", path, attributes.Mode.Perm(), size)
+	r.Plan(DryRunAction(r.Exists(path)), path, "")
+	return nil
+}
+
+func (r *DryRunFS) Delete(path string) error {
+	logger.Infof("[dry-run] would delete the file: %s", path)
+	r.Plan('D', path, "")
+	return nil
+}
+
+func (r *DryRunFS) Mkdir(path string) error {
+	logger.Infof("[dry-run] would create the directory: %s", path)
+	return nil
+}
+
+func (r *DryRunFS) Mkdirp(path string, attributes fs.Attributes) error {
+	if !r.IsDirectory(path) {
+		logger.Infof("[dry-run] would create the directory: %s, mode: %s", path, attributes.Mode.Perm())
+	}
+	return nil
+}
+
+func (r *DryRunFS) Rmdir(path string) error {
+	logger.Infof("[dry-run] would delete the directory: %s", path)
+	return nil
+}
+
+func (r *DryRunFS) Rmdirp(path, base string) error {
+	logger.V(VERBOSE_INFO).Infof("[dry-run] would remove the directory: %s, and its parents, if left empty", path)
+	return nil
+}
+
+func (r *DryRunFS) Move(path, destination string) error {
+	logger.Infof("[dry-run] would move: %s to: %s", path, destination)
+	return nil
+}
+
+func (r *DryRunFS) Touch(path string) error {
+	return nil
+}
+
+func (r *DryRunFS) Chown(path string, uid, gid int) error {
+	logger.V(VERBOSE_INFO).Infof("[dry-run] would change the owner of: %s to: %d:%d", path, uid, gid)
+	return nil
+}
+
+func (r *DryRunFS) Symlink(target, path string) error {
+	if current, err := os.Readlink(path); err == nil && current == target {
+		r.Plan(' ', path, "")
+		return nil
+	}
+	logger.Infof("[dry-run] would link: %s to: %s", path, target)
+	r.Plan(DryRunAction(r.Exists(path) || r.IsSymlink(path)), path, "")
+	return nil
+}
+
+func (r *DryRunFS) Chmod(path string, mode os.FileMode) error {
+	if stat, err := r.Stat(path); err == nil && stat.Mode().Perm() == mode.Perm() {
+		return nil
+	}
+	logger.Infof("[dry-run] would change the permissions of: %s to: %s", path, mode.Perm())
+	return nil
+}
+
+func (r *DryRunFS) SyncDirectory(path string) error {
+	return nil
+}
+
+/* The action of a write to the path, an existing path is replaced */
+func DryRunAction(exists bool) byte {
+	if exists {
+		return 'M'
+	}
+	return 'A'
+}
+
+/* The diff of the content of the file, unless the key is masked */
+func DryRunDiff(path, current, value string) string {
+	if kv.IsMasked(path) {
+		return "# the key is masked, the diff is not shown\n"
+	}
+	return UnifiedDiff(path+" (current)", path+" (planned)", current, value)
+}
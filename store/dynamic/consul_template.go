@@ -0,0 +1,166 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dynamic
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/gambol99/config-fs/store/discovery"
+)
+
+/* the key pair as handed back by the consul-template ls and tree methods */
+type KeyPair struct {
+	/* the key relative to the prefix requested */
+	Key string
+	/* the full path of the key */
+	Path string
+	/* the value of the key */
+	Value string
+}
+
+/*
+	The consul-template methods which are overlaid onto the function map when a template
+	is marked with the consul-template prefix, allowing existing templates to be used unmodified
+*/
+func (r *DynamicConfig) ConsulTemplateFunctions() template.FuncMap {
+	return template.FuncMap{
+		"key":          r.GetValue,
+		"keyOrDefault": r.KeyOrDefault,
+		"ls":           r.ListKeyPairs,
+		"tree":         r.TreeKeyPairs,
+		"service":      r.ConsulTemplateService,
+		"services":     r.FindServices,
+		"env":          os.Getenv,
+		"parseJSON":    r.ParseJSON,
+		"toJSON":       r.ToJSON,
+		"toLower":      strings.ToLower,
+		"toUpper":      strings.ToUpper,
+		"replaceAll":   r.ReplaceAll,
+		"join":         r.JoinList,
+	}
+}
+
+func (r *DynamicConfig) KeyOrDefault(key, value string) string {
+	if content := r.GetValue(key); content != "" {
+		return content
+	}
+	return value
+}
+
+/* the top level keys under the prefix, excluding directories */
+func (r *DynamicConfig) ListKeyPairs(prefix string) ([]KeyPair, error) {
+	return r.KeyPairs(prefix, false)
+}
+
+/* all the keys under the prefix, recursively */
+func (r *DynamicConfig) TreeKeyPairs(prefix string) ([]KeyPair, error) {
+	return r.KeyPairs(prefix, true)
+}
+
+func (r *DynamicConfig) KeyPairs(prefix string, recursive bool) ([]KeyPair, error) {
+	base := strings.TrimSuffix("/"+strings.TrimPrefix(prefix, "/"), "/")
+	list := make([]KeyPair, 0)
+	if err := r.WalkKeyPairs(base, base, recursive, &list); err != nil {
+		return nil, err
+	}
+	/* step: we add a watch on the prefix */
+	r.store.Watch(base)
+	return list, nil
+}
+
+func (r *DynamicConfig) WalkKeyPairs(base, directory string, recursive bool, list *[]KeyPair) error {
+	nodes, err := r.store.List(r.ctx, directory)
+	if err != nil {
+		logger.Errorf("Failed to get a list of keys under directory: %s, error: %s", directory, err)
+		return err
+	}
+	for _, node := range nodes {
+		if node.IsDir() {
+			if recursive {
+				if err := r.WalkKeyPairs(base, node.Path, recursive, list); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		*list = append(*list, KeyPair{
+			Key:   strings.TrimPrefix(strings.TrimPrefix(node.Path, base), "/"),
+			Path:  node.Path,
+			Value: node.Value,
+		})
+	}
+	return nil
+}
+
+/*
+	the consul-template service query, i.e. [tag.]name[@datacenter]; the discovery only queries the local
+	datacenter, so a query for another fails the render rather than rendering the endpoints of the local one
+*/
+func (r *DynamicConfig) ConsulTemplateService(query string) ([]discovery.Endpoint, error) {
+	if r.discovery == nil {
+		return nil, errors.New("No service discovery service was specified in config")
+	}
+	name, tag := query, ""
+	if strings.Contains(name, "@") {
+		logger.Errorf("Failed to query the service: %s, the datacenter can't be queried", query)
+		return nil, DatacenterErr
+	}
+	if index := strings.LastIndex(name, "."); index >= 0 {
+		tag, name = name[:index], name[index+1:]
+	}
+	endpoints, err := r.FindEndpoints(name)
+	if err != nil {
+		return nil, err
+	}
+	if tag == "" {
+		return endpoints, nil
+	}
+	list := make([]discovery.Endpoint, 0)
+	for _, endpoint := range endpoints {
+		if r.Contains(endpoint.Tags, tag) {
+			list = append(list, endpoint)
+		}
+	}
+	return list, nil
+}
+
+func (r *DynamicConfig) ParseJSON(content string) (interface{}, error) {
+	var data interface{}
+	if err := json.Unmarshal([]byte(content), &data); err != nil {
+		logger.Errorf("Failed to unmarshall the json data, error: %s", err)
+		return nil, err
+	}
+	return data, nil
+}
+
+func (r *DynamicConfig) ToJSON(data interface{}) (string, error) {
+	if content, err := json.Marshal(data); err != nil {
+		return "", err
+	} else {
+		return string(content), nil
+	}
+}
+
+func (r *DynamicConfig) ReplaceAll(from, to, content string) string {
+	return strings.Replace(content, from, to, -1)
+}
+
+/* consul-template takes the separator first, allowing {{ $list | join "," }} */
+func (r *DynamicConfig) JoinList(separator string, list []string) string {
+	return strings.Join(list, separator)
+}
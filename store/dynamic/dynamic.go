@@ -14,20 +14,112 @@ limitations under the License.
 package dynamic
 
 import (
+	"errors"
+	"flag"
+	"reflect"
 	"strings"
 	"sync"
 
+	"github.com/gambol99/config-fs/store/discovery"
 	"github.com/gambol99/config-fs/store/kv"
-	"github.com/golang/glog"
+	"github.com/gambol99/config-fs/store/logging"
+	"github.com/gambol99/config-fs/store/metrics"
 )
 
 const (
-	DYNAMIC_PREFIX = "$TEMPLATE$"
-	VERBOSE_LEVEL  = 5
+	DYNAMIC_PREFIX        = "$TEMPLATE$"
+	VERBOSE_LEVEL         = 5
+	DEFAULT_RENDER_PASSES = 10
+	/* the markers used to delimit the computed destinations in the rendered output */
+	DESTINATION_MARKER     = "\x00destination:"
+	DESTINATION_MARKER_END = "\x00"
+	/* the prefix used to mark a template written in the consul-template syntax */
+	CONSUL_TEMPLATE_PREFIX = "$CONSUL_TEMPLATE$"
 )
 
+var (
+	RenderCycleErr         = errors.New("The templated resources failed to converge, possible cycle between templates")
+	InvalidRenderPassesErr = errors.New("The number of render passes must be at least one")
+	RawTemplateErr         = errors.New("The rendered content still carries the template marker, refusing to write the template source")
+	RenderFailedErr        = errors.New("One or more of the templated resources failed to render")
+	DatacenterErr          = errors.New("The service discovery can't query another datacenter, remove the @datacenter from the service query")
+)
+
+/* the log of the templated resources */
+var logger = logging.For(logging.SUBSYSTEM_DYNAMIC)
+
+/* The configuration of the templated resources, the defaults given by DefaultConfig */
+type Config struct {
+	/* the maximum number of render passes used to settle the templates */
+	render_passes int
+	/* the store the templates retrieve their keys from, each template having its own agent */
+	store kv.Config
+	/* the service discovery the templates retrieve their services from */
+	discovery discovery.Config
+}
+
+/* An option applied to the configuration of the templated resources */
+type Option func(*Config) error
+
+/* The default configuration of the templated resources */
+func DefaultConfig() Config {
+	return Config{
+		render_passes: DEFAULT_RENDER_PASSES,
+		store:         kv.DefaultConfig(),
+		discovery:     discovery.DefaultConfig(),
+	}
+}
+
+/*
+	Binds the configuration to the flags, the current values being the defaults; the caller parses them. The store
+	is left to the caller, who usually shares its own via WithStore
+*/
+func RegisterFlags(flags *flag.FlagSet, config *Config) {
+	flags.IntVar(&config.render_passes, "render_passes", config.render_passes, "the maximum number of render passes used to settle interdependent templates")
+	discovery.RegisterFlags(flags, &config.discovery)
+}
+
+/* Applies the options to the configuration, in order */
+func (r *Config) Apply(options ...Option) error {
+	for _, option := range options {
+		if err := option(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* The configuration of the store the templates retrieve their keys from */
+func WithStore(store kv.Config) Option {
+	return func(config *Config) error {
+		config.store = store
+		return nil
+	}
+}
+
+/* The url of the service discovery backend, i.e. consul://localhost:8500 */
+func WithDiscovery(location string) Option {
+	return func(config *Config) error {
+		return config.discovery.Apply(discovery.WithURL(location))
+	}
+}
+
+/* The maximum number of render passes used to settle the interdependent templates */
+func WithRenderPasses(passes int) Option {
+	return func(config *Config) error {
+		if passes <= 0 {
+			return InvalidRenderPassesErr
+		}
+		config.render_passes = passes
+		return nil
+	}
+}
+
 type DynamicUpdateChannel chan string
 
+/* used by a resource to retrieve the rendered content of another templated resource */
+type ResourceResolver func(path string) (string, bool)
+
 type DynamicStore interface {
 	/* check if the path is a dyanmic config */
 	IsDynamic(path string) (DynamicResource, bool)
@@ -35,10 +127,18 @@ type DynamicStore interface {
 	IsDynamicContent(path, content string) bool
 	/* create a dyanmic config */
 	Create(path, content string, channel DynamicUpdateChannel) (string, error)
+	/* replace the dynamic config, the current one being kept should the new one fail to render */
+	Replace(path, content string, channel DynamicUpdateChannel) (string, error)
 	/* delete a dynamic config */
 	Delete(path string)
 	/* list the configs */
 	List() map[string]DynamicResource
+	/* re-render the configs until the content settles, returning those which changed */
+	Converge() ([]string, error)
+	/* the errors of the configs which failed to render on the last converge, path => error */
+	Errors() map[string]string
+	/* record the error of the config, i.e. when rendered outside of a converge, a nil error clearing it */
+	SetError(path string, err error)
 }
 
 type DynamicStoreImpl struct {
@@ -50,11 +150,17 @@ type DynamicStoreImpl struct {
 	backend kv.KVStore
 	/* the prefix used for check if content is dynamic */
 	prefix string
+	/* the configuration of the resources */
+	config Config
+	/* the errors of the resources which failed to render on the last converge, path => error */
+	errors map[string]string
 }
 
-func NewDynamicStore(prefix string, backend kv.KVStore) DynamicStore {
+func NewDynamicStore(prefix string, backend kv.KVStore, config Config) DynamicStore {
 	service := new(DynamicStoreImpl)
+	service.config = config
 	service.resources = make(map[string]DynamicResource, 0)
+	service.errors = make(map[string]string, 0)
 	service.prefix = DYNAMIC_PREFIX
 	service.backend = backend
 	if prefix != "" {
@@ -75,8 +181,8 @@ func (r *DynamicStoreImpl) IsDynamic(path string) (DynamicResource, bool) {
 
 /* check if the content of a resource is a dynamic content */
 func (r *DynamicStoreImpl) IsDynamicContent(path, content string) bool {
-	if strings.HasPrefix(content, r.prefix) {
-		glog.V(VERBOSE_LEVEL).Infof("Found dynamic content in file: %s", path)
+	if strings.HasPrefix(content, r.prefix) || strings.HasPrefix(content, CONSUL_TEMPLATE_PREFIX) {
+		logger.V(VERBOSE_LEVEL).Infof("Found dynamic content in file: %s", path)
 		return true
 	}
 	return false
@@ -93,34 +199,160 @@ func (r *DynamicStoreImpl) List() map[string]DynamicResource {
 }
 
 func (r *DynamicStoreImpl) Create(path, content string, channel DynamicUpdateChannel) (string, error) {
-	glog.V(VERBOSE_LEVEL).Infof("Creating a new dynamic config, path: %s", path)
-	if _, found := r.IsDynamic(path); found {
-		glog.Errorf("The dynamic config: %s already exist, we can skip creation", path)
-		return "", nil
+	logger.V(VERBOSE_LEVEL).Infof("Creating a new dynamic config, path: %s", path)
+	/* note: the rendered content of the existing config is returned, never an empty file */
+	if resource, found := r.IsDynamic(path); found {
+		logger.Errorf("The dynamic config: %s already exist, we can skip creation", path)
+		return resource.Content(false)
 	}
-	/* step: we need to create a dynamic config for this
+	resource, content, err := r.Build(path, content)
+	if err != nil {
+		return "", err
+	}
+	/* step: we need to listen out to events from the dynamic config */
+	resource.Watch(channel)
+	/* step: we need to add the map */
+	r.Add(path, resource)
+	/* return the content of the dynamic config */
+	return content, nil
+}
+
+/*
+	Replaces the dynamic config with one from the new content; the new config is rendered before the current one
+	is closed, so should it fail the current config (and the content rendered from it) is left in place
+*/
+func (r *DynamicStoreImpl) Replace(path, content string, channel DynamicUpdateChannel) (string, error) {
+	logger.V(VERBOSE_LEVEL).Infof("Replacing the dynamic config, path: %s", path)
+	resource, content, err := r.Build(path, content)
+	if err != nil {
+		return "", err
+	}
+	r.release(path)
+	resource.Watch(channel)
+	r.Add(path, resource)
+	return content, nil
+}
+
+/*
+	We need to create a dynamic config for this
 	- we read in the content
 	- we generate the content
-	- we create watches on the keys / services
+	- we create watches on the keys / services (once watched)
 	- and we update the store with a notification
-	*/
-	if resource, err := NewDynamicResource(path, content); err != nil {
-		glog.Errorf("Failed to create the templated resournce: %s, error: %s", path, err)
-		return "", err
+*/
+func (r *DynamicStoreImpl) Build(path, content string) (DynamicResource, string, error) {
+	resource, err := NewDynamicResource(path, content, r.Rendered, r.config)
+	if err != nil {
+		logger.Errorf("Failed to create the templated resournce: %s, error: %s", path, err)
+		metrics.ObserveRender(path, 0, err)
+		r.SetError(path, err)
+		return nil, "", err
+	}
+	/* step: we generate the dynamic content ready to return */
+	rendered, err := resource.Content(false)
+	if err != nil {
+		logger.Errorf("Failed to render the dynamic config: %s, error: %s", path, err)
+		r.SetError(path, err)
+		/* step: the config is never watched, so we release its agents here */
+		resource.Close()
+		return nil, "", err
+	}
+	r.SetError(path, nil)
+	return resource, rendered, nil
+}
+
+/* Record the error of the config, if any */
+func (r *DynamicStoreImpl) SetError(path string, err error) {
+	r.Lock()
+	defer r.Unlock()
+	if err != nil {
+		r.errors[path] = err.Error()
 	} else {
-		/* step: we generate the dynamic content ready to return */
-		if content, err := resource.Content(false); err != nil {
-			glog.Errorf("Failed to render the dynamic config: %s, error: %s", path, err)
-			return "", err
-		} else {
-			/* step: we need to listen out to events from the dynamic config */
-			resource.Watch(channel)
-			/* step: we need to add the map */
-			r.Add(path, resource)
-			/* return the content of the dynamic config */
-			return content, nil
+		delete(r.errors, path)
+	}
+}
+
+/* Checks if the content is the source of a template, i.e. it starts with one of the template markers */
+func IsTemplateSource(content string) bool {
+	return strings.HasPrefix(content, DYNAMIC_PREFIX) || strings.HasPrefix(content, CONSUL_TEMPLATE_PREFIX)
+}
+
+/* retrieve the rendered content of a templated resource, if the path is one */
+func (r *DynamicStoreImpl) Rendered(path string) (string, bool) {
+	if resource, found := r.IsDynamic(path); found {
+		return resource.Rendered(), true
+	}
+	return "", false
+}
+
+/*
+Templates are able to consume the output of other templates, so a change in one
+may alter the content of another. We keep re-rendering all the resources until the
+content stops changing, or we hit the pass limit, which we assume is a cycle
+*/
+func (r *DynamicStoreImpl) Converge() ([]string, error) {
+	changed := make(map[string]bool, 0)
+	failed := make(map[string]string, 0)
+	defer func() {
+		r.Lock()
+		defer r.Unlock()
+		/* note: the configs which failed to be created aren't rendered here, so their errors are kept */
+		for path, message := range r.errors {
+			if _, found := r.resources[path]; !found {
+				failed[path] = message
+			}
+		}
+		r.errors = failed
+	}()
+	for pass := 1; pass <= r.config.render_passes; pass++ {
+		updated := false
+		failed = make(map[string]string, 0)
+		for path, resource := range r.List() {
+			previous := resource.Rendered()
+			previousDestinations := resource.Destinations()
+			content, err := resource.Content(true)
+			if err != nil {
+				logger.Errorf("Failed to render the dynamic config: %s on pass: %d, error: %s", path, pass, err)
+				failed[path] = err.Error()
+				continue
+			}
+			if content != previous || !reflect.DeepEqual(previousDestinations, resource.Destinations()) {
+				logger.V(VERBOSE_LEVEL).Infof("Dynamic config: %s changed on render pass: %d", path, pass)
+				changed[path] = true
+				updated = true
+			}
+		}
+		if !updated {
+			break
 		}
+		if pass == r.config.render_passes {
+			logger.Errorf("The dynamic configs have not settled after %d passes, giving up", pass)
+			return r.Paths(changed), RenderCycleErr
+		}
+	}
+	/* note: the resources which failed on the last pass keep their previous content */
+	if len(failed) > 0 {
+		return r.Paths(changed), RenderFailedErr
 	}
+	return r.Paths(changed), nil
+}
+
+func (r *DynamicStoreImpl) Errors() map[string]string {
+	r.RLock()
+	defer r.RUnlock()
+	list := make(map[string]string, len(r.errors))
+	for path, message := range r.errors {
+		list[path] = message
+	}
+	return list
+}
+
+func (r *DynamicStoreImpl) Paths(paths map[string]bool) []string {
+	list := make([]string, 0)
+	for path, _ := range paths {
+		list = append(list, path)
+	}
+	return list
 }
 
 func (r *DynamicStoreImpl) Add(path string, resource DynamicResource) {
@@ -130,12 +362,20 @@ func (r *DynamicStoreImpl) Add(path string, resource DynamicResource) {
 }
 
 func (r *DynamicStoreImpl) Delete(path string) {
+	r.release(path)
+	metrics.ForgetRender(path)
+}
+
+/* Close and remove the config, though not the statistics of its renders, i.e. when replaced */
+func (r *DynamicStoreImpl) release(path string) {
+	/* step: we remove from the map */
 	r.Lock()
-	defer r.Unlock()
-	if resource, found := r.resources[path]; found {
-		/* step: close the resource */
+	resource, found := r.resources[path]
+	delete(r.resources, path)
+	delete(r.errors, path)
+	r.Unlock()
+	/* step: close the resource; note, outside the lock, as a render in flight may be resolving another config */
+	if found {
 		resource.Close()
-		/* step: we remove from the map */
-		delete(r.resources, path)
 	}
 }
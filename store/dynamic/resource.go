@@ -15,20 +15,22 @@ package dynamic
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path"
-	"strings"
+	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"text/template"
-	"reflect"
+	"time"
 
 	"github.com/gambol99/config-fs/store/discovery"
 	"github.com/gambol99/config-fs/store/kv"
-	"github.com/golang/glog"
+	"github.com/gambol99/config-fs/store/metrics"
 )
 
 type DynamicResource interface {
@@ -36,6 +38,10 @@ type DynamicResource interface {
 	Watch(channel DynamicUpdateChannel)
 	/* get the content of the config */
 	Content(forceRefresh bool) (string, error)
+	/* get the last rendered content, without regenerating */
+	Rendered() string
+	/* get the additional files computed by the template, path => content */
+	Destinations() map[string]string
 	/* shutdown and release the assets */
 	Close()
 }
@@ -52,54 +58,80 @@ type DynamicConfig struct {
 	store kv.KVStore
 	/* the generate content */
 	content string
+	/* the content of any computed destinations */
+	destinations map[string]string
 	/* the channel for listening to events */
 	storeUpdateChannel kv.NodeUpdateChannel
 	/* service update channel */
 	serviceUpdateChannel discovery.ServiceUpdateChannel
-	/* stop channel */
+	/* stop channel, closed once by the close */
 	stopChannel chan bool
+	closed      sync.Once
+	/* set once the watch has started, it closes the agents as it exits */
+	watching bool
+	/* the resolver for content of other templated resources */
+	resolver ResourceResolver
+	/* the context of the lookups made by the template, cancelled on close */
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewDynamicResource(filename, content string) (DynamicResource, error) {
-	glog.Infof("Creating new dynamic config, path: %s", filename)
+func NewDynamicResource(filename, content string, resolver ResourceResolver, settings Config) (DynamicResource, error) {
+	logger.Infof("Creating new dynamic config, path: %s", filename)
 	config := new(DynamicConfig)
 	config.path = filename
+	config.resolver = resolver
+	config.ctx, config.cancel = context.WithCancel(context.Background())
+	config.destinations = make(map[string]string, 0)
 	config.storeUpdateChannel = make(kv.NodeUpdateChannel, 5)
 	/* step: we create a new kv client for the resource */
-	if agent, err := kv.NewKVStore(config.storeUpdateChannel); err != nil {
-		glog.Errorf("Failed to create a kv agent, error: %s", err)
+	if agent, err := kv.New(settings.store, config.storeUpdateChannel); err != nil {
+		logger.Errorf("Failed to create a kv agent, error: %s", err)
 		return nil, err
 	} else {
 		config.store = agent
 		config.stopChannel = make(chan bool)
 		config.serviceUpdateChannel = make(discovery.ServiceUpdateChannel, 5)
 		/* step: create a discovery agent */
-		if disx, err := discovery.NewDiscovery(config.serviceUpdateChannel); err != nil {
+		if disx, err := discovery.NewDiscovery(settings.discovery, config.serviceUpdateChannel); err != nil {
 			agent.Close()
 			return nil, err
 		} else {
 			config.discovery = disx
 			/* step: create the function map for this template */
 			functionMap := template.FuncMap{
-				"service":    config.FindService,
-				"services":   config.FindServices,
-				"endpoints":  config.FindEndpoints,
-				"endpointsl": config.FindEndpointsList,
-				"get":        config.GetKeyPair,
-				"gets":       config.GetKerPairs,
-				"getv":       config.GetValue,
-				"getl":       config.GetList,
-				"json":       config.UnmarshallJSON,
-				"jsona":      config.UnmarshallJSONArray,
-				"contained":  config.Contains,
-				"base":       path.Base,
-				"dir":        path.Dir,
-				"split":      strings.Split,
-				"getenv":     os.Getenv,
-				"join":       strings.Join}
+				"service":     config.FindService,
+				"services":    config.FindServices,
+				"endpoints":   config.FindEndpoints,
+				"endpointsl":  config.FindEndpointsList,
+				"get":         config.GetKeyPair,
+				"gets":        config.GetKerPairs,
+				"getv":        config.GetValue,
+				"getl":        config.GetList,
+				"json":        config.UnmarshallJSON,
+				"jsona":       config.UnmarshallJSONArray,
+				"contained":   config.Contains,
+				"base":        path.Base,
+				"dir":         path.Dir,
+				"split":       strings.Split,
+				"getenv":      os.Getenv,
+				"destination": config.Destination,
+				"join":        strings.Join}
+
+			/* step: consul-template templates get a compatible function map overlaid */
+			if strings.HasPrefix(content, CONSUL_TEMPLATE_PREFIX) {
+				logger.V(VERBOSE_LEVEL).Infof("Dynamic config: %s is using the consul-template syntax", filename)
+				for name, method := range config.ConsulTemplateFunctions() {
+					functionMap[name] = method
+				}
+				content = content[len(CONSUL_TEMPLATE_PREFIX):]
+			} else {
+				content = strings.TrimPrefix(content, DYNAMIC_PREFIX)
+			}
 
 			if resource, err := template.New(filename).Funcs(functionMap).Parse(content); err != nil {
-				glog.Errorf("Failed to parse the dynamic config: %s, error: %s", config.path, err)
+				logger.Errorf("Failed to parse the dynamic config: %s, error: %s", config.path, err)
+				config.Close()
 				return nil, err
 			} else {
 				config.template = resource
@@ -109,31 +141,54 @@ func NewDynamicResource(filename, content string) (DynamicResource, error) {
 	}
 }
 
-func (r DynamicConfig) Close() {
-	glog.Infof("Closing the resources for dynamic config: %s", r.path)
-	r.stopChannel <- true
+func (r *DynamicConfig) Close() {
+	logger.Infof("Closing the resources for dynamic config: %s", r.path)
+	/* step: cancel any lookups of a render in flight */
+	r.cancel()
+	/* step: signal the watch to stop; closed rather than sent on, so we never wait on a render in flight */
+	r.closed.Do(func() {
+		close(r.stopChannel)
+		/* note: should the watch never have started (i.e. the config failed to render) there's no one else to */
+		r.RLock()
+		watching := r.watching
+		r.RUnlock()
+		if !watching {
+			r.CloseAgents()
+		}
+	})
+}
+
+/* Close the kv and discovery agents of the config */
+func (r *DynamicConfig) CloseAgents() {
+	/* step: the discovery agent is only created if a discovery url has been given */
+	if r.discovery != nil {
+		r.discovery.Close()
+	}
+	r.store.Close()
 }
 
 func (r *DynamicConfig) Watch(channel DynamicUpdateChannel) {
-	r.stopChannel = make(chan bool)
-	glog.V(VERBOSE_LEVEL).Infof("Adding a listener for the dynamic config: %s, channel: %v", r.path, channel)
+	r.Lock()
+	r.watching = true
+	r.Unlock()
+	logger.V(VERBOSE_LEVEL).Infof("Adding a listener for the dynamic config: %s, channel: %v", r.path, channel)
 	go func() {
 		for {
 			select {
 			case event := <-r.storeUpdateChannel:
-				glog.V(VERBOSE_LEVEL).Infof("Dynamic config: %s, event: %s", r.path, event)
+				logger.V(VERBOSE_LEVEL).Infof("Dynamic config: %s, event: %v", r.path, event)
 				if err := r.Generate(); err == nil {
 					channel <- r.path
 				}
 			case service := <-r.serviceUpdateChannel:
-				glog.V(VERBOSE_LEVEL).Infof("Dynamic config: %s, event: %s", r.path, service)
+				logger.V(VERBOSE_LEVEL).Infof("Dynamic config: %s, event: %s", r.path, service)
 				if err := r.Generate(); err == nil {
 					channel <- r.path
 				}
 			case <-r.stopChannel:
-				glog.Infof("Shutting down the resources for dynamic config: %s", r.path)
-				r.discovery.Close()
-				r.store.Close()
+				logger.Infof("Shutting down the resources for dynamic config: %s", r.path)
+				r.CloseAgents()
+				return
 			}
 		}
 	}()
@@ -141,42 +196,104 @@ func (r *DynamicConfig) Watch(channel DynamicUpdateChannel) {
 
 func (r *DynamicConfig) Content(forceRefresh bool) (string, error) {
 	/* step: get the content from the cache if there and refresh is false */
-	if r.content != "" && forceRefresh == false {
-		return r.content, nil
+	if content := r.Rendered(); content != "" && forceRefresh == false {
+		return content, nil
 	}
 	if err := r.Generate(); err != nil {
-		glog.Errorf("Failed to generate the dynamic content for config: %s, error: %s", r.path, err)
+		logger.Errorf("Failed to generate the dynamic content for config: %s, error: %s", r.path, err)
 		return "", err
 	} else {
-		return r.content, nil
+		return r.Rendered(), nil
 	}
 }
 
-func (r *DynamicConfig) Generate() error {
-	r.Lock()
-	defer r.Unlock()
+func (r *DynamicConfig) Rendered() string {
+	r.RLock()
+	defer r.RUnlock()
+	return r.content
+}
+
+func (r *DynamicConfig) Destinations() map[string]string {
+	r.RLock()
+	defer r.RUnlock()
+	list := make(map[string]string, 0)
+	for path, content := range r.destinations {
+		list[path] = content
+	}
+	return list
+}
+
+func (r *DynamicConfig) Generate() (err error) {
+	/* step: the render is recorded in the statistics of the template, whatever the outcome */
+	started := time.Now()
+	defer func() { metrics.ObserveRender(r.path, time.Since(started), err) }()
+	/* note: we don't hold the lock while rendering, as the template may resolve the content of another */
 	if content, err := r.Render(); err != nil {
-		glog.Errorf("Failed to re-generate the content for config: %s, error: %s", r.path, err)
+		logger.Errorf("Failed to re-generate the content for config: %s, error: %s", r.path, err)
 		return err
 	} else {
-		glog.V(VERBOSE_LEVEL).Infof("Updating the content for config: %s", r.path)
+		logger.V(VERBOSE_LEVEL).Infof("Updating the content for config: %s", r.path)
+		/* step: split out any computed destinations from the content */
+		content, destinations := r.SplitDestinations(content)
+		/* check: the template source is never written verbatim, the previous content is kept */
+		if IsTemplateSource(content) {
+			logger.Errorf("The rendered content of config: %s carries the template marker, keeping the previous content", r.path)
+			return RawTemplateErr
+		}
+		for destination, output := range destinations {
+			if IsTemplateSource(output) {
+				logger.Errorf("The destination: %s of config: %s carries the template marker, keeping the previous content", destination, r.path)
+				return RawTemplateErr
+			}
+		}
 		/* step: update the cache copy */
+		r.Lock()
 		r.content = content
+		r.destinations = destinations
+		r.Unlock()
 	}
 	return nil
 }
 
+/*
+	Splits the rendered output into the content for the resource itself and the content for
+	each of the destinations computed by the template, i.e. anything following a destination
+	marker up until the next marker is the content of that destination
+*/
+func (r *DynamicConfig) SplitDestinations(output string) (string, map[string]string) {
+	destinations := make(map[string]string, 0)
+	sections := strings.Split(output, DESTINATION_MARKER)
+	for _, section := range sections[1:] {
+		index := strings.Index(section, DESTINATION_MARKER_END)
+		if index < 0 {
+			logger.Errorf("Dynamic config: %s has a malformed destination section, skipping", r.path)
+			continue
+		}
+		/* step: we keep the destination inside the key space, the mount point is added by the store */
+		destination := path.Clean("/" + section[:index])
+		destinations[destination] += strings.TrimPrefix(section[index+len(DESTINATION_MARKER_END):], "\n")
+	}
+	return sections[0], destinations
+}
+
 func (r *DynamicConfig) Render() (string, error) {
 	var content bytes.Buffer
 	if err := r.template.Execute(&content, nil); err != nil {
 		return "", err
 	}
-	return content.String()[len(DYNAMIC_PREFIX):], nil
+	return content.String(), nil
 }
 
 /* Dynamic Config templating functions */
+
+/* Start a new section of output which is written to the destination path, relative to the mount */
+func (r *DynamicConfig) Destination(destination string) string {
+	logger.V(VERBOSE_LEVEL).Infof("Destination() config: %s, destination: %s", r.path, destination)
+	return DESTINATION_MARKER + destination + DESTINATION_MARKER_END
+}
+
 func (r *DynamicConfig) FindService(service string) (discovery.Service, error) {
-	glog.V(VERBOSE_LEVEL).Infof("FindService() service: %s", service)
+	logger.V(VERBOSE_LEVEL).Infof("FindService() service: %s", service)
 	/* step: make sure a discovery service exists */
 	if r.discovery == nil {
 		return discovery.Service{}, errors.New("No service discovery service was specified in config")
@@ -184,13 +301,13 @@ func (r *DynamicConfig) FindService(service string) (discovery.Service, error) {
 
 	/* step: we add a watch to the service via the agent, assuming there isn't one already */
 	if err := r.discovery.Watch(service); err != nil {
-		glog.Errorf("Failed to add a watch for service: %s, error: %s", service, err)
+		logger.Errorf("Failed to add a watch for service: %s, error: %s", service, err)
 		return discovery.Service{}, err
 	}
 
 	/* step: we attempt to find the exist, though it might not exist yet */
 	if service, err := r.discovery.Service(service); err != nil {
-		glog.Errorf("Failed to find the service: %s, error: %s", service, err)
+		logger.Errorf("Failed to find the service: %s, error: %s", service, err)
 		return discovery.Service{}, nil
 	} else {
 		return service, nil
@@ -198,7 +315,7 @@ func (r *DynamicConfig) FindService(service string) (discovery.Service, error) {
 }
 
 func (r *DynamicConfig) FindServices() ([]discovery.Service, error) {
-	glog.V(VERBOSE_LEVEL).Infof("FindServices()")
+	logger.V(VERBOSE_LEVEL).Infof("FindServices()")
 	/* step: make sure a discovery service exists */
 	if r.discovery == nil {
 		return nil, errors.New("No service discovery service was specified in config")
@@ -207,7 +324,7 @@ func (r *DynamicConfig) FindServices() ([]discovery.Service, error) {
 	/* step: get a list of services */
 	services, err := r.discovery.Services()
 	if err != nil {
-		glog.Errorf("Failed to retrieve a list of services from discovery provider, error: %s", err)
+		logger.Errorf("Failed to retrieve a list of services from discovery provider, error: %s", err)
 		return nil, err
 	}
 
@@ -216,17 +333,17 @@ func (r *DynamicConfig) FindServices() ([]discovery.Service, error) {
 }
 
 func (r *DynamicConfig) FindEndpoints(service string) ([]discovery.Endpoint, error) {
-	glog.V(VERBOSE_LEVEL).Infof("FindEndpoints() service: %s", service)
+	logger.V(VERBOSE_LEVEL).Infof("FindEndpoints() service: %s", service)
 
 	/* step: we add a watch to the service via the agent, assuming there isn't one already */
 	if err := r.discovery.Watch(service); err != nil {
-		glog.Errorf("Failed to add a watch for service: %s, error: %s", service, err)
+		logger.Errorf("Failed to add a watch for service: %s, error: %s", service, err)
 		return nil, err
 	}
 
 	/* step: find some endpoints */
 	if endpoints, err := r.discovery.Endpoints(service); err != nil {
-		glog.Errorf("Failed to find service: %s, error: %s", service, err)
+		logger.Errorf("Failed to find service: %s, error: %s", service, err)
 		return nil, err
 	} else {
 		return endpoints, nil
@@ -234,9 +351,9 @@ func (r *DynamicConfig) FindEndpoints(service string) ([]discovery.Endpoint, err
 }
 
 func (r *DynamicConfig) FindEndpointsList(service string) ([]string, error) {
-	glog.V(VERBOSE_LEVEL).Infof("FindEndpointsList() service: %s", service)
+	logger.V(VERBOSE_LEVEL).Infof("FindEndpointsList() service: %s", service)
 	if endpoints, err := r.FindEndpoints(service); err != nil {
-		glog.Errorf("Failed to find service: %s, error: %s", service, err)
+		logger.Errorf("Failed to find service: %s, error: %s", service, err)
 		return nil, err
 	} else {
 		list := make([]string, 0)
@@ -247,9 +364,20 @@ func (r *DynamicConfig) FindEndpointsList(service string) ([]string, error) {
 	}
 }
 
+/* check if the key is another templated resource, if so we use the rendered content */
+func (r *DynamicConfig) Resolve(key string) (string, bool) {
+	if r.resolver == nil || key == r.path {
+		return "", false
+	}
+	return r.resolver(key)
+}
+
 func (r *DynamicConfig) GetKeyPair(key string) (kv.Node, error) {
-	if node, err := r.store.Get(key); err != nil {
-		glog.Errorf("Failed to get the key: %s, error: %s", key, err)
+	if content, found := r.Resolve(key); found {
+		return kv.Node{Path: key, Value: content}, nil
+	}
+	if node, err := r.store.Get(r.ctx, key); err != nil {
+		logger.Errorf("Failed to get the key: %s, error: %s", key, err)
 		return kv.Node{}, err
 	} else {
 		return *node, nil
@@ -257,8 +385,11 @@ func (r *DynamicConfig) GetKeyPair(key string) (kv.Node, error) {
 }
 
 func (r *DynamicConfig) GetValue(key string) string {
-	if content, err := r.store.Get(key); err != nil {
-		glog.Errorf("Failed to get the key: %s, error: %s", key, err)
+	if content, found := r.Resolve(key); found {
+		return content
+	}
+	if content, err := r.store.Get(r.ctx, key); err != nil {
+		logger.Errorf("Failed to get the key: %s, error: %s", key, err)
 		return ""
 	} else {
 		/* step: we add a watch on the key */
@@ -269,8 +400,8 @@ func (r *DynamicConfig) GetValue(key string) string {
 }
 
 func (r *DynamicConfig) GetKerPairs(path string) ([]*kv.Node, error) {
-	if paths, err := r.store.List(path); err != nil {
-		glog.Errorf("Failed to get a list of keys under directory: %s, error: %s", path, err)
+	if paths, err := r.store.List(r.ctx, path); err != nil {
+		logger.Errorf("Failed to get a list of keys under directory: %s, error: %s", path, err)
 		return nil, err
 	} else {
 		/* step: we add a watch on the directory */
@@ -281,8 +412,8 @@ func (r *DynamicConfig) GetKerPairs(path string) ([]*kv.Node, error) {
 }
 
 func (r *DynamicConfig) GetList(path string) ([]string, error) {
-	if paths, err := r.store.List(path); err != nil {
-		glog.Errorf("Failed to get a list of keys under directory: %s, error: %s", path, err)
+	if paths, err := r.store.List(r.ctx, path); err != nil {
+		logger.Errorf("Failed to get a list of keys under directory: %s, error: %s", path, err)
 		return nil, err
 	} else {
 		/* step: we add a watch on the directory */
@@ -313,7 +444,7 @@ func (r *DynamicConfig) Contains(list interface{}, elem interface{}) bool {
 func (r *DynamicConfig) UnmarshallJSONArray(content string) ([]interface{}, error) {
 	var ret []interface{}
 	if err := json.Unmarshal([]byte(content), &ret); err != nil {
-		glog.Errorf("Failed to unmarshall the json data into an array, error: %s", err)
+		logger.Errorf("Failed to unmarshall the json data into an array, error: %s", err)
 		return nil, err
 	}
 	return ret, nil
@@ -322,7 +453,7 @@ func (r *DynamicConfig) UnmarshallJSONArray(content string) ([]interface{}, erro
 func (r *DynamicConfig) UnmarshallJSON(content string) (map[string]interface{}, error) {
 	var json_data map[string]interface{}
 	if err := json.Unmarshal([]byte(content), &json_data); err != nil {
-		glog.Errorf("Failed to unmarshall the json data, value: %s, error: %s", content, err)
+		logger.Errorf("Failed to unmarshall the json data, value: %s, error: %s", content, err)
 		return nil, err
 	} else {
 		return json_data, nil
@@ -0,0 +1,102 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"strings"
+	"unicode"
+)
+
+const (
+	/* the prefix used to mark a value as base64 encoded, i.e. binary content */
+	BASE64_PREFIX = "$BASE64$"
+	/* the prefix used to mark a value as gzip compressed and base64 encoded */
+	GZIP_PREFIX = "$GZIP$"
+)
+
+/* Checks if the value has been marked as encoded */
+func (r *ConfigurationStore) IsEncoded(value string) bool {
+	return strings.HasPrefix(value, BASE64_PREFIX) || r.IsCompressed(value)
+}
+
+/* Checks if the value has been marked as compressed */
+func (r *ConfigurationStore) IsCompressed(value string) bool {
+	return strings.HasPrefix(value, GZIP_PREFIX)
+}
+
+/*
+	Returns a reader over the decoded content of the value, the content is decoded as it's read so
+	large binary values can be streamed to the file rather than decoded in memory
+*/
+func (r *ConfigurationStore) DecodeReader(value string) io.Reader {
+	if !r.IsEncoded(value) {
+		return strings.NewReader(value)
+	}
+	/* step: compressed content is decompressed as it's decoded */
+	if r.IsCompressed(value) {
+		return &GzipReader{source: r.Base64Reader(value[len(GZIP_PREFIX):])}
+	}
+	return r.Base64Reader(value[len(BASE64_PREFIX):])
+}
+
+/* Returns a reader decoding the base64 content */
+func (r *ConfigurationStore) Base64Reader(content string) io.Reader {
+	/* step: we strip any whitespace, as the encoded content is often wrapped */
+	return base64.NewDecoder(base64.StdEncoding, &WhitespaceFilter{strings.NewReader(content)})
+}
+
+/*
+	A reader which decompresses the gzip content of the underlying reader; the gzip header is only read on
+	the first read, so an invalid header is reported as a read error of the content
+*/
+type GzipReader struct {
+	source io.Reader
+	reader *gzip.Reader
+}
+
+func (r *GzipReader) Read(buffer []byte) (int, error) {
+	if r.reader == nil {
+		reader, err := gzip.NewReader(r.source)
+		if err != nil {
+			return 0, err
+		}
+		r.reader = reader
+	}
+	return r.reader.Read(buffer)
+}
+
+/* A reader which drops any whitespace from the underlying reader */
+type WhitespaceFilter struct {
+	reader io.Reader
+}
+
+func (r *WhitespaceFilter) Read(buffer []byte) (int, error) {
+	for {
+		size, err := r.reader.Read(buffer)
+		filtered := 0
+		for _, b := range buffer[:size] {
+			if !unicode.IsSpace(rune(b)) {
+				buffer[filtered] = b
+				filtered++
+			}
+		}
+		/* step: don't hand back an empty read unless the underlying reader has finished */
+		if filtered > 0 || err != nil {
+			return filtered, err
+		}
+	}
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gambol99/config-fs/store/kv"
+)
+
+/*
+	A key whose value is prefixed with the marker is exploded into a tree of files beneath a directory at the path
+	of the key, a file per field of the JSON object; i.e. /app/config => $JSON${"db": {"host": "db.local"}} becomes
+	the file /config/app/config/db/host holding db.local. The elements of an array are named by their index.
+
+	A java properties or ini file can be exploded likewise; a file per property, named as the property (i.e. the
+	file db.host), or a file per key of the ini file, beneath a directory per section
+*/
+const (
+	EXPLODE_PREFIX            = "$JSON$"
+	EXPLODE_PROPERTIES_PREFIX = "$PROPERTIES$"
+	EXPLODE_INI_PREFIX        = "$INI$"
+)
+
+var InvalidExplodeErr = errors.New("The value of an exploded key must be a JSON object")
+
+/* Checks if the value of the key (after any attributes header) is to be exploded */
+func (r *ConfigurationStore) IsExplodedValue(node *kv.Node) bool {
+	_, value := r.ParseAttributes(node.Path, node.Value)
+	for _, prefix := range []string{EXPLODE_PREFIX, EXPLODE_PROPERTIES_PREFIX, EXPLODE_INI_PREFIX} {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Checks if the key has been exploded into a tree of files */
+func (r *ConfigurationStore) IsExploded(path string) bool {
+	r.RLock()
+	defer r.RUnlock()
+	_, found := r.exploded[path]
+	return found
+}
+
+/* Find the exploded key the path is a file of, if any */
+func (r *ConfigurationStore) ExplodedOwner(path string) (string, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	for key, _ := range r.exploded {
+		if path == key || strings.HasPrefix(path, key+"/") {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+/* The directory on disk the key is exploded beneath */
+func (r *ConfigurationStore) ExplodedPath(path string) string {
+	return r.MappedPath(path, false)
+}
+
+/* The files exploded from the keys, as full paths on disk */
+func (r *ConfigurationStore) ExplodedFiles() []string {
+	r.RLock()
+	defer r.RUnlock()
+	list := make([]string, 0)
+	for key, files := range r.exploded {
+		for name, _ := range files {
+			list = append(list, filepath.Join(r.ExplodedPath(key), filepath.FromSlash(name)))
+		}
+	}
+	return list
+}
+
+/* Explodes the document in the value of the key into a file per field, removing the fields no longer present */
+func (r *ConfigurationStore) UpdateExploded(ctx context.Context, node *kv.Node) (err error) {
+	path := node.Path
+	directory := r.ExplodedPath(path)
+	/* note: the state of the key is recorded against the directory, along with each of its files */
+	defer func() {
+		r.SetSyncState(path, directory, err)
+	}()
+	attributes, value := r.ParseAttributes(path, node.Value)
+	attributes.Source, attributes.Index = path, node.Index
+
+	files, err := ExplodeValue(value)
+	if err != nil {
+		logger.Errorf("Failed to explode the key: %s, error: %s", path, err)
+		return err
+	}
+
+	/* step: the key was previously materialized as a file or a template */
+	if _, found := r.dynamic.IsDynamic(path); found {
+		r.dynamic.Delete(path)
+		r.DeleteDestinations(path)
+	}
+	if r.fs.Exists(directory) && (r.fs.IsSymlink(directory) || !r.fs.IsDirectory(directory)) {
+		logger.Warningf("The key: %s is now exploded, removing the file: %s", path, directory)
+		if err := r.RemovePath(directory, false); err != nil {
+			return err
+		}
+	}
+	r.SetAttributes(path, attributes)
+	current := make(map[string]bool, 0)
+	for name, _ := range files {
+		current[name] = true
+	}
+	r.Lock()
+	r.SaveKeyState(path)
+	previous := r.exploded[path]
+	r.exploded[path] = current
+	r.Unlock()
+
+	/* step: write a file for each of the fields */
+	names := make([]string, 0)
+	for name, _ := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		full_path := filepath.Join(directory, filepath.FromSlash(name))
+		failed := r.WriteFile(full_path, files[name], attributes)
+		r.SetSyncState(path, full_path, failed)
+		if failed != nil {
+			logger.Errorf("Failed to write the field: %s of key: %s, error: %s", name, path, failed)
+			err = failed
+		}
+	}
+	/* step: remove the fields which have disappeared */
+	for name, _ := range previous {
+		if current[name] {
+			continue
+		}
+		full_path := filepath.Join(directory, filepath.FromSlash(name))
+		logger.V(VERBOSE_INFO).Infof("Removing the field: %s, no longer in the value of key: %s", name, path)
+		if r.fs.Exists(full_path) {
+			if err := r.RemovePath(full_path, false); err != nil {
+				logger.Errorf("Failed to remove the file: %s, error: %s", full_path, err)
+			}
+			r.PruneDirectory(r.fs.Dirname(full_path))
+		}
+	}
+	return err
+}
+
+/* Decodes the document in the value, by the marker it's prefixed with, into the files, relative path => content */
+func ExplodeValue(value string) (map[string]string, error) {
+	files := make(map[string]string, 0)
+	switch {
+	case strings.HasPrefix(value, EXPLODE_PROPERTIES_PREFIX):
+		properties, err := ParseProperties(strings.TrimPrefix(value, EXPLODE_PROPERTIES_PREFIX))
+		if err != nil {
+			return nil, err
+		}
+		for name, content := range properties {
+			if !IsFieldName(name) {
+				return nil, fmt.Errorf("the property: %q can't be used as a file name", name)
+			}
+			files[name] = content
+		}
+	case strings.HasPrefix(value, EXPLODE_INI_PREFIX):
+		keys, err := ParseINI(strings.TrimPrefix(value, EXPLODE_INI_PREFIX))
+		if err != nil {
+			return nil, err
+		}
+		for name, content := range keys {
+			section, key := path.Split(name)
+			if !IsFieldName(key) || (section != "" && !IsFieldName(strings.TrimSuffix(section, "/"))) {
+				return nil, fmt.Errorf("the key: %q can't be used as a file name", name)
+			}
+			files[name] = content
+		}
+	default:
+		/* step: decode the object, keeping the numbers as written */
+		var document interface{}
+		decoder := json.NewDecoder(strings.NewReader(strings.TrimPrefix(value, EXPLODE_PREFIX)))
+		decoder.UseNumber()
+		if err := decoder.Decode(&document); err != nil {
+			return nil, err
+		}
+		object, found := document.(map[string]interface{})
+		if !found {
+			return nil, InvalidExplodeErr
+		}
+		if err := FlattenJSON("", object, files); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+/* Removes the tree of files exploded from the key */
+func (r *ConfigurationStore) RemoveExploded(path string) error {
+	r.Lock()
+	r.SaveKeyState(path)
+	delete(r.exploded, path)
+	r.Unlock()
+	r.DeleteAttributes(path)
+	directory := r.ExplodedPath(path)
+	if !r.fs.Exists(directory) {
+		return nil
+	}
+	logger.V(VERBOSE_INFO).Infof("Removing the files exploded from key: %s", path)
+	if err := r.RemovePath(directory, true); err != nil {
+		logger.Errorf("Failed to remove the directory: %s, error: %s", directory, err)
+		return err
+	}
+	r.PruneDirectory(r.fs.Dirname(directory))
+	return nil
+}
+
+/* Flattens the JSON value into files, relative path => content; the scalars are written as in the JSON, strings unquoted */
+func FlattenJSON(prefix string, value interface{}, files map[string]string) error {
+	switch item := value.(type) {
+	case map[string]interface{}:
+		for name, field := range item {
+			if !IsFieldName(name) {
+				return fmt.Errorf("the field: %q can't be used as a file name", name)
+			}
+			if err := FlattenJSON(strings.TrimPrefix(prefix+"/"+name, "/"), field, files); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for index, element := range item {
+			if err := FlattenJSON(strings.TrimPrefix(fmt.Sprintf("%s/%d", prefix, index), "/"), element, files); err != nil {
+				return err
+			}
+		}
+	case string:
+		files[prefix] = item
+	case nil:
+		files[prefix] = ""
+	default:
+		files[prefix] = fmt.Sprintf("%v", item)
+	}
+	return nil
+}
+
+/* Checks the name of a field can be used as the name of a file */
+func IsFieldName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
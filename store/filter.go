@@ -0,0 +1,181 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"regexp"
+	"strings"
+)
+
+/*
+	The keys marked as never materialized, by default anything beneath an _internal directory or named with a
+	$SKIP$ prefix, i.e. /app/_internal/leader or /app/$SKIP$lock; the coordination keys kept alongside the config
+*/
+const DEFAULT_IGNORE_MARKERS = "_internal,$SKIP$"
+
+/* The include and exclude filters for the keys which are materialized */
+type Filter struct {
+	/* if any, a key must match one of these to be materialized */
+	includes []*regexp.Regexp
+	/* a key matching any of these is never materialized */
+	excludes []*regexp.Regexp
+	/* a key with a path segment beginning with any of these is never materialized */
+	markers []string
+}
+
+/* a list of regular expressions, a flag value given once per expression as they may well contain commas */
+type Expressions []string
+
+func (r *Expressions) String() string {
+	return strings.Join(*r, " ")
+}
+
+func (r *Expressions) Set(value string) error {
+	if _, err := regexp.Compile(value); err != nil {
+		return err
+	}
+	*r = append(*r, value)
+	return nil
+}
+
+/* Create a filter from the comma separated include and exclude glob patterns */
+func NewFilter(includes, excludes string) (*Filter, error) {
+	filter := new(Filter)
+	var err error
+	if filter.includes, err = CompileGlobs(includes); err != nil {
+		return nil, err
+	}
+	if filter.excludes, err = CompileGlobs(excludes); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+/*
+	Converts the glob patterns into regular expressions; a * matches within a path
+	segment, ** matches across segments and ? matches a single character, i.e.
+	/secrets/** matches everything under /secrets
+*/
+func CompileGlobs(patterns string) ([]*regexp.Regexp, error) {
+	list := make([]*regexp.Regexp, 0)
+	for _, pattern := range strings.Split(patterns, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if compiled, err := CompileGlob(pattern); err != nil {
+			logger.Errorf("Failed to compile the glob pattern: %s, error: %s", pattern, err)
+			return nil, err
+		} else {
+			list = append(list, compiled)
+		}
+	}
+	return list, nil
+}
+
+/* Converts a single glob pattern into a regular expression, as above */
+func CompileGlob(pattern string) (*regexp.Regexp, error) {
+	var expression string
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**"):
+			expression += ".*"
+			i++
+		case pattern[i] == '*':
+			expression += "[^/]*"
+		case pattern[i] == '?':
+			expression += "[^/]"
+		default:
+			expression += regexp.QuoteMeta(string(pattern[i]))
+		}
+	}
+	return regexp.Compile("^" + expression + "$")
+}
+
+/*
+	Add the regular expressions to the filter, matched (unanchored, unless they say otherwise) against the full
+	key path alongside the globs, i.e. ^/app/v[0-9]+/config$
+*/
+func (r *Filter) AddExpressions(includes, excludes Expressions) error {
+	for _, expression := range includes {
+		if compiled, err := regexp.Compile(expression); err != nil {
+			logger.Errorf("Failed to compile the include expression: %s, error: %s", expression, err)
+			return err
+		} else {
+			r.includes = append(r.includes, compiled)
+		}
+	}
+	for _, expression := range excludes {
+		if compiled, err := regexp.Compile(expression); err != nil {
+			logger.Errorf("Failed to compile the exclude expression: %s, error: %s", expression, err)
+			return err
+		} else {
+			r.excludes = append(r.excludes, compiled)
+		}
+	}
+	return nil
+}
+
+/* Set the ignore markers from the comma separated list */
+func (r *Filter) SetMarkers(markers string) {
+	r.markers = make([]string, 0)
+	for _, marker := range strings.Split(markers, ",") {
+		if marker = strings.TrimSpace(marker); marker != "" {
+			r.markers = append(r.markers, marker)
+		}
+	}
+}
+
+/* Check if any segment of the path begins with an ignore marker */
+func (r *Filter) IsMarked(path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		for _, marker := range r.markers {
+			if strings.HasPrefix(segment, marker) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* Check if the key should be materialized */
+func (r *Filter) IsIncluded(path string) bool {
+	if r.IsMarked(path) || r.Matches(r.excludes, path) {
+		return false
+	}
+	if len(r.includes) > 0 && !r.Matches(r.includes, path) {
+		return false
+	}
+	return true
+}
+
+/*
+	Check if we should descend into the directory; we always descend unless the directory
+	itself is excluded, as an include pattern may match something beneath it
+*/
+func (r *Filter) IsTraversable(path string) bool {
+	return !r.IsMarked(path) && !r.Matches(r.excludes, path)
+}
+
+/* a pattern ending in ** matches the directory itself as well, i.e. /secrets/** matches /secrets */
+func (r *Filter) Matches(expressions []*regexp.Regexp, path string) bool {
+	for _, expression := range expressions {
+		if expression.MatchString(path) {
+			return true
+		}
+		if strings.HasSuffix(expression.String(), ".*$") && expression.MatchString(path+"/") {
+			return true
+		}
+	}
+	return false
+}
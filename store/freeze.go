@@ -0,0 +1,42 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+)
+
+/*
+	The freeze key gives the operators a single switch to suspend the changes on every instance, i.e. during an
+	incident; while the key exists (whatever its value) the synchronization is paused, as with SIGUSR1, and it's
+	resumed once the key has been removed (or has expired, should it have been set with a ttl)
+*/
+const DEFAULT_FREEZE_KEY = "/config-fs/freeze"
+
+var FrozenErr = errors.New("The store is frozen, the freeze key has been set")
+
+/* Checks if the key is the freeze key */
+func (r *ConfigurationStore) IsFreezeKey(path string) bool {
+	return r.options.freeze_key != "" && path == CleanKey(r.options.freeze_key)
+}
+
+/* Checks if the freeze key presently exists in the store */
+func (r *ConfigurationStore) IsFrozen(ctx context.Context) bool {
+	if r.options.freeze_key == "" {
+		return false
+	}
+	_, err := r.kv.Get(ctx, CleanKey(r.options.freeze_key))
+	return err == nil
+}
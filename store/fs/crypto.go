@@ -0,0 +1,92 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+/* the header written at the start of an encrypted file */
+const ENCRYPTION_HEADER = "$CONFIGFS_AES256_GCM$"
+
+var (
+	InvalidKeyErr       = errors.New("The encryption key must be 32 bytes, either raw, hex or base64 encoded")
+	NotEncryptedErr     = errors.New("The file content is not encrypted")
+	InvalidEncryptedErr = errors.New("The encrypted content is invalid or truncated")
+)
+
+/* Loads the host key used to encrypt the files, the key can be raw, hex or base64 encoded */
+func LoadEncryptionKey(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		logger.Errorf("Failed to read the encryption key: %s, error: %s", path, err)
+		return nil, err
+	}
+	if len(content) == 32 {
+		return content, nil
+	}
+	encoded := strings.TrimSpace(string(content))
+	if key, err := hex.DecodeString(encoded); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, InvalidKeyErr
+}
+
+/* Creates a file store which encrypts the content of the files with the key */
+func NewEncryptedStoreFS(config Config, writes *RateLimiter, key []byte) (FileStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &StoreFS{aead: aead, config: config, writes: writes}, nil
+}
+
+/* Encrypts the content, producing header + nonce + sealed content */
+func (r *StoreFS) Encrypt(content string) (string, error) {
+	nonce := make([]byte, r.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := r.aead.Seal(nil, nonce, []byte(content), []byte(ENCRYPTION_HEADER))
+	return ENCRYPTION_HEADER + string(nonce) + string(sealed), nil
+}
+
+/* Decrypts the content produced by Encrypt */
+func (r *StoreFS) Decrypt(content []byte) ([]byte, error) {
+	if !bytes.HasPrefix(content, []byte(ENCRYPTION_HEADER)) {
+		return nil, NotEncryptedErr
+	}
+	content = content[len(ENCRYPTION_HEADER):]
+	if len(content) < r.aead.NonceSize() {
+		return nil, InvalidEncryptedErr
+	}
+	nonce, sealed := content[:r.aead.NonceSize()], content[r.aead.NonceSize():]
+	return r.aead.Open(nil, nonce, sealed, []byte(ENCRYPTION_HEADER))
+}
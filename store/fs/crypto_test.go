@@ -0,0 +1,163 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newTestEncryptedStore(t *testing.T, key []byte) *StoreFS {
+	store, err := NewEncryptedStoreFS(DefaultConfig(), nil, key)
+	if err != nil {
+		t.Fatalf("failed to create the encrypted store, error: %s", err)
+	}
+	return store.(*StoreFS)
+}
+
+func TestLoadEncryptionKey(t *testing.T) {
+	directory, err := ioutil.TempDir("", "crypto")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory, error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+	tests := []struct {
+		content string
+		valid   bool
+	}{
+		{string(testKey), true},
+		{hex.EncodeToString(testKey) + "\n", true},
+		{base64.StdEncoding.EncodeToString(testKey) + "\n", true},
+		{"too short", false},
+		{hex.EncodeToString(testKey[:20]), false},
+		{base64.StdEncoding.EncodeToString(append(testKey, 'x')), false},
+	}
+	for index, test := range tests {
+		filename := filepath.Join(directory, "key")
+		if err := ioutil.WriteFile(filename, []byte(test.content), 0600); err != nil {
+			t.Fatalf("failed to write the key, error: %s", err)
+		}
+		key, err := LoadEncryptionKey(filename)
+		if (err == nil) != test.valid {
+			t.Errorf("the key: %d, expected valid: %t, got error: %v", index, test.valid, err)
+		}
+		if test.valid && !bytes.Equal(key, testKey) {
+			t.Errorf("the key: %d, expected the key to be decoded, got: %q", index, key)
+		}
+	}
+	if _, err := LoadEncryptionKey(filepath.Join(directory, "missing")); err == nil {
+		t.Errorf("expected a missing key to be refused")
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	store := newTestEncryptedStore(t, testKey)
+	for _, content := range []string{"", "value", "line one\nline two\n", strings.Repeat("x", 1<<20), "\x00\xff binary"} {
+		encrypted, err := store.Encrypt(content)
+		if err != nil {
+			t.Fatalf("failed to encrypt the content, error: %s", err)
+		}
+		if !strings.HasPrefix(encrypted, ENCRYPTION_HEADER) || (content != "" && strings.Contains(encrypted, content)) {
+			t.Errorf("expected the content to be sealed behind the header")
+		}
+		decrypted, err := store.Decrypt([]byte(encrypted))
+		if err != nil {
+			t.Errorf("failed to decrypt the content, error: %s", err)
+		} else if string(decrypted) != content {
+			t.Errorf("the content didn't round trip, expected: %.20q, got: %.20q", content, decrypted)
+		}
+	}
+	/* step: the nonce is random, the same content never encrypts the same */
+	first, _ := store.Encrypt("value")
+	second, _ := store.Encrypt("value")
+	if first == second {
+		t.Errorf("expected a fresh nonce for each encryption")
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	store := newTestEncryptedStore(t, testKey)
+	encrypted, err := store.Encrypt("the secret")
+	if err != nil {
+		t.Fatalf("failed to encrypt the content, error: %s", err)
+	}
+	header, nonce := len(ENCRYPTION_HEADER), store.aead.NonceSize()
+	flip := func(position int) []byte {
+		content := []byte(encrypted)
+		content[position] ^= 0x01
+		return content
+	}
+	tests := map[string][]byte{
+		"the header":           flip(1),
+		"the nonce":            flip(header),
+		"the sealed content":   flip(header + nonce),
+		"the tag":              flip(len(encrypted) - 1),
+		"truncated":            []byte(encrypted[:len(encrypted)-1]),
+		"truncated to a nonce": []byte(encrypted[:header+nonce-1]),
+		"the header alone":     []byte(ENCRYPTION_HEADER),
+		"appended":             append([]byte(encrypted), 'x'),
+		"plain text":           []byte("the secret"),
+	}
+	for name, content := range tests {
+		if decrypted, err := store.Decrypt(content); err == nil {
+			t.Errorf("expected %s to be rejected, got: %q", name, decrypted)
+		}
+	}
+	if _, err := newTestEncryptedStore(t, []byte("fedcba9876543210fedcba9876543210")).Decrypt([]byte(encrypted)); err == nil {
+		t.Errorf("expected the content to be rejected with another key")
+	}
+}
+
+func TestEncryptedFiles(t *testing.T) {
+	directory, err := ioutil.TempDir("", "crypto")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory, error: %s", err)
+	}
+	defer os.RemoveAll(directory)
+	store := newTestEncryptedStore(t, testKey)
+	attributes := Attributes{Mode: 0600, UID: -1, GID: -1}
+	written := filepath.Join(directory, "written")
+	if err := store.Create(written, "the secret", attributes); err != nil {
+		t.Fatalf("failed to write the file, error: %s", err)
+	}
+	streamed := filepath.Join(directory, "streamed")
+	if err := store.Stream(streamed, strings.NewReader("the streamed secret"), attributes); err != nil {
+		t.Fatalf("failed to stream the file, error: %s", err)
+	}
+	for path, expected := range map[string]string{written: "the secret", streamed: "the streamed secret"} {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read the file: %s, error: %s", path, err)
+		}
+		if !bytes.HasPrefix(raw, []byte(ENCRYPTION_HEADER)) || bytes.Contains(raw, []byte(expected)) {
+			t.Errorf("expected the file: %s to be encrypted at rest", path)
+		}
+		if content, err := store.Read(path); err != nil || content != expected {
+			t.Errorf("the file: %s, expected: %q, got: %q, error: %v", path, expected, content, err)
+		}
+	}
+	/* step: a file modified on disk is refused rather than read */
+	ioutil.WriteFile(written, []byte(ENCRYPTION_HEADER+"tampered with the content"), 0600)
+	if _, err := store.Read(written); err == nil {
+		t.Errorf("expected the tampered file to be refused")
+	}
+}
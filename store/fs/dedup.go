@@ -0,0 +1,98 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+/* a file written, which any file with identical content and attributes can be linked to */
+type Blob struct {
+	/* the path of the file */
+	path string
+	/* the file info when it was written, used to check the file hasn't changed since */
+	info os.FileInfo
+}
+
+/* The digest of the content and the attributes shared by hard links */
+func (r *StoreFS) BlobDigest(content_sum string, attributes Attributes) string {
+	return fmt.Sprintf("%x:%o:%d:%d:%s", content_sum, attributes.Mode, attributes.UID, attributes.GID, attributes.Context)
+}
+
+/* Record the file as the blob for its content, so files with identical content can be linked to it */
+func (r *StoreFS) Register(path, content_sum string, attributes Attributes) {
+	if !r.config.dedup || r.aead != nil {
+		return
+	}
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.blobs == nil {
+		r.blobs = make(map[string]*Blob, 0)
+	}
+	r.blobs[r.BlobDigest(content_sum, attributes)] = &Blob{path: path, info: info}
+}
+
+/*
+	Replaces the path with a hard link to a file already written with identical content and attributes, if
+	any, returning true if linked. Encrypted content is never linked, as each file is sealed with its own nonce
+*/
+func (r *StoreFS) Dedup(path, content_sum string, attributes Attributes) bool {
+	if !r.config.dedup || r.aead != nil {
+		return false
+	}
+	digest := r.BlobDigest(content_sum, attributes)
+	r.Lock()
+	blob, found := r.blobs[digest]
+	r.Unlock()
+	if !found || blob.path == path {
+		return false
+	}
+	/* step: make sure the blob hasn't been changed or removed since it was written */
+	info, err := os.Lstat(blob.path)
+	if err != nil || !os.SameFile(info, blob.info) || !info.ModTime().Equal(blob.info.ModTime()) || info.Size() != blob.info.Size() {
+		logger.V(VERBOSE_LEVEL).Infof("Dedup() the blob: %s has changed or been removed, discarding", blob.path)
+		r.Lock()
+		if r.blobs[digest] == blob {
+			delete(r.blobs, digest)
+		}
+		r.Unlock()
+		return false
+	}
+	if r.quota != nil {
+		if err := r.quota.Reserve(path, info.Size()); err != nil {
+			return false
+		}
+	}
+	/* step: link alongside the path and rename over it, so the replacement is atomic */
+	temporary := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%d", filepath.Base(path), time.Now().UnixNano()))
+	if err := os.Link(blob.path, temporary); err != nil {
+		logger.V(VERBOSE_LEVEL).Infof("Dedup() failed to link the file: %s to: %s, error: %s", path, blob.path, err)
+		return false
+	}
+	if err := r.Rename(temporary, path); err != nil {
+		return false
+	}
+	logger.V(VERBOSE_LEVEL).Infof("Dedup() linked the file: %s to: %s, the content is identical", path, blob.path)
+	metrics.Increment(metrics.FILES_LINKED)
+	return true
+}
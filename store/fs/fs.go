@@ -14,37 +14,182 @@ limitations under the License.
 package fs
 
 import (
+	"crypto/cipher"
 	"crypto/md5"
 	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/gambol99/config-fs/store/kv"
+	"github.com/gambol99/config-fs/store/logging"
+	"github.com/gambol99/config-fs/store/metrics"
 )
 
 const (
 	VERBOSE_LEVEL           = 6
 	DEFAULT_DIRECTORY_PERMS = 0755
 	DEFAULT_FILE_PERMS      = 0644
+	/* the suffix used for the previous versions of a file, i.e. name.bak.<timestamp> */
+	BACKUP_SUFFIX = ".bak."
+	/* the timestamp format of the backups, which sorts chronologically */
+	BACKUP_TIMESTAMP = "20060102150405.000000000"
+	/* the extended attribute holding the selinux context */
+	SELINUX_XATTR = "security.selinux"
+	/* the extended attributes recording the key and revision the file was materialized from */
+	SOURCE_XATTR = "user.configfs.source"
+	INDEX_XATTR  = "user.configfs.index"
+	/* how long we wait on the readers to release their locks by default, before replacing the file regardless */
+	FLOCK_TIMEOUT = 2 * time.Second
+	/* the suffix of the lock file taken by the readers and the writer of a file, i.e. .name.lock */
+	FLOCK_SUFFIX = ".lock"
+	/* the interval between the attempts to take the lock */
+	FLOCK_INTERVAL = 10 * time.Millisecond
 )
 
+/* The configuration of the file store, the defaults given by DefaultConfig */
+type Config struct {
+	/* the number of previous versions of each file kept */
+	backups int
+	/* the maximum size of a file, zero is unlimited */
+	max_file_size int64
+	/* fsync the parent directories after a change */
+	fsync bool
+	/* record the key and index the file was materialized from in the extended attributes */
+	source_xattrs bool
+	/* hard link the files with identical content and attributes */
+	dedup bool
+	/* hold an exclusive advisory lock on the files while replaced, and how long we wait on the readers */
+	flock         bool
+	flock_timeout time.Duration
+	/* the files written per second across the file stores sharing a limiter, and the burst above it */
+	write_rate  float64
+	write_burst int
+}
+
+/* An option applied to the configuration of the file store */
+type Option func(*Config) error
+
+/* The default configuration of the file store */
+func DefaultConfig() Config {
+	return Config{source_xattrs: true, write_burst: 10, flock_timeout: FLOCK_TIMEOUT}
+}
+
+/* Binds the configuration to the flags, the current values being the defaults; the caller parses them */
+func RegisterFlags(flags *flag.FlagSet, config *Config) {
+	flags.IntVar(&config.backups, "backups", config.backups, "the number of previous versions of each file to keep, i.e. name.bak.<timestamp>, zero disables")
+	flags.BoolVar(&config.source_xattrs, "source_xattrs", config.source_xattrs, "record the key and store index the file was materialized from in the user.configfs.source and user.configfs.index extended attributes")
+	flags.BoolVar(&config.fsync, "fsync", config.fsync, "fsync the parent directories after the files are written, renamed or removed, so the changes survive a power loss")
+	flags.BoolVar(&config.flock, "flock", config.flock, "hold an exclusive advisory lock (flock) on the lock file of each file, i.e. .name.lock, while it's replaced, so readers taking a shared lock on it never open it mid-update")
+	flags.DurationVar(&config.flock_timeout, "flock_timeout", config.flock_timeout, "how long a write waits on the readers holding a shared lock under -flock, before the file is replaced regardless")
+	flags.BoolVar(&config.dedup, "dedup", config.dedup, "hard link the files with identical content and attributes to a single copy, rather than writing each")
+	flags.Int64Var(&config.max_file_size, "max_file_size", config.max_file_size, "the maximum size (in bytes) of a file, content exceeding it is not written, zero disables")
+	flags.Float64Var(&config.write_rate, "write_rate", config.write_rate, "the maximum number of files written (created or replaced) per second across the mount points, the writes beyond it are delayed, zero disables")
+	flags.IntVar(&config.write_burst, "write_burst", config.write_burst, "the number of files which can be written in a burst above the -write_rate")
+}
+
+/* Applies the options to the configuration, in order */
+func (r *Config) Apply(options ...Option) error {
+	for _, option := range options {
+		if err := option(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* The number of previous versions of each file to keep, zero disables */
+func WithBackups(backups int) Option {
+	return func(config *Config) error {
+		config.backups = backups
+		return nil
+	}
+}
+
+/* Fsync the parent directories after the files are written, renamed or removed */
+func WithFsync(fsync bool) Option {
+	return func(config *Config) error {
+		config.fsync = fsync
+		return nil
+	}
+}
+
+/* The maximum number of files written per second and the burst above it, a rate of zero disables */
+func WithWriteRate(rate float64, burst int) Option {
+	return func(config *Config) error {
+		config.write_rate, config.write_burst = rate, burst
+		return nil
+	}
+}
+
+/* Sets any of the configuration by the name of its flag, i.e. WithSetting("max_file_size", "1048576") */
+func WithSetting(name, value string) Option {
+	return func(config *Config) error {
+		flags := flag.NewFlagSet(name, flag.ContinueOnError)
+		RegisterFlags(flags, config)
+		return flags.Set(name, value)
+	}
+}
+
+/* Creates the limiter of the files written, to be shared by the file stores of the mount points */
+func (r Config) NewWriteLimiter() *RateLimiter {
+	return NewRateLimiter(r.write_rate, r.write_burst)
+}
+
 var (
 	DoesNotExistErr          = errors.New("The request entruy does not exists")
 	DirectoryDoesNotExistErr = errors.New("The directory does not exist")
 	FileDoesNotExistErr      = errors.New("The file does not exist")
 	NotFileErr               = errors.New("The argument is not a value file path")
 	IsNotDirectoryErr        = errors.New("The path is not a directory")
+	FileTooLargeErr          = errors.New("The content exceeds the maximum file size")
 )
 
+/* the log of the file store */
+var logger = logging.For(logging.SUBSYSTEM_FS)
+
+/* the attributes applied to the files written */
+type Attributes struct {
+	/* the permissions of the file */
+	Mode os.FileMode
+	/* the owner of the file, -1 leaves it unchanged */
+	UID int
+	/* the group of the file, -1 leaves it unchanged */
+	GID int
+	/* the selinux context of the file, if any */
+	Context string
+	/* the key the file was materialized from, if any */
+	Source string
+	/* the index of the store revision the key was last modified in */
+	Index uint64
+}
+
+/* accounts for the space used by the files written, refusing any write which would exceed it */
+type Quota interface {
+	/* the number of bytes the file at the path can grow to, a negative value is unlimited */
+	Allowance(path string) int64
+	/* record the size of the file written at the path, or refuse the write */
+	Reserve(path string, size int64) error
+	/* release the space used by the path and anything beneath it */
+	Release(path string)
+}
+
 type FileStore interface {
 	/* create a file from a k/v */
-	Create(path string, value string) error
+	Create(path string, value string, attributes Attributes) error
 	/* update the file */
-	Update(path string, value string) error
+	Update(path string, value string, attributes Attributes) error
+	/* create or update the file, streaming the content from the reader */
+	Stream(path string, reader io.Reader, attributes Attributes) error
 	/* delete the file */
 	Delete(path string) error
 	/* get a list of the children */
@@ -57,82 +202,589 @@ type FileStore interface {
 	IsFile(path string) bool
 	/* create a directory */
 	Mkdir(path string) error
-	/* create a directory structure */
-	Mkdirp(path string) error
+	/* create a directory structure, applying the attributes to any directories created */
+	Mkdirp(path string, attributes Attributes) error
 	/* delete the directory */
 	Rmdir(path string) error
+	/* delete the directory if empty, along with any parents left empty, up to the base */
+	Rmdirp(path, base string) error
+	/* move the file or directory to the destination, i.e. into the trash */
+	Move(path, destination string) error
 	/* get the hash of the file content */
 	Hash(path string) (string, error)
 	/* touch the file */
 	Touch(path string) error
 	/* parent directory */
 	Dirname(path string) string
+	/* change the owner and group of the path */
+	Chown(path string, uid, gid int) error
+	/* create or replace a symbolic link to the target */
+	Symlink(target, path string) error
+	/* checks if a symbolic link */
+	IsSymlink(path string) bool
+	/* get the file info of the path */
+	Stat(path string) (os.FileInfo, error)
+	/* change the permissions of the path */
+	Chmod(path string, mode os.FileMode) error
+	/* get a recursive list of the files (anything other than a directory) under the path */
+	Files(path string) ([]string, error)
+	/* read the content of the file, decrypting if required */
+	Read(path string) (string, error)
+	/* flush the entries of the directory to disk, if fsync has been requested */
+	SyncDirectory(path string) error
+	/* account for the space used by the files against the quota */
+	SetQuota(quota Quota)
 }
 
 type StoreFS struct {
+	/* a lock for the blobs */
+	sync.Mutex
+	/* the cipher used to encrypt the content of the files, if any */
+	aead cipher.AEAD
+	/* the quota the files written are accounted against, if any */
+	quota Quota
+	/* the files written, by the digest of the content and attributes, when deduplicating */
+	blobs map[string]*Blob
+	/* the configuration of the store */
+	config Config
+	/* the limiter the files written are throttled by, if any */
+	writes *RateLimiter
 }
 
-func NewStoreFS() FileStore {
-	return new(StoreFS)
+/* Creates a file store, the writes being throttled by the limiter (which may be shared) if given */
+func NewStoreFS(config Config, writes *RateLimiter) FileStore {
+	return &StoreFS{config: config, writes: writes}
 }
 
-func (r *StoreFS) Create(path string, value string) error {
+func (r *StoreFS) Create(path string, value string, attributes Attributes) error {
 	parentDirectory := filepath.Dir(path)
 	if !r.IsDirectory(parentDirectory) {
-		glog.Errorf("Failed to create file: %s, parent: %s does not exist", path, parentDirectory)
+		logger.Errorf("Failed to create file: %s, parent: %s does not exist", path, parentDirectory)
 		return DirectoryDoesNotExistErr
 	}
+	/* step: if the file already exists we only rewrite it when the content has changed */
+	if r.Exists(path) && !r.IsSymlink(path) && r.IsFile(path) {
+		return r.Update(path, value, attributes)
+	}
 	/* step: create the file */
-	glog.V(5).Infof("Create() path: %s, creating file, value: %s", path, value)
-	if fs, err := os.Create(path); err != nil {
-		glog.Errorf("Failed to create the file: %s, error: %s", path, err)
+	logger.V(5).Infof("Create() path: %s, creating file, value: %s", path, kv.MaskValue(path, value))
+	if err := r.WriteFile(path, value, attributes); err != nil {
+		logger.Errorf("Failed to create the file: %s, error: %s", path, err)
 		return err
-	} else {
-		/* change the perms to read only */
-		fs.Chmod(os.FileMode(DEFAULT_FILE_PERMS))
-		if _, err := fs.WriteString(value); err != nil {
-			glog.Errorf("Failed to write the contents to file, error: %s", err)
-			fs.Close()
-			os.Remove(path)
-		} else {
-			fs.Close()
+	}
+	return nil
+}
+
+/*
+	Writes the content to a temporary file in the same directory, syncs it and renames it over
+	the destination, so readers only ever see the old or the new content, never a partial write
+*/
+func (r *StoreFS) WriteFile(path string, value string, attributes Attributes) error {
+	/* step: guard against a rogue value filling the volume */
+	if r.config.max_file_size > 0 && int64(len(value)) > r.config.max_file_size {
+		logger.Errorf("Skipping the write to file: %s, the content (%d bytes) exceeds the maximum file size: %d bytes",
+			path, len(value), r.config.max_file_size)
+		metrics.Increment(metrics.FILES_TOO_LARGE)
+		return FileTooLargeErr
+	}
+	/* step: a flood of changes is paced by the write rate, if any */
+	r.Throttle(path)
+	/* step: identical content can be linked to rather than written */
+	if r.Dedup(path, r.HashString(value), attributes) {
+		return nil
+	}
+	/* step: if we are encrypting at rest, the content is encrypted before it hits the disk */
+	if r.aead != nil {
+		encrypted, err := r.Encrypt(value)
+		if err != nil {
+			logger.Errorf("Failed to encrypt the content for file: %s, error: %s", path, err)
+			return err
+		}
+		value = encrypted
+	}
+	temporary, content_sum, err := r.WriteTemporary(path, strings.NewReader(value), attributes, 0)
+	if err != nil {
+		return err
+	}
+	if err := r.Rename(temporary, path); err != nil {
+		return err
+	}
+	r.Register(path, content_sum, attributes)
+	return nil
+}
+
+/*
+	Streams the content from the reader to the file, so large values are never buffered fully in
+	memory; as with Create, the file is only replaced if the content has changed. Encrypted content
+	is sealed as a whole, so is buffered regardless
+*/
+func (r *StoreFS) Stream(path string, reader io.Reader, attributes Attributes) error {
+	parentDirectory := filepath.Dir(path)
+	if !r.IsDirectory(parentDirectory) {
+		logger.Errorf("Failed to create file: %s, parent: %s does not exist", path, parentDirectory)
+		return DirectoryDoesNotExistErr
+	}
+	if r.aead != nil {
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			logger.Errorf("Failed to read the content for file: %s, error: %s", path, err)
+			return err
+		}
+		return r.Create(path, string(content), attributes)
+	}
+	logger.V(5).Infof("Stream() path: %s, streaming the content to file", path)
+	temporary, content_sum, err := r.WriteTemporary(path, reader, attributes, r.config.max_file_size)
+	if err != nil {
+		return err
+	}
+	/* step: we only replace the file if the content is different */
+	if r.Exists(path) && !r.IsSymlink(path) && r.IsFile(path) {
+		if file_sum, err := r.ContentHash(path); err == nil && file_sum == content_sum {
+			logger.V(VERBOSE_LEVEL).Infof("The content of config file: %s has not changed, skipping the update", path)
+			os.Remove(temporary)
+			if err := r.Chmod(path, attributes.Mode); err != nil {
+				return err
+			}
+			if err := r.Chown(path, attributes.UID, attributes.GID); err != nil {
+				return err
+			}
+			if err := r.Label(path, attributes.Context); err != nil {
+				return err
+			}
+			r.Tag(path, attributes)
+			r.Register(path, content_sum, attributes)
+			return nil
+		}
+	}
+	r.Throttle(path)
+	if r.Dedup(path, content_sum, attributes) {
+		os.Remove(temporary)
+		return nil
+	}
+	if err := r.Rename(temporary, path); err != nil {
+		return err
+	}
+	r.Register(path, content_sum, attributes)
+	return nil
+}
+
+/*
+	Copies the content into a temporary file alongside the path, applying the attributes; returning
+	the name of the temporary file and the hash of the content. A limit above zero caps the size
+*/
+func (r *StoreFS) WriteTemporary(path string, reader io.Reader, attributes Attributes, limit int64) (string, string, error) {
+	temporary, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		logger.Errorf("Failed to create a temporary file for: %s, error: %s", path, err)
+		return "", "", err
+	}
+	/* step: make sure we don't leave the temporary file around on a failure */
+	failed := func(err error) (string, string, error) {
+		temporary.Close()
+		os.Remove(temporary.Name())
+		return "", "", err
+	}
+	/* step: we never copy more than the size cap, or the space left in the quota */
+	capacity := int64(-1)
+	if limit > 0 {
+		capacity = limit
+	}
+	if r.quota != nil {
+		if allowance := r.quota.Allowance(path); allowance >= 0 && (capacity < 0 || allowance < capacity) {
+			capacity = allowance
+		}
+	}
+	if capacity >= 0 {
+		reader = io.LimitReader(reader, capacity+1)
+	}
+	hasher := md5.New()
+	size, err := io.Copy(io.MultiWriter(temporary, hasher), reader)
+	if err != nil {
+		logger.Errorf("Failed to write the contents to file: %s, error: %s", temporary.Name(), err)
+		return failed(err)
+	}
+	if limit > 0 && size > limit {
+		logger.Errorf("Skipping the write to file: %s, the content exceeds the maximum file size: %d bytes", path, limit)
+		metrics.Increment(metrics.FILES_TOO_LARGE)
+		return failed(FileTooLargeErr)
+	}
+	if r.quota != nil {
+		if err := r.quota.Reserve(path, size); err != nil {
+			return failed(err)
+		}
+	}
+	if err := temporary.Chmod(attributes.Mode); err != nil {
+		logger.Errorf("Failed to change the permissions on file: %s, error: %s", temporary.Name(), err)
+		return failed(err)
+	}
+	if err := r.Chown(temporary.Name(), attributes.UID, attributes.GID); err != nil {
+		return failed(err)
+	}
+	if err := r.Label(temporary.Name(), attributes.Context); err != nil {
+		return failed(err)
+	}
+	r.Tag(temporary.Name(), attributes)
+	if err := temporary.Sync(); err != nil {
+		logger.Errorf("Failed to sync the file: %s, error: %s", temporary.Name(), err)
+		return failed(err)
+	}
+	if err := temporary.Close(); err != nil {
+		logger.Errorf("Failed to close the file: %s, error: %s", temporary.Name(), err)
+		return failed(err)
+	}
+	return temporary.Name(), string(hasher.Sum(nil)), nil
+}
+
+/*
+	Renames the temporary file over the path, removing it on a failure; with -flock the rename is made under the
+	lock of the path, so the readers taking a shared lock never open the file as it's replaced. The content
+	replaced is kept as a backup, only once the new content is ready to take its place, so a write refused (i.e.
+	by the quota) never rotates the backups
+*/
+func (r *StoreFS) Rename(temporary, path string) error {
+	if r.config.flock {
+		defer r.LockFile(path)()
+	}
+	backup, _ := r.Backup(path)
+	if err := os.Rename(temporary, path); err != nil {
+		logger.Errorf("Failed to rename the file: %s to %s, error: %s", temporary, path, err)
+		os.Remove(temporary)
+		if backup != "" {
+			os.Remove(backup)
+		}
+		return err
+	}
+	r.PruneBackups(path)
+	return r.SyncDirectory(filepath.Dir(path))
+}
+
+/* The stable file locking the path, as the file itself may be replaced on each write, i.e. .name.lock */
+func LockPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+FLOCK_SUFFIX)
+}
+
+/* Checks if the name is that of a lock file, i.e. .name.lock */
+func IsLockName(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, FLOCK_SUFFIX) && len(name) > len(FLOCK_SUFFIX)+1
+}
+
+/*
+	Checks if the name is one of the files we write alongside those of the keys, i.e. a temporary file written
+	ahead of a rename, .name.<digits>, or a lock file, .name.lock; a key may well be hidden, i.e. .htpasswd
+*/
+func IsTemporaryName(name string) bool {
+	index := strings.LastIndex(name, ".")
+	if !strings.HasPrefix(name, ".") || index <= 1 {
+		return false
+	}
+	if IsLockName(name) {
+		return true
+	}
+	suffix := name[index+1:]
+	for _, character := range suffix {
+		if character < '0' || character > '9' {
+			return false
+		}
+	}
+	return suffix != ""
+}
+
+/*
+	Takes an exclusive advisory lock on the lock file of the path, handing back the function releasing it; we wait
+	on any readers holding a shared lock up to the timeout, after which the file is written regardless
+*/
+func (r *StoreFS) LockFile(path string) func() {
+	file, err := os.OpenFile(LockPath(path), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		logger.Errorf("Failed to open the lock file of: %s, error: %s", path, err)
+		return func() {}
+	}
+	for deadline := time.Now().Add(r.config.flock_timeout); ; time.Sleep(FLOCK_INTERVAL) {
+		locked, err := TryLockFile(file)
+		if err != nil {
+			logger.Errorf("Failed to lock the file: %s, error: %s", path, err)
+			break
 		}
+		if locked {
+			return func() {
+				UnlockFile(file)
+				file.Close()
+			}
+		}
+		if time.Now().After(deadline) {
+			logger.Errorf("Timed out waiting on the readers of file: %s to release their locks, writing it regardless", path)
+			break
+		}
+	}
+	file.Close()
+	return func() {}
+}
+
+/*
+	The content of a file is always synced before it's renamed into place, but the rename (or any
+	creation or removal) is only durable once the parent directory has been synced as well
+*/
+func (r *StoreFS) SyncDirectory(path string) error {
+	if !r.config.fsync {
+		return nil
+	}
+	directory, err := os.Open(path)
+	if err != nil {
+		logger.Errorf("Failed to open the directory: %s for syncing, error: %s", path, err)
+		return err
+	}
+	defer directory.Close()
+	if err := directory.Sync(); err != nil {
+		logger.Errorf("Failed to sync the directory: %s, error: %s", path, err)
+		return err
 	}
 	return nil
 }
 
-func (r *StoreFS) Update(path string, value string) error {
+func (r *StoreFS) Update(path string, value string, attributes Attributes) error {
 	if !r.Exists(path) || !r.IsFile(path) {
-		glog.Errorf("The file: %s does not exist or is not a file", path)
+		logger.Errorf("The file: %s does not exist or is not a file", path)
 		return NotFileErr
 	}
 
 	/* step: we only update if the content is different */
-	if file_sum, err := r.Hash(path); err != nil {
-		glog.Errorf("Failed to generate a hash on the file: %s, error: %s", path, err)
+	if file_sum, err := r.ContentHash(path); err != nil {
+		logger.Errorf("Failed to generate a hash on the file: %s, error: %s", path, err)
 		return err
 	} else {
 		/* step: get a hash of the new content */
 		content_sum := r.HashString(value)
 		if file_sum == content_sum {
-			glog.Infof("The content of config file: %s has not changed, skipping the update", path)
+			logger.V(VERBOSE_LEVEL).Infof("The content of config file: %s has not changed, skipping the update", path)
+			/* step: the permissions may have changed though */
+			if err := r.Chmod(path, attributes.Mode); err != nil {
+				return err
+			}
+			if err := r.Chown(path, attributes.UID, attributes.GID); err != nil {
+				return err
+			}
+			if err := r.Label(path, attributes.Context); err != nil {
+				return err
+			}
+			r.Tag(path, attributes)
+			r.Register(path, content_sum, attributes)
 		} else {
-			if fs, err := os.Create(path); err != nil {
-				glog.Errorf("Failed to create the file: %s, error: %s", path, err)
+			/* note: the previous content is rotated into the backups as the file is replaced */
+			if err := r.WriteFile(path, value, attributes); err != nil {
+				logger.Errorf("Failed to update the file: %s, error: %s", path, err)
 				return err
-			} else {
-				defer fs.Close()
-				if _, err := fs.WriteString(value); err != nil {
-					glog.Errorf("Failed to write the contents to file, error: %s", err)
-				}
-				/* step: ensure the perms to read only */
-				fs.Chmod(os.FileMode(DEFAULT_FILE_PERMS))
 			}
 		}
 	}
 	return nil
 }
 
+/* change the permissions of the file, if they differ */
+func (r *StoreFS) Chmod(path string, mode os.FileMode) error {
+	if stat, err := r.Stat(path); err != nil {
+		return err
+	} else if stat.Mode().Perm() != mode.Perm() {
+		logger.V(VERBOSE_LEVEL).Infof("Chmod() path: %s, changing mode: %s to %s", path, stat.Mode().Perm(), mode.Perm())
+		if err := r.Unshare(path); err != nil {
+			return err
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			logger.Errorf("Failed to change the permissions on file: %s, error: %s", path, err)
+			return err
+		}
+	}
+	return nil
+}
+
+/* Keeps a copy of the current content of the file, if any, returning the path of the copy */
+func (r *StoreFS) Backup(path string) (string, error) {
+	if r.config.backups <= 0 {
+		return "", nil
+	}
+	if info, err := os.Lstat(path); err != nil || !info.Mode().IsRegular() {
+		return "", nil
+	}
+	backup := path + BACKUP_SUFFIX + time.Now().UTC().Format(BACKUP_TIMESTAMP)
+	logger.V(VERBOSE_LEVEL).Infof("Backup() path: %s, backup: %s", path, backup)
+	/* step: the file is replaced via a rename, so a hard link keeps the old content intact */
+	if err := os.Link(path, backup); err != nil {
+		logger.Errorf("Failed to backup the file: %s, error: %s", path, err)
+		return "", err
+	}
+	return backup, nil
+}
+
+/* Removes the oldest copies of the file beyond the retention */
+func (r *StoreFS) PruneBackups(path string) error {
+	if r.config.backups <= 0 {
+		return nil
+	}
+	versions, err := filepath.Glob(path + BACKUP_SUFFIX + "*")
+	if err != nil {
+		return err
+	}
+	sort.Strings(versions)
+	for len(versions) > r.config.backups {
+		logger.V(VERBOSE_LEVEL).Infof("Removing the expired backup: %s", versions[0])
+		if err := os.Remove(versions[0]); err != nil {
+			logger.Errorf("Failed to remove the backup: %s, error: %s", versions[0], err)
+		}
+		versions = versions[1:]
+	}
+	return nil
+}
+
+/* apply the selinux context to the path, an empty context leaves it unchanged */
+func (r *StoreFS) Label(path, context string) error {
+	if context == "" {
+		return nil
+	}
+	if current, err := GetXattr(path, SELINUX_XATTR); err == nil && strings.TrimRight(string(current), "\x00") == context {
+		return nil
+	}
+	if err := r.Unshare(path); err != nil {
+		return err
+	}
+	if err := SetXattr(path, SELINUX_XATTR, []byte(context)); err != nil {
+		logger.Errorf("Failed to apply the selinux context: %s to path: %s, error: %s", context, path, err)
+		return err
+	}
+	return nil
+}
+
+/*
+	Record the key and store index the file was materialized from, so any file can be traced back to the
+	revision in the store; the tracing is best effort, as not all file systems support user attributes
+*/
+func (r *StoreFS) Tag(path string, attributes Attributes) {
+	if !r.config.source_xattrs || attributes.Source == "" {
+		return
+	}
+	index := strconv.FormatUint(attributes.Index, 10)
+	if current, err := GetXattr(path, INDEX_XATTR); err == nil && string(current) == index {
+		if source, err := GetXattr(path, SOURCE_XATTR); err == nil && string(source) == attributes.Source {
+			return
+		}
+	}
+	if err := r.Unshare(path); err != nil {
+		return
+	}
+	if err := SetXattr(path, SOURCE_XATTR, []byte(attributes.Source)); err != nil {
+		logger.V(VERBOSE_LEVEL).Infof("Failed to record the source on file: %s, error: %s", path, err)
+		return
+	}
+	if err := SetXattr(path, INDEX_XATTR, []byte(index)); err != nil {
+		logger.V(VERBOSE_LEVEL).Infof("Failed to record the index on file: %s, error: %s", path, err)
+	}
+}
+
+/* change the owner and group of the path, a -1 leaves it unchanged */
+func (r *StoreFS) Chown(path string, uid, gid int) error {
+	if uid < 0 && gid < 0 {
+		return nil
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if owner, group, found := FileOwner(info); found && (uid < 0 || uid == owner) && (gid < 0 || gid == group) {
+			return nil
+		}
+	}
+	if err := r.Unshare(path); err != nil {
+		return err
+	}
+	logger.V(VERBOSE_LEVEL).Infof("Chown() path: %s, uid: %d, gid: %d", path, uid, gid)
+	if err := os.Lchown(path, uid, gid); err != nil {
+		logger.Errorf("Failed to change the ownership of: %s, error: %s", path, err)
+		return err
+	}
+	return nil
+}
+
+/*
+	Breaks the hard links of the file at the path, copying it (the permissions, owner and extended attributes
+	preserved) to a file of its own renamed over the path; so an attribute changed in place never alters the
+	other paths sharing the inode, i.e. the previous generation of the atomic swap
+*/
+func (r *StoreFS) Unshare(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() || LinkCount(info) <= 1 {
+		return nil
+	}
+	logger.V(VERBOSE_LEVEL).Infof("Unshare() path: %s, copying the file shared by %d links", path, LinkCount(info))
+	source, err := os.Open(path)
+	if err != nil {
+		logger.Errorf("Failed to open the file: %s, error: %s", path, err)
+		return err
+	}
+	defer source.Close()
+	temporary, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		logger.Errorf("Failed to create a temporary file for: %s, error: %s", path, err)
+		return err
+	}
+	failed := func(err error) error {
+		logger.Errorf("Failed to copy the file: %s, error: %s", path, err)
+		temporary.Close()
+		os.Remove(temporary.Name())
+		return err
+	}
+	if _, err := io.Copy(temporary, source); err != nil {
+		return failed(err)
+	}
+	if err := temporary.Chmod(info.Mode().Perm()); err != nil {
+		return failed(err)
+	}
+	if uid, gid, found := FileOwner(info); found {
+		if err := os.Lchown(temporary.Name(), uid, gid); err != nil {
+			return failed(err)
+		}
+	}
+	for _, name := range []string{SELINUX_XATTR, SOURCE_XATTR, INDEX_XATTR} {
+		if value, err := GetXattr(path, name); err == nil && len(value) > 0 {
+			SetXattr(temporary.Name(), name, value)
+		}
+	}
+	if err := temporary.Sync(); err != nil {
+		return failed(err)
+	}
+	if err := temporary.Close(); err != nil {
+		return failed(err)
+	}
+	if err := os.Rename(temporary.Name(), path); err != nil {
+		logger.Errorf("Failed to rename the file: %s to %s, error: %s", temporary.Name(), path, err)
+		os.Remove(temporary.Name())
+		return err
+	}
+	return r.SyncDirectory(filepath.Dir(path))
+}
+
+/* the hash of the content of the file, when encrypting we must compare the plain text */
+func (r *StoreFS) ContentHash(path string) (string, error) {
+	if r.aead == nil {
+		return r.Hash(path)
+	}
+	if content, err := r.Read(path); err != nil {
+		/* step: the content can't be decrypted, so it can't be what we want */
+		return "", nil
+	} else {
+		return r.HashString(content), nil
+	}
+}
+
+func (r *StoreFS) Read(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		logger.Errorf("Failed to read the file: %s, error: %s", path, err)
+		return "", err
+	}
+	if r.aead != nil {
+		if content, err = r.Decrypt(content); err != nil {
+			logger.Errorf("Failed to decrypt the file: %s, error: %s", path, err)
+			return "", err
+		}
+	}
+	return string(content), nil
+}
+
 func (r *StoreFS) HashString(content string) string {
 	hasher := md5.New()
 	io.WriteString(hasher, content)
@@ -140,36 +792,41 @@ func (r *StoreFS) HashString(content string) string {
 }
 
 func (r *StoreFS) Delete(path string) error {
-	glog.V(VERBOSE_LEVEL).Infof("Delete() deleting the file: %s", path)
+	logger.V(VERBOSE_LEVEL).Infof("Delete() deleting the file: %s", path)
 	if !r.Exists(path) {
-		glog.Errorf("The file: %s does not exist", path)
+		logger.Errorf("The file: %s does not exist", path)
 		return FileDoesNotExistErr
 	}
-	if !r.IsFile(path) {
-		glog.Errorf("The file: %s is not a file", path)
+	if !r.IsFile(path) && !r.IsSymlink(path) {
+		logger.Errorf("The file: %s is not a file", path)
 		return NotFileErr
 	}
 	/* attempt to delete the file */
 	if err := os.Remove(path); err != nil {
-		glog.Errorf("Failed to remove file: %s, error: %s", path, err)
+		logger.Errorf("Failed to remove file: %s, error: %s", path, err)
 		return err
 	}
-	return nil
+	/* step: the lock file goes with the file, whether or not we're presently locking */
+	os.Remove(LockPath(path))
+	if r.quota != nil {
+		r.quota.Release(path)
+	}
+	return r.SyncDirectory(filepath.Dir(path))
 }
 
 func (r *StoreFS) List(path string) ([]string, error) {
 	list := make([]string, 0)
 	/* step: check the path is a directory */
 	if !r.Exists(path) {
-		glog.Errorf("List() the path: %s does not exists", path)
+		logger.Errorf("List() the path: %s does not exists", path)
 		return nil, DoesNotExistErr
 	}
 	if !r.IsDirectory(path) {
-		glog.Errorf("List() the path: %s is not a directory", path)
+		logger.Errorf("List() the path: %s is not a directory", path)
 		return nil, DirectoryDoesNotExistErr
 	}
 	if files, err := ioutil.ReadDir(path); err != nil {
-		glog.Errorf("Failed to get a listing of directory: %s, error: %s", path, err)
+		logger.Errorf("Failed to get a listing of directory: %s, error: %s", path, err)
 		return nil, err
 	} else {
 		for _, file := range files {
@@ -180,15 +837,43 @@ func (r *StoreFS) List(path string) ([]string, error) {
 }
 
 func (r *StoreFS) Exists(path string) bool {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
+	/* note: we use lstat so a dangling link is still considered to exist */
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
 		return false
 	}
 	return true
 }
 
+func (r *StoreFS) IsSymlink(path string) bool {
+	if stat, err := os.Lstat(path); err != nil {
+		return false
+	} else {
+		return stat.Mode()&os.ModeSymlink != 0
+	}
+}
+
+/* Creates the link under a temporary name and renames it over the path, replacing any existing entry */
+func (r *StoreFS) Symlink(target, path string) error {
+	logger.V(VERBOSE_LEVEL).Infof("Symlink() path: %s, target: %s", path, target)
+	if current, err := os.Readlink(path); err == nil && current == target {
+		return nil
+	}
+	temporary := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%d", filepath.Base(path), time.Now().UnixNano()))
+	if err := os.Symlink(target, temporary); err != nil {
+		logger.Errorf("Failed to create the link: %s, error: %s", temporary, err)
+		return err
+	}
+	if err := os.Rename(temporary, path); err != nil {
+		logger.Errorf("Failed to rename the link: %s to %s, error: %s", temporary, path, err)
+		os.Remove(temporary)
+		return err
+	}
+	return r.SyncDirectory(filepath.Dir(path))
+}
+
 func (r *StoreFS) Stat(path string) (os.FileInfo, error) {
 	if stat, err := os.Stat(path); err != nil {
-		glog.Errorf("Failed to stat the path: %s, error: %s", path, err)
+		logger.Errorf("Failed to stat the path: %s, error: %s", path, err)
 		return nil, err
 	} else {
 		return stat, nil
@@ -197,11 +882,11 @@ func (r *StoreFS) Stat(path string) (os.FileInfo, error) {
 
 func (r *StoreFS) IsDirectory(path string) bool {
 	if found := r.Exists(path); !found {
-		glog.Errorf("IsDirectory() path: %s does not exist", path)
+		logger.Errorf("IsDirectory() path: %s does not exist", path)
 		return false
 	}
 	if stat, err := r.Stat(path); err != nil {
-		glog.Errorf("Failed to stat the file: %s, error: %s", path, err)
+		logger.Errorf("Failed to stat the file: %s, error: %s", path, err)
 		return false
 	} else {
 		return stat.IsDir()
@@ -210,12 +895,12 @@ func (r *StoreFS) IsDirectory(path string) bool {
 
 func (r *StoreFS) IsFile(path string) bool {
 	if found := r.Exists(path); !found {
-		glog.Errorf("IsFile() the file: %s does not exist", path)
+		logger.Errorf("IsFile() the file: %s does not exist", path)
 		return false
 	}
 	stat, err := r.Stat(path)
 	if err != nil {
-		glog.Errorf("Failed to stat the file: %s, error: %s", path, err)
+		logger.Errorf("Failed to stat the file: %s, error: %s", path, err)
 		return false
 	}
 	return !stat.IsDir()
@@ -225,44 +910,128 @@ func (r *StoreFS) Mkdir(path string) error {
 	parentDirectory := filepath.Dir(path)
 	/* step: check the directory exists */
 	if !r.Exists(parentDirectory) {
-		glog.Errorf("Failed to create directory, parent directory: %s does not exists", path, parentDirectory)
+		logger.Errorf("Failed to create directory, directory: %s, parent directory: %s does not exists", path, parentDirectory)
 		return errors.New("The parent directory does not exists")
 	}
 	if !r.IsDirectory(parentDirectory) {
-		glog.Errorf("Failed to create directory: %s, parent: %s is not a directorty", path, parentDirectory)
+		logger.Errorf("Failed to create directory: %s, parent: %s is not a directorty", path, parentDirectory)
 		return errors.New("The parent is not a directory")
 	}
 	if err := os.Mkdir(path, os.FileMode(DEFAULT_DIRECTORY_PERMS)); err != nil {
-		glog.Errorf("Failed to create the directory: %s, error: %s", path, err)
+		logger.Errorf("Failed to create the directory: %s, error: %s", path, err)
 		return err
 	}
 	return nil
 }
 
-func (r *StoreFS) Mkdirp(path string) error {
-	if err := os.MkdirAll(path, os.FileMode(DEFAULT_DIRECTORY_PERMS)); err != nil {
-		glog.Errorf("Failed to create the directory: %s, error: %s", path, err)
+func (r *StoreFS) Mkdirp(path string, attributes Attributes) error {
+	if r.Exists(path) {
+		if !r.IsDirectory(path) {
+			logger.Errorf("Failed to create the directory: %s, the path exists and is not a directory", path)
+			return IsNotDirectoryErr
+		}
+		return nil
+	}
+	/* step: ensure the parent exists first */
+	if parent := filepath.Dir(path); parent != path {
+		if err := r.Mkdirp(parent, attributes); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(path, attributes.Mode); err != nil && !os.IsExist(err) {
+		logger.Errorf("Failed to create the directory: %s, error: %s", path, err)
 		return err
 	}
-	return nil
+	/* step: the mode is subject to the umask on creation, so we apply it explicitly */
+	if err := os.Chmod(path, attributes.Mode); err != nil {
+		logger.Errorf("Failed to change the permissions on directory: %s, error: %s", path, err)
+		return err
+	}
+	if err := r.Chown(path, attributes.UID, attributes.GID); err != nil {
+		return err
+	}
+	if err := r.Label(path, attributes.Context); err != nil {
+		return err
+	}
+	return r.SyncDirectory(filepath.Dir(path))
 }
 
 func (r *StoreFS) Rmdir(path string) error {
 	if !r.Exists(path) {
-		glog.Errorf("Failed to delete directory: %s, the path does not exist", path)
+		logger.Errorf("Failed to delete directory: %s, the path does not exist", path)
 		return DirectoryDoesNotExistErr
 	}
 	if !r.IsDirectory(path) {
-		glog.Errorf("Failed to delete directory: %s, the path is not a directory", path)
+		logger.Errorf("Failed to delete directory: %s, the path is not a directory", path)
 		return DirectoryDoesNotExistErr
 	}
 	if err := os.RemoveAll(path); err != nil {
-		glog.Errorf("Failed to remove the directory: %s, error: %s", path, err)
+		logger.Errorf("Failed to remove the directory: %s, error: %s", path, err)
 		return err
 	}
+	if r.quota != nil {
+		r.quota.Release(path)
+	}
+	return r.SyncDirectory(filepath.Dir(path))
+}
+
+/* Moves the file or directory to the destination rather than deleting it, i.e. into the trash */
+func (r *StoreFS) Move(path, destination string) error {
+	if !r.Exists(path) {
+		logger.Errorf("Failed to move: %s, the path does not exist", path)
+		return FileDoesNotExistErr
+	}
+	if err := os.MkdirAll(filepath.Dir(destination), 0700); err != nil {
+		logger.Errorf("Failed to create the directory: %s, error: %s", filepath.Dir(destination), err)
+		return err
+	}
+	if err := os.Rename(path, destination); err != nil {
+		logger.Errorf("Failed to move: %s to: %s, error: %s", path, destination, err)
+		return err
+	}
+	if r.quota != nil {
+		r.quota.Release(path)
+	}
+	return r.SyncDirectory(filepath.Dir(path))
+}
+
+func (r *StoreFS) Rmdirp(path, base string) error {
+	for base != "" && path != base && strings.HasPrefix(path, base+string(filepath.Separator)) {
+		if r.IsDirectory(path) {
+			entries, err := ioutil.ReadDir(path)
+			if err != nil {
+				return err
+			}
+			/* step: the lock files left behind by the files removed don't keep the directory */
+			for _, entry := range entries {
+				if !IsLockName(entry.Name()) {
+					return nil
+				}
+			}
+			for _, entry := range entries {
+				os.Remove(filepath.Join(path, entry.Name()))
+			}
+			logger.V(VERBOSE_LEVEL).Infof("Rmdirp() removing the empty directory: %s", path)
+			/* step: a plain remove, so we never remove content created in the meantime */
+			if err := os.Remove(path); err != nil {
+				if !os.IsNotExist(err) {
+					logger.V(VERBOSE_LEVEL).Infof("Failed to remove the directory: %s, error: %s", path, err)
+				}
+				return nil
+			}
+			if err := r.SyncDirectory(filepath.Dir(path)); err != nil {
+				return err
+			}
+		}
+		path = filepath.Dir(path)
+	}
 	return nil
 }
 
+func (r *StoreFS) SetQuota(quota Quota) {
+	r.quota = quota
+}
+
 func (r *StoreFS) Dirname(path string) string {
 	return filepath.Dir(path)
 }
@@ -271,15 +1040,15 @@ const FILE_CHUNKS = 8192
 
 func (r *StoreFS) Hash(path string) (string, error) {
 	if !r.Exists(path) {
-		glog.Errorf("Failed to hash file: %s, the path does not exist", path)
+		logger.Errorf("Failed to hash file: %s, the path does not exist", path)
 		return "", FileDoesNotExistErr
 	}
 	if !r.IsFile(path) {
-		glog.Errorf("Failed to hash file: %s, the path is not a file", path)
+		logger.Errorf("Failed to hash file: %s, the path is not a file", path)
 		return "", FileDoesNotExistErr
 	}
 	if file, err := os.Open(path); err != nil {
-		glog.Errorf("Failed to open the fileL: %s, error: %s", path, err)
+		logger.Errorf("Failed to open the fileL: %s, error: %s", path, err)
 		return "", err
 	} else {
 		defer file.Close()
@@ -299,21 +1068,39 @@ func (r *StoreFS) Hash(path string) (string, error) {
 
 func (r *StoreFS) Touch(path string) error {
 	if !r.IsFile(path) {
-		glog.Errorf("Failed to hash file: %s, the path is not a file", path)
+		logger.Errorf("Failed to hash file: %s, the path is not a file", path)
 		return FileDoesNotExistErr
 	}
 	if err := os.Chtimes(path, time.Now(), time.Now()); err != nil {
-		glog.Errorf("Failed to update stats on file: %s, error: %s", path, err)
+		logger.Errorf("Failed to update stats on file: %s, error: %s", path, err)
 		return err
 	}
 	return nil
 }
 
+func (r *StoreFS) Files(path string) ([]string, error) {
+	paths := make([]string, 0)
+	if err := filepath.Walk(path, (filepath.WalkFunc)(func(file_path string, info os.FileInfo, err error) error {
+		if err != nil {
+			logger.Errorf("Failed to walk the directory: %s", file_path)
+			return err
+		}
+		if !info.IsDir() {
+			paths = append(paths, file_path)
+		}
+		return nil
+	})); err != nil {
+		logger.Errorf("Failed to walk the directory: %s, error: %s", path, err)
+		return nil, err
+	}
+	return paths, nil
+}
+
 func (r *StoreFS) ListDirectories(path string) ([]string, error) {
 	paths := make([]string, 0)
 	if err := filepath.Walk(path, (filepath.WalkFunc)(func(file_path string, info os.FileInfo, err error) error {
 		if err != nil {
-			glog.Errorf("Failed to walk the directory: %s", file_path)
+			logger.Errorf("Failed to walk the directory: %s", file_path)
 			return err
 		}
 		if info.IsDir() {
@@ -325,7 +1112,7 @@ func (r *StoreFS) ListDirectories(path string) ([]string, error) {
 		}
 		return nil
 	})); err != nil {
-		glog.Errorf("Failed to walk the directory: %s, error: %s", path, err)
+		logger.Errorf("Failed to walk the directory: %s, error: %s", path, err)
 		return nil, err
 	}
 	return paths, nil
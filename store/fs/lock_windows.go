@@ -0,0 +1,34 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"errors"
+	"os"
+)
+
+var UnsupportedLockErr = errors.New("Advisory file locking is not supported on windows")
+
+/* Attempts to take an exclusive advisory lock on the file without blocking, handing back false if it's held */
+func TryLockFile(file *os.File) (bool, error) {
+	return false, UnsupportedLockErr
+}
+
+/* Releases the advisory lock on the file */
+func UnlockFile(file *os.File) error {
+	return UnsupportedLockErr
+}
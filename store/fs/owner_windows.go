@@ -0,0 +1,31 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"os"
+)
+
+/* Retrieves the owner and group of the file, windows has no notion of a uid or gid */
+func FileOwner(info os.FileInfo) (int, int, bool) {
+	return -1, -1, false
+}
+
+/* The number of hard links to the file, taken to be one */
+func LinkCount(info os.FileInfo) uint64 {
+	return 1
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+/*
+	A token bucket, refilled at the rate (per second) up to the burst; a caller without a token is handed the time
+	until one is due, the tokens being reserved so the callers are served in the order they arrived
+*/
+type RateLimiter struct {
+	sync.Mutex
+	/* the tokens added per second, zero is unlimited */
+	rate float64
+	/* the most tokens held */
+	burst float64
+	/* the tokens available, negative when reserved ahead */
+	tokens float64
+	/* the time the tokens were last refilled */
+	last time.Time
+}
+
+/* Create a token bucket, the bucket starting full */
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+/* Takes a token, returning how long the caller must wait before it's due */
+func (r *RateLimiter) Reserve() time.Duration {
+	if r == nil || r.rate <= 0 {
+		return 0
+	}
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	r.tokens = math.Min(r.burst, r.tokens+now.Sub(r.last).Seconds()*r.rate)
+	r.last = now
+	if r.tokens--; r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / r.rate * float64(time.Second))
+}
+
+/* Takes a token, waiting until it's due; returns the time waited */
+func (r *RateLimiter) Wait() time.Duration {
+	delay := r.Reserve()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return delay
+}
+
+/* Waits on the write limiter before the file at the path is written, if a rate has been set */
+func (r *StoreFS) Throttle(path string) {
+	if delay := r.writes.Wait(); delay > 0 {
+		logger.V(VERBOSE_LEVEL).Infof("The write to file: %s was delayed by: %s, exceeding the write rate", path, delay)
+		metrics.Increment(metrics.WRITES_THROTTLED)
+	}
+}
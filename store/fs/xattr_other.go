@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"errors"
+)
+
+var UnsupportedXattrErr = errors.New("Extended attributes are only supported on linux")
+
+/* Sets the extended attribute on the path */
+func SetXattr(path, name string, value []byte) error {
+	return UnsupportedXattrErr
+}
+
+/* Retrieves the extended attribute from the path */
+func GetXattr(path, name string) ([]byte, error) {
+	return nil, UnsupportedXattrErr
+}
@@ -0,0 +1,482 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gambol99/config-fs/store/dynamic"
+	"github.com/gambol99/config-fs/store/fs"
+	"github.com/gambol99/config-fs/store/kv"
+)
+
+/*
+	With -mode=fuse the keys are served through a read only fuse filesystem at the mount point, rather than being
+	materialized as files; every lookup and open goes to the store, so the files always reflect the live store and
+	nothing is persisted on disk, and a template is rendered as it's opened. As with the files, the keys beneath
+	the root are found under their full path, the directories above the root holding only the path down to it; a
+	link is served as a symlink, the attributes header of a key applied to its file, and the keys filtered by the
+	-include, -exclude and -ignore_markers are hidden
+*/
+const (
+	/* the keys are materialized as files under the mount point */
+	MODE_FILES = "files"
+	/* the keys are served through a fuse filesystem at the mount point */
+	MODE_FUSE = "fuse"
+	/* the time given to each request of the filesystem to the store, and the rendering of a template */
+	FUSE_REQUEST_TIMEOUT = 10 * time.Second
+)
+
+var (
+	InvalidModeErr = errors.New("Invalid mode, must be files or fuse")
+	FuseOptionsErr = errors.New("The fuse mode serves the keys as they are read, it can't be used with -mounts, -key_mapping, -atomic_swap, -atomic_dir, -aggregate, -json_document, -tmpfs, -archive, -writeback, -dry_run or -onetime")
+)
+
+/* Checks the mode is one we know of */
+func ValidateMode(mode string) error {
+	switch mode {
+	case MODE_FILES, MODE_FUSE:
+		return nil
+	}
+	return InvalidModeErr
+}
+
+/* a key served by the filesystem, either a directory, a file or a link */
+type FuseEntry struct {
+	/* the key in the store */
+	Key string
+	/* set if the key is a directory */
+	Directory bool
+	/* the target of a link, relative to the directory of the entry */
+	Link string
+	/* the content of the file, the attributes header removed */
+	Value string
+	/* set if the content is the source of a template, rendered as the file is opened */
+	Template bool
+	/* the permissions and owner of the file or directory */
+	Attributes fs.Attributes
+}
+
+/* The name of the entry in its directory */
+func (r *FuseEntry) Name() string {
+	return filepath.Base(filepath.FromSlash(r.Key))
+}
+
+/* The filesystem of the keys, served at the mount point */
+type FuseStore struct {
+	/* a lock for the templates rendered */
+	sync.RWMutex
+	/* the configuration of the store */
+	options Config
+	/* the k/v agent for the store */
+	kv kv.KVStore
+	/* the include and exclude filters for the keys */
+	filter *Filter
+	/* the configuration of the templates */
+	templates dynamic.Config
+	/* the owner of the files and directories */
+	uid int
+	gid int
+	/* the templates rendered, key => status, and the content last rendered by each */
+	rendered map[string]TemplateStatus
+	content  map[string]string
+	/* closed once the filesystem has been mounted */
+	ready chan struct{}
+	/* unmounts the filesystem, set once mounted */
+	unmount func() error
+	/* ensures the filesystem is only released the once */
+	closer sync.Once
+}
+
+/* Create the filesystem of the keys, served at the mount point once synchronized */
+func NewFuseStore(settings Config) (Store, error) {
+	if len(settings.mounts) > 0 || len(settings.key_mapping) > 0 || settings.atomic_swap || len(settings.atomic_dirs) > 0 ||
+		len(settings.aggregates) > 0 || len(settings.documents) > 0 || settings.tmpfs || settings.archive != "" ||
+		settings.writeback != "" || settings.dry_run || settings.onetime {
+		logger.Errorf("The fuse mode can't be used with the options materializing the files")
+		return nil, FuseOptionsErr
+	}
+	service := new(FuseStore)
+	service.options = settings
+	service.options.cfg_directory = filepath.Clean(service.options.cfg_directory)
+	service.rendered = make(map[string]TemplateStatus, 0)
+	service.content = make(map[string]string, 0)
+	service.ready = make(chan struct{})
+	logger.Infof("Creating a fuse filesystem, root: '%s', mountpoint: '%s'", service.options.root_key, service.options.cfg_directory)
+	var err error
+	/* note: the leader and freeze keys are never served, should they be beneath the root */
+	excludes := service.options.exclude
+	for _, key := range []string{service.options.leader_key, service.options.freeze_key} {
+		if key != "" {
+			excludes = strings.Join([]string{excludes, CleanKey(key)}, ",")
+		}
+	}
+	if service.filter, err = NewFilter(service.options.include, excludes); err != nil {
+		return nil, err
+	}
+	if err := service.filter.AddExpressions(service.options.include_regexp, service.options.exclude_regexp); err != nil {
+		return nil, err
+	}
+	service.filter.SetMarkers(service.options.ignore_markers)
+	service.uid, service.gid = os.Getuid(), os.Getgid()
+	if service.options.file_owner != "" {
+		if service.uid, err = LookupUser(service.options.file_owner); err != nil {
+			logger.Errorf("Failed to resolve the file owner: %s, error: %s", service.options.file_owner, err)
+			return nil, err
+		}
+	}
+	if service.options.file_group != "" {
+		if service.gid, err = LookupGroup(service.options.file_group); err != nil {
+			logger.Errorf("Failed to resolve the file group: %s, error: %s", service.options.file_group, err)
+			return nil, err
+		}
+	}
+	/* note: the templates retrieve their keys from the same store, each with an agent of its own */
+	service.templates = service.options.dynamic
+	if err := service.templates.Apply(dynamic.WithStore(service.options.kv)); err != nil {
+		return nil, err
+	}
+	/* note: the keys are never watched, every read going to the store */
+	if service.kv, err = kv.New(service.options.kv, make(kv.NodeUpdateChannel, 1)); err != nil {
+		logger.Errorf("Failed to create the K/V Store, error: %s", err)
+		return nil, err
+	}
+	return service, nil
+}
+
+/* Mount the filesystem at the mount point, the keys being served until closed */
+func (r *FuseStore) Synchronize(ctx context.Context) error {
+	logger.Infof("Serving the keys beneath the root: %s, at the mount point: %s, store: %s", r.options.root_key, r.options.cfg_directory, r.kv.URL())
+	if err := os.MkdirAll(r.options.cfg_directory, os.FileMode(r.options.dir_mode)); err != nil {
+		logger.Errorf("Failed to create the mount point: %s, error: %s", r.options.cfg_directory, err)
+		return err
+	}
+	unmount, err := MountFuse(r.options.cfg_directory, r)
+	if err != nil {
+		logger.Errorf("Failed to mount the fuse filesystem at: %s, error: %s", r.options.cfg_directory, err)
+		return err
+	}
+	r.Lock()
+	r.unmount = unmount
+	r.Unlock()
+	close(r.ready)
+	return nil
+}
+
+/* Unmount the filesystem and release the agent */
+func (r *FuseStore) Close() {
+	r.closer.Do(func() {
+		r.RLock()
+		unmount := r.unmount
+		r.RUnlock()
+		if unmount != nil {
+			logger.Infof("Unmounting the fuse filesystem at: %s", r.options.cfg_directory)
+			if err := unmount(); err != nil {
+				logger.Errorf("Failed to unmount the fuse filesystem at: %s, error: %s", r.options.cfg_directory, err)
+			}
+		}
+		r.kv.Close()
+	})
+}
+
+/* Nothing is persisted under the mount point, so there's nothing to delete */
+func (r *FuseStore) Delete() error {
+	return nil
+}
+
+/* No changes are ever made to the mount point, so the handler is never called */
+func (r *FuseStore) Subscribe(handler func(ChangeEvent)) func() {
+	return func() {}
+}
+
+/* A channel closed once the filesystem has been mounted */
+func (r *FuseStore) Ready() <-chan struct{} {
+	return r.ready
+}
+
+/* The status of the mount point, the store being probed for its reachability */
+func (r *FuseStore) Status(ctx context.Context) []MountStatus {
+	status := MountStatus{
+		Mount: r.options.cfg_directory,
+		Root:  r.options.root_key,
+		Store: r.kv.URL(),
+	}
+	select {
+	case <-r.ready:
+		status.Ready = true
+	default:
+	}
+	probe, cancel := context.WithTimeout(ctx, HEALTH_PROBE_TIMEOUT)
+	defer cancel()
+	if _, err := r.kv.Index(probe); err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Reachable = true
+	}
+	return []MountStatus{status}
+}
+
+/* The reads always go to the store, there's nothing to pause */
+func (r *FuseStore) Pause() {
+	logger.Infof("The fuse filesystem serves the keys as they're read, there's nothing to pause")
+}
+
+/* The reads always go to the store, there's nothing to resume */
+func (r *FuseStore) Resume() {}
+
+/* The reads always go to the store, there's nothing to reconcile */
+func (r *FuseStore) Resync() {}
+
+/* The reads always go to the store, UnknownPrefixErr if the prefix isn't beneath the root */
+func (r *FuseStore) ResyncPrefix(prefix string) error {
+	if root := CleanKey(r.options.root_key); CleanKey(prefix) != root && !IsBeneathKey(root, CleanKey(prefix)) {
+		return UnknownPrefixErr
+	}
+	return nil
+}
+
+/* No files are materialized */
+func (r *FuseStore) Files(prefix string) []FileStatus {
+	return []FileStatus{}
+}
+
+/* The templates rendered since mounted, sorted by key */
+func (r *FuseStore) Templates() []TemplateStatus {
+	r.RLock()
+	defer r.RUnlock()
+	list := make([]TemplateStatus, 0)
+	for _, template := range r.rendered {
+		list = append(list, template)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+/* The content last rendered by the template of the key */
+func (r *FuseStore) Template(key string) (string, error) {
+	r.RLock()
+	defer r.RUnlock()
+	if content, found := r.content[CleanKey(key)]; found {
+		return content, nil
+	}
+	return "", TemplateNotFoundErr
+}
+
+/* The events of the store are never handled */
+func (r *FuseStore) History(query HistoryQuery) []HistoryEvent {
+	return []HistoryEvent{}
+}
+
+/* Checks if the key is above the root, i.e. a directory on the path down to it */
+func (r *FuseStore) IsAboveRoot(key string) bool {
+	return IsBeneathKey(key, CleanKey(r.options.root_key))
+}
+
+/* Look up the key in the store, os.ErrNotExist if it doesn't exist or isn't served */
+func (r *FuseStore) Lookup(ctx context.Context, key string) (*FuseEntry, error) {
+	key = CleanKey(key)
+	root := CleanKey(r.options.root_key)
+	if key == "/" || r.IsAboveRoot(key) {
+		return r.DirectoryEntry(key), nil
+	}
+	if key != root && !IsBeneathKey(root, key) {
+		return nil, os.ErrNotExist
+	}
+	node, err := r.kv.Get(ctx, key)
+	if err != nil {
+		if kv.IsKeyNotFound(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	entry, found := r.Entry(node)
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	return entry, nil
+}
+
+/* The entries of the directory, sorted by name */
+func (r *FuseStore) List(ctx context.Context, key string) ([]*FuseEntry, error) {
+	key = CleanKey(key)
+	/* step: above the root, only the path down to it is served */
+	if root := CleanKey(r.options.root_key); r.IsAboveRoot(key) {
+		name := strings.SplitN(strings.TrimPrefix(root, strings.TrimSuffix(key, "/")+"/"), "/", 2)[0]
+		return []*FuseEntry{r.DirectoryEntry(strings.TrimSuffix(key, "/") + "/" + name)}, nil
+	}
+	nodes, err := r.kv.List(ctx, key)
+	if err != nil {
+		if kv.IsKeyNotFound(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	list := make([]*FuseEntry, 0)
+	for _, node := range nodes {
+		if entry, found := r.Entry(node); found {
+			list = append(list, entry)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list, nil
+}
+
+/* The entry of a directory, with the permissions of the directories */
+func (r *FuseStore) DirectoryEntry(key string) *FuseEntry {
+	return &FuseEntry{
+		Key:        key,
+		Directory:  true,
+		Attributes: fs.Attributes{Mode: os.FileMode(r.options.dir_mode) | os.ModeDir, UID: r.uid, GID: r.gid},
+	}
+}
+
+/* Converts the node to the entry served, false if filtered */
+func (r *FuseStore) Entry(node *kv.Node) (*FuseEntry, bool) {
+	key := CleanKey(node.Path)
+	if node.Directory {
+		if !r.filter.IsTraversable(key) {
+			return nil, false
+		}
+		return r.DirectoryEntry(key), true
+	}
+	if !r.filter.IsIncluded(key) || IsMetadataKey(key) {
+		return nil, false
+	}
+	entry := &FuseEntry{Key: key, Value: node.Value}
+	/* note: the filesystem is read only, the write permissions are never given */
+	entry.Attributes = fs.Attributes{Mode: os.FileMode(r.options.file_mode).Perm() &^ 0222, UID: r.uid, GID: r.gid}
+	if strings.HasPrefix(entry.Value, ATTRIBUTES_PREFIX) {
+		header := entry.Value[len(ATTRIBUTES_PREFIX):]
+		entry.Value = ""
+		if index := strings.Index(header, "\n"); index >= 0 {
+			header, entry.Value = header[:index], header[index+1:]
+		}
+		r.ApplyAttributes(key, header, &entry.Attributes)
+	}
+	switch {
+	case strings.HasPrefix(entry.Value, LINK_PREFIX):
+		target := strings.TrimSpace(entry.Value[len(LINK_PREFIX):])
+		if err := ValidateKey("/" + strings.TrimPrefix(target, "/")); err != nil {
+			logger.Errorf("Invalid link in the key: %s, target: %q, error: %s", key, target, err)
+			return nil, false
+		}
+		/* step: we use a relative link so it remains valid if the mount is moved or bind mounted */
+		link, err := filepath.Rel(filepath.Dir(DiskPath(r.options.cfg_directory, key)), DiskPath(r.options.cfg_directory, target))
+		if err != nil {
+			logger.Errorf("Failed to compute the link from the key: %s to: %s, error: %s", key, target, err)
+			return nil, false
+		}
+		entry.Link, entry.Value = link, ""
+	case dynamic.IsTemplateSource(entry.Value):
+		entry.Template = true
+	}
+	return entry, true
+}
+
+/* Applies the permissions and owner of the attributes header to the file, the other attributes being ignored */
+func (r *FuseStore) ApplyAttributes(key, header string, attributes *fs.Attributes) {
+	for _, field := range strings.Fields(header) {
+		items := strings.SplitN(field, "=", 2)
+		if len(items) != 2 {
+			logger.Errorf("Invalid attribute: %s in key: %s, skipping", field, key)
+			continue
+		}
+		var err error
+		switch items[0] {
+		case "mode":
+			var mode os.FileMode
+			if mode, err = ParseFileMode(items[1]); err == nil {
+				attributes.Mode = mode.Perm() &^ 0222
+			}
+		case "owner":
+			attributes.UID, err = LookupUser(items[1])
+		case "group":
+			attributes.GID, err = LookupGroup(items[1])
+		}
+		if err != nil {
+			logger.Errorf("Invalid attribute: %s in key: %s, error: %s", field, key, err)
+		}
+	}
+}
+
+/* The content of the file as it's opened, the key read from the store and rendered should it be a template */
+func (r *FuseStore) Open(ctx context.Context, key string) (string, error) {
+	entry, err := r.Lookup(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if entry.Directory || entry.Link != "" {
+		return "", os.ErrInvalid
+	}
+	if !entry.Template {
+		return entry.Value, nil
+	}
+	return r.Render(ctx, entry, make(map[string]bool, 0))
+}
+
+/*
+	Renders the template of the entry; the content of another template it consumes is rendered in turn, bar those
+	already being rendered, i.e. a cycle, whose source is used as is
+*/
+func (r *FuseStore) Render(ctx context.Context, entry *FuseEntry, rendering map[string]bool) (content string, err error) {
+	rendering[entry.Key] = true
+	defer delete(rendering, entry.Key)
+	status := TemplateStatus{Mount: r.options.cfg_directory, Key: entry.Key}
+	defer func() {
+		if err != nil {
+			status.Error = err.Error()
+		}
+		r.Lock()
+		r.rendered[entry.Key] = status
+		if err == nil {
+			r.content[entry.Key] = content
+		}
+		r.Unlock()
+	}()
+	resolver := func(key string) (string, bool) {
+		if rendering[CleanKey(key)] {
+			return "", false
+		}
+		other, err := r.Lookup(ctx, key)
+		if err != nil || !other.Template {
+			return "", false
+		}
+		content, err := r.Render(ctx, other, rendering)
+		return content, err == nil
+	}
+	resource, err := dynamic.NewDynamicResource(entry.Key, entry.Value, resolver, r.templates)
+	if err != nil {
+		logger.Errorf("Failed to create the template: %s, error: %s", entry.Key, err)
+		return "", err
+	}
+	defer resource.Close()
+	if content, err = resource.Content(true); err != nil {
+		logger.Errorf("Failed to render the template: %s, error: %s", entry.Key, err)
+		return "", err
+	}
+	status.Size = len(content)
+	/* note: the destinations computed by a template aren't served, only its own content */
+	for destination, _ := range resource.Destinations() {
+		status.Destinations = append(status.Destinations, destination)
+	}
+	sort.Strings(status.Destinations)
+	return content, nil
+}
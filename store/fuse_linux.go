@@ -0,0 +1,193 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+)
+
+/*
+	Mounts the filesystem of the keys at the mount point and serves it until unmounted; nothing is cached by the
+	kernel, the attributes and entries being looked up afresh on every access and the files read directly, so a
+	change in the store is seen on the next read
+*/
+func MountFuse(directory string, store *FuseStore) (func() error, error) {
+	options := []fuse.MountOption{fuse.FSName("config-fs"), fuse.Subtype("configfs"), fuse.ReadOnly(), fuse.DefaultPermissions()}
+	/* note: the permissions are checked by the kernel, so the other users are allowed in when we're able to */
+	if os.Geteuid() == 0 {
+		options = append(options, fuse.AllowOther())
+	}
+	conn, err := fuse.Mount(directory, options...)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := fusefs.Serve(conn, &fuseFS{store: store}); err != nil {
+			logger.Errorf("Failed to serve the fuse filesystem at: %s, error: %s", directory, err)
+		}
+	}()
+	<-conn.Ready
+	if err := conn.MountError; err != nil {
+		conn.Close()
+		return nil, err
+	}
+	logger.Infof("Mounted the fuse filesystem at: %s", directory)
+	return func() error {
+		if err := fuse.Unmount(directory); err != nil {
+			return err
+		}
+		return conn.Close()
+	}, nil
+}
+
+/* the filesystem served, rooted at the top of the keys */
+type fuseFS struct {
+	store *FuseStore
+}
+
+func (r *fuseFS) Root() (fusefs.Node, error) {
+	return &fuseDirectory{store: r.store, entry: r.store.DirectoryEntry("/")}, nil
+}
+
+/* a directory of the keys */
+type fuseDirectory struct {
+	store *FuseStore
+	entry *FuseEntry
+}
+
+func (r *fuseDirectory) Attr(ctx context.Context, attr *fuse.Attr) error {
+	fuseAttributes(r.entry, attr)
+	attr.Mode = os.ModeDir | r.entry.Attributes.Mode.Perm()
+	return nil
+}
+
+func (r *fuseDirectory) Lookup(ctx context.Context, request *fuse.LookupRequest, response *fuse.LookupResponse) (fusefs.Node, error) {
+	ctx, cancel := context.WithTimeout(ctx, FUSE_REQUEST_TIMEOUT)
+	defer cancel()
+	/* note: the entries aren't cached, so a key added or removed is seen on the next lookup */
+	response.EntryValid = 0
+	entry, err := r.store.Lookup(ctx, path.Join(r.entry.Key, request.Name))
+	if err != nil {
+		return nil, fuseError(err)
+	}
+	return fuseNode(r.store, entry), nil
+}
+
+func (r *fuseDirectory) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	ctx, cancel := context.WithTimeout(ctx, FUSE_REQUEST_TIMEOUT)
+	defer cancel()
+	entries, err := r.store.List(ctx, r.entry.Key)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+	list := make([]fuse.Dirent, 0)
+	for _, entry := range entries {
+		dirent := fuse.Dirent{Name: entry.Name(), Type: fuse.DT_File}
+		switch {
+		case entry.Directory:
+			dirent.Type = fuse.DT_Dir
+		case entry.Link != "":
+			dirent.Type = fuse.DT_Link
+		}
+		list = append(list, dirent)
+	}
+	return list, nil
+}
+
+/* a file of a key, read from the store (and rendered, if a template) as it's opened */
+type fuseFile struct {
+	store *FuseStore
+	entry *FuseEntry
+}
+
+func (r *fuseFile) Attr(ctx context.Context, attr *fuse.Attr) error {
+	fuseAttributes(r.entry, attr)
+	attr.Mode = r.entry.Attributes.Mode.Perm()
+	/* note: a template is only rendered once opened, its size is unknown until then */
+	if !r.entry.Template {
+		attr.Size = uint64(len(r.entry.Value))
+	}
+	return nil
+}
+
+func (r *fuseFile) Open(ctx context.Context, request *fuse.OpenRequest, response *fuse.OpenResponse) (fusefs.Handle, error) {
+	ctx, cancel := context.WithTimeout(ctx, FUSE_REQUEST_TIMEOUT)
+	defer cancel()
+	content, err := r.store.Open(ctx, r.entry.Key)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+	/* note: the size given by the attributes may be stale, or zero for a template, so the page cache is bypassed */
+	response.Flags |= fuse.OpenDirectIO
+	return &fuseHandle{content: []byte(content)}, nil
+}
+
+/* the content of a file as it was opened */
+type fuseHandle struct {
+	content []byte
+}
+
+func (r *fuseHandle) ReadAll(ctx context.Context) ([]byte, error) {
+	return r.content, nil
+}
+
+/* a link of a key to another */
+type fuseLink struct {
+	store *FuseStore
+	entry *FuseEntry
+}
+
+func (r *fuseLink) Attr(ctx context.Context, attr *fuse.Attr) error {
+	fuseAttributes(r.entry, attr)
+	attr.Mode = os.ModeSymlink | 0777
+	attr.Size = uint64(len(r.entry.Link))
+	return nil
+}
+
+func (r *fuseLink) Readlink(ctx context.Context, request *fuse.ReadlinkRequest) (string, error) {
+	return r.entry.Link, nil
+}
+
+/* The node serving the entry */
+func fuseNode(store *FuseStore, entry *FuseEntry) fusefs.Node {
+	switch {
+	case entry.Directory:
+		return &fuseDirectory{store: store, entry: entry}
+	case entry.Link != "":
+		return &fuseLink{store: store, entry: entry}
+	}
+	return &fuseFile{store: store, entry: entry}
+}
+
+/* Fills in the owner of the entry, the attributes never being cached */
+func fuseAttributes(entry *FuseEntry, attr *fuse.Attr) {
+	attr.Valid = 0
+	attr.Uid = uint32(entry.Attributes.UID)
+	attr.Gid = uint32(entry.Attributes.GID)
+}
+
+/* Converts the error to that returned to the caller, ENOENT for a key which doesn't exist and EIO otherwise */
+func fuseError(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return fuse.ENOENT
+	}
+	logger.Errorf("Failed to serve the request of the fuse filesystem, error: %s", err)
+	return fuse.EIO
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/gambol99/config-fs/store/dynamic"
+	"github.com/gambol99/config-fs/store/kv"
+)
+
+/* a store holding the keys given, the directories implied by them, the remaining methods left unimplemented */
+type fakeFuseKV struct {
+	kv.KVStore
+	keys map[string]string
+}
+
+func (r *fakeFuseKV) URL() string { return "etcd://127.0.0.1:4001" }
+
+func (r *fakeFuseKV) Get(ctx context.Context, key string) (*kv.Node, error) {
+	if value, found := r.keys[key]; found {
+		return &kv.Node{Path: key, Value: value}, nil
+	}
+	for name := range r.keys {
+		if IsBeneathKey(key, name) {
+			return &kv.Node{Path: key, Directory: true}, nil
+		}
+	}
+	return nil, &etcd.EtcdError{ErrorCode: kv.ETCD_KEY_NOT_FOUND}
+}
+
+func (r *fakeFuseKV) List(ctx context.Context, directory string) ([]*kv.Node, error) {
+	if _, err := r.Get(ctx, directory); err != nil {
+		return nil, err
+	}
+	children := make(map[string]*kv.Node, 0)
+	for name, value := range r.keys {
+		if !IsBeneathKey(directory, name) {
+			continue
+		}
+		child := strings.TrimSuffix(directory, "/") + "/" + strings.SplitN(strings.TrimPrefix(name, strings.TrimSuffix(directory, "/")+"/"), "/", 2)[0]
+		if child == name {
+			children[child] = &kv.Node{Path: name, Value: value}
+		} else {
+			children[child] = &kv.Node{Path: child, Directory: true}
+		}
+	}
+	list := make([]*kv.Node, 0)
+	for _, node := range children {
+		list = append(list, node)
+	}
+	return list, nil
+}
+
+func newTestFuseStore(t *testing.T, keys map[string]string) *FuseStore {
+	options := DefaultConfig()
+	options.root_key = "/prod/app"
+	options.cfg_directory = filepath.FromSlash("/config")
+	filter, err := NewFilter("", "/prod/app/secrets/**")
+	if err != nil {
+		t.Fatalf("failed to create the filter, error: %s", err)
+	}
+	filter.SetMarkers(options.ignore_markers)
+	return &FuseStore{
+		options:   options,
+		kv:        &fakeFuseKV{keys: keys},
+		filter:    filter,
+		templates: dynamic.DefaultConfig(),
+		uid:       1000,
+		gid:       1000,
+		rendered:  make(map[string]TemplateStatus, 0),
+		content:   make(map[string]string, 0),
+		ready:     make(chan struct{}),
+	}
+}
+
+func TestFuseLookup(t *testing.T) {
+	store := newTestFuseStore(t, map[string]string{
+		"/prod/app/db":                 "host=db",
+		"/prod/app/nested/cache":       "host=cache",
+		"/prod/app/secrets/password":   "secret",
+		"/prod/app/" + META_KEY:        "mode=0600",
+		"/prod/app/private":            ATTRIBUTES_PREFIX + " mode=0640 other=ignored\nkey=value",
+		"/prod/app/writable":           ATTRIBUTES_PREFIX + " mode=0666\n",
+		"/prod/app/current":            LINK_PREFIX + "/prod/app/nested/cache",
+		"/prod/app/template":           dynamic.DYNAMIC_PREFIX + "{{ \"rendered\" }}",
+		"/prod/other/key":              "outside",
+		"/prod/application/key":        "sharing the prefix",
+		"/prod/app/nested/deeper/leaf": "leaf",
+	})
+	tests := []struct {
+		key       string
+		found     bool
+		directory bool
+		value     string
+		mode      os.FileMode
+		link      string
+		template  bool
+	}{
+		{key: "/", found: true, directory: true},
+		{key: "/prod", found: true, directory: true},
+		{key: "/prod/app", found: true, directory: true},
+		{key: "/prod/app/db", found: true, value: "host=db", mode: 0444},
+		{key: "/prod/app/nested", found: true, directory: true},
+		{key: "/prod/app/nested/cache", found: true, value: "host=cache", mode: 0444},
+		{key: "/prod/app/private", found: true, value: "key=value", mode: 0440},
+		/* note: the filesystem is read only, so the write permissions are never given */
+		{key: "/prod/app/writable", found: true, value: "", mode: 0444},
+		{key: "/prod/app/current", found: true, link: "nested/cache"},
+		{key: "/prod/app/template", found: true, template: true, value: dynamic.DYNAMIC_PREFIX + "{{ \"rendered\" }}", mode: 0444},
+		{key: "/prod/app/missing"},
+		{key: "/prod/app/secrets/password"},
+		{key: "/prod/app/" + META_KEY},
+		{key: "/prod/other/key"},
+		{key: "/prod/application/key"},
+		{key: "/other"},
+	}
+	for _, test := range tests {
+		entry, err := store.Lookup(context.Background(), test.key)
+		if !test.found {
+			if err != os.ErrNotExist {
+				t.Errorf("the key: %s, expected it not to exist, got: %v, error: %v", test.key, entry, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("the key: %s, expected to be found, got error: %s", test.key, err)
+			continue
+		}
+		if entry.Directory != test.directory || entry.Value != test.value || entry.Link != test.link || entry.Template != test.template {
+			t.Errorf("the key: %s, expected: %+v, got: %+v", test.key, test, entry)
+		}
+		if !test.directory && test.link == "" && entry.Attributes.Mode != test.mode {
+			t.Errorf("the key: %s, expected the mode: %s, got: %s", test.key, test.mode, entry.Attributes.Mode)
+		}
+		if entry.Attributes.UID != 1000 || entry.Attributes.GID != 1000 {
+			t.Errorf("the key: %s, expected the default owner, got: %d:%d", test.key, entry.Attributes.UID, entry.Attributes.GID)
+		}
+	}
+}
+
+func TestFuseList(t *testing.T) {
+	store := newTestFuseStore(t, map[string]string{
+		"/prod/app/db":               "host=db",
+		"/prod/app/nested/cache":     "host=cache",
+		"/prod/app/secrets/password": "secret",
+		"/prod/app/_internal/holder": "node-1",
+		"/prod/app/" + META_KEY:      "mode=0600",
+		"/prod/other/key":            "outside",
+	})
+	tests := []struct {
+		key   string
+		names []string
+	}{
+		/* note: above the root, only the path down to it is listed */
+		{"/", []string{"prod"}},
+		{"/prod", []string{"app"}},
+		{"/prod/app", []string{"db", "nested"}},
+		{"/prod/app/nested", []string{"cache"}},
+	}
+	for _, test := range tests {
+		entries, err := store.List(context.Background(), test.key)
+		if err != nil {
+			t.Errorf("the directory: %s, failed to list, error: %s", test.key, err)
+			continue
+		}
+		names := make([]string, 0)
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+			if !IsBeneathKey(test.key, entry.Key) || path.Dir(entry.Key) != test.key {
+				t.Errorf("the directory: %s, the entry: %s isn't a child", test.key, entry.Key)
+			}
+		}
+		if strings.Join(names, ",") != strings.Join(test.names, ",") {
+			t.Errorf("the directory: %s, expected: %v, got: %v", test.key, test.names, names)
+		}
+	}
+	if _, err := store.List(context.Background(), "/prod/app/missing"); err != os.ErrNotExist {
+		t.Errorf("expected a missing directory not to exist, got: %v", err)
+	}
+}
+
+func TestFuseOpen(t *testing.T) {
+	store := newTestFuseStore(t, map[string]string{
+		"/prod/app/db":       "host=db",
+		"/prod/app/template": dynamic.DYNAMIC_PREFIX + "db: {{ getv \"/prod/app/other\" }}",
+		"/prod/app/other":    dynamic.DYNAMIC_PREFIX + "{{ \"rendered\" }}",
+		"/prod/app/broken":   dynamic.DYNAMIC_PREFIX + "{{ .Missing",
+		"/prod/app/current":  LINK_PREFIX + "/prod/app/db",
+	})
+	tests := []struct {
+		key     string
+		content string
+		failed  bool
+	}{
+		{key: "/prod/app/db", content: "host=db"},
+		/* note: the content of another template it consumes is rendered in turn */
+		{key: "/prod/app/template", content: "db: rendered"},
+		{key: "/prod/app/broken", failed: true},
+		{key: "/prod/app/current", failed: true},
+		{key: "/prod/app", failed: true},
+		{key: "/prod/app/missing", failed: true},
+	}
+	for _, test := range tests {
+		content, err := store.Open(context.Background(), test.key)
+		if (err != nil) != test.failed {
+			t.Errorf("the key: %s, expected failure: %t, got error: %v", test.key, test.failed, err)
+			continue
+		}
+		if content != test.content {
+			t.Errorf("the key: %s, expected: %q, got: %q", test.key, test.content, content)
+		}
+	}
+	/* step: the renders are recorded for the admin api */
+	if content, err := store.Template("/prod/app/template"); err != nil || content != "db: rendered" {
+		t.Errorf("expected the content last rendered, got: %q, error: %v", content, err)
+	}
+	if _, err := store.Template("/prod/app/broken"); err != TemplateNotFoundErr {
+		t.Errorf("expected the failed template to have no content, got: %v", err)
+	}
+	keys := make([]string, 0)
+	for _, template := range store.Templates() {
+		keys = append(keys, template.Key)
+		if (template.Error != "") != (template.Key == "/prod/app/broken") {
+			t.Errorf("the template: %s, unexpected error: %q", template.Key, template.Error)
+		}
+	}
+	if strings.Join(keys, ",") != "/prod/app/broken,/prod/app/other,/prod/app/template" {
+		t.Errorf("expected the templates rendered sorted by key, got: %v", keys)
+	}
+}
+
+func TestFuseOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"mounts", "/prod/app=/config"},
+		{"key_mapping", "lowercase"},
+		{"atomic_swap", "true"},
+		{"atomic_dir", "/prod/app/nginx"},
+		{"aggregate", "/prod/app/env"},
+		{"json_document", "/prod/app/nginx"},
+		{"tmpfs", "true"},
+		{"archive", "/tmp/config.tgz"},
+		{"writeback", "/prod/app/**"},
+		{"dry_run", "true"},
+		{"onetime", "true"},
+	}
+	for _, test := range tests {
+		if _, err := New(DefaultConfig(), WithSetting("mode", MODE_FUSE), WithSetting(test.name, test.value)); err != FuseOptionsErr {
+			t.Errorf("the option: %s, expected it to be refused with the fuse mode, got: %v", test.name, err)
+		}
+	}
+	if _, err := New(DefaultConfig(), WithSetting("mode", "memory")); err != InvalidModeErr {
+		t.Errorf("expected an unknown mode to be refused, got: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+/*
+	A mistyped -mount combined with -delete_on_exit (or -prune=delete) could remove files we never wrote, so the
+	mount points of the system (/, /etc, the home directories and the like) are refused outright, and anything else
+	is only deleted from once it carries the sentinel; the sentinel is created at the first sync when the mount
+	point is ours, i.e. we created it, mounted a tmpfs on it or found it empty. A mount point which already held
+	files is never claimed, the sentinel must be created by hand should it truly be ours
+*/
+const MANAGED_SENTINEL = ".configfs-managed"
+
+var (
+	DangerousMountErr = errors.New("The mount point is a system or home directory, it's never deleted from")
+	UnmanagedMountErr = errors.New("The mount point lacks the sentinel, it's not ours to delete from")
+)
+
+/* the directories of the system, never a mount point we'd delete from */
+var SystemDirectories = []string{
+	"/bin", "/boot", "/dev", "/etc", "/home", "/lib", "/lib32", "/lib64", "/opt", "/proc", "/root", "/run",
+	"/sbin", "/srv", "/sys", "/tmp", "/usr", "/usr/bin", "/usr/lib", "/usr/local", "/usr/sbin", "/var",
+	"/var/lib", "/var/log", "/Users", "/Applications", "/Library", "/System", "/private",
+}
+
+/* the parents of the home directories, each directory directly beneath being one */
+var HomeDirectories = []string{"/home", "/Users"}
+
+/* Checks if the directory is the root, a directory of the system or a home directory */
+func IsDangerousMountPoint(directory string) bool {
+	candidates := []string{filepath.Clean(directory)}
+	/* note: a link to a directory of the system is as dangerous as the directory */
+	if resolved, err := filepath.EvalSymlinks(directory); err == nil {
+		candidates = append(candidates, filepath.Clean(resolved))
+	}
+	dangerous := make([]string, 0)
+	homes := append([]string{}, HomeDirectories...)
+	for _, path := range SystemDirectories {
+		dangerous = append(dangerous, filepath.FromSlash(path))
+	}
+	if home, err := os.UserHomeDir(); err == nil && home != "" {
+		dangerous = append(dangerous, home)
+		homes = append(homes, filepath.Dir(home))
+	}
+	/* note: the variables are only set on windows */
+	for _, name := range []string{"SystemRoot", "ProgramFiles", "ProgramFiles(x86)", "ProgramData", "USERPROFILE"} {
+		if value := os.Getenv(name); value != "" {
+			dangerous = append(dangerous, value)
+		}
+	}
+	for _, candidate := range candidates {
+		/* check: the root of the file system, or of a volume */
+		if candidate == filepath.VolumeName(candidate)+string(filepath.Separator) {
+			return true
+		}
+		for _, path := range dangerous {
+			if SamePath(candidate, filepath.Clean(path)) {
+				return true
+			}
+		}
+		for _, path := range homes {
+			if SamePath(filepath.Dir(candidate), filepath.Clean(filepath.FromSlash(path))) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* Compares the paths, ignoring the case on windows */
+func SamePath(a, b string) bool {
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+/* The path of the sentinel marking the mount point as ours */
+func (r *ConfigurationStore) SentinelPath() string {
+	return filepath.Join(r.options.cfg_directory, MANAGED_SENTINEL)
+}
+
+/* Checks if the mount point carries the sentinel */
+func (r *ConfigurationStore) IsManaged() bool {
+	_, err := os.Lstat(r.SentinelPath())
+	return err == nil
+}
+
+/*
+	Creates the sentinel at the first sync, provided the mount point is ours: created by us, a tmpfs we mounted or
+	found empty. A mount point which already held files is left unclaimed, with a warning
+*/
+func (r *ConfigurationStore) ClaimMountPoint(created bool) {
+	if r.options.dry_run || r.IsManaged() {
+		return
+	}
+	if !created {
+		if entries, err := ioutil.ReadDir(r.options.cfg_directory); err != nil || len(entries) > 0 {
+			logger.Warningf("The mount point: %s already holds files and lacks the sentinel: %s, nothing will be deleted from it, "+
+				"create the sentinel by hand should it be ours", r.options.cfg_directory, MANAGED_SENTINEL)
+			return
+		}
+	}
+	logger.V(VERBOSE_INFO).Infof("Creating the sentinel: %s, claiming the mount point", r.SentinelPath())
+	if err := ioutil.WriteFile(r.SentinelPath(), []byte{}, os.FileMode(r.options.file_mode)); err != nil {
+		logger.Errorf("Failed to create the sentinel: %s, error: %s", r.SentinelPath(), err)
+	}
+}
+
+/*
+	Checks the mount point may be deleted from: never a directory of the system, and only with the sentinel in
+	place; an empty mount point (i.e. once the tmpfs has been unmounted) has nothing to lose
+*/
+func (r *ConfigurationStore) GuardDeletion() error {
+	if IsDangerousMountPoint(r.options.cfg_directory) {
+		logger.Errorf("Refusing to delete from the mount point: %s, it's a system or home directory", r.options.cfg_directory)
+		return DangerousMountErr
+	}
+	if r.IsManaged() {
+		return nil
+	}
+	if entries, err := ioutil.ReadDir(r.options.cfg_directory); err == nil && len(entries) <= 0 {
+		return nil
+	}
+	logger.Errorf("Refusing to delete from the mount point: %s, it lacks the sentinel: %s", r.options.cfg_directory, MANAGED_SENTINEL)
+	return UnmanagedMountErr
+}
@@ -0,0 +1,273 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gambol99/config-fs/store/fs"
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+/*
+The hash index records the content and attributes written to each file, along with the size, modification
+time, permissions and owner of the file once written; on a restart the presync skips any file whose content
+and attributes are unchanged in the store and which on disk is as we left it, without reading it. A file
+which has been touched since (or isn't in the index) is compared and written as before. The index is only
+consulted by the presync, the periodic reconciliation still reads the files to find any drift
+*/
+var InvalidHashIndexErr = errors.New("The hash index can't be used with the atomic swap, as each sync writes a new generation")
+
+/* the content and attributes written to a file, and the file as we left it */
+type HashEntry struct {
+	/* the digest of the content written, before any encryption */
+	Content string
+	/* the digest of the file on disk */
+	Digest string
+	/* the attributes the file was written with */
+	Attributes fs.Attributes
+	/* the file once written */
+	Size    int64
+	ModTime int64
+	Mode    os.FileMode
+	UID     int
+	GID     int
+}
+
+/* The index of the files written, by full path, persisted between runs */
+type HashIndex struct {
+	sync.RWMutex
+	/* the file the index is persisted to */
+	filename string
+	/* the entries of the files, full path => entry */
+	entries map[string]HashEntry
+	/* set when the entries have changed since last saved */
+	dirty bool
+}
+
+/* Load the index from the file, an empty index if it doesn't exist yet or can't be read, so it's rebuilt */
+func LoadHashIndex(filename string) (*HashIndex, error) {
+	index := &HashIndex{
+		filename: filename,
+		entries:  make(map[string]HashEntry, 0),
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return index, err
+	}
+	if err := json.Unmarshal(content, &index.entries); err != nil {
+		index.entries = make(map[string]HashEntry, 0)
+		return index, err
+	}
+	return index, nil
+}
+
+/* The digest of the content, as recorded in the index */
+func (r *HashIndex) ContentDigest(content string) string {
+	hasher := md5.New()
+	io.WriteString(hasher, content)
+	return fmt.Sprintf("%x", hasher.Sum(nil))
+}
+
+/* Retrieve the entry of the file, if the file on disk is still as we left it */
+func (r *HashIndex) Current(full_path string) (HashEntry, bool) {
+	if r == nil {
+		return HashEntry{}, false
+	}
+	r.RLock()
+	entry, found := r.entries[full_path]
+	r.RUnlock()
+	if !found {
+		return entry, false
+	}
+	info, err := os.Lstat(full_path)
+	if err != nil || !info.Mode().IsRegular() {
+		return entry, false
+	}
+	uid, gid, _ := fs.FileOwner(info)
+	if info.Size() != entry.Size || info.ModTime().UnixNano() != entry.ModTime || info.Mode() != entry.Mode ||
+		uid != entry.UID || gid != entry.GID {
+		return entry, false
+	}
+	return entry, true
+}
+
+/* Checks if the file is as we left it, having been written with the same content and attributes */
+func (r *HashIndex) IsCurrent(full_path, content string, attributes fs.Attributes) bool {
+	entry, found := r.Current(full_path)
+	return found && entry.Attributes == attributes && entry.Content == r.ContentDigest(content)
+}
+
+/* The fingerprint of the file (as per Fingerprint) if it's as we left it, without reading it */
+func (r *HashIndex) Fingerprint(full_path string) (string, bool) {
+	entry, found := r.Current(full_path)
+	if !found {
+		return "", false
+	}
+	return fmt.Sprintf("%s:%s", entry.Mode, entry.Digest), true
+}
+
+/* Record the content and attributes written to the file, along with the file as we left it */
+func (r *HashIndex) Record(storefs fs.FileStore, full_path, content string, attributes fs.Attributes) {
+	if r == nil {
+		return
+	}
+	info, err := os.Lstat(full_path)
+	if err != nil || !info.Mode().IsRegular() {
+		r.Forget(full_path)
+		return
+	}
+	digest, err := storefs.Hash(full_path)
+	if err != nil {
+		r.Forget(full_path)
+		return
+	}
+	uid, gid, _ := fs.FileOwner(info)
+	r.Lock()
+	defer r.Unlock()
+	r.entries[full_path] = HashEntry{
+		Content:    r.ContentDigest(content),
+		Digest:     fmt.Sprintf("%x", digest),
+		Attributes: attributes,
+		Size:       info.Size(),
+		ModTime:    info.ModTime().UnixNano(),
+		Mode:       info.Mode(),
+		UID:        uid,
+		GID:        gid,
+	}
+	r.dirty = true
+}
+
+/* The entry of the file, whether or not the file is still as we left it */
+func (r *HashIndex) Entry(full_path string) (HashEntry, bool) {
+	if r == nil {
+		return HashEntry{}, false
+	}
+	r.RLock()
+	defer r.RUnlock()
+	entry, found := r.entries[full_path]
+	return entry, found
+}
+
+/* Replace the entry of the file, removing it if not found, i.e. as saved by Entry */
+func (r *HashIndex) Replace(full_path string, entry HashEntry, found bool) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if found {
+		r.entries[full_path] = entry
+	} else {
+		delete(r.entries, full_path)
+	}
+	r.dirty = true
+}
+
+/* Remove the entry of the file, i.e. the write failed */
+func (r *HashIndex) Forget(full_path string) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if _, found := r.entries[full_path]; found {
+		delete(r.entries, full_path)
+		r.dirty = true
+	}
+}
+
+/* Persist the index if changed, dropping the entries of the files which no longer exist */
+func (r *HashIndex) Save() error {
+	if r == nil {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	for full_path, _ := range r.entries {
+		if _, err := os.Lstat(full_path); err != nil {
+			delete(r.entries, full_path)
+			r.dirty = true
+		}
+	}
+	if !r.dirty {
+		return nil
+	}
+	content, err := json.Marshal(r.entries)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(r.filename), "."+filepath.Base(r.filename)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(append(content, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), r.filename); err != nil {
+		return err
+	}
+	r.dirty = false
+	return nil
+}
+
+/* Checks if the initial presync is in progress */
+func (r *ConfigurationStore) IsPresync() bool {
+	return atomic.LoadInt32(&r.presync) == 1
+}
+
+/* Checks if the presync can skip the write of the file, it being unchanged since written by a previous run */
+func (r *ConfigurationStore) IsUnchanged(full_path, content string, attributes fs.Attributes) bool {
+	if !r.IsPresync() || !r.hashes.IsCurrent(full_path, content, attributes) {
+		return false
+	}
+	logger.V(VERBOSE_LEVEL).Infof("The file: %s is unchanged since last written, skipping the presync", full_path)
+	metrics.Increment(metrics.PRESYNC_SKIPPED)
+	return true
+}
+
+/* Record the outcome of a write to the file in the hash index, returning the error of the write */
+func (r *ConfigurationStore) RecordWrite(full_path, content string, attributes fs.Attributes, err error) error {
+	r.SaveHashEntry(full_path)
+	if err != nil {
+		r.hashes.Forget(full_path)
+		return err
+	}
+	r.hashes.Record(r.fs, full_path, content, attributes)
+	return nil
+}
+
+/* Persist the hash index, if requested */
+func (r *ConfigurationStore) SaveHashIndex() {
+	if err := r.hashes.Save(); err != nil {
+		logger.Errorf("Failed to persist the hash index to: %s, error: %s", r.options.hash_index, err)
+	}
+}
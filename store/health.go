@@ -0,0 +1,189 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+/*
+	With -health_address a small http server answers the probes of a supervisor (i.e. kubernetes or a systemd
+	watchdog); /healthz answers while the process is alive, /readyz once every mount point has been synchronized
+	in full and the store can be reached, and /status with a summary of the mount points as JSON. The server is
+	started ahead of the initial sync, so a probe can tell a slow start from a dead one
+*/
+const (
+	HEALTH_PATH = "/healthz"
+	READY_PATH  = "/readyz"
+	STATUS_PATH = "/status"
+	/* the time the store is given to answer the probe of its reachability */
+	HEALTH_PROBE_TIMEOUT = 3 * time.Second
+)
+
+/* the status of a mount point, as answered by /status */
+type MountStatus struct {
+	/* the mount point and the root of the keys materialized under it */
+	Mount string `json:"mount"`
+	Root  string `json:"root"`
+	/* the url of the store, and whether it could be reached (the error if not) */
+	Store     string `json:"store"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+	/* set once the mount point has been synchronized in full */
+	Ready bool `json:"ready"`
+	/* set while the synchronization is paused, or pinned to a snapshot */
+	Paused bool `json:"paused"`
+	Pinned bool `json:"pinned"`
+	/* set while this instance is the leader, when the mount point is shared */
+	Leader *bool `json:"leader,omitempty"`
+	/* the files whose last write failed */
+	Failed int `json:"failed_files"`
+	/* the progress of the current (or last) full sync */
+	Progress ProgressReport `json:"progress"`
+}
+
+/* the summary of the process, as answered by /status */
+type HealthStatus struct {
+	/* the version of the process */
+	Version string `json:"version,omitempty"`
+	/* when the process started, and the time since */
+	Started time.Time `json:"started"`
+	Uptime  string    `json:"uptime"`
+	/* set once every mount point is ready and the store can be reached */
+	Ready bool `json:"ready"`
+	/* the status of each of the mount points */
+	Mounts []MountStatus `json:"mounts"`
+	/* the counters, as published by the expvar */
+	Counters map[string]int64 `json:"counters"`
+}
+
+/* the time the process started */
+var started = time.Now().UTC()
+
+/* The status of the mount point, the store being probed for its reachability */
+func (r *ConfigurationStore) Status(ctx context.Context) []MountStatus {
+	status := MountStatus{
+		Mount:    r.options.cfg_directory,
+		Root:     r.options.root_key,
+		Store:    r.kv.URL(),
+		Ready:    r.readiness.IsReady(),
+		Paused:   r.IsPaused(),
+		Pinned:   r.IsPinned(),
+		Failed:   len(states.FailedSince(r.options.cfg_directory, time.Time{})),
+		Progress: r.progress.Report(),
+	}
+	if r.election != nil {
+		leading := r.election.IsLeader()
+		status.Leader = &leading
+	}
+	probe, cancel := context.WithTimeout(ctx, HEALTH_PROBE_TIMEOUT)
+	defer cancel()
+	if _, err := r.kv.Index(probe); err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Reachable = true
+	}
+	return []MountStatus{status}
+}
+
+/* The summary of the process and each of the mount points */
+func Health(ctx context.Context, store Store, version string) HealthStatus {
+	status := HealthStatus{
+		Version:  version,
+		Started:  started,
+		Uptime:   time.Since(started).Truncate(time.Second).String(),
+		Ready:    true,
+		Mounts:   store.Status(ctx),
+		Counters: metrics.Snapshot(),
+	}
+	for _, mount := range status.Mounts {
+		if !mount.Ready || !mount.Reachable {
+			status.Ready = false
+		}
+	}
+	return status
+}
+
+/* The handler of the health endpoints */
+func HealthHandler(store Store, version string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(HEALTH_PATH, func(writer http.ResponseWriter, request *http.Request) {
+		fmt.Fprintln(writer, "ok")
+	})
+	mux.HandleFunc(READY_PATH, func(writer http.ResponseWriter, request *http.Request) {
+		reasons := make([]string, 0)
+		for _, mount := range store.Status(request.Context()) {
+			if !mount.Reachable {
+				reasons = append(reasons, fmt.Sprintf("%s: the store can't be reached, error: %s", mount.Mount, mount.Error))
+			}
+			if !mount.Ready {
+				reasons = append(reasons, fmt.Sprintf("%s: not yet synchronized", mount.Mount))
+			}
+		}
+		if len(reasons) > 0 {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(writer, strings.Join(reasons, "\n"))
+			return
+		}
+		fmt.Fprintln(writer, "ok")
+	})
+	mux.HandleFunc(STATUS_PATH, func(writer http.ResponseWriter, request *http.Request) {
+		status := Health(request.Context(), store, version)
+		writer.Header().Set("Content-Type", "application/json")
+		if !status.Ready {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		}
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(status)
+	})
+	return mux
+}
+
+/*
+	Serve the health endpoints of the store on the -health_address, if given, until the context is cancelled; the
+	address is bound before returning, so a failure to listen is reported to the caller
+*/
+func ServeHealth(ctx context.Context, settings Config, store Store, version string) error {
+	if settings.health_address == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", settings.health_address)
+	if err != nil {
+		logger.Errorf("Failed to listen on the health address: %s, error: %s", settings.health_address, err)
+		return err
+	}
+	server := &http.Server{Handler: HealthHandler(store, version), ReadHeaderTimeout: 10 * time.Second}
+	logger.Infof("Serving the health endpoints on: %s", listener.Addr())
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("The health server has failed, error: %s", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+	return nil
+}
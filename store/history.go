@@ -0,0 +1,190 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gambol99/config-fs/store/kv"
+)
+
+/*
+	The last -history_size events handled by each mount point (the changes to the keys received from the store, the
+	files written and templates rendered, and the writes and renders which failed) are kept in memory, so the
+	question of what changed at a time can be answered via the admin api (GET /v1/history) rather than by grepping
+	the verbose logs. The oldest events are dropped as the buffer fills
+*/
+const (
+	/* a key was changed or deleted in the store */
+	HISTORY_KEY_UPDATED = "key_updated"
+	HISTORY_KEY_DELETED = "key_deleted"
+	/* the write of a file failed */
+	HISTORY_WRITE_FAILED = "write_failed"
+	/* a template failed to render, or fails differently */
+	HISTORY_TEMPLATE_FAILED = "template_failed"
+	/* the changes staged were rejected by the validation */
+	HISTORY_VALIDATION_FAILED = "validation_failed"
+)
+
+/* an event handled by the mount point */
+type HistoryEvent struct {
+	/* when the event was handled */
+	Time time.Time `json:"time"`
+	/* the mount point */
+	Mount string `json:"mount"`
+	/* the type of event; those above, or that of the change made to the file (file_created, template_rendered) */
+	Type string `json:"type"`
+	/* the key, and the path of the file as seen under the mount point, if known */
+	Key  string `json:"key,omitempty"`
+	Path string `json:"path,omitempty"`
+	/* the index of the store revision of a change to a key */
+	Index uint64 `json:"index,omitempty"`
+	/* the error of a failure */
+	Error string `json:"error,omitempty"`
+}
+
+/* the events wanted from the history, an empty field matching every event */
+type HistoryQuery struct {
+	/* the events handled at or after, and before */
+	Since time.Time
+	Until time.Time
+	/* the type of the events */
+	Type string
+	/* the key or path of the events is, or is beneath, the prefix */
+	Prefix string
+	/* the most recent events returned, at most */
+	Limit int
+}
+
+/* Checks if the event is one wanted by the query */
+func (r HistoryQuery) Matches(event HistoryEvent) bool {
+	switch {
+	case !r.Since.IsZero() && event.Time.Before(r.Since):
+		return false
+	case !r.Until.IsZero() && !event.Time.Before(r.Until):
+		return false
+	case r.Type != "" && event.Type != r.Type:
+		return false
+	}
+	if r.Prefix != "" {
+		prefix := strings.TrimSuffix(r.Prefix, "/")
+		for _, name := range []string{event.Key, event.Path} {
+			if name != "" && (name == prefix || strings.HasPrefix(name, prefix+"/")) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+/* The events matching the query, oldest first; with a limit, the most recent of them */
+func (r HistoryQuery) Filter(events []HistoryEvent) []HistoryEvent {
+	list := make([]HistoryEvent, 0)
+	for _, event := range events {
+		if r.Matches(event) {
+			list = append(list, event)
+		}
+	}
+	if r.Limit > 0 && len(list) > r.Limit {
+		list = list[len(list)-r.Limit:]
+	}
+	return list
+}
+
+/* A ring buffer of the last events handled */
+type History struct {
+	sync.RWMutex
+	/* the events, the oldest at next once the buffer has filled */
+	events []HistoryEvent
+	/* the position the next event is written to */
+	next int
+	/* set once the buffer has filled */
+	full bool
+}
+
+/* Create a history of the last size events, nil (recording nothing) if the size isn't positive */
+func NewHistory(size int) *History {
+	if size <= 0 {
+		return nil
+	}
+	return &History{events: make([]HistoryEvent, size)}
+}
+
+/* Record the events, dropping the oldest should the buffer be full; a nil history records nothing */
+func (r *History) Record(events ...HistoryEvent) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	for _, event := range events {
+		r.events[r.next] = event
+		if r.next = (r.next + 1) % len(r.events); r.next == 0 {
+			r.full = true
+		}
+	}
+}
+
+/* The events recorded, oldest first */
+func (r *History) Events() []HistoryEvent {
+	if r == nil {
+		return []HistoryEvent{}
+	}
+	r.RLock()
+	defer r.RUnlock()
+	if !r.full {
+		return append([]HistoryEvent{}, r.events[:r.next]...)
+	}
+	return append(append([]HistoryEvent{}, r.events[r.next:]...), r.events[:r.next]...)
+}
+
+/* The events handled by the mount point matching the query, oldest first */
+func (r *ConfigurationStore) History(query HistoryQuery) []HistoryEvent {
+	return query.Filter(r.history.Events())
+}
+
+/* Record an event of the mount point in the history */
+func (r *ConfigurationStore) RecordHistory(event HistoryEvent) {
+	if r.history == nil {
+		return
+	}
+	event.Mount = r.options.cfg_directory
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	r.history.Record(event)
+}
+
+/* Record the change to a key received from the store */
+func (r *ConfigurationStore) RecordKeyEvent(event kv.NodeChange) {
+	change := HistoryEvent{Type: HISTORY_KEY_UPDATED, Key: event.Node.Path, Index: event.Node.Index}
+	if event.Operation == kv.DELETED {
+		change.Type = HISTORY_KEY_DELETED
+	}
+	r.RecordHistory(change)
+}
+
+/* The events of the mounts matching the query, oldest first; with a limit, the most recent of them */
+func MergeHistory(query HistoryQuery, lists ...[]HistoryEvent) []HistoryEvent {
+	events := make([]HistoryEvent, 0)
+	for _, list := range lists {
+		events = append(events, list...)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return query.Filter(events)
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	The hooks run once the files under the mount point have changed, each for the files matching its path glob
+	(i.e. /config/haproxy/**), in order; a hook runs a command or sends a signal to the process in a pid file.
+	Should a hook fail, the later hooks are still run unless its failure policy is abort. The hooks are read from a
+	JSON file, a list of:
+
+		{"path": "/config/haproxy/**", "command": "systemctl reload haproxy", "order": 1, "on_failure": "abort"}
+		{"path": "/config/nginx/*.conf", "signal": "HUP", "pidfile": "/run/nginx.pid", "timeout": "10s"}
+*/
+const (
+	/* the failure policies of a hook */
+	HOOK_CONTINUE = "continue"
+	HOOK_ABORT    = "abort"
+	/* the time a hook is given to complete by default */
+	HOOK_TIMEOUT = 5 * time.Minute
+)
+
+var (
+	InvalidHookErr   = errors.New("Invalid hook, requires a path and either a command or a signal and pidfile, the failure policy being continue or abort")
+	InvalidSignalErr = errors.New("Invalid signal, must be one of HUP, INT, QUIT, TERM, USR1 or USR2, and isn't supported on windows")
+)
+
+/* a hook run when the files matching its path have changed */
+type Hook struct {
+	/* the glob of the paths under the mount point, empty matches every path */
+	Path string `json:"path"`
+	/* the command run (via sh -c) */
+	Command string `json:"command,omitempty"`
+	/* or the signal sent to the process in the pid file */
+	Signal string `json:"signal,omitempty"`
+	Pidfile string `json:"pidfile,omitempty"`
+	/* the hooks are run in ascending order, those of the same order as listed */
+	Order int `json:"order,omitempty"`
+	/* continue (the default) or abort the remaining hooks on a failure */
+	OnFailure string `json:"on_failure,omitempty"`
+	/* the time the command is given to complete */
+	Timeout string `json:"timeout,omitempty"`
+	/* the compiled path glob */
+	matcher *regexp.Regexp
+	/* the signal parsed */
+	signal os.Signal
+	/* the timeout parsed */
+	timeout time.Duration
+}
+
+/* Read the hooks from the file, sorted by order */
+func LoadHooks(filename string) ([]*Hook, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	hooks := make([]*Hook, 0)
+	if err := json.Unmarshal(content, &hooks); err != nil {
+		return nil, err
+	}
+	for index, hook := range hooks {
+		if hook.Path == "" {
+			logger.Errorf("The hook: %d in: %s has no path", index+1, filename)
+			return nil, InvalidHookErr
+		}
+		if err := hook.Compile(); err != nil {
+			logger.Errorf("Invalid hook: %d in: %s, error: %s", index+1, filename, err)
+			return nil, err
+		}
+	}
+	sort.SliceStable(hooks, func(i, j int) bool { return hooks[i].Order < hooks[j].Order })
+	return hooks, nil
+}
+
+/* Validates the hook, compiling the path glob and parsing the signal and timeout */
+func (r *Hook) Compile() error {
+	if (r.Command == "") == (r.Signal == "") || (r.Signal != "" && r.Pidfile == "") {
+		return InvalidHookErr
+	}
+	switch r.OnFailure {
+	case "", HOOK_CONTINUE, HOOK_ABORT:
+	default:
+		return InvalidHookErr
+	}
+	var err error
+	if r.Signal != "" {
+		if r.signal, err = ParseSignal(r.Signal); err != nil {
+			return err
+		}
+	}
+	r.timeout = HOOK_TIMEOUT
+	if r.Timeout != "" {
+		if r.timeout, err = time.ParseDuration(r.Timeout); err != nil {
+			return err
+		}
+	}
+	if r.Path != "" {
+		if r.matcher, err = CompileGlob(filepath.ToSlash(r.Path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* The paths matching the glob of the hook */
+func (r *Hook) Matching(paths []string) []string {
+	if r.matcher == nil {
+		return paths
+	}
+	list := make([]string, 0)
+	for _, path := range paths {
+		if r.matcher.MatchString(filepath.ToSlash(path)) {
+			list = append(list, path)
+		}
+	}
+	return list
+}
+
+/* A description of the hook, for the logs */
+func (r *Hook) String() string {
+	if r.Command != "" {
+		return fmt.Sprintf("command: %s", r.Command)
+	}
+	return fmt.Sprintf("signal: %s to the pidfile: %s", r.Signal, r.Pidfile)
+}
+
+/* Run the hook for the paths changed, the paths given to a command on the stdin and in CONFIG_FS_CHANGED */
+func (r *Hook) Execute(paths []string, mount string) error {
+	if r.signal != nil {
+		content, err := ioutil.ReadFile(r.Pidfile)
+		if err != nil {
+			return err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			return fmt.Errorf("invalid pid in the pidfile: %s", r.Pidfile)
+		}
+		process, err := os.FindProcess(pid)
+		if err != nil {
+			return err
+		}
+		return process.Signal(r.signal)
+	}
+	changed := strings.Join(paths, "\n")
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	command := ShellCommand(ctx, r.Command)
+	command.Env = append(os.Environ(), ENV_CHANGED+"="+changed, ENV_MOUNT+"="+mount)
+	command.Stdin = strings.NewReader(changed + "\n")
+	if output, err := command.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s, output: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
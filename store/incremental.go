@@ -0,0 +1,145 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gambol99/config-fs/store/kv"
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+/*
+	With the incremental sync, the refresh interval applies only the keys modified since the index of the store
+	at the last sync, replayed from the history of the store, rather than listing and comparing the whole of it.
+	A full reconciliation is still made whenever the changes can't be had (i.e. the history has been cleared, or
+	more has changed than is worth replaying), when requested, on a resume and when changes from the store have
+	been lost, each of which records the index afresh
+*/
+
+/* The index of the store ahead of a full sync, zero if not syncing incrementally or it can't be had */
+func (r *ConfigurationStore) SyncIndex(ctx context.Context) uint64 {
+	if !r.options.incremental_sync {
+		return 0
+	}
+	index, err := r.kv.Index(ctx)
+	if err != nil {
+		logger.Warningf("Failed to get the index of the store, the next refresh will be a full reconciliation, error: %s", err)
+		return 0
+	}
+	return index
+}
+
+/* Record the index of the store the mount point has been synchronized to, zero forces a full reconciliation */
+func (r *ConfigurationStore) SetSynced(index uint64) {
+	atomic.StoreUint64(&r.synced, index)
+}
+
+/* The refresh interval has passed, apply the changes since the last sync, or reconcile in full if we can't */
+func (r *ConfigurationStore) HandleRefreshEvent(ctx context.Context) {
+	since := atomic.LoadUint64(&r.synced)
+	if since <= 0 {
+		r.HandleTimerEvent(ctx)
+		return
+	}
+	changes, index, err := r.kv.Changes(ctx, r.options.root_key, since)
+	if err != nil && ctx.Err() != nil {
+		return
+	} else if err != nil {
+		logger.Warningf("Unable to get the changes to the store since the index: %d, performing a full reconciliation, error: %s", since, err)
+		r.HandleTimerEvent(ctx)
+		return
+	}
+	logger.V(VERBOSE_LEVEL).Infof("Applying %d changes to the store since the index: %d, up to: %d", len(changes), since, index)
+	r.PurgeTrash()
+	r.Transaction(func() {
+		summary := r.ReconcileChanges(ctx, changes)
+		if summary.Total() > 0 {
+			logger.Infof("Reconciled the mount point against the changes to the store, created: %d, updated: %d, deleted: %d files",
+				summary.Created, summary.Updated, summary.Deleted)
+		}
+	})
+	/* check: cancelled part way, the changes are replayed from the same index on the next refresh */
+	if ctx.Err() != nil {
+		return
+	}
+	r.SetSynced(index)
+	r.RecordSync(index)
+	metrics.Increment(metrics.INCREMENTAL_SYNCS)
+	r.SaveSyncState()
+	r.SaveHashIndex()
+}
+
+/*
+	Reconciles the keys changed against the mount point, the latest change of each key being applied in the order
+	made (the higher priorities first); the deletions already applied (i.e. by the watch) are skipped, there being
+	nothing left to remove
+*/
+func (r *ConfigurationStore) ReconcileChanges(ctx context.Context, changes []kv.NodeChange) *Reconciliation {
+	summary := new(Reconciliation)
+	/* step: the latest change of each key, in order */
+	seen := make(map[string]bool, 0)
+	latest := make([]kv.NodeChange, 0)
+	for index := len(changes) - 1; index >= 0; index-- {
+		if path := changes[index].Node.Path; !seen[path] {
+			seen[path] = true
+			latest = append([]kv.NodeChange{changes[index]}, latest...)
+		}
+	}
+	for _, event := range r.options.priorities.Order(latest) {
+		if ctx.Err() != nil {
+			break
+		}
+		path := event.Node.Path
+		if event.Operation == kv.DELETED && !r.IsMaterialized(path) {
+			continue
+		}
+		full_path := r.FullPath(path)
+		before := r.Fingerprint(full_path)
+		r.HandleNodeEvent(ctx, event)
+		after := r.Fingerprint(full_path)
+		switch {
+		case before == after:
+		case after == "":
+			logger.V(VERBOSE_INFO).Infof("Reconciled the file: %s of key: %s, the key had been deleted", full_path, path)
+			summary.Deleted++
+		case before == "":
+			logger.V(VERBOSE_INFO).Infof("Reconciled the file: %s of key: %s, the file was missing", full_path, path)
+			summary.Created++
+		default:
+			logger.V(VERBOSE_INFO).Infof("Reconciled the file: %s of key: %s, the file had drifted", full_path, path)
+			summary.Updated++
+		}
+	}
+	metrics.Add(metrics.DRIFT_RECONCILED, int64(summary.Total()))
+	r.status.Drifted(int64(summary.Total()))
+	return summary
+}
+
+/* Checks if the key (or anything beneath it) has anything left under the mount point to remove */
+func (r *ConfigurationStore) IsMaterialized(path string) bool {
+	if _, found := r.AggregateOf(path); found || IsMetadataKey(path) || r.fs.Exists(r.FullPath(path)) {
+		return true
+	}
+	r.RLock()
+	defer r.RUnlock()
+	for key, _ := range r.attributes {
+		if key == path || strings.HasPrefix(key, path+"/") {
+			return true
+		}
+	}
+	return false
+}
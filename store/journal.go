@@ -0,0 +1,338 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/gambol99/config-fs/store/kv"
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+const (
+	/* the operations recorded in the journal */
+	JOURNAL_CHANGED = "changed"
+	JOURNAL_DELETED = "deleted"
+	JOURNAL_DONE    = "done"
+	/* the number of entries written before the journal is compacted to the changes outstanding */
+	JOURNAL_COMPACT_SIZE = 1000
+)
+
+/*
+	The journal of the changes received from the store; each change is recorded (and synced to disk) before it's
+	applied and marked as done once it has been, so a crash in between leaves the change outstanding in the journal
+	and it's replayed on the next start, rather than the mount point being out of date until the next reconciliation.
+	A change left outstanding by a failure (i.e. rejected by the validation) is marked as done once a reconciliation
+	has applied the key. The journal is a file of JSON lines, compacted to the changes outstanding as it grows
+*/
+type WriteJournal struct {
+	sync.Mutex
+	/* the path of the journal */
+	filename string
+	/* the journal, opened for appending */
+	file *os.File
+	/* the sequence of the last entry */
+	sequence uint64
+	/* the changes outstanding, the latest for each key */
+	pending map[string]JournalEntry
+	/* the number of entries written since the journal was last truncated */
+	written int
+}
+
+/* An entry in the journal */
+type JournalEntry struct {
+	/* the sequence of the change, for a done entry the latest change applied */
+	Sequence uint64 `json:"seq"`
+	/* the key changed */
+	Key string `json:"key"`
+	/* the operation, changed, deleted or done */
+	Operation string `json:"op"`
+	/* the key is a directory */
+	Directory bool `json:"dir,omitempty"`
+}
+
+/* Open the journal, reading the changes left outstanding by a previous run */
+func OpenJournal(filename string) (*WriteJournal, error) {
+	journal := &WriteJournal{
+		filename: filename,
+		pending:  make(map[string]JournalEntry, 0),
+	}
+	if file, err := os.Open(filename); err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var entry JournalEntry
+			/* note: a crash can leave the last line partially written, it was never synced */
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				logger.Warningf("Skipping an invalid entry in the journal: %s, error: %s", filename, err)
+				continue
+			}
+			journal.Record(entry)
+			journal.written++
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	journal.file = file
+	return journal, nil
+}
+
+/* Apply the entry to the changes outstanding */
+func (r *WriteJournal) Record(entry JournalEntry) {
+	if entry.Sequence > r.sequence {
+		r.sequence = entry.Sequence
+	}
+	if entry.Operation != JOURNAL_DONE {
+		r.pending[entry.Key] = entry
+	} else if pending, found := r.pending[entry.Key]; found && pending.Sequence <= entry.Sequence {
+		delete(r.pending, entry.Key)
+	}
+}
+
+/* Record the change before it's applied, returning its sequence; a nil journal records nothing */
+func (r *WriteJournal) Begin(event kv.NodeChange) uint64 {
+	if r == nil {
+		return 0
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.sequence++
+	entry := JournalEntry{Sequence: r.sequence, Key: event.Node.Path, Operation: JOURNAL_CHANGED, Directory: event.Node.IsDir()}
+	if event.Operation == kv.DELETED {
+		entry.Operation = JOURNAL_DELETED
+	}
+	r.Record(entry)
+	if err := r.Write(entry, true); err != nil {
+		logger.Errorf("Failed to record the change to key: %s in the journal: %s, error: %s", entry.Key, r.filename, err)
+	}
+	return entry.Sequence
+}
+
+/* Mark the changes to the key, up to and including the sequence, as applied */
+func (r *WriteJournal) Complete(key string, sequence uint64) {
+	if r == nil || sequence == 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.Done(JournalEntry{Sequence: sequence, Key: key, Operation: JOURNAL_DONE})
+}
+
+/*
+	Mark the changes to the keys beneath the prefix, up to and including the sequence, as applied, bar those of the
+	keys failed; i.e. a reconciliation begun after the sequence has since brought the keys in line with the store
+*/
+func (r *WriteJournal) CompleteBeneath(prefix string, sequence uint64, failed map[string]bool) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	prefix = CleanKey(prefix)
+	for key, entry := range r.pending {
+		if entry.Sequence <= sequence && !failed[key] && (key == prefix || IsBeneathKey(prefix, key)) {
+			logger.V(VERBOSE_INFO).Infof("The change to key: %s has been applied by the reconciliation, marking it as done", key)
+			r.Done(JournalEntry{Sequence: entry.Sequence, Key: key, Operation: JOURNAL_DONE})
+		}
+	}
+}
+
+/* Record the done entry, compacting the journal should it have grown; the lock must be held */
+func (r *WriteJournal) Done(entry JournalEntry) {
+	r.Record(entry)
+	/* note: the changes outstanding are carried over, so we only compact once they're outnumbered by the rest */
+	if r.written >= JOURNAL_COMPACT_SIZE && r.written >= 2*len(r.pending) {
+		if err := r.Compact(); err == nil {
+			return
+		}
+	}
+	if err := r.Write(entry, false); err != nil {
+		logger.Errorf("Failed to record the change to key: %s as done in the journal: %s, error: %s", entry.Key, r.filename, err)
+	}
+}
+
+/* The sequence of the last change recorded */
+func (r *WriteJournal) Sequence() uint64 {
+	if r == nil {
+		return 0
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.sequence
+}
+
+/* The changes outstanding, in the order received */
+func (r *WriteJournal) Pending() []JournalEntry {
+	if r == nil {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	list := make([]JournalEntry, 0)
+	for _, entry := range r.pending {
+		list = append(list, entry)
+	}
+	sort.Sort(JournalEntries(list))
+	return list
+}
+
+/* Append the entry to the journal, syncing it to disk if requested */
+func (r *WriteJournal) Write(entry JournalEntry, synced bool) error {
+	content, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	if _, err := r.file.Write(append(content, '\n')); err != nil {
+		return err
+	}
+	r.written++
+	if synced {
+		return r.file.Sync()
+	}
+	return nil
+}
+
+/* Empty the journal, nothing being outstanding */
+func (r *WriteJournal) Truncate() error {
+	if err := r.file.Truncate(0); err != nil {
+		logger.Errorf("Failed to truncate the journal: %s, error: %s", r.filename, err)
+		return err
+	}
+	r.written = 0
+	return nil
+}
+
+/*
+	Rewrite the journal with only the changes outstanding, via a temporary file renamed over it, so the journal
+	doesn't grow without bound while a change is left outstanding; truncated should there be none
+*/
+func (r *WriteJournal) Compact() error {
+	if len(r.pending) <= 0 {
+		return r.Truncate()
+	}
+	temporary, err := ioutil.TempFile(filepath.Dir(r.filename), "."+filepath.Base(r.filename)+".")
+	if err != nil {
+		logger.Errorf("Failed to compact the journal: %s, error: %s", r.filename, err)
+		return err
+	}
+	defer os.Remove(temporary.Name())
+	failed := func(err error) error {
+		logger.Errorf("Failed to compact the journal: %s, error: %s", r.filename, err)
+		temporary.Close()
+		return err
+	}
+	pending := make([]JournalEntry, 0, len(r.pending))
+	for _, entry := range r.pending {
+		pending = append(pending, entry)
+	}
+	sort.Sort(JournalEntries(pending))
+	for _, entry := range pending {
+		content, err := json.Marshal(&entry)
+		if err != nil {
+			return failed(err)
+		}
+		if _, err := temporary.Write(append(content, '\n')); err != nil {
+			return failed(err)
+		}
+	}
+	if err := temporary.Chmod(0600); err != nil {
+		return failed(err)
+	}
+	if err := temporary.Sync(); err != nil {
+		return failed(err)
+	}
+	if err := temporary.Close(); err != nil {
+		return failed(err)
+	}
+	if err := os.Rename(temporary.Name(), r.filename); err != nil {
+		logger.Errorf("Failed to compact the journal: %s, error: %s", r.filename, err)
+		return err
+	}
+	/* step: the journal is reopened for appending, the previous file having been replaced */
+	file, err := os.OpenFile(r.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		logger.Errorf("Failed to reopen the journal: %s, error: %s", r.filename, err)
+		return err
+	}
+	r.file.Close()
+	r.file, r.written = file, len(pending)
+	return nil
+}
+
+/* Close the journal */
+func (r *WriteJournal) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	if len(r.pending) <= 0 {
+		r.Truncate()
+	}
+	return r.file.Close()
+}
+
+/* sorts the entries by sequence */
+type JournalEntries []JournalEntry
+
+func (r JournalEntries) Len() int           { return len(r) }
+func (r JournalEntries) Less(i, j int) bool { return r[i].Sequence < r[j].Sequence }
+func (r JournalEntries) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+/*
+	Replay the changes left outstanding in the journal by a previous run; the keys are read afresh from the store,
+	as the value received then may since have changed, and a key no longer in the store is deleted. If the store
+	can't be reached the changes are left outstanding for the next start, as is a key which can't be read
+*/
+func (r *ConfigurationStore) ReplayJournal(ctx context.Context) error {
+	pending := r.journal.Pending()
+	if len(pending) <= 0 {
+		return nil
+	}
+	logger.Warningf("Replaying %d changes left outstanding in the journal: %s", len(pending), r.options.journal)
+	for _, entry := range pending {
+		event := kv.NodeChange{Node: kv.Node{Path: entry.Key, Directory: entry.Directory}, Operation: kv.DELETED}
+		if node, err := r.kv.Get(ctx, entry.Key); err == nil {
+			event = kv.NodeChange{Node: *node, Operation: kv.CHANGED}
+		} else if !kv.IsKeyNotFound(err) {
+			if _, err := r.kv.List(ctx, r.options.root_key); err != nil {
+				logger.Errorf("Failed to replay the journal, the store is unreachable, error: %s", err)
+				return err
+			}
+			/* note: only a key not found is taken as deleted, i.e. not one we lack the permissions to read */
+			logger.Errorf("Failed to read the key: %s to replay from the journal, leaving it outstanding, error: %s", entry.Key, err)
+			continue
+		}
+		logger.V(VERBOSE_INFO).Infof("Replaying the change to key: %s from the journal", entry.Key)
+		if r.Transaction(func() { r.HandleNodeEvent(ctx, event) }) {
+			r.journal.Complete(entry.Key, entry.Sequence)
+		}
+		metrics.Increment(metrics.JOURNAL_REPLAYED)
+	}
+	return nil
+}
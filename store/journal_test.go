@@ -0,0 +1,190 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gambol99/config-fs/store/kv"
+)
+
+func openTestJournal(t *testing.T) (*WriteJournal, string, func()) {
+	directory, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory, error: %s", err)
+	}
+	filename := filepath.Join(directory, "journal")
+	journal, err := OpenJournal(filename)
+	if err != nil {
+		os.RemoveAll(directory)
+		t.Fatalf("failed to open the journal: %s, error: %s", filename, err)
+	}
+	return journal, filename, func() { os.RemoveAll(directory) }
+}
+
+func journalLines(t *testing.T, filename string) int {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("failed to open the journal: %s, error: %s", filename, err)
+	}
+	defer file.Close()
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
+
+func pendingKeys(journal *WriteJournal) []string {
+	keys := make([]string, 0)
+	for _, entry := range journal.Pending() {
+		keys = append(keys, entry.Key)
+	}
+	return keys
+}
+
+func TestJournalNil(t *testing.T) {
+	var journal *WriteJournal
+	if sequence := journal.Begin(changed("/a", "1")); sequence != 0 {
+		t.Errorf("a nil journal should record nothing, got the sequence: %d", sequence)
+	}
+	journal.Complete("/a", 1)
+	journal.CompleteBeneath("/", 1, nil)
+	if journal.Pending() != nil || journal.Sequence() != 0 || journal.Close() != nil {
+		t.Errorf("a nil journal should have nothing outstanding")
+	}
+}
+
+func TestJournalRecordComplete(t *testing.T) {
+	journal, _, cleanup := openTestJournal(t)
+	defer cleanup()
+	defer journal.Close()
+
+	first := journal.Begin(changed("/a", "1"))
+	second := journal.Begin(kv.NodeChange{Node: kv.Node{Path: "/b"}, Operation: kv.DELETED})
+	third := journal.Begin(changed("/a", "2"))
+	if first != 1 || second != 2 || third != 3 || journal.Sequence() != 3 {
+		t.Fatalf("expected the sequences 1, 2 and 3, got: %d, %d and %d", first, second, third)
+	}
+	pending := journal.Pending()
+	if len(pending) != 2 || pending[0].Key != "/b" || pending[0].Operation != JOURNAL_DELETED || pending[1].Key != "/a" || pending[1].Sequence != 3 {
+		t.Fatalf("expected the latest change for each key outstanding, got: %v", pending)
+	}
+	/* step: completing an earlier change leaves the later one outstanding */
+	journal.Complete("/a", first)
+	if keys := pendingKeys(journal); len(keys) != 2 {
+		t.Errorf("the change to /a should still be outstanding, got: %v", keys)
+	}
+	journal.Complete("/a", third)
+	journal.Complete("/b", second)
+	if keys := pendingKeys(journal); len(keys) != 0 {
+		t.Errorf("expected nothing outstanding, got: %v", keys)
+	}
+}
+
+func TestJournalCompleteBeneath(t *testing.T) {
+	journal, _, cleanup := openTestJournal(t)
+	defer cleanup()
+	defer journal.Close()
+
+	journal.Begin(changed("/prod/a", "1"))
+	journal.Begin(changed("/prod/b", "1"))
+	journal.Begin(changed("/production/c", "1"))
+	sequence := journal.Sequence()
+	journal.Begin(changed("/prod/d", "1"))
+	journal.CompleteBeneath("/prod", sequence, map[string]bool{"/prod/b": true})
+	keys := pendingKeys(journal)
+	if len(keys) != 3 || keys[0] != "/prod/b" || keys[1] != "/production/c" || keys[2] != "/prod/d" {
+		t.Errorf("expected /prod/b, /production/c and /prod/d outstanding, got: %v", keys)
+	}
+}
+
+func TestJournalReopen(t *testing.T) {
+	journal, filename, cleanup := openTestJournal(t)
+	defer cleanup()
+
+	journal.Begin(changed("/a", "1"))
+	journal.Begin(changed("/b", "1"))
+	journal.Complete("/a", 1)
+	if err := journal.Close(); err != nil {
+		t.Fatalf("failed to close the journal, error: %s", err)
+	}
+	/* step: a partially written line, as left by a crash, is skipped */
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("failed to open the journal: %s, error: %s", filename, err)
+	}
+	file.WriteString(`{"seq":3,"key":"/c"`)
+	file.Close()
+
+	reopened, err := OpenJournal(filename)
+	if err != nil {
+		t.Fatalf("failed to reopen the journal, error: %s", err)
+	}
+	keys := pendingKeys(reopened)
+	if len(keys) != 1 || keys[0] != "/b" {
+		t.Errorf("expected /b outstanding, got: %v", keys)
+	}
+	if sequence := reopened.Begin(changed("/c", "1")); sequence != 3 {
+		t.Errorf("expected the sequence to carry on from the journal, got: %d", sequence)
+	}
+	reopened.Complete("/b", 2)
+	reopened.Complete("/c", 3)
+	if err := reopened.Close(); err != nil {
+		t.Fatalf("failed to close the journal, error: %s", err)
+	}
+	/* step: nothing being outstanding, the journal is emptied on close */
+	if info, err := os.Stat(filename); err != nil || info.Size() != 0 {
+		t.Errorf("expected the journal to be empty, error: %v", err)
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	journal, filename, cleanup := openTestJournal(t)
+	defer cleanup()
+
+	outstanding := journal.Begin(changed("/outstanding", "1"))
+	for index := 0; index < JOURNAL_COMPACT_SIZE; index++ {
+		journal.Complete("/a", journal.Begin(changed("/a", "1")))
+	}
+	/* step: the journal has been compacted to the change outstanding, bar the entries since */
+	if lines := journalLines(t, filename); lines >= JOURNAL_COMPACT_SIZE {
+		t.Errorf("expected the journal to have been compacted, got: %d lines", lines)
+	}
+	if err := journal.Close(); err != nil {
+		t.Fatalf("failed to close the journal, error: %s", err)
+	}
+	reopened, err := OpenJournal(filename)
+	if err != nil {
+		t.Fatalf("failed to reopen the journal, error: %s", err)
+	}
+	defer reopened.Close()
+	pending := reopened.Pending()
+	if len(pending) != 1 || pending[0].Key != "/outstanding" || pending[0].Sequence != outstanding {
+		t.Errorf("expected the change to /outstanding to survive the compaction, got: %v", pending)
+	}
+	if sequence := reopened.Sequence(); sequence < outstanding {
+		t.Errorf("the sequence went backwards after the compaction, got: %d", sequence)
+	}
+	/* step: no temporary files are left behind */
+	entries, _ := ioutil.ReadDir(filepath.Dir(filename))
+	if len(entries) != 1 {
+		t.Errorf("expected only the journal in the directory, got: %d entries", len(entries))
+	}
+}
@@ -14,29 +14,42 @@ limitations under the License.
 package kv
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/url"
+	"path"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/coreos/go-etcd/etcd"
-	"github.com/golang/glog"
+)
+
+const (
+	/* the error returned by etcd when the index watched from has been cleared from the history */
+	ETCD_INDEX_CLEARED = 401
+	/* the error returned by etcd when the key doesn't exist */
+	ETCD_KEY_NOT_FOUND = 100
+	/* the most changes replayed from the history, beyond which listing the store is cheaper (etcd keeps 1000) */
+	MAX_CHANGES = 1000
+	/* the time given to replay each change from the history, which should be immediate */
+	CHANGES_TIMEOUT = 5 * time.Second
 )
 
 type EtcdStoreClient struct {
 	/* a lock for the watcher map */
 	sync.RWMutex
-	/* the base root key */
-	baseKey string
 	/* the url of the etcd hosts */
 	uri string
 	/* a list of etcd hosts */
 	hosts []string
 	/* the etcd client - under the hood is http client which should be pooled i believe */
 	client *etcd.Client
-	/* stop channel for the client */
+	/* stop channel for the client, closed to cancel the watch */
 	stopChannel chan bool
+	/* ensures the client is only closed the once */
+	closer sync.Once
 	/* stop channel for reciever */
 	stopRecieverChannel chan bool
 	/* the update channel we send our changes to */
@@ -45,10 +58,9 @@ type EtcdStoreClient struct {
 	watchedKeys map[string]bool
 }
 
-func NewEtcdStoreClient(location *url.URL, channel NodeUpdateChannel) (KVStore, error) {
+func NewEtcdStoreClient(location *url.URL, prefixes WatchPrefixes, channel NodeUpdateChannel) (KVStore, error) {
 	/* step: create the client */
 	store := new(EtcdStoreClient)
-	store.baseKey = "/"
 	store.hosts = make([]string, 0)
 	store.uri = location.String()
 	store.channel = channel
@@ -58,57 +70,70 @@ func NewEtcdStoreClient(location *url.URL, channel NodeUpdateChannel) (KVStore,
 	for _, host := range strings.Split(location.Host, ",") {
 		store.hosts = append(store.hosts, "http://"+host)
 	}
-	glog.Infof("Creating a Etcd Agent for K/V Store, host: %s", store.hosts)
+	logger.Infof("Creating a Etcd Agent for K/V Store, host: %s", store.hosts)
 
 	/* step: create the etcd client */
 	store.client = etcd.NewClient(store.hosts)
 	store.client.SetConsistency(etcd.WEAK_CONSISTENCY)
 
-	/* step: start watching for events */
-	store.WatchEvents()
+	/* step: start watching for events beneath each of the prefixes */
+	for _, prefix := range prefixes.Roots() {
+		store.WatchEvents(prefix)
+	}
 
 	return store, nil
 }
 
 func (r *EtcdStoreClient) Close() {
-	glog.Infof("Shutting down the etcd client")
-	r.stopChannel <- true
+	r.closer.Do(func() {
+		logger.Infof("Shutting down the etcd client")
+		close(r.stopChannel)
+	})
 }
 
-func (r *EtcdStoreClient) WatchEvents() {
-	glog.V(VERBOSE_LEVEL).Infof("Starting the event watcher for the etcd clinet, channel: %v", r.channel)
-	/* the kill switch for the goroutine */
-	kill_off := false
+/* Checks if the client has been closed */
+func (r *EtcdStoreClient) IsClosed() bool {
+	select {
+	case <-r.stopChannel:
+		return true
+	default:
+		return false
+	}
+}
 
-	/* routine: waits on the shutdown signal for the client and flicks the kill switch */
-	go func() {
-		glog.V(VERBOSE_LEVEL).Infof("Waiting on a shutdown signal from consumer, channel: %v", r.channel)
-		/* step: wait for the shutdown signal */
-		<-r.stopChannel
-		/* @perhaps : we could speed up the take down by using a stop channel on the watch? */
-		glog.V(VERBOSE_LEVEL).Infof("Flicking the kill switch for watcher, channel: %v", r.baseKey, r.channel)
-		kill_off = true
-	}()
+func (r *EtcdStoreClient) WatchEvents(prefix string) {
+	logger.V(VERBOSE_LEVEL).Infof("Starting the event watcher for the etcd clinet, prefix: %s, channel: %v", prefix, r.channel)
 
-	/* routine: loops around watching until flick the switch */
+	/* routine: loops around watching until the client is closed, which also cancels the watch in flight */
 	go func() {
 		/* step: set the index to zero for now */
 		wait_index := uint64(0)
-		/* step: look until we hit the kill switch */
 		for {
-			if kill_off {
+			/* step: apply a watch on the key and wait */
+			response, err := r.client.Watch(prefix, wait_index, true, nil, r.stopChannel)
+			/* step: have we been requested to quit */
+			if r.IsClosed() {
 				break
 			}
-			/* step: apply a watch on the key and wait */
-			response, err := r.client.Watch(r.baseKey, wait_index, true, nil, nil)
-			if err != nil {
-				glog.Errorf("Failed to attempting to watch the key: %s, error: %s", r.baseKey, err)
-				time.Sleep(3 * time.Second)
-				wait_index = uint64(0)
+			/* step: the history has been compacted past our index, so the changes since are lost to the watch; we
+			carry on from the current index and have the changes beneath the prefix resynchronized */
+			if cleared, found := err.(*etcd.EtcdError); found && cleared.ErrorCode == ETCD_INDEX_CLEARED {
+				logger.Warningf("The history of the store has been cleared past the index: %d, watching the key: %s from the index: %d and resynchronizing",
+					wait_index, prefix, cleared.Index+1)
+				wait_index = cleared.Index + 1
+				select {
+				case r.channel <- NodeChange{Node: Node{Path: prefix, Directory: true, Index: cleared.Index}, Operation: RESYNC}:
+				case <-r.stopChannel:
+				}
 				continue
 			}
-			/* step: have we been requested to quit */
-			if kill_off {
+			/* note: we retry from the same index, so nothing is missed unless the history is cleared in the meantime */
+			if err != nil {
+				logger.Errorf("Failed to attempting to watch the key: %s, error: %s", prefix, err)
+				select {
+				case <-time.After(3 * time.Second):
+				case <-r.stopChannel:
+				}
 				continue
 			}
 			/* step: update the wait index */
@@ -117,7 +142,7 @@ func (r *EtcdStoreClient) WatchEvents() {
 			/* step: cool - we have a notification - lets check if this key is being watched */
 			go r.ProcessNodeChange(response)
 		}
-		glog.V(VERBOSE_LEVEL).Infof("Exitted the k/v watcher routine, channel: %v", r.channel)
+		logger.V(VERBOSE_LEVEL).Infof("Exitted the k/v watcher routine, channel: %v", r.channel)
 	}()
 }
 
@@ -137,74 +162,143 @@ func (r *EtcdStoreClient) ValidateKey(key string) string {
 	return key
 }
 
-func (r *EtcdStoreClient) Get(key string) (*Node, error) {
+func (r *EtcdStoreClient) Get(ctx context.Context, key string) (*Node, error) {
 	lookup := r.ValidateKey(key)
 	/* step: lets check the cache */
-	if response, err := r.GetRaw(lookup); err != nil {
-		glog.Errorf("Failed to get the key: %s, error: %s", lookup, err)
+	if response, err := r.GetRaw(ctx, lookup); err != nil {
+		logger.Errorf("Failed to get the key: %s, error: %s", lookup, err)
 		return nil, err
 	} else {
 		return r.CreateNode(response.Node), nil
 	}
 }
 
-func (r *EtcdStoreClient) GetRaw(key string) (*etcd.Response, error) {
-	glog.V(VERBOSE_LEVEL).Infof("GetRaw() key: %s", key)
-	response, err := r.client.Get(key, false, true)
+func (r *EtcdStoreClient) GetRaw(ctx context.Context, key string) (*etcd.Response, error) {
+	logger.V(VERBOSE_LEVEL).Infof("GetRaw() key: %s", key)
+	response, err := r.Request(ctx, "GET", key, url.Values{"recursive": {"true"}, "sorted": {"false"}}, nil)
 	if err != nil {
-		glog.Errorf("Failed to get the key: %s, error: %s", key, err)
+		logger.Errorf("Failed to get the key: %s, error: %s", key, err)
 		return nil, err
 	}
 	return response, nil
 }
 
-func (r *EtcdStoreClient) Set(key string, value string) error {
-	glog.V(VERBOSE_LEVEL).Infof("Set() key: %s, value: %s", key, value)
-	_, err := r.client.Set(key, value, uint64(0))
+func (r *EtcdStoreClient) Set(ctx context.Context, key string, value string) error {
+	logger.V(VERBOSE_LEVEL).Infof("Set() key: %s, value: %s", key, MaskValue(key, value))
+	_, err := r.Request(ctx, "PUT", key, nil, EtcdValues(value, 0))
 	if err != nil {
-		glog.Errorf("Failed to set the key: %s, error: %s", key, err)
+		logger.Errorf("Failed to set the key: %s, error: %s", key, err)
 		return err
 	}
 	return nil
 }
 
-func (r *EtcdStoreClient) Delete(key string) error {
-	glog.V(VERBOSE_LEVEL).Infof("Delete() deleting the key: %s", key)
-	if _, err := r.client.Delete(key, false); err != nil {
-		glog.Errorf("Delete() failed to delete key: %s, error: %s", key, err)
+func (r *EtcdStoreClient) Create(ctx context.Context, key string, value string) (*Node, error) {
+	logger.V(VERBOSE_LEVEL).Infof("Create() key: %s, value: %s", key, MaskValue(key, value))
+	response, err := r.Request(ctx, "PUT", key, url.Values{"prevExist": {"false"}}, EtcdValues(value, 0))
+	if err != nil {
+		logger.Errorf("Failed to create the key: %s, error: %s", key, err)
+		return nil, err
+	}
+	return r.CreateNode(response.Node), nil
+}
+
+func (r *EtcdStoreClient) CompareAndSwap(ctx context.Context, key string, value string, index uint64) (*Node, error) {
+	logger.V(VERBOSE_LEVEL).Infof("CompareAndSwap() key: %s, index: %d, value: %s", key, index, MaskValue(key, value))
+	response, err := r.Swap(ctx, key, value, 0, index)
+	if err != nil {
+		logger.Errorf("Failed to compare and swap the key: %s, index: %d, error: %s", key, index, err)
+		return nil, err
+	}
+	return r.CreateNode(response.Node), nil
+}
+
+func (r *EtcdStoreClient) CreateLease(ctx context.Context, key string, value string, ttl time.Duration) (*Node, error) {
+	logger.V(VERBOSE_LEVEL).Infof("CreateLease() key: %s, ttl: %s, value: %s", key, ttl, MaskValue(key, value))
+	response, err := r.Request(ctx, "PUT", key, url.Values{"prevExist": {"false"}}, EtcdValues(value, TTLSeconds(ttl)))
+	if err != nil {
+		logger.V(VERBOSE_LEVEL).Infof("Failed to create the lease on key: %s, error: %s", key, err)
+		return nil, err
+	}
+	return r.CreateNode(response.Node), nil
+}
+
+func (r *EtcdStoreClient) RenewLease(ctx context.Context, key string, value string, ttl time.Duration, index uint64) (*Node, error) {
+	logger.V(VERBOSE_LEVEL).Infof("RenewLease() key: %s, ttl: %s, index: %d", key, ttl, index)
+	response, err := r.Swap(ctx, key, value, TTLSeconds(ttl), index)
+	if err != nil {
+		logger.Errorf("Failed to renew the lease on key: %s, index: %d, error: %s", key, index, err)
+		return nil, err
+	}
+	return r.CreateNode(response.Node), nil
+}
+
+/* Sets the key, failing unless it was last modified at the index */
+func (r *EtcdStoreClient) Swap(ctx context.Context, key string, value string, ttl uint64, index uint64) (*etcd.Response, error) {
+	if index == 0 {
+		return nil, fmt.Errorf("You must give either prevValue or prevIndex.")
+	}
+	return r.Request(ctx, "PUT", key, url.Values{"prevIndex": {fmt.Sprintf("%d", index)}}, EtcdValues(value, ttl))
+}
+
+func (r *EtcdStoreClient) CompareAndDelete(ctx context.Context, key string, index uint64) error {
+	logger.V(VERBOSE_LEVEL).Infof("CompareAndDelete() key: %s, index: %d", key, index)
+	if index == 0 {
+		return fmt.Errorf("You must give either prevValue or prevIndex.")
+	}
+	if _, err := r.Request(ctx, "DELETE", key, url.Values{"prevIndex": {fmt.Sprintf("%d", index)}}, nil); err != nil {
+		logger.Errorf("Failed to delete the key: %s, index: %d, error: %s", key, index, err)
+		return err
+	}
+	return nil
+}
+
+/* The ttl in whole seconds, as etcd expects; rounded up, with a minimum of a second */
+func TTLSeconds(ttl time.Duration) uint64 {
+	seconds := uint64((ttl + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+func (r *EtcdStoreClient) Delete(ctx context.Context, key string) error {
+	logger.V(VERBOSE_LEVEL).Infof("Delete() deleting the key: %s", key)
+	if _, err := r.Request(ctx, "DELETE", key, url.Values{"recursive": {"false"}, "dir": {"false"}}, nil); err != nil {
+		logger.Errorf("Delete() failed to delete key: %s, error: %s", key, err)
 		return err
 	}
 	return nil
 }
 
-func (r *EtcdStoreClient) RemovePath(path string) error {
-	glog.V(VERBOSE_LEVEL).Infof("RemovePath() deleting the path: %s", path)
-	if _, err := r.client.Delete(path, true); err != nil {
-		glog.Errorf("RemovePath() failed to delete key: %s, error: %s", path, err)
+func (r *EtcdStoreClient) RemovePath(ctx context.Context, path string) error {
+	logger.V(VERBOSE_LEVEL).Infof("RemovePath() deleting the path: %s", path)
+	if _, err := r.Request(ctx, "DELETE", path, url.Values{"recursive": {"true"}, "dir": {"false"}}, nil); err != nil {
+		logger.Errorf("RemovePath() failed to delete key: %s, error: %s", path, err)
 		return err
 	}
 	return nil
 }
 
-func (r *EtcdStoreClient) Mkdir(path string) error {
-	glog.V(VERBOSE_LEVEL).Infof("Mkdir() path: %s", path)
-	if _, err := r.client.CreateDir(path, uint64(0)); err != nil {
-		glog.Errorf("Mkdir() failed to create directory node: %s, error: %s", path, err)
+func (r *EtcdStoreClient) Mkdir(ctx context.Context, path string) error {
+	logger.V(VERBOSE_LEVEL).Infof("Mkdir() path: %s", path)
+	if _, err := r.Request(ctx, "PUT", path, url.Values{"prevExist": {"false"}, "dir": {"true"}}, EtcdValues("", 0)); err != nil {
+		logger.Errorf("Mkdir() failed to create directory node: %s, error: %s", path, err)
 		return err
 	}
 	return nil
 }
 
-func (r *EtcdStoreClient) List(path string) ([]*Node, error) {
+func (r *EtcdStoreClient) List(ctx context.Context, path string) ([]*Node, error) {
 	key := r.ValidateKey(path)
-	glog.V(VERBOSE_LEVEL).Infof("List() path: %s", key)
-	if response, err := r.GetRaw(path); err != nil {
-		glog.Errorf("List() failed to get path: %s, error: %s", key, err)
+	logger.V(VERBOSE_LEVEL).Infof("List() path: %s", key)
+	if response, err := r.GetRaw(ctx, path); err != nil {
+		logger.Errorf("List() failed to get path: %s, error: %s", key, err)
 		return nil, err
 	} else {
 		list := make([]*Node, 0)
 		if response.Node.Dir == false {
-			glog.Errorf("List() path: %s is not a directory node", key)
+			logger.Errorf("List() path: %s is not a directory node", key)
 			return nil, InvalidDirectoryErr
 		}
 		for _, item := range response.Node.Nodes {
@@ -214,30 +308,149 @@ func (r *EtcdStoreClient) List(path string) ([]*Node, error) {
 	}
 }
 
-func (e *EtcdStoreClient) Paths(path string, paths *[]string) ([]string, error) {
-	response, err := e.client.Get(path, false, true)
+func (e *EtcdStoreClient) Paths(ctx context.Context, path string, paths *[]string) ([]string, error) {
+	response, err := e.GetRaw(ctx, path)
 	if err != nil {
 		return nil, errors.New("Unable to complete walking the tree" + err.Error())
 	}
 	for _, node := range response.Node.Nodes {
 		if node.Dir {
-			e.Paths(node.Key, paths)
+			e.Paths(ctx, node.Key, paths)
 		} else {
-			glog.Infof("Found service container: %s appending now", node.Key)
+			logger.Infof("Found service container: %s appending now", node.Key)
 			*paths = append(*paths, node.Key)
 		}
 	}
 	return *paths, nil
 }
 
+func (r *EtcdStoreClient) Index(ctx context.Context) (uint64, error) {
+	response, err := r.Request(ctx, "GET", "/", url.Values{"recursive": {"false"}, "sorted": {"false"}}, nil)
+	if err != nil {
+		logger.Errorf("Failed to get the index of the store, error: %s", err)
+		return 0, err
+	}
+	return response.EtcdIndex, nil
+}
+
+/*
+	Replays the changes since the index from the history of the store, a watch on the root being answered
+	immediately with the next change in the history; the changes beneath the path are returned, in order. A
+	change which doesn't come back promptly (i.e. the changes left are to hidden keys) gives up on the replay
+*/
+func (r *EtcdStoreClient) Changes(ctx context.Context, path string, since uint64) ([]NodeChange, uint64, error) {
+	prefix := r.ValidateKey(path)
+	current, err := r.Index(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if current-since > MAX_CHANGES {
+		return nil, 0, ChangesUnavailableErr
+	}
+	changes := make([]NodeChange, 0)
+	for wait_index := since + 1; wait_index <= current; {
+		timeout, cancel := context.WithTimeout(ctx, CHANGES_TIMEOUT)
+		stop, release := CancelChannel(timeout)
+		response, err := r.client.Watch("/", wait_index, true, nil, stop)
+		release()
+		cancel()
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		} else if cleared, found := err.(*etcd.EtcdError); found && cleared.ErrorCode == ETCD_INDEX_CLEARED {
+			return nil, 0, ChangesUnavailableErr
+		} else if err == etcd.ErrWatchStoppedByUser {
+			return nil, 0, ChangesUnavailableErr
+		} else if err != nil {
+			logger.Errorf("Failed to get the changes since the index: %d, error: %s", since, err)
+			return nil, 0, err
+		}
+		if response.Node.ModifiedIndex > current {
+			break
+		}
+		wait_index = response.Node.ModifiedIndex + 1
+		if key := response.Node.Key; prefix == "/" || key == prefix || strings.HasPrefix(key, prefix+"/") {
+			changes = append(changes, r.CreateNodeChange(response))
+		}
+	}
+	return changes, current, nil
+}
+
+/*
+	Sends the request for the key to etcd, the request being cancelled along with the context; the error of the
+	context is returned should it be done before the request completes
+*/
+func (r *EtcdStoreClient) Request(ctx context.Context, method, key string, options, values url.Values) (*etcd.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	relative := EtcdPath(key)
+	if len(options) > 0 {
+		relative += "?" + options.Encode()
+	}
+	cancel, release := CancelChannel(ctx)
+	defer release()
+	raw, err := r.client.SendRequest(etcd.NewRawRequest(method, relative, values, cancel))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return raw.Unmarshal()
+}
+
+/* Checks if the error is that of a key not in the store, rather than a failure to reach or read it */
+func IsKeyNotFound(err error) bool {
+	missing, found := err.(*etcd.EtcdError)
+	return found && missing.ErrorCode == ETCD_KEY_NOT_FOUND
+}
+
+/* The path of the key in the etcd api, url escaped (bar the slashes) */
+func EtcdPath(key string) string {
+	relative := strings.Replace(url.QueryEscape(path.Join("keys", key)), "%2F", "/", -1)
+	if relative == "keys" {
+		relative = "keys/"
+	}
+	return relative
+}
+
+/* The form values of a write, the value and ttl (if any) */
+func EtcdValues(value string, ttl uint64) url.Values {
+	values := url.Values{}
+	if value != "" {
+		values.Set("value", value)
+	}
+	if ttl > 0 {
+		values.Set("ttl", fmt.Sprintf("%d", ttl))
+	}
+	return values
+}
+
+/* A channel closed once the context is done, as the etcd client expects; the release stops watching the context */
+func CancelChannel(ctx context.Context) (chan bool, func()) {
+	if ctx.Done() == nil {
+		return nil, func() {}
+	}
+	cancel := make(chan bool)
+	released := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(cancel)
+		case <-released:
+		}
+	}()
+	return cancel, func() { close(released) }
+}
+
 func (r *EtcdStoreClient) Watch(key string) {
 	r.Lock()
 	defer r.Unlock()
 	/* step: we check if the key is being watched and if not add it */
 	if _, found := r.watchedKeys[key]; found {
-		glog.V(VERBOSE_LEVEL).Infof("Thy key: %s is already being wathed, skipping for now", key)
+		logger.V(VERBOSE_LEVEL).Infof("Thy key: %s is already being wathed, skipping for now", key)
 	} else {
-		glog.V(VERBOSE_LEVEL).Infof("Adding a watch on the key: %s", key)
+		logger.V(VERBOSE_LEVEL).Infof("Adding a watch on the key: %s", key)
 		r.watchedKeys[key] = true
 	}
 }
@@ -251,32 +464,38 @@ func (r *EtcdStoreClient) ProcessNodeChange(response *etcd.Response) {
 	defer r.RUnlock()
 	/* step: iterate the list and find out if our key is being watched */
 	path := response.Node.Key
-	glog.V(VERBOSE_LEVEL).Infof("Checking if key: %s is being watched", path)
+	logger.V(VERBOSE_LEVEL).Infof("Checking if key: %s is being watched", path)
 	for watch_key, _ := range r.watchedKeys {
 		if strings.HasPrefix(path, watch_key) {
-			glog.V(VERBOSE_LEVEL).Infof("Sending notification of change on key: %s, channel: %v, event: %v", path, r.channel, response)
-			/* step: we create an event and send upstream */
-			var event NodeChange
-			event.Node.Path = response.Node.Key
-			event.Node.Value = response.Node.Value
-			event.Node.Directory = response.Node.Dir
-			switch response.Action {
-			case "set":
-				event.Operation = CHANGED
-			case "delete":
-				event.Operation = DELETED
-			}
-			/* step: send the event upstream via the channel */
-			r.channel <- event
+			logger.V(VERBOSE_LEVEL).Infof("Sending notification of change on key: %s, channel: %v, event: %v", path, r.channel, response)
+			/* step: we create an event and send upstream via the channel */
+			r.channel <- r.CreateNodeChange(response)
 			return
 		}
 	}
-	glog.V(VERBOSE_LEVEL).Infof("The key: %s is presently not being watched, we can ignore for now", path )
+	logger.V(VERBOSE_LEVEL).Infof("The key: %s is presently not being watched, we can ignore for now", path )
+}
+
+/* Create the event of the change from the response of a watch */
+func (r *EtcdStoreClient) CreateNodeChange(response *etcd.Response) NodeChange {
+	var event NodeChange
+	event.Node.Path = response.Node.Key
+	event.Node.Value = response.Node.Value
+	event.Node.Directory = response.Node.Dir
+	event.Node.Index = response.Node.ModifiedIndex
+	switch response.Action {
+	case "set", "create", "update", "compareAndSwap":
+		event.Operation = CHANGED
+	case "delete", "expire", "compareAndDelete":
+		event.Operation = DELETED
+	}
+	return event
 }
 
 func (r *EtcdStoreClient) CreateNode(response *etcd.Node) *Node {
 	node := &Node{}
 	node.Path = response.Key
+	node.Index = response.ModifiedIndex
 	if response.Dir == false {
 		node.Directory = false
 		node.Value = response.Value
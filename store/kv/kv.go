@@ -14,11 +14,13 @@ limitations under the License.
 package kv
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"net/url"
+	"time"
 
-	"github.com/golang/glog"
+	"github.com/gambol99/config-fs/store/logging"
 )
 
 const (
@@ -27,54 +29,157 @@ const (
 )
 
 var (
-	kv_store_url        *string
 	InvalidUrlErr       = errors.New("Invalid URI error, please check backend url")
 	InvalidDirectoryErr = errors.New("Invalid directory specified")
+	/* the changes since the index can't be had from the history of the store, a full listing is required */
+	ChangesUnavailableErr = errors.New("The changes since the index are no longer available from the history of the store")
 )
 
-func init() {
-	kv_store_url = flag.String("store", DEFAULT_KV_STORE, "the url for key / value store")
+/* the log of the k/v agents */
+var logger = logging.For(logging.SUBSYSTEM_KV)
+
+/* The configuration of a k/v agent, the defaults given by DefaultConfig */
+type Config struct {
+	/* the url of the store, i.e. etcd://host:port[,host:port] */
+	url string
+	/* the prefixes of the keys watched for changes, the whole store if none */
+	watch_prefixes WatchPrefixes
+	/* the patterns of the keys whose values are masked in the logs */
+	mask_keys string
+}
+
+/* An option applied to the configuration of the agent */
+type Option func(*Config) error
+
+/* The default configuration of an agent */
+func DefaultConfig() Config {
+	return Config{url: DEFAULT_KV_STORE}
+}
+
+/* Binds the configuration to the flags, the current values being the defaults; the caller parses them */
+func RegisterFlags(flags *flag.FlagSet, config *Config) {
+	flags.StringVar(&config.url, "store", config.url, "the url for key / value store")
+	flags.Var(&config.watch_prefixes, "watch_prefix", "a prefix of the keys watched for changes (defaults to the whole store), can be given multiple times or comma separated, must cover the keys materialized and referenced by the templates")
+	flags.StringVar(&config.mask_keys, "mask_keys", config.mask_keys, "a comma separated list of key patterns whose values are masked in the logs, i.e. *password*,/secrets/*")
+}
+
+/* Applies the options to the configuration, in order */
+func (r *Config) Apply(options ...Option) error {
+	for _, option := range options {
+		if err := option(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* The url of the store, i.e. etcd://localhost:4001 */
+func WithURL(location string) Option {
+	return func(config *Config) error {
+		if _, err := url.Parse(location); err != nil {
+			return InvalidUrlErr
+		}
+		config.url = location
+		return nil
+	}
+}
+
+/* Adds the prefixes of the keys watched for changes, by default the whole store is watched */
+func WithWatchPrefixes(prefixes ...string) Option {
+	return func(config *Config) error {
+		for _, prefix := range prefixes {
+			if err := config.watch_prefixes.Set(prefix); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+/* The comma separated patterns of the keys whose values are masked in the logs */
+func WithMaskKeys(patterns string) Option {
+	return func(config *Config) error {
+		config.mask_keys = patterns
+		return nil
+	}
+}
+
+/* Sets any of the configuration by the name of its flag, i.e. WithSetting("store", "etcd://10.0.0.1:4001") */
+func WithSetting(name, value string) Option {
+	return func(config *Config) error {
+		flags := flag.NewFlagSet(name, flag.ContinueOnError)
+		RegisterFlags(flags, config)
+		return flags.Set(name, value)
+	}
 }
 
+/*
+	The operations against the store are given a context, the request being cancelled along with it, i.e. on a
+	timeout imposed by the caller or a shutdown
+*/
 type KVStore interface {
 	/* get the url for the kv store */
 	URL() string
 	/* retrieve a key from the store */
-	Get(key string) (*Node, error)
+	Get(ctx context.Context, key string) (*Node, error)
 	/* List all the keys under a path */
-	Paths(path string, paths *[]string) ([]string, error)
+	Paths(ctx context.Context, path string, paths *[]string) ([]string, error)
 	/* Get a list of all the nodes under the path */
-	List(path string) ([]*Node, error)
+	List(ctx context.Context, path string) ([]*Node, error)
 	/* set a key in the store */
-	Set(key string, value string) error
+	Set(ctx context.Context, key string, value string) error
+	/* create a key, failing if it already exists */
+	Create(ctx context.Context, key string, value string) (*Node, error)
+	/* set a key, failing unless it was last modified at the index */
+	CompareAndSwap(ctx context.Context, key string, value string, index uint64) (*Node, error)
+	/* create a key which expires after the ttl unless renewed, failing if it already exists */
+	CreateLease(ctx context.Context, key string, value string, ttl time.Duration) (*Node, error)
+	/* renew the ttl of a key, failing unless it was last modified at the index */
+	RenewLease(ctx context.Context, key string, value string, ttl time.Duration, index uint64) (*Node, error)
+	/* delete a key, failing unless it was last modified at the index */
+	CompareAndDelete(ctx context.Context, key string, index uint64) error
 	/* delete a key from the store */
-	Delete(key string) error
+	Delete(ctx context.Context, key string) error
 	/* recursively delete a path */
-	RemovePath(path string) error
+	RemovePath(ctx context.Context, path string) error
 	/* Create a directory node */
-	Mkdir(path string) error
+	Mkdir(ctx context.Context, path string) error
+	/* retrieve the current index of the store */
+	Index(ctx context.Context) (uint64, error)
+	/* the changes beneath the path since the index, in order, and the index of the store they're current to */
+	Changes(ctx context.Context, path string, since uint64) ([]NodeChange, uint64, error)
 	/* watch for changes on the key */
 	Watch(key string)
 	/* release all the resources */
 	Close()
 }
 
-func NewKVStore(channel NodeUpdateChannel) (KVStore, error) {
-	glog.Infof("Creating a new kv provider: %s", *kv_store_url)
-	if uri, err := url.Parse(*kv_store_url); err != nil {
-		glog.Errorf("Failed to parse the url: %s, error: %s", *kv_store_url, err)
+/*
+	Create an agent for the store from the configuration, the options applied over it; the events of the keys
+	watched are sent to the channel. Note, the masking of the values in the logs applies to the whole process
+*/
+func New(config Config, channel NodeUpdateChannel, options ...Option) (KVStore, error) {
+	if err := config.Apply(options...); err != nil {
+		return nil, err
+	}
+	logger.Infof("Creating a new kv provider: %s", config.url)
+	if config.mask_keys != "" {
+		MaskKeys(config.mask_keys)
+	}
+	if uri, err := url.Parse(config.url); err != nil {
+		logger.Errorf("Failed to parse the url: %s, error: %s", config.url, err)
 		return nil, err
 	} else {
 		switch uri.Scheme {
 		case "etcd":
-			if agent, err := NewEtcdStoreClient(uri, channel); err != nil {
-				glog.Errorf("Failed to create the K/V provider: %s, error: %s", *kv_store_url, err)
+			if agent, err := NewEtcdStoreClient(uri, config.watch_prefixes, channel); err != nil {
+				logger.Errorf("Failed to create the K/V provider: %s, error: %s", config.url, err)
 				return nil, err
 			} else {
 				return agent, nil
 			}
 		default:
-			return nil, errors.New("Unsupported key/value store: " + *kv_store_url)
+			return nil, errors.New("Unsupported key/value store: " + config.url)
 		}
 	}
 }
@@ -0,0 +1,70 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kv
+
+import (
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+const MASKED_VALUE = "****"
+
+/* the comma separated patterns of the keys masked, shared by the agents as the logging is */
+var mask_keys atomic.Value
+
+/* Sets the patterns of the keys whose values are masked in the logs, i.e. *password*,/secrets/* */
+func MaskKeys(patterns string) {
+	mask_keys.Store(patterns)
+}
+
+/*
+	Masks the value of the key if it matches any of the deny-list patterns. The patterns
+	are matched against the key, each of its trailing path segments and its base name,
+	so /secrets/* will match both the key /secrets/db and the file /config/secrets/db
+*/
+func MaskValue(key, value string) string {
+	if IsMasked(key) {
+		return MASKED_VALUE
+	}
+	return value
+}
+
+/* check if the key matches any of the mask patterns */
+func IsMasked(key string) bool {
+	patterns, _ := mask_keys.Load().(string)
+	if patterns == "" {
+		return false
+	}
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if matched, _ := path.Match(pattern, path.Base(key)); matched {
+			return true
+		}
+		for suffix := key; suffix != ""; {
+			if matched, _ := path.Match(pattern, suffix); matched {
+				return true
+			}
+			index := strings.Index(suffix[1:], "/")
+			if index < 0 {
+				break
+			}
+			suffix = suffix[index+1:]
+		}
+	}
+	return false
+}
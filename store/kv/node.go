@@ -23,6 +23,8 @@ const (
 	UNKNOWN = 0
 	CHANGED = 1
 	DELETED = 2
+	/* the watch lost its place in the history of the store, the changes beneath the path need resynchronizing */
+	RESYNC = 3
 )
 
 type NodeChange struct {
@@ -41,10 +43,12 @@ type Node struct {
 	Value string
 	/* the type of node it is, directory or file */
 	Directory bool
+	/* the index of the store revision the node was last modified in */
+	Index uint64
 }
 
 func (n Node) String() string {
-	return fmt.Sprintf("path: %s, value: %s, type: %s", n.Path, n.Value, n.Directory)
+	return fmt.Sprintf("path: %s, value: %s, directory: %t, index: %d", n.Path, MaskValue(n.Path, n.Value), n.Directory, n.Index)
 }
 
 func (n Node) IsDir() bool {
@@ -0,0 +1,70 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kv
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+var InvalidPrefixErr = errors.New("Invalid watch prefix, must be an absolute key, i.e. /prod/app")
+
+/* the prefixes of the keys watched, a flag value which can be given multiple times */
+type WatchPrefixes []string
+
+func (r *WatchPrefixes) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *WatchPrefixes) Set(value string) error {
+	for _, prefix := range strings.Split(value, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix == "" {
+			continue
+		}
+		if !strings.HasPrefix(prefix, "/") {
+			return InvalidPrefixErr
+		}
+		*r = append(*r, path.Clean(prefix))
+	}
+	return nil
+}
+
+/*
+	The keys the watches are placed on; a prefix beneath another is dropped, as the events would
+	otherwise be received twice, and with no prefixes given we watch the whole store
+*/
+func (r WatchPrefixes) Roots() []string {
+	roots := make([]string, 0)
+	for _, prefix := range r {
+		covered := false
+		for _, other := range r {
+			if other != prefix && (other == "/" || strings.HasPrefix(prefix, other+"/")) {
+				covered = true
+			}
+		}
+		for _, root := range roots {
+			if root == prefix {
+				covered = true
+			}
+		}
+		if !covered {
+			roots = append(roots, prefix)
+		}
+	}
+	if len(roots) <= 0 {
+		return []string{"/"}
+	}
+	return roots
+}
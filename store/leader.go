@@ -0,0 +1,198 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gambol99/config-fs/store/kv"
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+var InvalidLeaderTTLErr = errors.New("The ttl of the leader key must be at least a second")
+
+/*
+	The election of a single writer amongst the instances sharing a mount point (i.e. on a network filesystem); the
+	instance holding the leader key writes, the key being created with a ttl and renewed at a third of it, while the
+	others stand by, attempting to create the key at the same interval so one of them takes over once it expires
+	(or is released on shutdown). Should the renewals fail, the leader steps down two thirds of the ttl after the
+	last successful renewal was sent, so it has stopped writing a third of the ttl before the key could expire and
+	a standby take over
+*/
+type LeaderElection struct {
+	sync.Mutex
+	/* the k/v store holding the key */
+	kv kv.KVStore
+	/* the key held by the leader */
+	key string
+	/* the identity of this instance, the value of the key */
+	identity string
+	/* the ttl of the key */
+	ttl time.Duration
+	/* the index of the key when last created or renewed by us */
+	index uint64
+	/* the time the request which last created or renewed the key was sent, the key can't expire before the ttl from it */
+	renewed time.Time
+	/* we hold the key */
+	leading bool
+}
+
+/* Create the election on the key, the instance identified by the hostname and process id */
+func NewLeaderElection(store kv.KVStore, key string, ttl time.Duration) *LeaderElection {
+	hostname, _ := os.Hostname()
+	return &LeaderElection{
+		kv:       store,
+		key:      key,
+		identity: fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+		ttl:      ttl,
+	}
+}
+
+/* Checks if we hold the leader key */
+func (r *LeaderElection) IsLeader() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.leading
+}
+
+/* Attempt to create or renew the key until the context is cancelled, calling the handler whenever the leadership changes */
+func (r *LeaderElection) Run(ctx context.Context, changed func(leading bool)) {
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+	for {
+		leading := r.Campaign(ctx)
+		if leading != r.IsLeader() {
+			r.Lock()
+			r.leading = leading
+			r.Unlock()
+			if leading {
+				logger.Infof("Elected as the leader: %s, holding the key: %s", r.identity, r.key)
+				metrics.Set(metrics.LEADER, 1)
+			} else {
+				logger.Warningf("Lost the leadership of the key: %s, standing by", r.key)
+				metrics.Set(metrics.LEADER, 0)
+			}
+			metrics.Increment(metrics.LEADER_CHANGES)
+			changed(leading)
+		}
+		/* step: whatever the ticker, the leadership is given up by the deadline unless renewed */
+		var expired <-chan time.Time
+		if leading {
+			expired = time.After(time.Until(r.Deadline()))
+		}
+		select {
+		case <-ticker.C:
+		case <-expired:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/* Create the key, or renew it if we hold it, returning if we are the leader */
+func (r *LeaderElection) Campaign(ctx context.Context) bool {
+	r.Lock()
+	leading, index := r.leading, r.index
+	r.Unlock()
+	sent := time.Now()
+	if leading {
+		/* note: a renewal answered past the deadline is of no use, we'll have stepped down */
+		deadline := r.Deadline()
+		renewal, cancel := context.WithDeadline(ctx, deadline)
+		defer cancel()
+		node, err := r.kv.RenewLease(renewal, r.key, r.identity, r.ttl, index)
+		if err == nil {
+			r.Renewed(node, sent)
+			return true
+		}
+		/* step: the key was taken or deleted, else we hold on until the deadline */
+		if current, err := r.kv.Get(renewal, r.key); err == nil && current.Value != r.identity {
+			logger.Warningf("The leader key: %s is now held by: %s", r.key, current.Value)
+			return false
+		}
+		if time.Now().Before(deadline) {
+			return true
+		}
+		logger.Warningf("Failed to renew the leader key: %s within %s of the last renewal, stepping down", r.key, r.ttl*2/3)
+		return false
+	}
+	node, err := r.kv.CreateLease(ctx, r.key, r.identity, r.ttl)
+	if err != nil {
+		logger.V(VERBOSE_LEVEL).Infof("The leader key: %s is held by another instance, standing by", r.key)
+		return false
+	}
+	r.Renewed(node, sent)
+	return true
+}
+
+/* Record the creation or renewal of the key, by the request sent at the time given */
+func (r *LeaderElection) Renewed(node *kv.Node, sent time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	r.index, r.renewed = node.Index, sent
+}
+
+/* The time the leadership is given up by unless renewed, two thirds of the ttl after the last renewal was sent */
+func (r *LeaderElection) Deadline() time.Time {
+	r.Lock()
+	defer r.Unlock()
+	return r.renewed.Add(r.ttl * 2 / 3)
+}
+
+/* Release the key if we hold it, so a standby takes over without waiting on the ttl */
+func (r *LeaderElection) Release() {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if !r.leading {
+		return
+	}
+	logger.Infof("Releasing the leader key: %s", r.key)
+	/* note: there's no waiting on the store past the ttl, the key would have expired by then */
+	ctx, cancel := context.WithTimeout(context.Background(), r.ttl)
+	defer cancel()
+	if err := r.kv.CompareAndDelete(ctx, r.key, r.index); err != nil {
+		logger.Errorf("Failed to release the leader key: %s, error: %s", r.key, err)
+	}
+	r.leading = false
+	metrics.Set(metrics.LEADER, 0)
+}
+
+/*
+	Stand by until elected the leader, returning false if the context is cancelled first; once elected, a loss
+	of the leadership pauses the synchronization, until elected again
+*/
+func (r *ConfigurationStore) AwaitLeadership(ctx context.Context) bool {
+	elected := make(chan struct{})
+	var once sync.Once
+	go r.election.Run(ctx, func(leading bool) {
+		if leading {
+			once.Do(func() { close(elected) })
+		}
+		r.SetPaused(PAUSE_LEADER, !leading)
+	})
+	select {
+	case <-elected:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
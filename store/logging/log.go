@@ -0,0 +1,180 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+/* The log of a subsystem, i.e. var logger = logging.For(logging.SUBSYSTEM_KV) */
+type Log struct {
+	/* the subsystem logging */
+	subsystem string
+	/* the fields added to every message */
+	fields map[string]interface{}
+}
+
+/* Create the log of the subsystem */
+func For(subsystem string) *Log {
+	return &Log{subsystem: subsystem, fields: make(map[string]interface{}, 0)}
+}
+
+/* A copy of the log adding the fields (key, value pairs) to every message, i.e. With("mount", "/config") */
+func (r *Log) With(fields ...interface{}) *Log {
+	log := For(r.subsystem)
+	for key, value := range r.fields {
+		log.fields[key] = value
+	}
+	for key, value := range Fields(fields...) {
+		log.fields[key] = value
+	}
+	return log
+}
+
+/* Checks if the messages of the severity and verbosity are logged, per the level of the subsystem or -v */
+func (r *Log) Enabled(severity Severity, verbosity int) bool {
+	current.RLock()
+	level, found := current.levels[r.subsystem]
+	current.RUnlock()
+	if !found {
+		/* note: the -vmodule isn't consulted, as the caller of glog would be ourselves */
+		return severity > INFO || verbosity <= 0 || bool(glog.V(glog.Level(verbosity)))
+	}
+	switch severity {
+	case INFO:
+		return level >= verbosity
+	case WARNING:
+		return level >= LevelNames["warning"]
+	}
+	return true
+}
+
+/* The messages of the verbosity, logged only if the subsystem is as verbose */
+func (r *Log) V(verbosity int) Verbose {
+	return Verbose{log: r, verbosity: verbosity, enabled: r.Enabled(INFO, verbosity)}
+}
+
+func (r *Log) Infof(format string, args ...interface{}) {
+	r.emit(INFO, 0, fmt.Sprintf(format, args...), nil)
+}
+
+func (r *Log) Warningf(format string, args ...interface{}) {
+	r.emit(WARNING, 0, fmt.Sprintf(format, args...), nil)
+}
+
+func (r *Log) Errorf(format string, args ...interface{}) {
+	r.emit(ERROR, 0, fmt.Sprintf(format, args...), nil)
+}
+
+/* Log the message and exit */
+func (r *Log) Fatalf(format string, args ...interface{}) {
+	r.emit(FATAL, 0, fmt.Sprintf(format, args...), nil)
+}
+
+/* Log the message along with the fields (key, value pairs), i.e. Info("applied the key", "key", path) */
+func (r *Log) Info(message string, fields ...interface{}) {
+	r.emit(INFO, 0, message, fields)
+}
+
+func (r *Log) Warning(message string, fields ...interface{}) {
+	r.emit(WARNING, 0, message, fields)
+}
+
+func (r *Log) Error(message string, fields ...interface{}) {
+	r.emit(ERROR, 0, message, fields)
+}
+
+/* Flush the messages buffered by the logger */
+func (r *Log) Flush() {
+	Flush()
+}
+
+/* note: each of the methods logging calls this directly, so the caller is always two frames up */
+func (r *Log) emit(severity Severity, verbosity int, message string, fields []interface{}) {
+	if !r.Enabled(severity, verbosity) {
+		return
+	}
+	entry := Entry{
+		Time:      time.Now(),
+		Severity:  severity,
+		Verbosity: verbosity,
+		Subsystem: r.subsystem,
+		Message:   message,
+		Fields:    r.fields,
+	}
+	if len(fields) > 0 {
+		entry.Fields = make(map[string]interface{}, len(r.fields)+len(fields)/2)
+		for key, value := range r.fields {
+			entry.Fields[key] = value
+		}
+		for key, value := range Fields(fields...) {
+			entry.Fields[key] = value
+		}
+	}
+	if _, file, line, found := runtime.Caller(2); found {
+		entry.Caller = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+	current.RLock()
+	logger := current.logger
+	current.RUnlock()
+	logger.Log(entry)
+	if severity == FATAL {
+		logger.Flush()
+		os.Exit(255)
+	}
+}
+
+/* The messages of a verbosity, i.e. logger.V(VERBOSE_LEVEL).Infof("...") */
+type Verbose struct {
+	log       *Log
+	verbosity int
+	enabled   bool
+}
+
+func (r Verbose) Infof(format string, args ...interface{}) {
+	if r.enabled {
+		r.log.emit(INFO, r.verbosity, fmt.Sprintf(format, args...), nil)
+	}
+}
+
+func (r Verbose) Info(message string, fields ...interface{}) {
+	if r.enabled {
+		r.log.emit(INFO, r.verbosity, message, fields)
+	}
+}
+
+/* The fields of the key, value pairs; a key without a value is given an empty one */
+func Fields(pairs ...interface{}) map[string]interface{} {
+	fields := make(map[string]interface{}, len(pairs)/2)
+	for index := 0; index < len(pairs); index += 2 {
+		key := fmt.Sprint(pairs[index])
+		if index+1 >= len(pairs) {
+			fields[key] = ""
+			continue
+		}
+		value := pairs[index+1]
+		/* note: an error would otherwise be encoded as an empty object */
+		if err, found := value.(error); found {
+			value = err.Error()
+		}
+		fields[key] = value
+	}
+	return fields
+}
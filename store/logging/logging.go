@@ -0,0 +1,261 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	The messages of each subsystem (the store, the k/v agent, the file store, the templates, the discovery and the metrics)
+	are logged via a Logger; by default glog, as text, or with -log_format=json a JSON document per line on the stderr,
+	carrying the subsystem, the severity and any fields, so they can be shipped and queried as is. The verbosity
+	of each subsystem can be set on its own (-log_level=kv=6), otherwise it's that of -v, and code embedding the
+	store can inject a Logger of its own
+*/
+const (
+	/* the subsystems */
+	SUBSYSTEM_MAIN      = "main"
+	SUBSYSTEM_STORE     = "store"
+	SUBSYSTEM_KV        = "kv"
+	SUBSYSTEM_FS        = "fs"
+	SUBSYSTEM_DYNAMIC   = "dynamic"
+	SUBSYSTEM_DISCOVERY = "discovery"
+	SUBSYSTEM_METRICS   = "metrics"
+	/* the formats of the logs */
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+)
+
+var (
+	InvalidFormatErr = errors.New("Invalid log format, must be either text or json")
+	InvalidLevelErr  = errors.New("Invalid log level, must be SUBSYSTEM=LEVEL, the level being error, warning, info or a verbosity, i.e. kv=6")
+)
+
+/* the severity of a message, the verbosity of an info message being given by V */
+type Severity int
+
+const (
+	INFO Severity = iota
+	WARNING
+	ERROR
+	FATAL
+)
+
+/* The name of the severity, an info message with a verbosity being a debug message */
+func (r Severity) Name(verbosity int) string {
+	switch r {
+	case WARNING:
+		return "warning"
+	case ERROR:
+		return "error"
+	case FATAL:
+		return "fatal"
+	}
+	if verbosity > 0 {
+		return "debug"
+	}
+	return "info"
+}
+
+/* A message of the log */
+type Entry struct {
+	/* when the message was logged */
+	Time time.Time
+	/* the severity, and the verbosity of an info message */
+	Severity  Severity
+	Verbosity int
+	/* the subsystem logging the message */
+	Subsystem string
+	/* the message */
+	Message string
+	/* the fields of the message, if any */
+	Fields map[string]interface{}
+	/* the file and line the message was logged from */
+	Caller string
+}
+
+/* The interface to a logger, the sink of the messages of every subsystem */
+type Logger interface {
+	/* log the message; a fatal message is flushed and the process exits once logged */
+	Log(entry Entry)
+	/* flush any messages buffered */
+	Flush()
+}
+
+/* the logger and the verbosity of the subsystems */
+var current = struct {
+	sync.RWMutex
+	logger Logger
+	levels Levels
+}{logger: NewGlogLogger(), levels: make(Levels, 0)}
+
+/* Replace the logger of every subsystem */
+func SetLogger(logger Logger) {
+	current.Lock()
+	defer current.Unlock()
+	current.logger = logger
+}
+
+/* Flush the messages buffered by the logger, i.e. before exitting */
+func Flush() {
+	current.RLock()
+	logger := current.logger
+	current.RUnlock()
+	logger.Flush()
+}
+
+/* The configuration of the logging */
+type Config struct {
+	/* the format of the logs, text or json */
+	format string
+	/* the verbosity of the subsystems */
+	levels Levels
+	/* the logger injected in place of the above, if any */
+	logger Logger
+}
+
+/* An option applied to the configuration of the logging */
+type Option func(*Config) error
+
+/* The default configuration of the logging, text via glog */
+func DefaultConfig() Config {
+	return Config{format: FORMAT_TEXT}
+}
+
+/* Binds the configuration to the flags, the current values being the defaults; the caller parses them */
+func RegisterFlags(flags *flag.FlagSet, config *Config) {
+	flags.StringVar(&config.format, "log_format", config.format, "the format of the logs, text (via glog, as given by -logtostderr and the like) or json, a document per line on the stderr carrying the subsystem, severity and fields")
+	flags.Var(&config.levels, "log_level", "the verbosity of a subsystem (store, kv, fs, dynamic, discovery or metrics), SUBSYSTEM=LEVEL, the level being error, warning, info or a verbosity as with -v (which is used otherwise), can be given multiple times")
+}
+
+/* Applies the options to the configuration, in order */
+func (r *Config) Apply(options ...Option) error {
+	for _, option := range options {
+		if err := option(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* The format of the logs, text or json */
+func WithFormat(format string) Option {
+	return func(config *Config) error {
+		if err := ValidateFormat(format); err != nil {
+			return err
+		}
+		config.format = format
+		return nil
+	}
+}
+
+/* The verbosity of a subsystem, i.e. WithLevel("kv", "6") or WithLevel("fs", "error") */
+func WithLevel(subsystem, level string) Option {
+	return func(config *Config) error {
+		return config.levels.Set(subsystem + "=" + level)
+	}
+}
+
+/* A logger of our own, taking the messages of every subsystem in place of the format */
+func WithLogger(logger Logger) Option {
+	return func(config *Config) error {
+		config.logger = logger
+		return nil
+	}
+}
+
+/* Checks the format of the logs is one we support */
+func ValidateFormat(format string) error {
+	switch format {
+	case FORMAT_TEXT, FORMAT_JSON:
+		return nil
+	}
+	return InvalidFormatErr
+}
+
+/* Applies the configuration to the logging of every subsystem */
+func Configure(config Config) error {
+	if err := ValidateFormat(config.format); err != nil {
+		return err
+	}
+	logger := config.logger
+	if logger == nil {
+		switch config.format {
+		case FORMAT_JSON:
+			logger = NewJSONLogger(os.Stderr)
+		default:
+			logger = NewGlogLogger()
+		}
+	}
+	levels := make(Levels, len(config.levels))
+	for subsystem, level := range config.levels {
+		levels[subsystem] = level
+	}
+	current.Lock()
+	defer current.Unlock()
+	current.logger, current.levels = logger, levels
+	return nil
+}
+
+/*
+	The verbosity of the subsystems, a flag value of SUBSYSTEM=LEVEL; a verbosity as with -v, or error and warning
+	logging only the messages of that severity and above
+*/
+type Levels map[string]int
+
+/* the levels given by name, as verbosities */
+var LevelNames = map[string]int{"error": -2, "warning": -1, "info": 0}
+
+func (r *Levels) String() string {
+	items := make([]string, 0)
+	for subsystem, level := range *r {
+		items = append(items, fmt.Sprintf("%s=%d", subsystem, level))
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (r *Levels) Set(value string) error {
+	if *r == nil {
+		*r = make(Levels, 0)
+	}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		items := strings.SplitN(item, "=", 2)
+		if len(items) != 2 || strings.TrimSpace(items[0]) == "" {
+			return InvalidLevelErr
+		}
+		name := strings.ToLower(strings.TrimSpace(items[1]))
+		level, found := LevelNames[name]
+		if !found {
+			var err error
+			if level, err = strconv.Atoi(name); err != nil || level < 0 {
+				return InvalidLevelErr
+			}
+		}
+		(*r)[strings.TrimSpace(items[0])] = level
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+/* the frames between glog and the caller of the log, i.e. the sink, the emit and the method logging */
+const GLOG_DEPTH = 3
+
+/* The logger writing the messages as text via glog, the fields appended as key=value */
+type GlogLogger struct{}
+
+/* Create a logger writing via glog */
+func NewGlogLogger() Logger {
+	return &GlogLogger{}
+}
+
+func (r *GlogLogger) Log(entry Entry) {
+	message := entry.Message
+	if len(entry.Fields) > 0 {
+		keys := make([]string, 0, len(entry.Fields))
+		for key, _ := range entry.Fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		items := []string{message}
+		for _, key := range keys {
+			items = append(items, fmt.Sprintf("%s=%v", key, entry.Fields[key]))
+		}
+		message = strings.Join(items, " ")
+	}
+	switch entry.Severity {
+	case WARNING:
+		glog.WarningDepth(GLOG_DEPTH, message)
+	case ERROR:
+		glog.ErrorDepth(GLOG_DEPTH, message)
+	case FATAL:
+		glog.FatalDepth(GLOG_DEPTH, message)
+	default:
+		glog.InfoDepth(GLOG_DEPTH, message)
+	}
+}
+
+func (r *GlogLogger) Flush() {
+	glog.Flush()
+}
+
+/* The logger writing each message as a JSON document on a line of its own */
+type JSONLogger struct {
+	sync.Mutex
+	/* where the messages are written */
+	writer io.Writer
+}
+
+/* Create a logger writing the messages as JSON to the writer, i.e. os.Stderr */
+func NewJSONLogger(writer io.Writer) Logger {
+	return &JSONLogger{writer: writer}
+}
+
+/* note: the fields are placed alongside our own, which take precedence should the names clash */
+func (r *JSONLogger) Log(entry Entry) {
+	document := make(map[string]interface{}, len(entry.Fields)+6)
+	for key, value := range entry.Fields {
+		document[key] = value
+	}
+	document["time"] = entry.Time.UTC().Format(time.RFC3339Nano)
+	document["level"] = entry.Severity.Name(entry.Verbosity)
+	document["subsystem"] = entry.Subsystem
+	document["msg"] = entry.Message
+	if entry.Verbosity > 0 {
+		document["v"] = entry.Verbosity
+	}
+	if entry.Caller != "" {
+		document["caller"] = entry.Caller
+	}
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		encoded, _ = json.Marshal(map[string]interface{}{
+			"time":      document["time"],
+			"level":     document["level"],
+			"subsystem": entry.Subsystem,
+			"msg":       entry.Message,
+			"error":     fmt.Sprintf("the fields could not be encoded, error: %s", err),
+		})
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.writer.Write(append(encoded, '\n'))
+}
+
+func (r *JSONLogger) Flush() {}
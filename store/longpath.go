@@ -0,0 +1,70 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+	A file whose path would exceed the limits of the platform is written to a flat hashed layout rather than
+	failing the write; the index file lists the hashes against the original keys, one per line, i.e.
+
+	/_configfs_hashed/index
+	3f786850e387550fdab836ed7e6dc881de23001b /app/a/very/long/key
+*/
+const (
+	HASHED_DIRECTORY = "/_configfs_hashed"
+	HASHED_INDEX     = HASHED_DIRECTORY + "/index"
+)
+
+/* Maps the key onto the hashed layout, updating the index if the key had not been hashed */
+func (r *ConfigurationStore) HashedPath(key string) string {
+	hash := fmt.Sprintf("%x", sha1.Sum([]byte(CleanKey(key))))
+	path := HASHED_DIRECTORY + "/" + hash
+	if r.mapping.Hash(key, hash, path) {
+		logger.Infof("The path of the key: %s is too long, writing it to: %s", key, path)
+		r.WriteHashedIndex()
+	}
+	return path
+}
+
+/* Writes the index of the hashed files, removing it once none remain */
+func (r *ConfigurationStore) WriteHashedIndex() {
+	r.hashedLock.Lock()
+	defer r.hashedLock.Unlock()
+	full_path := DiskPath(r.BasePath(), HASHED_INDEX)
+	hashed := r.mapping.Hashed()
+	if len(hashed) <= 0 {
+		if r.fs.Exists(full_path) {
+			if err := r.fs.Delete(full_path); err != nil {
+				logger.Errorf("Failed to remove the hashed index: %s, error: %s", full_path, err)
+			}
+			r.PruneDirectory(r.fs.Dirname(full_path))
+		}
+		return
+	}
+	lines := make([]string, 0)
+	for hash, key := range hashed {
+		lines = append(lines, hash+" "+key)
+	}
+	sort.Strings(lines)
+	content := strings.Join(lines, "\n") + "\n"
+	if err := r.WriteFile(full_path, content, r.DefaultAttributes(HASHED_DIRECTORY)); err != nil {
+		logger.Errorf("Failed to write the hashed index: %s, error: %s", full_path, err)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gambol99/config-fs/store/fs"
+)
+
+func newTestStore(t *testing.T) (*ConfigurationStore, func()) {
+	directory, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory, error: %s", err)
+	}
+	options := DefaultConfig()
+	options.cfg_directory = directory
+	store := &ConfigurationStore{
+		options: options,
+		fs:      fs.NewStoreFS(fs.DefaultConfig(), nil),
+		mapping: NewKeyMapping(nil),
+		uid:     -1,
+		gid:     -1,
+	}
+	return store, func() { os.RemoveAll(directory) }
+}
+
+func TestLongPathMapped(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	long := "/app/" + strings.Repeat("a", MAX_NAME)
+	tests := []struct {
+		key    string
+		file   bool
+		hashed bool
+	}{
+		{"/app/db", true, false},
+		{"/app", false, false},
+		{long, true, true},
+		{"/app" + strings.Repeat("/abcdefgh", MAX_PATH/9+1), true, true},
+		/* note: only the files are hashed, the directories are left as is */
+		{long, false, false},
+	}
+	for _, test := range tests {
+		path := store.MappedPath(test.key, test.file)
+		expected := DiskPath(store.BasePath(), test.key)
+		if test.hashed {
+			expected = DiskPath(store.BasePath(), fmt.Sprintf("%s/%x", HASHED_DIRECTORY, sha1.Sum([]byte(test.key))))
+		}
+		if path != expected {
+			t.Errorf("the key: %.40s..., file: %t, expected: %s, got: %s", test.key, test.file, expected, path)
+		}
+		if test.hashed && IsTooLong(path) {
+			t.Errorf("the hashed path: %s should not be too long", path)
+		}
+	}
+}
+
+func TestLongPathIndex(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	first, second := "/app/"+strings.Repeat("a", MAX_NAME), "/app/"+strings.Repeat("b", MAX_NAME)
+	index := DiskPath(store.BasePath(), HASHED_INDEX)
+	/* step: the same key is hashed to the same file, the index listing each key once */
+	for _, key := range []string{first, second, first} {
+		store.FilePath(key)
+	}
+	content := readTestFile(t, index)
+	first_line := fmt.Sprintf("%x %s", sha1.Sum([]byte(first)), first)
+	second_line := fmt.Sprintf("%x %s", sha1.Sum([]byte(second)), second)
+	expected := first_line + "\n" + second_line + "\n"
+	if second_line < first_line {
+		expected = second_line + "\n" + first_line + "\n"
+	}
+	if content != expected {
+		t.Errorf("expected the index to list the hashed keys in order, got: %q", content)
+	}
+	/* step: the hashed files map back onto the original keys */
+	for _, key := range []string{first, second} {
+		if converted := store.mapping.Key(strings.TrimPrefix(store.FilePath(key), store.BasePath())); converted != key {
+			t.Errorf("the key: %.40s... didn't map back from the hashed layout, got: %.40s...", key, converted)
+		}
+	}
+	/* step: once none of the hashed keys remain, the index is removed along with the directory */
+	store.mapping.Forget(first)
+	store.WriteHashedIndex()
+	if content := readTestFile(t, index); content != second_line+"\n" {
+		t.Errorf("expected a single key in the index, got: %q", content)
+	}
+	store.mapping.Forget(second)
+	store.WriteHashedIndex()
+	if _, err := os.Stat(index); !os.IsNotExist(err) {
+		t.Errorf("expected the index to have been removed, error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(index)); !os.IsNotExist(err) {
+		t.Errorf("expected the empty hashed directory to have been pruned, error: %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	/* strip the prefix from the keys, i.e. strip_prefix=/prod/app */
+	MAPPING_STRIP_PREFIX = "strip_prefix"
+	/* add the extension to the file names, i.e. extension=.conf */
+	MAPPING_EXTENSION = "extension"
+	/* lowercase the names */
+	MAPPING_LOWERCASE = "lowercase"
+	/* replace the characters with the replacement, i.e. replace=:*=_ */
+	MAPPING_REPLACE = "replace"
+)
+
+var InvalidMappingErr = errors.New("Invalid mapping rule, must be strip_prefix=PREFIX, extension=EXT, lowercase or replace=CHARS=REPLACEMENT")
+
+/* a rule of the mapping between the keys and the file names */
+type MappingRule struct {
+	/* the name of the rule */
+	Name string
+	/* the argument of the rule, if any */
+	Value string
+}
+
+/* the mapping rules, a flag value which can be given multiple times and applied in order */
+type MappingRules []MappingRule
+
+func (r *MappingRules) String() string {
+	list := make([]string, 0)
+	for _, rule := range *r {
+		if rule.Value == "" {
+			list = append(list, rule.Name)
+		} else {
+			list = append(list, rule.Name+"="+rule.Value)
+		}
+	}
+	return strings.Join(list, ",")
+}
+
+func (r *MappingRules) Set(value string) error {
+	items := strings.SplitN(value, "=", 2)
+	rule := MappingRule{Name: items[0]}
+	if len(items) > 1 {
+		rule.Value = items[1]
+	}
+	switch rule.Name {
+	case MAPPING_STRIP_PREFIX:
+		if rule.Value = CleanKey(rule.Value); rule.Value == "/" {
+			return InvalidMappingErr
+		}
+	case MAPPING_EXTENSION:
+		if rule.Value == "" || strings.Contains(rule.Value, "/") {
+			return InvalidMappingErr
+		}
+	case MAPPING_LOWERCASE:
+	case MAPPING_REPLACE:
+		/* step: the replacement can't introduce a separator or a traversal */
+		if parts := strings.SplitN(rule.Value, "=", 2); len(parts) != 2 || parts[0] == "" || strings.ContainsAny(rule.Value, "/") || strings.Contains(parts[1], ".") {
+			return InvalidMappingErr
+		}
+	default:
+		return InvalidMappingErr
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+/*
+	Maps the keys onto the names of the files and back again; as lowercasing or replacing characters can't be
+	reversed, the keys mapped are recorded and the structural rules (the prefix and extension) only undone for
+	paths we haven't seen
+*/
+type KeyMapping struct {
+	sync.RWMutex
+	/* the rules applied, in order */
+	rules MappingRules
+	/* the paths mapped, relative path => key */
+	keys map[string]string
+	/* the keys mapped as files, i.e. with the extension */
+	files map[string]bool
+	/* the keys whose path was too long, hash => key */
+	hashed map[string]string
+}
+
+/* Create the mapping from the rules */
+func NewKeyMapping(rules MappingRules) *KeyMapping {
+	return &KeyMapping{
+		rules:  rules,
+		keys:   make(map[string]string, 0),
+		files:  make(map[string]bool, 0),
+		hashed: make(map[string]string, 0),
+	}
+}
+
+/* Map the key onto the path relative to the mount point, the extension is only added to files */
+func (r *KeyMapping) Map(key string, file bool) string {
+	key = CleanKey(key)
+	/* step: keys differing only in their unicode normalization are materialized as one file */
+	path := norm.NFC.String(key)
+	if len(r.rules) <= 0 && path == key {
+		r.RLock()
+		defer r.RUnlock()
+		if existing, found := r.keys[path]; found && existing != key {
+			logger.Errorf("The keys: %s and %s are both mapped to the path: %s, the latter wins", existing, key, path)
+		}
+		return key
+	}
+	r.Lock()
+	defer r.Unlock()
+	if file {
+		r.files[key] = true
+	}
+	for _, rule := range r.rules {
+		switch rule.Name {
+		case MAPPING_STRIP_PREFIX:
+			if path == rule.Value {
+				path = "/"
+			} else if strings.HasPrefix(path, rule.Value+"/") {
+				path = path[len(rule.Value):]
+			}
+		case MAPPING_EXTENSION:
+			if r.files[key] && path != "/" && !strings.HasSuffix(path, rule.Value) {
+				path += rule.Value
+			}
+		case MAPPING_LOWERCASE:
+			path = strings.ToLower(path)
+		case MAPPING_REPLACE:
+			parts := strings.SplitN(rule.Value, "=", 2)
+			path = strings.NewReplacer(ReplacePairs(parts[0], parts[1])...).Replace(path)
+		}
+	}
+	if existing, found := r.keys[path]; found && existing != key {
+		logger.Errorf("The keys: %s and %s are both mapped to the path: %s, the latter wins", existing, key, path)
+	}
+	r.keys[path] = key
+	return path
+}
+
+/* Map the file onto the hashed path, recording it for the index, returns true if the key had not been hashed */
+func (r *KeyMapping) Hash(key, hash, path string) bool {
+	r.Lock()
+	defer r.Unlock()
+	key = CleanKey(key)
+	r.keys[path], r.files[key] = key, true
+	if r.hashed[hash] == key {
+		return false
+	}
+	r.hashed[hash] = key
+	return true
+}
+
+/* Retrieve a copy of the hashed keys, hash => key */
+func (r *KeyMapping) Hashed() map[string]string {
+	r.RLock()
+	defer r.RUnlock()
+	hashed := make(map[string]string, 0)
+	for hash, key := range r.hashed {
+		hashed[hash] = key
+	}
+	return hashed
+}
+
+/* Map the path relative to the mount point back to the key */
+func (r *KeyMapping) Key(path string) string {
+	r.RLock()
+	defer r.RUnlock()
+	/* step: the file system may have decomposed the name, i.e. on macOS */
+	path = norm.NFC.String(path)
+	if key, found := r.keys[path]; found {
+		return key
+	}
+	if len(r.rules) <= 0 {
+		return path
+	}
+	/* step: we've not seen the path, so we undo what we can */
+	for index := len(r.rules) - 1; index >= 0; index-- {
+		rule := r.rules[index]
+		switch rule.Name {
+		case MAPPING_STRIP_PREFIX:
+			path = CleanKey(rule.Value + path)
+		case MAPPING_EXTENSION:
+			path = strings.TrimSuffix(path, rule.Value)
+		}
+	}
+	return path
+}
+
+/* Checks if the key has been mapped as a file */
+func (r *KeyMapping) IsFile(key string) bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.files[CleanKey(key)]
+}
+
+/* Forget the key and anything beneath it, i.e. once deleted, returns true if any of the keys were hashed */
+func (r *KeyMapping) Delete(key string) bool {
+	key = CleanKey(key)
+	return r.Remove(func(item string) bool {
+		return item == key || strings.HasPrefix(item, key+"/")
+	})
+}
+
+/* Forget the key of a file, leaving anything recorded beneath the same name, returns true if it was hashed */
+func (r *KeyMapping) Forget(key string) bool {
+	key = CleanKey(key)
+	return r.Remove(func(item string) bool {
+		return item == key
+	})
+}
+
+/* Forget the keys matched, returns true if any of them were hashed */
+func (r *KeyMapping) Remove(matches func(string) bool) bool {
+	r.Lock()
+	defer r.Unlock()
+	for path, item := range r.keys {
+		if matches(item) {
+			delete(r.keys, path)
+			delete(r.files, item)
+		}
+	}
+	hashed := false
+	for hash, item := range r.hashed {
+		if matches(item) {
+			delete(r.hashed, hash)
+			hashed = true
+		}
+	}
+	return hashed
+}
+
+/* The pairs for a replacer, replacing each of the characters with the replacement */
+func ReplacePairs(characters, replacement string) []string {
+	pairs := make([]string, 0)
+	for _, character := range characters {
+		pairs = append(pairs, string(character), replacement)
+	}
+	return pairs
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"testing"
+)
+
+func newTestMapping(t *testing.T, rules ...string) *KeyMapping {
+	var list MappingRules
+	for _, rule := range rules {
+		if err := list.Set(rule); err != nil {
+			t.Fatalf("failed to parse the mapping rule: %s, error: %s", rule, err)
+		}
+	}
+	return NewKeyMapping(list)
+}
+
+func TestMappingRulesSet(t *testing.T) {
+	tests := map[string]bool{
+		"strip_prefix=/prod/app": true,
+		"strip_prefix=prod/app/": true,
+		"extension=.conf":        true,
+		"lowercase":              true,
+		"replace=:*=_":           true,
+		"strip_prefix=/":         false,
+		"strip_prefix=":          false,
+		"extension=":             false,
+		"extension=/conf":        false,
+		"replace=:*":             false,
+		"replace==_":             false,
+		"replace=:=/":            false,
+		"replace=:=..":           false,
+		"replace=:=.":            false,
+		"uppercase":              false,
+		"strip_prefix/prod":      false,
+	}
+	for rule, valid := range tests {
+		var rules MappingRules
+		if err := rules.Set(rule); (err == nil) != valid {
+			t.Errorf("the rule: %s, expected valid: %t, got error: %v", rule, valid, err)
+		}
+	}
+	var rules MappingRules
+	rules.Set("strip_prefix=prod/app/")
+	rules.Set("lowercase")
+	if value := rules.String(); value != "strip_prefix=/prod/app,lowercase" {
+		t.Errorf("expected the rules to be cleaned and listed in order, got: %s", value)
+	}
+}
+
+func TestMappingMap(t *testing.T) {
+	tests := []struct {
+		rules []string
+		key   string
+		file  bool
+		path  string
+	}{
+		{nil, "/app/db", true, "/app/db"},
+		{nil, "app//db/", true, "/app/db"},
+		{[]string{"strip_prefix=/prod/app"}, "/prod/app/db", true, "/db"},
+		{[]string{"strip_prefix=/prod/app"}, "/prod/app", false, "/"},
+		{[]string{"strip_prefix=/prod/app"}, "/prod/application/db", true, "/prod/application/db"},
+		{[]string{"extension=.conf"}, "/app/db", true, "/app/db.conf"},
+		{[]string{"extension=.conf"}, "/app/db.conf", true, "/app/db.conf"},
+		{[]string{"extension=.conf"}, "/app", false, "/app"},
+		{[]string{"lowercase"}, "/App/DB", true, "/app/db"},
+		{[]string{"replace=:*=_"}, "/app/host:80*", true, "/app/host_80_"},
+		{[]string{"strip_prefix=/prod", "extension=.yaml", "lowercase"}, "/prod/App/DB", true, "/app/db.yaml"},
+		/* note: the keys are normalized, so a decomposed key maps to the composed name */
+		{nil, "/app/cafe\u0301", true, "/app/caf\u00e9"},
+	}
+	for _, test := range tests {
+		mapping := newTestMapping(t, test.rules...)
+		if path := mapping.Map(test.key, test.file); path != test.path {
+			t.Errorf("the key: %q, rules: %v, expected: %q, got: %q", test.key, test.rules, test.path, path)
+		}
+	}
+}
+
+func TestMappingRoundTrip(t *testing.T) {
+	rules := [][]string{
+		nil,
+		{"strip_prefix=/prod/app"},
+		{"extension=.conf"},
+		{"lowercase"},
+		{"replace=:=_"},
+		{"strip_prefix=/prod/app", "extension=.conf", "lowercase", "replace=:=_"},
+	}
+	keys := []string{"/prod/app/db", "/prod/app/Nested/Key:1", "/prod/app/.htpasswd", "/other/key"}
+	for _, list := range rules {
+		mapping := newTestMapping(t, list...)
+		for _, key := range keys {
+			path := mapping.Map(key, true)
+			if converted := mapping.Key(path); converted != key {
+				t.Errorf("the key: %s, rules: %v, mapped to: %s, mapped back to: %s", key, list, path, converted)
+			}
+			if !mapping.IsFile(key) && len(list) > 0 {
+				t.Errorf("the key: %s, rules: %v, should be recorded as a file", key, list)
+			}
+		}
+	}
+}
+
+func TestMappingKeyUnseen(t *testing.T) {
+	mapping := newTestMapping(t, "strip_prefix=/prod/app", "extension=.conf")
+	/* step: the structural rules are undone for a path never mapped, i.e. a file found on disk */
+	if key := mapping.Key("/nested/db.conf"); key != "/prod/app/nested/db" {
+		t.Errorf("expected the prefix and extension to be undone, got: %s", key)
+	}
+	if key := mapping.Key("/"); key != "/prod/app" {
+		t.Errorf("expected the root to map to the prefix, got: %s", key)
+	}
+	if key := newTestMapping(t).Key("/app/db"); key != "/app/db" {
+		t.Errorf("expected the path as is without any rules, got: %s", key)
+	}
+}
+
+func TestMappingDelete(t *testing.T) {
+	mapping := newTestMapping(t, "lowercase")
+	mapping.Map("/App/DB", true)
+	mapping.Map("/App/Nested/Key", true)
+	mapping.Map("/Application/Key", true)
+	mapping.Hash("/App/Long", "abc123", "/_configfs_hashed/abc123")
+	if !mapping.Delete("/App") {
+		t.Errorf("expected the hashed key beneath to be reported")
+	}
+	for _, key := range []string{"/App/DB", "/App/Nested/Key", "/App/Long"} {
+		if mapping.IsFile(key) {
+			t.Errorf("the key: %s should have been forgotten", key)
+		}
+	}
+	if !mapping.IsFile("/Application/Key") {
+		t.Errorf("the key sharing the prefix should have been left alone")
+	}
+	if key := mapping.Key("/application/key"); key != "/Application/Key" {
+		t.Errorf("expected the key sharing the prefix to still map back, got: %s", key)
+	}
+	if mapping.Forget("/Application/Key") {
+		t.Errorf("the key wasn't hashed")
+	}
+	if mapping.IsFile("/Application/Key") {
+		t.Errorf("the key should have been forgotten")
+	}
+}
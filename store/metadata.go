@@ -0,0 +1,100 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/gambol99/config-fs/store/kv"
+)
+
+/*
+	A directory can carry a metadata key defining the default attributes of everything materialized beneath
+	it; the defaults of the deeper directories override their parents, and the attributes header of a key
+	overrides both. The key itself is never materialized, i.e. /app/_configfs_meta
+
+	# the defaults for the app
+	mode=0640 owner=app group=app dir_mode=0750
+*/
+const META_KEY = "_configfs_meta"
+
+/* Checks if the key is the metadata of a directory */
+func IsMetadataKey(key string) bool {
+	return path.Base(key) == META_KEY
+}
+
+/* Record the metadata of the directory, an empty value removes it */
+func (r *ConfigurationStore) SetMetadata(directory, value string) {
+	r.metadataLock.Lock()
+	defer r.metadataLock.Unlock()
+	/* step: strip the comments */
+	fields := make([]string, 0)
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			fields = append(fields, line)
+		}
+	}
+	r.SaveMetadataState(directory)
+	if len(fields) <= 0 {
+		delete(r.metadata, directory)
+		return
+	}
+	r.metadata[directory] = strings.Join(fields, " ")
+}
+
+/* Remove the metadata of the directory and anything beneath it */
+func (r *ConfigurationStore) DeleteMetadata(directory string) {
+	r.metadataLock.Lock()
+	defer r.metadataLock.Unlock()
+	for item, _ := range r.metadata {
+		if item == directory || strings.HasPrefix(item, directory+"/") {
+			r.SaveMetadataState(item)
+			delete(r.metadata, item)
+		}
+	}
+}
+
+/* Retrieve the metadata applying to the path, from the shallowest directory to the deepest */
+func (r *ConfigurationStore) Metadata(key string) []string {
+	r.metadataLock.RLock()
+	defer r.metadataLock.RUnlock()
+	list := make([]string, 0)
+	for directory := CleanKey(key); ; directory = path.Dir(directory) {
+		if fields, found := r.metadata[directory]; found {
+			list = append([]string{fields}, list...)
+		}
+		if directory == "/" {
+			break
+		}
+	}
+	return list
+}
+
+/* Handle a change to the metadata of a directory, reapplying the attributes to everything beneath it */
+func (r *ConfigurationStore) HandleMetadataEvent(ctx context.Context, event kv.NodeChange) {
+	directory := path.Dir(event.Node.Path)
+	logger.V(VERBOSE_INFO).Infof("The metadata of directory: %s has changed, reapplying the attributes", directory)
+	switch event.Operation {
+	case kv.CHANGED:
+		r.SetMetadata(directory, event.Node.Value)
+	case kv.DELETED:
+		r.SetMetadata(directory, "")
+	}
+	if err := r.BuildDirectory(ctx, directory); err != nil {
+		logger.Errorf("Failed to reapply the attributes beneath the directory: %s, error: %s", directory, err)
+	}
+	r.ConvergeTemplates()
+}
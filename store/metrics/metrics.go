@@ -0,0 +1,149 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+)
+
+const (
+	/* the name the counters are published under, i.e. /debug/vars */
+	METRICS_NAME = "config_fs"
+	/* the number of writes skipped as the content exceeded the size cap */
+	FILES_TOO_LARGE = "files_too_large"
+	/* the number of writes delayed by the write rate limit */
+	WRITES_THROTTLED = "writes_throttled"
+	/* the number of local changes to the mount point which were reverted */
+	DRIFT_REPAIRED = "drift_repaired"
+	/* the number of files corrected by the periodic reconciliation against the store */
+	DRIFT_RECONCILED = "drift_reconciled"
+	/* the number of times a file was observed to have drifted from the store, when observing */
+	DRIFT_OBSERVED = "drift_observed"
+	/* the number of files presently drifted from the store, when observing */
+	DRIFTED_FILES = "drifted_files"
+	/* the number of files found under the mount point which none of the keys produce */
+	ORPHANS_FOUND = "orphans_found"
+	/* the number of files hard linked to a file with identical content, rather than written */
+	FILES_LINKED = "files_linked"
+	/* the number of writes refused as the mount point would exceed the quota */
+	QUOTA_EXCEEDED = "quota_exceeded"
+	/* the number of bytes used under the mount point, when a quota has been set */
+	QUOTA_USED = "quota_used_bytes"
+	/* the number of files created, updated, deleted and left unchanged by the initial sync on startup */
+	STARTUP_CREATED   = "startup_files_created"
+	STARTUP_UPDATED   = "startup_files_updated"
+	STARTUP_DELETED   = "startup_files_deleted"
+	STARTUP_UNCHANGED = "startup_files_unchanged"
+	/* the number of files the initial sync skipped without reading, as unchanged since written per the hash index */
+	PRESYNC_SKIPPED = "presync_files_skipped"
+	/* the number of refreshes which applied only the changes to the store since the last sync */
+	INCREMENTAL_SYNCS = "incremental_syncs"
+	/* the number of changes to keys skipped as the value had already been applied, i.e. the echo of a change */
+	UPDATES_SKIPPED = "updates_skipped"
+	/* the number of events superseded by a later event within the coalescing window, or while queued */
+	EVENTS_COALESCED = "events_coalesced"
+	/* the number of changes from the store dropped as the event queue was full */
+	EVENTS_DROPPED = "events_dropped"
+	/* the number of changes from the store queued for the event loop, a gauge */
+	EVENT_QUEUE_DEPTH = "event_queue_depth"
+	/* the number of events received while the synchronization was paused, applied on resume */
+	EVENTS_DEFERRED = "events_deferred"
+	/* the number of changes left outstanding in the journal by a previous run, replayed on startup */
+	JOURNAL_REPLAYED = "journal_replayed"
+	/* set to 1 while this instance holds the leader key, a gauge */
+	LEADER = "leader"
+	/* the number of times the leadership has been gained or lost */
+	LEADER_CHANGES = "leader_changes"
+	/* the number of times the validation of the staged changes failed, the changes not promoted */
+	VALIDATIONS_FAILED = "validations_failed"
+	/* the number of files whose verification failed once written, the previous content being restored */
+	VERIFICATIONS_FAILED = "verifications_failed"
+	/* the number of hooks run (including the on change command) once the files changed, and those which failed */
+	HOOKS_RUN    = "hooks_run"
+	HOOKS_FAILED = "hooks_failed"
+	/* the number of batches of events posted to the webhooks, and those which failed */
+	WEBHOOKS_SENT   = "webhooks_sent"
+	WEBHOOKS_FAILED = "webhooks_failed"
+	/* the number of snapshots taken of the mount point */
+	SNAPSHOTS_TAKEN = "snapshots_taken"
+	/* the number of times the mount point was rolled back to a snapshot */
+	SNAPSHOTS_RESTORED = "snapshots_restored"
+	/* the number of files changed locally which conflicted with a change in the store */
+	SYNC_CONFLICTS = "sync_conflicts"
+	/* the number of local changes written back to the store */
+	WRITEBACK_APPLIED = "writeback_applied"
+	/* the number of local changes which failed to be written back, i.e. the store had changed */
+	WRITEBACK_CONFLICTS = "writeback_conflicts"
+	/* the number of writes vetoed by a pre-write hook */
+	WRITES_VETOED = "writes_vetoed"
+	/* the number of change events dropped as the queue of a subscriber was full */
+	SUBSCRIBER_EVENTS_DROPPED = "subscriber_events_dropped"
+)
+
+/* the counters, published via expvar */
+var counters = expvar.NewMap(METRICS_NAME)
+
+/* the names of the counters which are gauges, i.e. set rather than added to */
+var gauges = struct {
+	sync.RWMutex
+	names map[string]bool
+}{names: make(map[string]bool, 0)}
+
+/* Increment the named counter */
+func Increment(name string) {
+	counters.Add(name, 1)
+}
+
+/* Add the delta to the named counter */
+func Add(name string, delta int64) {
+	counters.Add(name, delta)
+}
+
+/* Set the named counter to the value, i.e. a gauge */
+func Set(name string, value int64) {
+	gauge := new(expvar.Int)
+	gauge.Set(value)
+	counters.Set(name, gauge)
+	gauges.Lock()
+	defer gauges.Unlock()
+	gauges.names[name] = true
+}
+
+/* Checks if the named counter is a gauge, i.e. it has been set */
+func IsGauge(name string) bool {
+	gauges.RLock()
+	defer gauges.RUnlock()
+	return gauges.names[name]
+}
+
+/* Retrieve the current value of the named counter */
+func Get(name string) int64 {
+	if value := counters.Get(name); value != nil {
+		count, _ := strconv.ParseInt(value.String(), 10, 64)
+		return count
+	}
+	return 0
+}
+
+/* Retrieve a snapshot of all the counters */
+func Snapshot() map[string]int64 {
+	snapshot := make(map[string]int64, 0)
+	counters.Do(func(kv expvar.KeyValue) {
+		count, _ := strconv.ParseInt(kv.Value.String(), 10, 64)
+		snapshot[kv.Key] = count
+	})
+	return snapshot
+}
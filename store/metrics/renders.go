@@ -0,0 +1,134 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"expvar"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	The renders of each template are counted, along with the failures, the failures since the last success and when
+	it started failing, and the percentiles of the duration of the recent renders; they're published per template
+	as the config_fs_templates expvar and pushed to statsd tagged with the template, so an alert can be raised on a
+	template which has been failing for a while
+*/
+const (
+	/* the name the statistics of the templates are published under */
+	RENDERS_NAME = "config_fs_templates"
+	/* the number of the last renders of a template the percentiles are taken over */
+	RENDER_SAMPLES = 256
+)
+
+/* the statistics of the renders of a template */
+type RenderStats struct {
+	/* the renders attempted, and those which failed */
+	Renders  int64 `json:"renders"`
+	Failures int64 `json:"failures"`
+	/* the failures since the last render which succeeded, and when the first of them happened */
+	ConsecutiveFailures int64      `json:"consecutive_failures"`
+	FailingSince        *time.Time `json:"failing_since,omitempty"`
+	/* when the template was last rendered */
+	LastRender time.Time `json:"last_render"`
+	/* the percentiles of the duration of the recent renders, in milliseconds */
+	P50 float64 `json:"p50_ms"`
+	P90 float64 `json:"p90_ms"`
+	P99 float64 `json:"p99_ms"`
+	/* the durations of the last renders, the oldest at next once full */
+	samples []time.Duration
+	next    int
+}
+
+/* the statistics of each of the templates, by key */
+var renders = struct {
+	sync.RWMutex
+	templates map[string]*RenderStats
+}{templates: make(map[string]*RenderStats, 0)}
+
+func init() {
+	expvar.Publish(RENDERS_NAME, expvar.Func(func() interface{} { return RenderSnapshot() }))
+}
+
+/* Record a render of the template, the duration of a template which never got as far as rendering being zero */
+func ObserveRender(name string, duration time.Duration, err error) {
+	renders.Lock()
+	defer renders.Unlock()
+	stats, found := renders.templates[name]
+	if !found {
+		stats = &RenderStats{samples: make([]time.Duration, 0, RENDER_SAMPLES)}
+		renders.templates[name] = stats
+	}
+	stats.Renders++
+	stats.LastRender = time.Now().UTC()
+	if err != nil {
+		stats.Failures++
+		if stats.ConsecutiveFailures++; stats.FailingSince == nil {
+			since := stats.LastRender
+			stats.FailingSince = &since
+		}
+	} else {
+		stats.ConsecutiveFailures, stats.FailingSince = 0, nil
+	}
+	if duration > 0 {
+		if len(stats.samples) < RENDER_SAMPLES {
+			stats.samples = append(stats.samples, duration)
+		} else {
+			stats.samples[stats.next] = duration
+			stats.next = (stats.next + 1) % RENDER_SAMPLES
+		}
+	}
+}
+
+/* Forget the statistics of the template, i.e. it's been removed */
+func ForgetRender(name string) {
+	renders.Lock()
+	defer renders.Unlock()
+	delete(renders.templates, name)
+}
+
+/* A copy of the statistics of each of the templates, the percentiles computed */
+func RenderSnapshot() map[string]RenderStats {
+	renders.RLock()
+	defer renders.RUnlock()
+	snapshot := make(map[string]RenderStats, len(renders.templates))
+	for name, stats := range renders.templates {
+		durations := append([]time.Duration{}, stats.samples...)
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		copied := *stats
+		copied.samples, copied.next = nil, 0
+		copied.P50 = Percentile(durations, 0.5)
+		copied.P90 = Percentile(durations, 0.9)
+		copied.P99 = Percentile(durations, 0.99)
+		snapshot[name] = copied
+	}
+	return snapshot
+}
+
+/* The percentile (0-1) of the sorted durations in milliseconds, by the nearest rank; zero if there are none */
+func Percentile(sorted []time.Duration, percentile float64) float64 {
+	if len(sorted) <= 0 {
+		return 0
+	}
+	rank := int(math.Ceil(percentile*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return float64(sorted[rank]) / float64(time.Millisecond)
+}
@@ -0,0 +1,323 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gambol99/config-fs/store/logging"
+)
+
+/*
+	With -statsd_address the counters published via expvar are also pushed to a statsd agent (i.e. the datadog
+	agent) over udp on an interval; the counters as the change since the last push, the gauges as their value. The
+	tags are given in the dogstatsd format (|#host:web-1,env:prod), which the datadog agent, telegraf and the like
+	understand. The statistics of each template are pushed as template.NAME, tagged with the key of the template
+*/
+const (
+	/* the largest packet sent to the agent, so it isn't fragmented on a typical network */
+	STATSD_PACKET_SIZE = 1432
+)
+
+var InvalidTagErr = errors.New("Invalid statsd tag, must be NAME:VALUE, i.e. env:prod")
+
+/* the log of the metrics */
+var logger = logging.For(logging.SUBSYSTEM_METRICS)
+
+/* The configuration of the push of the metrics to statsd */
+type Config struct {
+	/* the address of the statsd agent, host:port, empty disables */
+	statsd_address string
+	/* the prefix of the names of the metrics */
+	statsd_prefix string
+	/* the interval the metrics are pushed on */
+	statsd_interval time.Duration
+	/* the tags added to every metric */
+	statsd_tags Tags
+}
+
+/* An option applied to the configuration of the metrics */
+type Option func(*Config) error
+
+/* The default configuration of the metrics, nothing is pushed */
+func DefaultConfig() Config {
+	return Config{
+		statsd_prefix:   METRICS_NAME,
+		statsd_interval: 10 * time.Second,
+	}
+}
+
+/* Binds the configuration to the flags, the current values being the defaults; the caller parses them */
+func RegisterFlags(flags *flag.FlagSet, config *Config) {
+	flags.StringVar(&config.statsd_address, "statsd_address", config.statsd_address, "push the metrics to the statsd (or datadog) agent on this address, i.e. 127.0.0.1:8125, empty disables")
+	flags.StringVar(&config.statsd_prefix, "statsd_prefix", config.statsd_prefix, "the prefix of the names of the metrics pushed to statsd")
+	flags.DurationVar(&config.statsd_interval, "statsd_interval", config.statsd_interval, "the interval the metrics are pushed to statsd on")
+	flags.Var(&config.statsd_tags, "statsd_tags", "a comma separated list of NAME:VALUE tags added to the metrics pushed to statsd, i.e. env:prod, the host and mount being added unless given, can be given multiple times")
+}
+
+/* Applies the options to the configuration, in order */
+func (r *Config) Apply(options ...Option) error {
+	for _, option := range options {
+		if err := option(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Push the metrics to the statsd agent on the address */
+func WithStatsd(address string) Option {
+	return func(config *Config) error {
+		config.statsd_address = address
+		return nil
+	}
+}
+
+/* A tag added to the metrics pushed, i.e. WithTag("env", "prod") */
+func WithTag(name, value string) Option {
+	return func(config *Config) error {
+		return config.statsd_tags.Set(name + ":" + value)
+	}
+}
+
+/* Checks if the tag has been given */
+func (r Config) HasTag(name string) bool {
+	for _, tag := range r.statsd_tags {
+		if strings.SplitN(tag, ":", 2)[0] == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Push the metrics to the statsd agent, if configured, on the interval until the context is cancelled, when the
+	last of them are pushed; the tags are added to those configured. The address is resolved before returning, so a
+	bad address is reported to the caller
+*/
+func Push(ctx context.Context, config Config, tags ...string) error {
+	if config.statsd_address == "" {
+		return nil
+	}
+	if config.statsd_interval <= 0 {
+		return fmt.Errorf("the statsd interval must be positive")
+	}
+	connection, err := net.Dial("udp", config.statsd_address)
+	if err != nil {
+		logger.Errorf("Failed to connect to the statsd agent: %s, error: %s", config.statsd_address, err)
+		return err
+	}
+	sink := NewStatsdSink(connection, config.statsd_prefix, append(append([]string{}, config.statsd_tags...), tags...))
+	logger.Infof("Pushing the metrics to the statsd agent: %s every %s", config.statsd_address, config.statsd_interval)
+	go func() {
+		defer connection.Close()
+		ticker := time.NewTicker(config.statsd_interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				sink.Flush()
+				return
+			}
+			if err := sink.Flush(); err != nil {
+				logger.Warningf("Failed to push the metrics to the statsd agent: %s, error: %s", config.statsd_address, err)
+			}
+		}
+	}()
+	return nil
+}
+
+/* Writes the counters to a statsd agent */
+type StatsdSink struct {
+	/* the connection to the agent */
+	connection net.Conn
+	/* the prefix of the names */
+	prefix string
+	/* the tags of every metric, already formatted */
+	tags string
+	/* the value of the counters when last pushed */
+	previous map[string]int64
+}
+
+/* A line pushed to the agent; for a counter, the value it's recorded as pushed at once the line has been sent */
+type StatsdLine struct {
+	/* the line, i.e. config_fs.files_written:3|c */
+	Text string
+	/* the name the counter is recorded under, empty for a gauge */
+	Counter string
+	/* the value of the counter */
+	Value int64
+}
+
+/* Create a sink writing the counters to the connection */
+func NewStatsdSink(connection net.Conn, prefix string, tags []string) *StatsdSink {
+	sink := &StatsdSink{connection: connection, prefix: prefix, previous: make(map[string]int64, 0)}
+	if len(tags) > 0 {
+		sink.tags = "|#" + strings.Join(tags, ",")
+	}
+	return sink
+}
+
+/* The lines of the counters changed since last pushed, and the gauges, sorted by name */
+func (r *StatsdSink) Lines() []StatsdLine {
+	snapshot := Snapshot()
+	names := make([]string, 0, len(snapshot))
+	for name, _ := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]StatsdLine, 0)
+	for _, name := range names {
+		value := snapshot[name]
+		metric := name
+		if r.prefix != "" {
+			metric = r.prefix + "." + name
+		}
+		if IsGauge(name) {
+			lines = append(lines, StatsdLine{Text: fmt.Sprintf("%s:%d|g%s", metric, value, r.tags)})
+			continue
+		}
+		if delta := value - r.previous[name]; delta != 0 {
+			lines = append(lines, StatsdLine{Text: fmt.Sprintf("%s:%d|c%s", metric, delta, r.tags), Counter: name, Value: value})
+		}
+	}
+	return append(lines, r.TemplateLines()...)
+}
+
+/*
+	The lines of the statistics of each template, sorted by key; the renders and failures as the change since last
+	pushed, and the failures since the last success, the seconds it's been failing and the percentiles of the
+	durations as gauges
+*/
+func (r *StatsdSink) TemplateLines() []StatsdLine {
+	snapshot := RenderSnapshot()
+	names := make([]string, 0, len(snapshot))
+	for name, _ := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metric := func(name string) string {
+		if r.prefix != "" {
+			return r.prefix + ".template." + name
+		}
+		return "template." + name
+	}
+	lines := make([]StatsdLine, 0)
+	for _, name := range names {
+		stats := snapshot[name]
+		tags := "|#template:" + TagValue(name)
+		if r.tags != "" {
+			tags = r.tags + ",template:" + TagValue(name)
+		}
+		for _, counter := range []struct {
+			name  string
+			value int64
+		}{{"renders", stats.Renders}, {"render_failures", stats.Failures}} {
+			key := "template." + counter.name + "/" + name
+			if delta := counter.value - r.previous[key]; delta != 0 {
+				lines = append(lines, StatsdLine{Text: fmt.Sprintf("%s:%d|c%s", metric(counter.name), delta, tags), Counter: key, Value: counter.value})
+			}
+		}
+		failing := int64(0)
+		if stats.FailingSince != nil {
+			failing = int64(time.Since(*stats.FailingSince).Seconds())
+		}
+		lines = append(lines,
+			StatsdLine{Text: fmt.Sprintf("%s:%d|g%s", metric("consecutive_failures"), stats.ConsecutiveFailures, tags)},
+			StatsdLine{Text: fmt.Sprintf("%s:%d|g%s", metric("failing_seconds"), failing, tags)},
+			StatsdLine{Text: fmt.Sprintf("%s:%.3f|g%s", metric("render_p50_ms"), stats.P50, tags)},
+			StatsdLine{Text: fmt.Sprintf("%s:%.3f|g%s", metric("render_p90_ms"), stats.P90, tags)},
+			StatsdLine{Text: fmt.Sprintf("%s:%.3f|g%s", metric("render_p99_ms"), stats.P99, tags)})
+	}
+	return lines
+}
+
+/* The value made safe for a tag, the separators of the dogstatsd format replaced */
+func TagValue(value string) string {
+	return strings.Map(func(char rune) rune {
+		switch char {
+		case ',', '|', '#', '\n', ' ', '\t':
+			return '_'
+		}
+		return char
+	}, value)
+}
+
+/*
+	Write the counters changed and the gauges to the agent, as many lines to a packet as fit; the counters are only
+	recorded as pushed once their packet has been sent, so the change in those of a packet which failed is pushed
+	on the next flush. Returns the first error, the remaining packets still being sent
+*/
+func (r *StatsdSink) Flush() error {
+	var failed error
+	packet := make([]byte, 0, STATSD_PACKET_SIZE)
+	counters := make([]StatsdLine, 0)
+	send := func() {
+		if _, err := r.connection.Write(packet); err != nil {
+			if failed == nil {
+				failed = err
+			}
+		} else {
+			for _, line := range counters {
+				r.previous[line.Counter] = line.Value
+			}
+		}
+		packet, counters = packet[:0], counters[:0]
+	}
+	for _, line := range r.Lines() {
+		if len(packet) > 0 && len(packet)+len(line.Text)+1 > STATSD_PACKET_SIZE {
+			send()
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line.Text...)
+		if line.Counter != "" {
+			counters = append(counters, line)
+		}
+	}
+	if len(packet) > 0 {
+		send()
+	}
+	return failed
+}
+
+/* The tags of the metrics, a flag value of NAME:VALUE which can be given multiple times */
+type Tags []string
+
+func (r *Tags) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *Tags) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		items := strings.SplitN(item, ":", 2)
+		if len(items) != 2 || items[0] == "" || items[1] == "" || strings.ContainsAny(item, "|#\n") {
+			return InvalidTagErr
+		}
+		*r = append(*r, item)
+	}
+	return nil
+}
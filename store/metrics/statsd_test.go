@@ -0,0 +1,88 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+/* a connection recording the packets written, failing the writes while broken */
+type fakeConnection struct {
+	net.Conn
+	broken  bool
+	packets []string
+}
+
+func (r *fakeConnection) Write(packet []byte) (int, error) {
+	if r.broken {
+		return 0, errors.New("connection refused")
+	}
+	r.packets = append(r.packets, string(packet))
+	return len(packet), nil
+}
+
+func (r *fakeConnection) Sent(metric string) []string {
+	lines := make([]string, 0)
+	for _, packet := range r.packets {
+		for _, line := range strings.Split(packet, "\n") {
+			if strings.HasPrefix(line, metric+":") {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return lines
+}
+
+func TestStatsdFlushCounters(t *testing.T) {
+	connection := new(fakeConnection)
+	sink := NewStatsdSink(connection, "test", []string{"env:prod"})
+	Add(FILES_LINKED, 3)
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("failed to flush the metrics, error: %s", err)
+	}
+	if sent := connection.Sent("test." + FILES_LINKED); len(sent) != 1 || sent[0] != "test."+FILES_LINKED+":3|c|#env:prod" {
+		t.Errorf("expected the counter to be pushed as its change, got: %v", sent)
+	}
+	/* step: a counter which hasn't changed isn't pushed again */
+	connection.packets = nil
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("failed to flush the metrics, error: %s", err)
+	}
+	if sent := connection.Sent("test." + FILES_LINKED); len(sent) != 0 {
+		t.Errorf("expected the unchanged counter to be skipped, got: %v", sent)
+	}
+}
+
+func TestStatsdFlushFailure(t *testing.T) {
+	connection := new(fakeConnection)
+	sink := NewStatsdSink(connection, "failure", nil)
+	sink.Flush()
+	Add(WRITES_THROTTLED, 2)
+	/* step: the change in the counters of a packet which failed is pushed on the next flush */
+	connection.broken = true
+	if err := sink.Flush(); err == nil {
+		t.Fatalf("expected the flush to fail")
+	}
+	Add(WRITES_THROTTLED, 5)
+	connection.broken, connection.packets = false, nil
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("failed to flush the metrics, error: %s", err)
+	}
+	if sent := connection.Sent("failure." + WRITES_THROTTLED); len(sent) != 1 || sent[0] != "failure."+WRITES_THROTTLED+":7|c" {
+		t.Errorf("expected the change since the last push to be pushed, got: %v", sent)
+	}
+}
@@ -0,0 +1,272 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/gambol99/config-fs/store/fs"
+)
+
+var (
+	InvalidMountErr     = errors.New("Invalid mount, must be PREFIX=DIRECTORY, i.e. /app1=/etc/app1")
+	OverlappingMountErr = errors.New("The directories of the mounts must not be the same or beneath one another")
+	MountsArchiveErr    = errors.New("The archive can't be used with multiple mounts, as each would overwrite it")
+	MountsJournalErr    = errors.New("The journal can't be used with multiple mounts, as each would overwrite it")
+	MountsLeaderErr     = errors.New("The leader election can't be used with multiple mounts")
+	MountsSnapshotErr   = errors.New("The snapshots can't be used with multiple mounts, as each would overwrite them")
+)
+
+/* a prefix of the keys and the directory they are materialized under */
+type MountMapping struct {
+	/* the prefix of the keys, i.e. the root */
+	Prefix string
+	/* the directory, i.e. the mount point */
+	Directory string
+}
+
+/* the mounts handled by the process, a flag value which can be given multiple times */
+type MountMappings []MountMapping
+
+func (r *MountMappings) String() string {
+	list := make([]string, 0)
+	for _, mount := range *r {
+		list = append(list, mount.Prefix+"="+mount.Directory)
+	}
+	return strings.Join(list, ",")
+}
+
+func (r *MountMappings) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		items := strings.SplitN(item, "=", 2)
+		if len(items) != 2 || !strings.HasPrefix(items[0], "/") || strings.TrimSpace(items[1]) == "" {
+			return InvalidMountErr
+		}
+		if err := ValidateKey(items[0]); err != nil {
+			return err
+		}
+		*r = append(*r, MountMapping{Prefix: CleanKey(items[0]), Directory: filepath.Clean(strings.TrimSpace(items[1]))})
+	}
+	return nil
+}
+
+/* The stores of the mount points, all handled by the one process */
+type MountStores []Store
+
+/* Create a store for each of the mounts, all handled by the one process */
+func NewMountStores(settings Config, writes *fs.RateLimiter) (Store, error) {
+	if settings.archive != "" {
+		logger.Errorf("The archive: %s can't be used with multiple mounts", settings.archive)
+		return nil, MountsArchiveErr
+	}
+	if settings.journal != "" {
+		logger.Errorf("The journal: %s can't be used with multiple mounts", settings.journal)
+		return nil, MountsJournalErr
+	}
+	if settings.leader_key != "" {
+		logger.Errorf("The leader key: %s can't be used with multiple mounts", settings.leader_key)
+		return nil, MountsLeaderErr
+	}
+	if settings.snapshot_dir != "" {
+		logger.Errorf("The snapshot directory: %s can't be used with multiple mounts", settings.snapshot_dir)
+		return nil, MountsSnapshotErr
+	}
+	for index, mount := range settings.mounts {
+		for _, other := range settings.mounts[index+1:] {
+			if mount.Directory == other.Directory || IsBeneath(mount.Directory, other.Directory) || IsBeneath(other.Directory, mount.Directory) {
+				logger.Errorf("The mount directories: %s and %s overlap", mount.Directory, other.Directory)
+				return nil, OverlappingMountErr
+			}
+		}
+	}
+	stores := make(MountStores, 0)
+	for _, mounted := range MountOptions(settings) {
+		store, err := NewMountStore(mounted, writes)
+		if err != nil {
+			logger.Errorf("Failed to create the store for the mount: %s=%s, error: %s", mounted.root_key, mounted.cfg_directory, err)
+			/* step: release the stores of the mounts already created */
+			stores.Close()
+			return nil, err
+		}
+		stores = append(stores, store)
+	}
+	return stores, nil
+}
+
+/*
+	The options of each of the mounts, a copy in which the prefix and directory of the mount replace the root and
+	mount point, the prefix being stripped from the keys ahead of any other mapping rules, i.e. /secrets/app1/db
+	=> /run/secrets/db; the remaining options are shared by all of them. Without any mounts, the options as given
+*/
+func MountOptions(settings Config) []Config {
+	if len(settings.mounts) <= 0 {
+		return []Config{settings}
+	}
+	list := make([]Config, 0)
+	for _, mount := range settings.mounts {
+		mounted := settings
+		mounted.root_key, mounted.cfg_directory = mount.Prefix, mount.Directory
+		mounted.key_mapping = make(MappingRules, 0)
+		if mount.Prefix != "/" {
+			mounted.key_mapping = append(mounted.key_mapping, MappingRule{Name: MAPPING_STRIP_PREFIX, Value: mount.Prefix})
+		}
+		mounted.key_mapping = append(mounted.key_mapping, settings.key_mapping...)
+		list = append(list, mounted)
+	}
+	return list
+}
+
+/* Synchronize each of the mounts, until the context is cancelled; the files which failed on a onetime sync are gathered */
+func (r MountStores) Synchronize(ctx context.Context) error {
+	var failed FailedFilesErr
+	for _, store := range r {
+		if err := store.Synchronize(ctx); err != nil {
+			if files, found := err.(FailedFilesErr); found {
+				failed = append(failed, files...)
+				continue
+			}
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+/* Shutdown each of the mounts, blocking until the changes in flight have been applied */
+func (r MountStores) Close() {
+	for _, store := range r {
+		store.Close()
+	}
+}
+
+/* Pause the application of changes to each of the mounts */
+func (r MountStores) Pause() {
+	for _, store := range r {
+		store.Pause()
+	}
+}
+
+/* Resume the application of changes to each of the mounts */
+func (r MountStores) Resume() {
+	for _, store := range r {
+		store.Resume()
+	}
+}
+
+/* Registers the handler for the changes made to each of the mounts, returning a function which unsubscribes it */
+func (r MountStores) Subscribe(handler func(ChangeEvent)) func() {
+	unsubscribers := make([]func(), 0)
+	for _, store := range r {
+		unsubscribers = append(unsubscribers, store.Subscribe(handler))
+	}
+	return func() {
+		for _, unsubscribe := range unsubscribers {
+			unsubscribe()
+		}
+	}
+}
+
+/* A channel closed once each of the mounts is ready */
+func (r MountStores) Ready() <-chan struct{} {
+	ready := make(chan struct{})
+	go func() {
+		defer close(ready)
+		for _, store := range r {
+			<-store.Ready()
+		}
+	}()
+	return ready
+}
+
+/* The status of each of the mounts */
+func (r MountStores) Status(ctx context.Context) []MountStatus {
+	list := make([]MountStatus, 0)
+	for _, store := range r {
+		list = append(list, store.Status(ctx)...)
+	}
+	return list
+}
+
+/* Reconcile each of the mounts against the store now */
+func (r MountStores) Resync() {
+	for _, store := range r {
+		store.Resync()
+	}
+}
+
+/* Reconcile the keys beneath the prefix of each of the mounts holding any */
+func (r MountStores) ResyncPrefix(prefix string) error {
+	err := UnknownPrefixErr
+	for _, store := range r {
+		if store.ResyncPrefix(prefix) == nil {
+			err = nil
+		}
+	}
+	return err
+}
+
+/* The files managed by each of the mounts */
+func (r MountStores) Files(prefix string) []FileStatus {
+	list := make([]FileStatus, 0)
+	for _, store := range r {
+		list = append(list, store.Files(prefix)...)
+	}
+	return list
+}
+
+/* The templates of each of the mounts */
+func (r MountStores) Templates() []TemplateStatus {
+	list := make([]TemplateStatus, 0)
+	for _, store := range r {
+		list = append(list, store.Templates()...)
+	}
+	return list
+}
+
+/* The content last rendered by the template of the key, in whichever of the mounts it's in */
+func (r MountStores) Template(key string) (string, error) {
+	for _, store := range r {
+		if content, err := store.Template(key); err == nil {
+			return content, nil
+		}
+	}
+	return "", TemplateNotFoundErr
+}
+
+/* The last events handled by the mounts matching the query, oldest first */
+func (r MountStores) History(query HistoryQuery) []HistoryEvent {
+	lists := make([][]HistoryEvent, 0)
+	for _, store := range r {
+		lists = append(lists, store.History(HistoryQuery{}))
+	}
+	return MergeHistory(query, lists...)
+}
+
+/* Delete the configuration directory of each of the mounts */
+func (r MountStores) Delete() error {
+	for _, store := range r {
+		if err := store.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gambol99/config-fs/store/kv"
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+/* the period the changes to the store or mount point must settle for before the drift is checked again */
+const OBSERVE_SETTLE = time.Second
+
+/* the files which have drifted from the store, returned by a onetime observation */
+type DriftedFilesErr []string
+
+func (r DriftedFilesErr) Error() string {
+	return fmt.Sprintf("%d files have drifted from the store: %s", len(r), strings.Join(r, ", "))
+}
+
+/*
+	Observes the mount point (or each of the mounts) without ever writing to it, reporting the files which have
+	drifted from the store, i.e. where another tool owns the files; the drift is checked on startup, whenever the
+	store or the mount point changes and on every interval, until the context is cancelled. With -onetime the drift
+	is checked the once, the files drifted being returned
+*/
+func ObserveMountPoint(ctx context.Context, settings Config) error {
+	observed := make(map[string]PlannedChange, 0)
+	drifted, err := ObserveDrift(ctx, settings, observed)
+	if err != nil {
+		return err
+	}
+	if settings.onetime {
+		if len(drifted) > 0 {
+			return DriftedFilesErr(drifted)
+		}
+		return nil
+	}
+	/* step: watch the store and the mount points for changes */
+	nodes := make(kv.NodeUpdateChannel, 10)
+	kvstore, err := kv.New(settings.kv, nodes)
+	if err != nil {
+		return err
+	}
+	defer kvstore.Close()
+	watcher, err := NewWatchService()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	files := make(WatchServiceChannel, 10)
+	watcher.AddWatchListener(files)
+	for _, mounted := range MountOptions(settings) {
+		kvstore.Watch(mounted.root_key)
+		if err := watcher.AddDirectoryWatch(mounted.cfg_directory); err != nil {
+			logger.Warningf("Failed to watch the mount point: %s, relying on the interval, error: %s", mounted.cfg_directory, err)
+		}
+	}
+	ticker := time.NewTicker(time.Duration(settings.refresh_interval) * time.Second)
+	defer ticker.Stop()
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-nodes:
+			settle = time.After(OBSERVE_SETTLE)
+		case <-files:
+			settle = time.After(OBSERVE_SETTLE)
+		case <-settle:
+			settle = nil
+			ObserveDrift(ctx, settings, observed)
+		case <-ticker.C:
+			ObserveDrift(ctx, settings, observed)
+		case <-ctx.Done():
+			logger.Infof("Stopping the observation of the mount point")
+			return nil
+		}
+	}
+}
+
+/*
+	Compares the mount points against the store, reporting the files which have drifted since the last check and
+	those whose drift has been resolved; the observed drift is updated, the paths drifted returned sorted
+*/
+func ObserveDrift(ctx context.Context, settings Config, observed map[string]PlannedChange) ([]string, error) {
+	current := make(map[string]PlannedChange, 0)
+	for _, mounted := range MountOptions(settings) {
+		changes, err := DiffMount(ctx, mounted)
+		if err != nil {
+			logger.Errorf("Failed to compare the mount point: %s against the store, error: %s", mounted.cfg_directory, err)
+			return nil, err
+		}
+		for _, change := range changes {
+			current[change.Path] = change
+		}
+	}
+	drifted := make([]string, 0)
+	for path, change := range current {
+		drifted = append(drifted, path)
+		if previous, found := observed[path]; found && previous.Action == change.Action && previous.Diff == change.Diff {
+			continue
+		}
+		logger.Warningf("Drift observed on the file: %s (%c)\n%s", path, change.Action, change.Diff)
+		metrics.Increment(metrics.DRIFT_OBSERVED)
+	}
+	for path, _ := range observed {
+		if _, found := current[path]; !found {
+			logger.Infof("The drift of the file: %s has been resolved", path)
+			delete(observed, path)
+		}
+	}
+	for path, change := range current {
+		observed[path] = change
+	}
+	sort.Strings(drifted)
+	metrics.Set(metrics.DRIFTED_FILES, int64(len(drifted)))
+	logger.V(VERBOSE_INFO).Infof("Observed the mount point, %d files have drifted from the store", len(drifted))
+	return drifted, nil
+}
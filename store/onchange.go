@@ -0,0 +1,357 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gambol99/config-fs/store/fs"
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+/*
+	The hooks run after the files under the mount point have changed, i.e. to reload a service (see Hook); the
+	changes are recorded as they're written and the hooks run once they've settled for the delay, so a batch of
+	changes runs them the once; should the changes never settle (i.e. a key updated every half second) the hooks
+	are run regardless once the first change has waited ten times the delay. The paths changed (as seen under the mount point) are given to a command on the
+	stdin, a line each, and in CONFIG_FS_CHANGED; the runs are never concurrent, the changes made during a run
+	following in the next
+*/
+
+const (
+	/* the environment variable holding the paths changed, a line each */
+	ENV_CHANGED = "CONFIG_FS_CHANGED"
+	/* the multiple of the delay the first change pending waits for at most, however often the changes follow */
+	HOOK_MAX_DEFERRAL = 10
+)
+
+/*
+	Wraps the file store, recording the paths changed by the writes and how, along with the templates rendered; a
+	write which leaves the file as it was (i.e. the content is unchanged) isn't recorded
+*/
+type ChangeRecorderFS struct {
+	fs.FileStore
+	/* a lock for the changes */
+	sync.Mutex
+	/* the paths changed since last taken, and how */
+	changed map[string]ChangeEvent
+	/* the files of the templates rendered since last taken */
+	rendered map[string]ChangeEvent
+}
+
+/* Wrap the file store, recording the changes */
+func NewChangeRecorderFS(store fs.FileStore) *ChangeRecorderFS {
+	return &ChangeRecorderFS{
+		FileStore: store,
+		changed:   make(map[string]ChangeEvent, 0),
+		rendered:  make(map[string]ChangeEvent, 0),
+	}
+}
+
+/*
+	Record the path as changed if the modification replaced, removed or altered it; a file created and then updated
+	by the same transaction is still created
+*/
+func (r *ChangeRecorderFS) Modify(path, key string, modify func() error) error {
+	before, missing := os.Lstat(path)
+	if err := modify(); err != nil {
+		return err
+	}
+	after, removed := os.Lstat(path)
+	if missing != nil || removed != nil || !os.SameFile(before, after) || before.Mode() != after.Mode() ||
+		before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime()) {
+		r.Lock()
+		defer r.Unlock()
+		change := ChangeEvent{Type: FILE_UPDATED, Path: path, Key: key}
+		switch {
+		case removed != nil:
+			change.Type = FILE_DELETED
+		case missing != nil || r.changed[path].Type == FILE_CREATED:
+			change.Type = FILE_CREATED
+		}
+		if change.Key == "" {
+			change.Key = r.changed[path].Key
+		}
+		r.changed[path] = change
+	}
+	return nil
+}
+
+/* Record the file rendered by the template, a nil recorder records nothing */
+func (r *ChangeRecorderFS) Rendered(path, key string) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.rendered[path] = ChangeEvent{Type: TEMPLATE_RENDERED, Path: path, Key: key}
+}
+
+/* Take the changes since last taken, the files changed sorted by path followed by the templates rendered */
+func (r *ChangeRecorderFS) Changes() []ChangeEvent {
+	r.Lock()
+	defer r.Unlock()
+	list := make([]ChangeEvent, 0)
+	for _, changes := range []map[string]ChangeEvent{r.changed, r.rendered} {
+		paths := make([]string, 0)
+		for path, _ := range changes {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			list = append(list, changes[path])
+		}
+	}
+	r.changed = make(map[string]ChangeEvent, 0)
+	r.rendered = make(map[string]ChangeEvent, 0)
+	return list
+}
+
+func (r *ChangeRecorderFS) Create(path string, value string, attributes fs.Attributes) error {
+	return r.Modify(path, attributes.Source, func() error { return r.FileStore.Create(path, value, attributes) })
+}
+
+func (r *ChangeRecorderFS) Update(path string, value string, attributes fs.Attributes) error {
+	return r.Modify(path, attributes.Source, func() error { return r.FileStore.Update(path, value, attributes) })
+}
+
+func (r *ChangeRecorderFS) Stream(path string, reader io.Reader, attributes fs.Attributes) error {
+	return r.Modify(path, attributes.Source, func() error { return r.FileStore.Stream(path, reader, attributes) })
+}
+
+func (r *ChangeRecorderFS) Delete(path string) error {
+	return r.Modify(path, "", func() error { return r.FileStore.Delete(path) })
+}
+
+func (r *ChangeRecorderFS) Symlink(target, path string) error {
+	return r.Modify(path, "", func() error { return r.FileStore.Symlink(target, path) })
+}
+
+func (r *ChangeRecorderFS) Chmod(path string, mode os.FileMode) error {
+	return r.Modify(path, "", func() error { return r.FileStore.Chmod(path, mode) })
+}
+
+func (r *ChangeRecorderFS) Move(path, destination string) error {
+	return r.Modify(path, "", func() error { return r.FileStore.Move(path, destination) })
+}
+
+/* Runs the hooks once the changes have settled */
+type ChangeHooks struct {
+	/* a lock for the paths pending */
+	sync.Mutex
+	/* the hooks, in the order run */
+	hooks []*Hook
+	/* the mount point, given to the command */
+	mount string
+	/* the period the changes must settle for */
+	delay time.Duration
+	/* the paths changed since the last run */
+	pending map[string]bool
+	/* signalled when a change is recorded */
+	notify chan struct{}
+	/* serializes the runs of the hooks */
+	running sync.Mutex
+}
+
+/* Create the runner of the hooks */
+func NewChangeHooks(hooks []*Hook, mount string, delay time.Duration) *ChangeHooks {
+	return &ChangeHooks{
+		hooks:   hooks,
+		mount:   mount,
+		delay:   delay,
+		pending: make(map[string]bool, 0),
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+/* Record the paths changed, the hooks are run once they've settled; a nil runner records nothing */
+func (r *ChangeHooks) Notify(paths []string) {
+	if r == nil || len(paths) <= 0 {
+		return
+	}
+	r.Lock()
+	for _, path := range paths {
+		r.pending[path] = true
+	}
+	r.Unlock()
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+/* Run the hooks as the changes settle, or once the first change has waited long enough, until the context is cancelled */
+func (r *ChangeHooks) Run(ctx context.Context) {
+	var settle, deadline <-chan time.Time
+	for {
+		select {
+		case <-r.notify:
+			settle = time.After(r.delay)
+			/* note: the deadline isn't extended, so a stream of changes can't defer the hooks forever */
+			if deadline == nil {
+				deadline = time.After(HOOK_MAX_DEFERRAL * r.delay)
+			}
+		case <-settle:
+			settle, deadline = nil, nil
+			r.Flush()
+		case <-deadline:
+			logger.V(VERBOSE_INFO).Infof("The changes haven't settled within: %s, running the hooks regardless", HOOK_MAX_DEFERRAL*r.delay)
+			settle, deadline = nil, nil
+			r.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/*
+	Run the hooks matching the paths pending, if any, in order; a failure is logged and the remaining hooks run,
+	unless the hook aborts on a failure. A nil runner runs nothing
+*/
+func (r *ChangeHooks) Flush() {
+	if r == nil {
+		return
+	}
+	r.running.Lock()
+	defer r.running.Unlock()
+	r.Lock()
+	paths := make([]string, 0)
+	for path, _ := range r.pending {
+		paths = append(paths, path)
+	}
+	r.pending = make(map[string]bool, 0)
+	r.Unlock()
+	if len(paths) <= 0 {
+		return
+	}
+	sort.Strings(paths)
+	for _, hook := range r.hooks {
+		matching := hook.Matching(paths)
+		if len(matching) <= 0 {
+			continue
+		}
+		logger.V(VERBOSE_INFO).Infof("Running the hook, %s, %d files changed", hook, len(matching))
+		if err := hook.Execute(matching, r.mount); err != nil {
+			logger.Errorf("The hook, %s failed, %d files changed, error: %s", hook, len(matching), err)
+			metrics.Increment(metrics.HOOKS_FAILED)
+			if hook.OnFailure == HOOK_ABORT {
+				logger.Warningf("Skipping the remaining hooks, the hook, %s aborts on a failure", hook)
+				return
+			}
+			continue
+		}
+		metrics.Increment(metrics.HOOKS_RUN)
+	}
+}
+
+/* The errors of the templates already reported, so a template is reported as it starts failing rather than on every change */
+type TemplateFailures struct {
+	sync.Mutex
+	/* the errors reported, path => error */
+	reported map[string]string
+}
+
+/* Create the tracker of the templates failing */
+func NewTemplateFailures() *TemplateFailures {
+	return &TemplateFailures{reported: make(map[string]string, 0)}
+}
+
+/*
+	Given the errors of the templates (path => error), returns those not yet reported, or whose error has since
+	changed; the templates no longer failing are forgotten, so should they fail again they're reported again
+*/
+func (r *TemplateFailures) Failed(current map[string]string) map[string]string {
+	r.Lock()
+	defer r.Unlock()
+	failed := make(map[string]string, 0)
+	for path, message := range current {
+		if r.reported[path] != message {
+			failed[path] = message
+		}
+	}
+	r.reported = current
+	return failed
+}
+
+/* Hand the templates which have started failing (or fail differently) since last checked to the webhooks and history */
+func (r *ConfigurationStore) NotifyTemplateErrors() {
+	if r.webhooks == nil && r.history == nil {
+		return
+	}
+	failed := r.failures.Failed(r.dynamic.Errors())
+	paths := make([]string, 0)
+	for path, _ := range failed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	now := time.Now().UTC()
+	for _, path := range paths {
+		full_path := r.StatePath(r.FullPath(path))
+		r.webhooks.Notify(WebhookEvent{Type: WEBHOOK_TEMPLATE_FAILED, Path: full_path, Key: path, Error: failed[path], Time: now})
+		r.RecordHistory(HistoryEvent{Type: HISTORY_TEMPLATE_FAILED, Path: full_path, Key: path, Error: failed[path], Time: now})
+	}
+}
+
+/* Drop the changes recorded, i.e. those of a generation discarded */
+func (r *ConfigurationStore) DiscardChanges() {
+	if r.recorder != nil {
+		r.recorder.Changes()
+	}
+}
+
+/*
+	Hand the files changed by the transaction to the hooks and the subscribers, as seen under the mount point; our
+	own files (the links of the atomic swap, backups and so on) and the directories are left out
+*/
+func (r *ConfigurationStore) NotifyChanges() {
+	if r.recorder == nil {
+		return
+	}
+	paths := make([]string, 0)
+	events := make([]ChangeEvent, 0)
+	webhooks := make([]WebhookEvent, 0)
+	now := time.Now()
+	for _, change := range r.recorder.Changes() {
+		if unstaged := r.UnstagedPath(change.Path); r.IsAtomicLink(unstaged) || r.IsInternalFile(unstaged) {
+			continue
+		}
+		if stat, err := os.Stat(change.Path); err == nil && stat.IsDir() {
+			continue
+		}
+		/* step: the key of a file removed or moved isn't given, so it's taken from the path */
+		if change.Key == "" {
+			change.Key, _ = r.KeyPath(change.Path)
+		}
+		change.Path, change.Time = r.StatePath(change.Path), now
+		r.RecordHistory(HistoryEvent{Type: string(change.Type), Key: change.Key, Path: change.Path, Time: now.UTC()})
+		if change.Type != TEMPLATE_RENDERED {
+			paths = append(paths, change.Path)
+			webhooks = append(webhooks, WebhookEvent{Type: WEBHOOK_CHANGED, Path: change.Path, Key: change.Key, Time: now.UTC()})
+		}
+		events = append(events, change)
+	}
+	if len(events) > 0 {
+		r.status.Changed()
+	}
+	r.hooks.Notify(paths)
+	r.webhooks.Notify(webhooks...)
+	if r.subscribers.HasSubscribers() {
+		r.subscribers.Publish(events)
+	}
+}
@@ -0,0 +1,30 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var InvalidOnetimeErr = errors.New("The onetime sync can't be used with tmpfs or delete on exit, the files would be removed on exit")
+
+/* The files which couldn't be written by a onetime sync, the rest of the mount point having been synchronized */
+type FailedFilesErr []string
+
+func (r FailedFilesErr) Error() string {
+	return fmt.Sprintf("failed to write %d files: %s", len(r), strings.Join(r, ", "))
+}
+
@@ -0,0 +1,101 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/* the room left in the names for the suffixes of the temporary files and backups */
+const NAME_MARGIN = 32
+
+var (
+	InvalidKeyErr = errors.New("The key contains a traversal (. or ..) or unsafe characters")
+)
+
+/*
+	Validates the key before anything is materialized from it; a key may not contain NUL bytes or other
+	control characters, nor . or .. path segments, as these could be used to write outside the mount point.
+	The segments must also be valid file names on the platform, i.e. no drive letters or separators on windows
+*/
+func ValidateKey(path string) error {
+	if path == "" || !strings.HasPrefix(path, "/") {
+		return InvalidKeyErr
+	}
+	for _, character := range path {
+		if character < 0x20 || character == 0x7f {
+			return InvalidKeyErr
+		}
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "." || segment == ".." || !IsValidSegment(segment) {
+			return InvalidKeyErr
+		}
+	}
+	return nil
+}
+
+/* Normalizes the key as an absolute path, the keys are always separated by a / regardless of the platform */
+func CleanKey(key string) string {
+	return path.Clean("/" + key)
+}
+
+/*
+	The keys are always separated by a /, whereas the paths on disk use the separator of the platform; converts
+	the key to the path on disk beneath the base, i.e. /app/db => C:\config\app\db on windows
+*/
+func DiskPath(base, key string) string {
+	if key = CleanKey(key); key == "/" {
+		return base
+	}
+	return strings.TrimSuffix(base, string(filepath.Separator)) + filepath.FromSlash(key)
+}
+
+/* Converts the path on disk back to the key, handing back false if the path is not beneath the base */
+func DiskKey(base, full_path string) (string, bool) {
+	if base == "" {
+		return "", false
+	}
+	if full_path == base {
+		return "/", true
+	}
+	if !IsBeneath(base, full_path) {
+		return "", false
+	}
+	return filepath.ToSlash(full_path[len(strings.TrimSuffix(base, string(filepath.Separator))):]), true
+}
+
+/*
+	Checks if the path on disk exceeds the limits of the platform; the names are kept short enough for the
+	temporary files and backups written alongside them, i.e. .name.<random> and name.bak.<timestamp>
+*/
+func IsTooLong(full_path string) bool {
+	if len(full_path) >= MAX_PATH-NAME_MARGIN {
+		return true
+	}
+	for _, name := range strings.Split(full_path, string(filepath.Separator)) {
+		if len(name) > MAX_NAME-NAME_MARGIN {
+			return true
+		}
+	}
+	return false
+}
+
+/* Checks if the path on disk is beneath the base */
+func IsBeneath(base, full_path string) bool {
+	return strings.HasPrefix(full_path, strings.TrimSuffix(base, string(filepath.Separator))+string(filepath.Separator))
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+const (
+	/* the maximum length of a path, i.e. PATH_MAX */
+	MAX_PATH = 4096
+	/* the maximum length of a file name, i.e. NAME_MAX */
+	MAX_NAME = 255
+)
+
+/* Checks the segment of a key is a valid file name, anything other than a / or NUL is */
+func IsValidSegment(segment string) bool {
+	return true
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		valid bool
+	}{
+		{"/app/config", true},
+		{"/app/.htpasswd", true},
+		{"/app/..config", true},
+		{"/app/config..", true},
+		{"/app/config.d/file", true},
+		{"/", true},
+		{"", false},
+		{"app/config", false},
+		{"./app/config", false},
+		{"../etc/passwd", false},
+		{"/..", false},
+		{"/../etc/passwd", false},
+		{"/app/../../etc/passwd", false},
+		{"/app/..", false},
+		{"/app/./config", false},
+		{"/app/.", false},
+		{"/.", false},
+		{"/app/con\x00fig", false},
+		{"/app/config\x00", false},
+		{"/app/con\nfig", false},
+		{"/app/con\rfig", false},
+		{"/app/con\tfig", false},
+		{"/app/\x1bconfig", false},
+		{"/app/config\x7f", false},
+	}
+	for _, test := range tests {
+		if err := ValidateKey(test.key); (err == nil) != test.valid {
+			t.Errorf("the key: %q, expected valid: %t, got error: %v", test.key, test.valid, err)
+		}
+	}
+}
+
+func TestCleanKey(t *testing.T) {
+	tests := map[string]string{
+		"":                "/",
+		"/":               "/",
+		"app":             "/app",
+		"/app/":           "/app",
+		"//app//config":   "/app/config",
+		"/app/./config":   "/app/config",
+		"/app/../config":  "/config",
+		"/../../etc":      "/etc",
+		"../../etc":       "/etc",
+		"/app/.htpasswd/": "/app/.htpasswd",
+	}
+	for key, expected := range tests {
+		if cleaned := CleanKey(key); cleaned != expected {
+			t.Errorf("the key: %q, expected: %s, got: %s", key, expected, cleaned)
+		}
+	}
+}
+
+func TestDiskPath(t *testing.T) {
+	base := filepath.FromSlash("/config")
+	tests := map[string]string{
+		"/":                "/config",
+		"":                 "/config",
+		"/app/db":          "/config/app/db",
+		"app/db":           "/config/app/db",
+		"/app/../../etc":   "/config/etc",
+		"../../etc/passwd": "/config/etc/passwd",
+		"/app/./db/":       "/config/app/db",
+	}
+	for key, expected := range tests {
+		if path := DiskPath(base, key); path != filepath.FromSlash(expected) {
+			t.Errorf("the key: %q, expected: %s, got: %s", key, filepath.FromSlash(expected), path)
+		}
+		/* step: whatever the key, the path never escapes the base */
+		if path := DiskPath(base, key); path != base && !IsBeneath(base, path) {
+			t.Errorf("the key: %q escaped the base: %s", key, path)
+		}
+	}
+	if path := DiskPath(base+string(filepath.Separator), "/app"); path != filepath.FromSlash("/config/app") {
+		t.Errorf("expected the trailing separator of the base to be ignored, got: %s", path)
+	}
+}
+
+func TestDiskKey(t *testing.T) {
+	base := filepath.FromSlash("/config")
+	tests := []struct {
+		path  string
+		key   string
+		found bool
+	}{
+		{"/config", "/", true},
+		{"/config/app/db", "/app/db", true},
+		{"/config/.htpasswd", "/.htpasswd", true},
+		{"/configuration/app", "", false},
+		{"/etc/passwd", "", false},
+		{"/", "", false},
+	}
+	for _, test := range tests {
+		key, found := DiskKey(base, filepath.FromSlash(test.path))
+		if found != test.found || key != test.key {
+			t.Errorf("the path: %s, expected: %q (%t), got: %q (%t)", test.path, test.key, test.found, key, found)
+		}
+	}
+	if _, found := DiskKey("", filepath.FromSlash("/config/app")); found {
+		t.Errorf("expected no key without a base")
+	}
+	/* step: the keys round trip through the paths on disk */
+	for _, key := range []string{"/app", "/app/db", "/app/.htpasswd", "/a/b/c/d"} {
+		if converted, found := DiskKey(base, DiskPath(base, key)); !found || converted != key {
+			t.Errorf("the key: %s didn't round trip, got: %s", key, converted)
+		}
+	}
+}
+
+func TestIsBeneath(t *testing.T) {
+	tests := []struct {
+		base    string
+		path    string
+		beneath bool
+	}{
+		{"/config", "/config/app", true},
+		{"/config/", "/config/app", true},
+		{"/config", "/config/app/db", true},
+		{"/config", "/config", false},
+		{"/config", "/configuration", false},
+		{"/config", "/configuration/app", false},
+		{"/config", "/etc", false},
+		{"/config", "/", false},
+	}
+	for _, test := range tests {
+		if beneath := IsBeneath(filepath.FromSlash(test.base), filepath.FromSlash(test.path)); beneath != test.beneath {
+			t.Errorf("the path: %s beneath: %s, expected: %t, got: %t", test.path, test.base, test.beneath, beneath)
+		}
+	}
+}
+
+func TestIsTooLong(t *testing.T) {
+	if IsTooLong(filepath.FromSlash("/config/app/db")) {
+		t.Errorf("a short path should not be too long")
+	}
+	if !IsTooLong(filepath.FromSlash("/config/" + strings.Repeat("a", MAX_NAME))) {
+		t.Errorf("a name of the maximum length leaves no room for the temporary files")
+	}
+	if !IsTooLong(filepath.FromSlash("/config" + strings.Repeat("/abcdefgh", MAX_PATH/9+1))) {
+		t.Errorf("a path beyond the maximum length should be too long")
+	}
+}
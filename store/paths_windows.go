@@ -0,0 +1,53 @@
+//go:build windows
+// +build windows
+
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"strings"
+)
+
+const (
+	/* the maximum length of a path, i.e. MAX_PATH, unless long paths have been enabled */
+	MAX_PATH = 260
+	/* the maximum length of a file name */
+	MAX_NAME = 255
+)
+
+/* the device names reserved by windows, regardless of any extension, i.e. NUL or nul.txt */
+var ReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+/*
+	Checks the segment of a key is a valid file name on windows; the separators, drive letters and wildcard
+	characters are rejected, as are names ending in a dot or space and the reserved device names
+*/
+func IsValidSegment(segment string) bool {
+	if strings.ContainsAny(segment, "<>:\"|?*\\") {
+		return false
+	}
+	if strings.HasSuffix(segment, ".") || strings.HasSuffix(segment, " ") {
+		return false
+	}
+	name := strings.ToUpper(segment)
+	if index := strings.Index(name, "."); index >= 0 {
+		name = name[:index]
+	}
+	return !ReservedNames[name]
+}
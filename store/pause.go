@@ -0,0 +1,81 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+	While paused the changes from the store and templates are tracked (coalesced into a batch, see EventBatch) but
+	not applied, nor are the local changes repaired or the mount point reconciled; on resume the backlog is applied
+	as a single batch and the mount point reconciled, so the drift left unrepaired is corrected. The synchronization
+	can be paused for a number of reasons at once, and is only resumed once none of them remain
+*/
+const (
+	/* paused by the operator, i.e. SIGUSR1 */
+	PAUSE_OPERATOR = "operator"
+	/* the leadership of a shared mount point has been lost */
+	PAUSE_LEADER = "leader"
+	/* the freeze key has been set in the store */
+	PAUSE_FREEZE = "freeze"
+	/* the mount point has been rolled back and pinned to a snapshot */
+	PAUSE_PINNED = "pinned"
+)
+
+/* a request to pause or resume the synchronization for a reason */
+type PauseRequest struct {
+	/* the reason for the pause */
+	Reason string
+	/* pause (true) or resume (false) */
+	Paused bool
+}
+
+/* Pause the application of changes to the mount point, until resumed */
+func (r *ConfigurationStore) Pause() {
+	r.SetPaused(PAUSE_OPERATOR, true)
+}
+
+/* Resume the application of changes, applying those received while paused */
+func (r *ConfigurationStore) Resume() {
+	r.SetPaused(PAUSE_OPERATOR, false)
+}
+
+/* Request the event loop pauses or resumes for the reason; ignored if the loop isn't running */
+func (r *ConfigurationStore) SetPaused(reason string, paused bool) {
+	if r.done == nil {
+		return
+	}
+	select {
+	case r.pauseChannel <- PauseRequest{Reason: reason, Paused: paused}:
+	case <-r.done:
+	}
+}
+
+/* The reasons the synchronization is paused, sorted and comma separated */
+func PauseReasons(reasons map[string]bool) string {
+	list := make([]string, 0)
+	for reason, _ := range reasons {
+		list = append(list, reason)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+/* Checks if the synchronization is paused */
+func (r *ConfigurationStore) IsPaused() bool {
+	return atomic.LoadInt32(&r.paused) == 1
+}
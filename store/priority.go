@@ -0,0 +1,159 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gambol99/config-fs/store/kv"
+)
+
+/*
+	The directories of the store can be given a priority (-priority=DIRECTORY=PRIORITY), so the critical paths
+	(i.e. /config/tls) are applied ahead of the bulk data; the priority of a key is that of the longest directory
+	it's beneath, zero otherwise, and the higher the sooner. A full sync (the initial build, or a reconciliation)
+	makes a pass of the tree for each priority, highest first, each pass only listing the directories leading to
+	the keys of its priority; a batch of events is applied in priority order, though an event is never moved ahead
+	of an earlier event on a directory (i.e. a directory deleted and a key recreated beneath it)
+*/
+type SyncPriorities map[string]int
+
+func (r *SyncPriorities) String() string {
+	items := make([]string, 0)
+	for directory, priority := range *r {
+		items = append(items, fmt.Sprintf("%s=%d", directory, priority))
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (r *SyncPriorities) Set(value string) error {
+	if *r == nil {
+		*r = make(SyncPriorities, 0)
+	}
+	items := strings.SplitN(value, "=", 2)
+	if len(items) != 2 || !strings.HasPrefix(items[0], "/") {
+		return fmt.Errorf("invalid priority: %s, should be DIRECTORY=PRIORITY", value)
+	}
+	priority, err := strconv.Atoi(strings.TrimSpace(items[1]))
+	if err != nil {
+		return fmt.Errorf("invalid priority: %s, the priority must be an integer", value)
+	}
+	(*r)[CleanKey(items[0])] = priority
+	return nil
+}
+
+/* The priority of the key, that of the longest directory it's beneath */
+func (r SyncPriorities) Of(path string) int {
+	priority, matched := 0, -1
+	for directory, item := range r {
+		if directory == "/" || path == directory || strings.HasPrefix(path, directory+"/") {
+			if len(directory) > matched {
+				priority, matched = item, len(directory)
+			}
+		}
+	}
+	return priority
+}
+
+/* The priorities of the keys beneath the directory, highest first */
+func (r SyncPriorities) Levels(directory string) []int {
+	seen := map[int]bool{r.Of(directory): true}
+	for prefix, priority := range r {
+		if IsBeneathKey(directory, prefix) {
+			seen[priority] = true
+		}
+	}
+	levels := make([]int, 0)
+	for priority, _ := range seen {
+		levels = append(levels, priority)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(levels)))
+	return levels
+}
+
+/* Checks if the directory may hold keys of the priority, i.e. it's of the priority or leads to a directory which is */
+func (r SyncPriorities) Reaches(directory string, level int) bool {
+	if r.Of(directory) == level {
+		return true
+	}
+	for prefix, priority := range r {
+		if priority == level && IsBeneathKey(directory, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Orders the events by priority, highest first; the events on a directory are barriers which nothing is moved
+	across, the keys being unique otherwise nothing else can overlap
+*/
+func (r SyncPriorities) Order(events []kv.NodeChange) []kv.NodeChange {
+	if len(r) <= 0 {
+		return events
+	}
+	ordered := make([]kv.NodeChange, 0, len(events))
+	sortSegment := func(segment []kv.NodeChange) {
+		sort.SliceStable(segment, func(i, j int) bool {
+			return r.Of(segment[i].Node.Path) > r.Of(segment[j].Node.Path)
+		})
+		ordered = append(ordered, segment...)
+	}
+	segment := make([]kv.NodeChange, 0)
+	for _, event := range events {
+		if event.Node.IsDir() {
+			sortSegment(segment)
+			ordered = append(ordered, event)
+			segment = make([]kv.NodeChange, 0)
+			continue
+		}
+		segment = append(segment, event)
+	}
+	sortSegment(segment)
+	return ordered
+}
+
+/* Checks if the key is strictly beneath the directory of the store */
+func IsBeneathKey(directory, key string) bool {
+	if directory == "/" {
+		return key != "/"
+	}
+	return strings.HasPrefix(key, directory+"/")
+}
+
+/*
+	The nodes of the listing a pass of the priority visits: the keys (and aggregated directories) of the priority,
+	and the directories which may hold any beneath them
+*/
+func (r *ConfigurationStore) PassListing(listing []*kv.Node, level int) []*kv.Node {
+	if len(r.options.priorities) <= 0 {
+		return listing
+	}
+	nodes := make([]*kv.Node, 0, len(listing))
+	for _, node := range listing {
+		switch {
+		case node.IsDir() && !r.IsAggregate(node.Path):
+			if r.options.priorities.Reaches(node.Path, level) {
+				nodes = append(nodes, node)
+			}
+		case r.options.priorities.Of(node.Path) == level:
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
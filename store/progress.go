@@ -0,0 +1,230 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gambol99/config-fs/store/kv"
+)
+
+/*
+	The progress of the initial build and the full reconciliations of the mount points, so a slow sync can be told
+	from a hung one; the keys are counted as the directories are listed, so the total is of the keys found so far
+	and grows until every directory has been listed, the estimate of the time remaining being of those. The progress
+	is logged on the -progress_interval while a sync runs and published as the config_fs_progress expvar
+*/
+const (
+	PROGRESS_NAME = "config_fs_progress"
+	/* the kinds of sync */
+	PROGRESS_BUILD     = "build"
+	PROGRESS_RECONCILE = "reconcile"
+)
+
+/* the progress of a sync, as published */
+type ProgressReport struct {
+	/* the kind of sync, build or reconcile */
+	Operation string `json:"operation"`
+	/* set while the sync is running */
+	Running bool `json:"running"`
+	/* the keys processed, and found so far */
+	Processed int64 `json:"processed"`
+	Total     int64 `json:"total"`
+	/* the directories found which are still to be listed */
+	Directories int64 `json:"directories"`
+	/* the size of the content of the keys applied */
+	Bytes int64 `json:"bytes"`
+	/* when the sync started, and finished */
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	/* the time elapsed, and the estimate of the time remaining (of the keys found so far) */
+	Elapsed string `json:"elapsed"`
+	ETA     string `json:"eta,omitempty"`
+}
+
+/* the progress of the sync of a mount point */
+type SyncProgress struct {
+	/* the counters, updated as the sync runs */
+	processed   int64
+	total       int64
+	directories int64
+	bytes       int64
+	/* a lock for the below */
+	sync.RWMutex
+	/* the mount point */
+	mount string
+	/* the kind of sync, and when it started and finished */
+	operation string
+	started   time.Time
+	finished  time.Time
+	/* closed once the sync has finished, stopping the logging */
+	stop chan struct{}
+}
+
+/* the progress of the mount points, mount point => progress */
+var progress = struct {
+	sync.RWMutex
+	mounts map[string]*SyncProgress
+}{mounts: make(map[string]*SyncProgress, 0)}
+
+func init() {
+	expvar.Publish(PROGRESS_NAME, expvar.Func(func() interface{} {
+		progress.RLock()
+		defer progress.RUnlock()
+		reports := make(map[string]ProgressReport, len(progress.mounts))
+		for mount, tracker := range progress.mounts {
+			reports[mount] = tracker.Report()
+		}
+		return reports
+	}))
+}
+
+/* Create the progress of the mount point, published along with those of the other mount points */
+func NewSyncProgress(mount string) *SyncProgress {
+	tracker := &SyncProgress{mount: mount}
+	progress.Lock()
+	defer progress.Unlock()
+	progress.mounts[mount] = tracker
+	return tracker
+}
+
+/* Start tracking a sync, logging the progress on the interval (if any) until it's finished */
+func (r *SyncProgress) Start(operation string, interval time.Duration) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	atomic.StoreInt64(&r.processed, 0)
+	atomic.StoreInt64(&r.total, 0)
+	atomic.StoreInt64(&r.directories, 1)
+	atomic.StoreInt64(&r.bytes, 0)
+	r.operation, r.started, r.finished = operation, time.Now().UTC(), time.Time{}
+	r.stop = make(chan struct{})
+	if interval <= 0 {
+		return
+	}
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				report := r.Report()
+				if report.ETA == "" {
+					report.ETA = "unknown"
+				}
+				logger.Infof("The %s of the mount point: %s has processed %d of the %d keys found (%d directories left to list), %d bytes applied, elapsed: %s, eta: %s",
+					report.Operation, r.mount, report.Processed, report.Total, report.Directories, report.Bytes, report.Elapsed, report.ETA)
+			}
+		}
+	}(r.stop)
+}
+
+/* The directory has been listed, with the keys and directories found beneath it */
+func (r *SyncProgress) Listed(keys, directories int) {
+	if r == nil {
+		return
+	}
+	atomic.AddInt64(&r.total, int64(keys))
+	atomic.AddInt64(&r.directories, int64(directories)-1)
+}
+
+/* The directory is to be listed again, i.e. on the pass of another priority */
+func (r *SyncProgress) Relisted() {
+	if r == nil {
+		return
+	}
+	atomic.AddInt64(&r.directories, 1)
+}
+
+/* The key has been processed, with the size of its content */
+func (r *SyncProgress) Processed(bytes int) {
+	if r == nil {
+		return
+	}
+	atomic.AddInt64(&r.processed, 1)
+	atomic.AddInt64(&r.bytes, int64(bytes))
+}
+
+/* The sync has finished, stopping the logging */
+func (r *SyncProgress) Finish() {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+	r.finished = time.Now().UTC()
+	logger.V(VERBOSE_INFO).Infof("The %s of the mount point: %s has finished, processed %d of the %d keys found (%d directories left unlisted), %d bytes applied, elapsed: %s",
+		r.operation, r.mount, atomic.LoadInt64(&r.processed), atomic.LoadInt64(&r.total), atomic.LoadInt64(&r.directories),
+		atomic.LoadInt64(&r.bytes), r.finished.Sub(r.started).Truncate(time.Second))
+}
+
+/* A report of the progress of the current (or last) sync */
+func (r *SyncProgress) Report() ProgressReport {
+	r.RLock()
+	defer r.RUnlock()
+	report := ProgressReport{
+		Operation:   r.operation,
+		Running:     r.stop != nil,
+		Processed:   atomic.LoadInt64(&r.processed),
+		Total:       atomic.LoadInt64(&r.total),
+		Directories: atomic.LoadInt64(&r.directories),
+		Bytes:       atomic.LoadInt64(&r.bytes),
+		Started:     r.started,
+	}
+	elapsed := time.Since(r.started)
+	if !r.finished.IsZero() {
+		finished := r.finished
+		report.Finished, elapsed = &finished, r.finished.Sub(r.started)
+	}
+	report.Elapsed = elapsed.Truncate(time.Second).String()
+	if report.Running && report.Processed > 0 && report.Total > report.Processed {
+		remaining := time.Duration(int64(elapsed) / report.Processed * (report.Total - report.Processed))
+		report.ETA = remaining.Truncate(time.Second).String()
+	}
+	return report
+}
+
+/*
+	Counts the keys and the directories to be descended into in the listing; a directory aggregated into a single
+	file is counted as a key, being written as one
+*/
+func (r *ConfigurationStore) CountListing(listing []*kv.Node) (int, int) {
+	keys, directories := 0, 0
+	for _, node := range listing {
+		switch {
+		case ValidateKey(node.Path) != nil || IsMetadataKey(node.Path):
+		case node.IsFile():
+			if r.filter.IsIncluded(node.Path) {
+				keys++
+			}
+		case !r.filter.IsTraversable(node.Path):
+		case r.IsAggregate(node.Path):
+			keys++
+		default:
+			directories++
+		}
+	}
+	return keys, directories
+}
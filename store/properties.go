@@ -0,0 +1,278 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	The encoding of the java .properties and .ini files, used by the aggregated directories (a directory of keys
+	into a single file) and the exploded keys (a single file into a tree of files). The values are keyed by their
+	path relative to the directory, i.e. db/host; in a properties file the path is written as db.host, in an ini
+	file the directory is the section, i.e. host under [db]
+*/
+
+/* Encodes the values as a properties file, a line per key sorted by name, the names and values escaped */
+func EncodeProperties(values map[string]string) string {
+	names := make([]string, 0)
+	for name, _ := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	content := ""
+	for _, name := range names {
+		content += fmt.Sprintf("%s=%s\n", EscapeProperty(strings.Replace(name, "/", ".", -1), true), EscapeProperty(values[name], false))
+	}
+	return content
+}
+
+/* Escapes the name or value of a property; the characters outside of printable ascii are written as \uXXXX */
+func EscapeProperty(value string, key bool) string {
+	escaped := ""
+	for index, char := range value {
+		switch {
+		case char == '\\':
+			escaped += `\\`
+		case char == '\n':
+			escaped += `\n`
+		case char == '\r':
+			escaped += `\r`
+		case char == '\t':
+			escaped += `\t`
+		case char == '\f':
+			escaped += `\f`
+		case char == ' ' && (key || index == 0):
+			escaped += `\ `
+		case key && strings.ContainsRune("=:#!", char):
+			escaped += `\` + string(char)
+		case !key && index == 0 && strings.ContainsRune("#!", char):
+			escaped += `\` + string(char)
+		case char < 0x20 || char > 0x7e:
+			for _, unit := range EncodeUTF16(char) {
+				escaped += fmt.Sprintf(`\u%04x`, unit)
+			}
+		default:
+			escaped += string(char)
+		}
+	}
+	return escaped
+}
+
+/* The utf-16 code units of the character, a surrogate pair outside of the basic plane */
+func EncodeUTF16(char rune) []rune {
+	if char < 0x10000 {
+		return []rune{char}
+	}
+	char -= 0x10000
+	return []rune{0xd800 + (char>>10)&0x3ff, 0xdc00 + char&0x3ff}
+}
+
+/*
+	Parses a properties file into the values, name => value; the comments (# or !) and blank lines are skipped, a
+	line ending in a backslash continues on the next, and the name is separated from the value by the first
+	unescaped =, : or whitespace
+*/
+func ParseProperties(content string) (map[string]string, error) {
+	values := make(map[string]string, 0)
+	lines := strings.Split(strings.Replace(content, "\r\n", "\n", -1), "\n")
+	for index := 0; index < len(lines); index++ {
+		line := strings.TrimLeft(lines[index], " \t\f")
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		/* step: join the continuation lines */
+		for IsContinued(line) && index+1 < len(lines) {
+			index++
+			line = line[:len(line)-1] + strings.TrimLeft(lines[index], " \t\f")
+		}
+		if IsContinued(line) {
+			line = line[:len(line)-1]
+		}
+		/* step: find the end of the name */
+		end, escaped := len(line), false
+		for position, char := range line {
+			if escaped {
+				escaped = false
+				continue
+			}
+			if char == '\\' {
+				escaped = true
+			} else if strings.ContainsRune("=: \t\f", char) {
+				end = position
+				break
+			}
+		}
+		name, value := line[:end], strings.TrimLeft(line[end:], " \t\f")
+		if value != "" && (value[0] == '=' || value[0] == ':') {
+			value = strings.TrimLeft(value[1:], " \t\f")
+		}
+		name, err := UnescapeProperty(name)
+		if err != nil {
+			return nil, err
+		}
+		if values[name], err = UnescapeProperty(value); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+/* Checks if the line ends in an odd number of backslashes, i.e. continues on the next */
+func IsContinued(line string) bool {
+	count := 0
+	for index := len(line) - 1; index >= 0 && line[index] == '\\'; index-- {
+		count++
+	}
+	return count%2 == 1
+}
+
+/* Reverses the escaping of a property name or value */
+func UnescapeProperty(value string) (string, error) {
+	if !strings.Contains(value, `\`) {
+		return value, nil
+	}
+	units := make([]rune, 0)
+	chars := []rune(value)
+	for index := 0; index < len(chars); index++ {
+		if chars[index] != '\\' || index+1 >= len(chars) {
+			units = append(units, chars[index])
+			continue
+		}
+		index++
+		switch chars[index] {
+		case 'n':
+			units = append(units, '\n')
+		case 'r':
+			units = append(units, '\r')
+		case 't':
+			units = append(units, '\t')
+		case 'f':
+			units = append(units, '\f')
+		case 'u':
+			if index+4 >= len(chars) {
+				return "", fmt.Errorf("invalid unicode escape in: %q", value)
+			}
+			unit, err := strconv.ParseUint(string(chars[index+1:index+5]), 16, 16)
+			if err != nil {
+				return "", fmt.Errorf("invalid unicode escape in: %q", value)
+			}
+			units = append(units, rune(unit))
+			index += 4
+		default:
+			units = append(units, chars[index])
+		}
+	}
+	return DecodeUTF16(units), nil
+}
+
+/* Joins any surrogate pairs in the utf-16 code units */
+func DecodeUTF16(units []rune) string {
+	decoded := ""
+	for index := 0; index < len(units); index++ {
+		unit := units[index]
+		if unit >= 0xd800 && unit < 0xdc00 && index+1 < len(units) && units[index+1] >= 0xdc00 && units[index+1] < 0xe000 {
+			unit = 0x10000 + (unit-0xd800)<<10 + (units[index+1] - 0xdc00)
+			index++
+		}
+		decoded += string(unit)
+	}
+	return decoded
+}
+
+/*
+	Encodes the values as an ini file; the keys immediately beneath the directory come first, followed by a
+	section per subdirectory (the deeper directories named with dots, i.e. [db.pool]); a value spanning lines is
+	double quoted with the line breaks escaped
+*/
+func EncodeINI(values map[string]string) string {
+	sections := make(map[string]map[string]string, 0)
+	for name, value := range values {
+		section := ""
+		if index := strings.LastIndex(name, "/"); index >= 0 {
+			section, name = strings.Replace(name[:index], "/", ".", -1), name[index+1:]
+		}
+		if sections[section] == nil {
+			sections[section] = make(map[string]string, 0)
+		}
+		sections[section][name] = value
+	}
+	names := make([]string, 0)
+	for section, _ := range sections {
+		names = append(names, section)
+	}
+	sort.Strings(names)
+	content := ""
+	for _, section := range names {
+		if section != "" {
+			if content != "" {
+				content += "\n"
+			}
+			content += fmt.Sprintf("[%s]\n", section)
+		}
+		keys := make([]string, 0)
+		for key, _ := range sections[section] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := sections[section][key]
+			if strings.ContainsAny(value, "\r\n") || value != strings.TrimSpace(value) {
+				value = strconv.Quote(value)
+			}
+			content += fmt.Sprintf("%s = %s\n", key, value)
+		}
+	}
+	return content
+}
+
+/*
+	Parses an ini file into the values, keyed by section/name (or the name alone before the first section); the
+	comments (; or #) and blank lines are skipped and a double quoted value is unquoted
+*/
+func ParseINI(content string) (map[string]string, error) {
+	values := make(map[string]string, 0)
+	section := ""
+	for number, line := range strings.Split(strings.Replace(content, "\r\n", "\n", -1), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || line[0] == ';' || line[0] == '#':
+			continue
+		case line[0] == '[':
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("invalid section on line %d: %q", number+1, line)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		items := strings.SplitN(line, "=", 2)
+		if len(items) != 2 {
+			return nil, fmt.Errorf("invalid line %d: %q, expected NAME = VALUE", number+1, line)
+		}
+		name, value := strings.TrimSpace(items[0]), strings.TrimSpace(items[1])
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			}
+		}
+		if section != "" {
+			name = section + "/" + name
+		}
+		values[name] = value
+	}
+	return values, nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEscapeProperty(t *testing.T) {
+	tests := []struct {
+		value   string
+		key     bool
+		escaped string
+	}{
+		{"plain", false, "plain"},
+		{"a key", true, `a\ key`},
+		{"a value", false, "a value"},
+		{" leading", false, `\ leading`},
+		{"a=b:c#d!e", true, `a\=b\:c\#d\!e`},
+		{"a=b:c#d!e", false, "a=b:c#d!e"},
+		{"#comment", false, `\#comment`},
+		{"!comment", false, `\!comment`},
+		{"back\\slash", false, `back\\slash`},
+		{"line\nbreak\r\ttab\f", false, `line\nbreak\r\ttab\f`},
+		{"caf\u00e9", false, `caf\u00e9`},
+		{"\U0001f600", false, `\ud83d\ude00`},
+		{"bell\x07", false, `bell\u0007`},
+	}
+	for _, test := range tests {
+		if escaped := EscapeProperty(test.value, test.key); escaped != test.escaped {
+			t.Errorf("the value: %q, key: %t, expected: %s, got: %s", test.value, test.key, test.escaped, escaped)
+		}
+	}
+}
+
+func TestParseProperties(t *testing.T) {
+	tests := []struct {
+		content string
+		values  map[string]string
+	}{
+		{"a=1\nb = 2\nc:3\nd 4\n", map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}},
+		{"# comment\n! comment\n\n   \na=1\r\n", map[string]string{"a": "1"}},
+		{"  indented = value with spaces  ", map[string]string{"indented": "value with spaces  "}},
+		{"a\\ key = 1\na\\=b = 2", map[string]string{"a key": "1", "a=b": "2"}},
+		{"empty=\nnothing", map[string]string{"empty": "", "nothing": ""}},
+		{"a=first, \\\n    second\nb=2", map[string]string{"a": "first, second", "b": "2"}},
+		{"a=ends in a backslash\\\\\nb=2", map[string]string{"a": `ends in a backslash\`, "b": "2"}},
+		{"a=continued at the end\\", map[string]string{"a": "continued at the end"}},
+		{`a=caf\u00e9 \ud83d\ude00`, map[string]string{"a": "caf\u00e9 \U0001f600"}},
+		{"a=1\na=2", map[string]string{"a": "2"}},
+	}
+	for _, test := range tests {
+		values, err := ParseProperties(test.content)
+		if err != nil {
+			t.Errorf("failed to parse the properties: %q, error: %s", test.content, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, test.values) {
+			t.Errorf("the properties: %q, expected: %v, got: %v", test.content, test.values, values)
+		}
+	}
+	for _, content := range []string{`a=\u00`, `a=\u00zz`, `\uxyz1=a`} {
+		if _, err := ParseProperties(content); err == nil {
+			t.Errorf("expected the properties: %q to be refused", content)
+		}
+	}
+}
+
+func TestPropertiesRoundTrip(t *testing.T) {
+	values := map[string]string{
+		"db/host":     "db.example.com",
+		"db/password": "p@ss=word:#!",
+		"a key":       " leading and trailing ",
+		"multi":       "line one\nline two\r\n\tindented",
+		"unicode":     "caf\u00e9 \U0001f600 \u4e2d\u6587",
+		"empty":       "",
+		"backslash":   `C:\path\to\`,
+		"#hash":       "!bang",
+	}
+	encoded := EncodeProperties(values)
+	decoded, err := ParseProperties(encoded)
+	if err != nil {
+		t.Fatalf("failed to parse the encoded properties, error: %s", err)
+	}
+	/* note: the directories are written with dots, as read back */
+	values["db.host"], values["db.password"] = values["db/host"], values["db/password"]
+	delete(values, "db/host")
+	delete(values, "db/password")
+	if !reflect.DeepEqual(decoded, values) {
+		t.Errorf("the properties didn't round trip, encoded: %q, got: %v", encoded, decoded)
+	}
+	if encoded := EncodeProperties(map[string]string{"b": "2", "a/c": "3", "a": "1"}); encoded != "a=1\na.c=3\nb=2\n" {
+		t.Errorf("expected the properties to be sorted by name, got: %q", encoded)
+	}
+}
+
+func TestParseINI(t *testing.T) {
+	tests := []struct {
+		content string
+		values  map[string]string
+	}{
+		{"a = 1\nb=2\n", map[string]string{"a": "1", "b": "2"}},
+		{"; comment\n# comment\n\ntop = 1\n[db]\nhost = db.example.com\n[ cache ]\nsize = 10\r\n", map[string]string{"top": "1", "db/host": "db.example.com", "cache/size": "10"}},
+		{"[db]\nurl = postgres://host/db?a=b\n", map[string]string{"db/url": "postgres://host/db?a=b"}},
+		{`a = "line one\nline two"`, map[string]string{"a": "line one\nline two"}},
+		{`a = " padded "`, map[string]string{"a": " padded "}},
+		{`a = "not closed`, map[string]string{"a": `"not closed`}},
+		{"a =", map[string]string{"a": ""}},
+	}
+	for _, test := range tests {
+		values, err := ParseINI(test.content)
+		if err != nil {
+			t.Errorf("failed to parse the ini: %q, error: %s", test.content, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, test.values) {
+			t.Errorf("the ini: %q, expected: %v, got: %v", test.content, test.values, values)
+		}
+	}
+	for _, content := range []string{"[db\na = 1", "a line without a value"} {
+		if _, err := ParseINI(content); err == nil {
+			t.Errorf("expected the ini: %q to be refused", content)
+		}
+	}
+}
+
+func TestEncodeINI(t *testing.T) {
+	values := map[string]string{
+		"top":          "1",
+		"db/host":      "db.example.com",
+		"db/banner":    "line one\nline two",
+		"db/padded":    " padded ",
+		"db/pool/size": "10",
+		"cache/size":   "5",
+	}
+	expected := "top = 1\n\n[cache]\nsize = 5\n\n[db]\nbanner = \"line one\\nline two\"\nhost = db.example.com\npadded = \" padded \"\n\n[db.pool]\nsize = 10\n"
+	encoded := EncodeINI(values)
+	if encoded != expected {
+		t.Fatalf("expected: %q, got: %q", expected, encoded)
+	}
+	/* step: the sections one level deep round trip */
+	delete(values, "db/pool/size")
+	decoded, err := ParseINI(EncodeINI(values))
+	if err != nil {
+		t.Fatalf("failed to parse the encoded ini, error: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, values) {
+		t.Errorf("the ini didn't round trip, expected: %v, got: %v", values, decoded)
+	}
+}
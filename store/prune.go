@@ -0,0 +1,135 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/gambol99/config-fs/store/fs"
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+const (
+	/* the orphaned files are logged, but left in place */
+	PRUNE_REPORT = "report"
+	/* the orphaned files are removed */
+	PRUNE_DELETE = "delete"
+)
+
+var InvalidPruneErr = errors.New("Invalid prune specified, must be either report or delete")
+
+/* Checks the prune option is one we support, empty disables */
+func ValidatePrune(prune string) error {
+	switch prune {
+	case "", PRUNE_REPORT, PRUNE_DELETE:
+		return nil
+	}
+	return InvalidPruneErr
+}
+
+/*
+	Finds the files under the mount point which none of the keys (or templates) produce, i.e. left over from a
+	missed deletion or created by hand, and depending on the prune option reports or removes them; the keys are
+	those seen in a complete listing of the store, so a failed listing never prunes anything. Our own files, the
+	hidden files, the trash and the backups are left alone. Returns the number of orphans found
+*/
+func (r *ConfigurationStore) PruneOrphans(keys map[string]bool) (int, error) {
+	base := r.BasePath()
+	if base == "" || !r.fs.IsDirectory(base) {
+		return 0, nil
+	}
+	/* step: the files we expect to find */
+	desired := map[string]bool{
+		DiskPath(base, HASHED_INDEX): true,
+	}
+	for _, file := range r.ExplodedFiles() {
+		desired[r.UnstagedPath(file)] = true
+	}
+	for path, _ := range keys {
+		if r.IsExploded(path) {
+			continue
+		}
+		desired[r.UnstagedPath(r.FilePath(path))] = true
+		desired[r.UnstagedPath(r.FullPath(path))] = true
+	}
+	r.RLock()
+	for _, computed := range r.destinations {
+		for destination, _ := range computed {
+			desired[r.UnstagedPath(r.DestinationPath(destination))] = true
+		}
+	}
+	r.RUnlock()
+
+	files, err := r.fs.Files(base)
+	if err != nil {
+		logger.Errorf("Failed to list the files under the mount point: %s, error: %s", base, err)
+		return 0, err
+	}
+	/* check: the orphans are only removed from a mount point which is ours, otherwise they're reported */
+	prune := r.options.prune
+	if prune == PRUNE_DELETE && r.GuardDeletion() != nil {
+		prune = PRUNE_REPORT
+	}
+	orphans := 0
+	seen := make(map[string]bool, 0)
+	for _, file := range files {
+		/* step: the files of the atomic directories are found in each of their generations */
+		if file = r.UnstagedPath(file); seen[file] || r.IsAtomicLink(file) {
+			continue
+		}
+		seen[file] = true
+		if desired[file] || r.IsInternalFile(file) {
+			continue
+		}
+		orphans++
+		metrics.Increment(metrics.ORPHANS_FOUND)
+		if prune == PRUNE_REPORT {
+			logger.Warningf("The file: %s is not produced by any of the keys in the store", file)
+			continue
+		}
+		logger.Infof("Removing the file: %s, it's not produced by any of the keys in the store", file)
+		staged := r.StagedPath(file)
+		if err := r.fs.Delete(staged); err != nil {
+			logger.Errorf("Failed to remove the orphaned file: %s, error: %s", file, err)
+			continue
+		}
+		r.PruneDirectory(r.fs.Dirname(staged))
+	}
+	return orphans, nil
+}
+
+/*
+	Checks if the file is one of our own rather than the file of a key, i.e. a temporary or lock file, a backup, in
+	the trash, or the sentinel, readiness or status file at the top of the mount point
+*/
+func (r *ConfigurationStore) IsInternalFile(full_path string) bool {
+	return IsInternalPath(r.options.cfg_directory, full_path)
+}
+
+/* As above, for the path beneath the mount point */
+func IsInternalPath(mount, full_path string) bool {
+	name := filepath.Base(full_path)
+	if IsInternalName(name) || strings.Contains(name, fs.BACKUP_SUFFIX) {
+		return true
+	}
+	if filepath.Dir(full_path) == mount {
+		switch name {
+		case MANAGED_SENTINEL, READY_FILE, STATUS_FILE, TRASH_DIRECTORY:
+			return true
+		}
+	}
+	return IsBeneath(filepath.Join(mount, TRASH_DIRECTORY), full_path)
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gambol99/config-fs/store/kv"
+)
+
+const (
+	/* the timestamp of the diffs captured */
+	QUARANTINE_TIMESTAMP = "20060102150405.000000000"
+	/* the permissions of the quarantine directory, the diffs may well contain secrets */
+	QUARANTINE_DIR_MODE = 0700
+)
+
+/*
+	Captures a unified diff between the local copy (prior to being reverted) and the content restored from
+	the store, i.e. /var/lib/config-fs/quarantine/app_db_password.20150102150405.000000000.diff, so operators can
+	see what a human or rogue process changed on the host; the content of masked keys isn't captured
+*/
+func (r *ConfigurationStore) Quarantine(path, local string) {
+	full_path := r.LocalPath(path)
+	restored := ""
+	if r.fs.IsFile(full_path) && !r.fs.IsSymlink(full_path) {
+		restored, _ = r.fs.Read(full_path)
+	}
+	now := time.Now().UTC()
+	report := fmt.Sprintf("# drift detected on key: %s, mount: %s, time: %s\n", path, r.options.cfg_directory, now.Format(time.RFC3339))
+	switch {
+	case local == restored:
+		report += "# the content is unchanged, the permissions, ownership or file type had been altered\n"
+	case kv.IsMasked(path):
+		report += "# the content had been altered, the key is masked so the diff is not captured\n"
+	default:
+		report += UnifiedDiff(path+" (local)", path+" (store)", local, restored)
+	}
+	if err := os.MkdirAll(r.options.quarantine_dir, QUARANTINE_DIR_MODE); err != nil {
+		logger.Errorf("Failed to create the quarantine directory: %s, error: %s", r.options.quarantine_dir, err)
+		return
+	}
+	name := fmt.Sprintf("%s.%s.diff", strings.Replace(strings.TrimPrefix(path, "/"), "/", "_", -1), now.Format(QUARANTINE_TIMESTAMP))
+	filename := filepath.Join(r.options.quarantine_dir, name)
+	if err := ioutil.WriteFile(filename, []byte(report), 0600); err != nil {
+		logger.Errorf("Failed to write the quarantine diff: %s, error: %s", filename, err)
+		return
+	}
+	logger.Infof("Captured the local changes to: %s in: %s", path, filename)
+}
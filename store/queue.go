@@ -0,0 +1,171 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/gambol99/config-fs/store/kv"
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+/*
+The changes from the store are queued for the event loop in a bounded channel; should the loop fall behind
+and the channel fill (i.e. an event storm), the overflow policy decides what happens to the events which follow
+
+  - block: the store is held up until there's room, nothing is lost though the watch falls behind
+  - coalesce: the events wait in order, the latest for each key superseding any before it, so a storm on a
+    handful of keys is applied as a handful of changes
+  - drop: the events are discarded (and counted), the mount point being reconciled against the store to
+    recover whatever was missed
+*/
+const (
+	OVERFLOW_BLOCK    = "block"
+	OVERFLOW_COALESCE = "coalesce"
+	OVERFLOW_DROP     = "drop"
+	/* the number of events queued for the event loop by default */
+	DEFAULT_QUEUE_SIZE = 1000
+)
+
+var (
+	InvalidOverflowErr  = errors.New("Invalid overflow policy, must be block, coalesce or drop")
+	InvalidQueueSizeErr = errors.New("The size of the event queue must be greater than zero")
+)
+
+/* Checks the overflow policy is one we know of */
+func ValidateOverflow(policy string) error {
+	switch policy {
+	case OVERFLOW_BLOCK, OVERFLOW_COALESCE, OVERFLOW_DROP:
+		return nil
+	}
+	return InvalidOverflowErr
+}
+
+/* The bounded queue of the changes from the store, applying the overflow policy once full */
+type EventQueue struct {
+	/* the overflow policy */
+	policy string
+	/* the channel the store sends the changes on */
+	input kv.NodeUpdateChannel
+	/* the bounded channel the event loop receives them from */
+	output kv.NodeUpdateChannel
+	/* the events waiting on room in the channel, by key, and the order of the keys */
+	pending map[string]kv.NodeChange
+	order   []string
+	/* set when an event has been dropped, the mount point needs reconciling */
+	dropped int32
+	/* closed to stop the queue, and by the queue once stopped */
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+/* Create and start the queue */
+func NewEventQueue(size int, policy string) *EventQueue {
+	queue := &EventQueue{
+		policy:  policy,
+		input:   make(kv.NodeUpdateChannel),
+		output:  make(kv.NodeUpdateChannel, size),
+		pending: make(map[string]kv.NodeChange, 0),
+		order:   make([]string, 0),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go queue.Run()
+	return queue
+}
+
+/* Forward the events into the channel until stopped, the events pending are flushed into it as room is made */
+func (r *EventQueue) Run() {
+	defer close(r.stopped)
+	for {
+		/* step: the next of the events waiting on room, if any */
+		var output kv.NodeUpdateChannel
+		var next kv.NodeChange
+		if len(r.order) > 0 {
+			output, next = r.output, r.pending[r.order[0]]
+		}
+		/* note: when blocking, we stop receiving while an event waits, so the store is held up */
+		input := r.input
+		if r.policy == OVERFLOW_BLOCK && output != nil {
+			input = nil
+		}
+		select {
+		case event := <-input:
+			r.Add(event)
+		case output <- next:
+			delete(r.pending, r.order[0])
+			r.order = r.order[1:]
+		case <-r.stop:
+			/* step: the event loop keeps receiving until the sources are closed, so nothing pending is lost */
+			for _, key := range r.order {
+				r.output <- r.pending[key]
+			}
+			return
+		}
+		metrics.Set(metrics.EVENT_QUEUE_DEPTH, int64(len(r.output)+len(r.order)))
+	}
+}
+
+/* Queue the event, applying the overflow policy if there's no room */
+func (r *EventQueue) Add(event kv.NodeChange) {
+	/* step: with nothing waiting, the event goes straight into the channel if there's room */
+	if len(r.order) <= 0 {
+		select {
+		case r.output <- event:
+			return
+		default:
+		}
+	}
+	/* note: a resync is never superseded by a change to the prefix */
+	key := event.Node.Path
+	if event.Operation == kv.RESYNC {
+		key = ""
+	}
+	switch r.policy {
+	case OVERFLOW_DROP:
+		logger.V(VERBOSE_INFO).Infof("The event queue is full, dropping the event on key: %s", key)
+		metrics.Increment(metrics.EVENTS_DROPPED)
+		atomic.StoreInt32(&r.dropped, 1)
+		return
+	case OVERFLOW_COALESCE:
+		/* step: the key moves to the back with its latest event, so it's never applied ahead of a change before it */
+		if _, found := r.pending[key]; found {
+			metrics.Increment(metrics.EVENTS_COALESCED)
+			for index, queued := range r.order {
+				if queued == key {
+					r.order = append(r.order[:index], r.order[index+1:]...)
+					break
+				}
+			}
+		}
+	}
+	r.pending[key] = event
+	r.order = append(r.order, key)
+}
+
+/* Checks if any events have been dropped since last asked, the mount point needs reconciling */
+func (r *EventQueue) Dropped() bool {
+	return atomic.CompareAndSwapInt32(&r.dropped, 1, 0)
+}
+
+/* Stop the queue, flushing the events pending into the channel; the event loop must be receiving */
+func (r *EventQueue) Close() {
+	select {
+	case <-r.stopped:
+	default:
+		close(r.stop)
+		<-r.stopped
+	}
+}
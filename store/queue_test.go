@@ -0,0 +1,156 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gambol99/config-fs/store/kv"
+)
+
+/* a queue which isn't running, so the events added stay where the overflow policy put them */
+func newTestQueue(size int, policy string) *EventQueue {
+	return &EventQueue{
+		policy:  policy,
+		output:  make(kv.NodeUpdateChannel, size),
+		pending: make(map[string]kv.NodeChange, 0),
+		order:   make([]string, 0),
+	}
+}
+
+func changed(path, value string) kv.NodeChange {
+	return kv.NodeChange{Node: kv.Node{Path: path, Value: value}, Operation: kv.CHANGED}
+}
+
+func resync(path string) kv.NodeChange {
+	return kv.NodeChange{Node: kv.Node{Path: path, Directory: true}, Operation: kv.RESYNC}
+}
+
+func TestValidateOverflow(t *testing.T) {
+	for _, policy := range []string{OVERFLOW_BLOCK, OVERFLOW_COALESCE, OVERFLOW_DROP} {
+		if err := ValidateOverflow(policy); err != nil {
+			t.Errorf("the policy: %s should be valid, error: %s", policy, err)
+		}
+	}
+	if err := ValidateOverflow("discard"); err != InvalidOverflowErr {
+		t.Errorf("the policy: discard should be invalid, got: %v", err)
+	}
+}
+
+func TestEventQueueAdd(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		size    int
+		events  []kv.NodeChange
+		output  []kv.NodeChange
+		pending []kv.NodeChange
+		dropped bool
+	}{
+		{
+			name:   "room in the channel",
+			policy: OVERFLOW_DROP,
+			size:   3,
+			events: []kv.NodeChange{changed("/a", "1"), changed("/b", "1"), changed("/a", "2")},
+			output: []kv.NodeChange{changed("/a", "1"), changed("/b", "1"), changed("/a", "2")},
+		},
+		{
+			name:    "block waits on room",
+			policy:  OVERFLOW_BLOCK,
+			size:    1,
+			events:  []kv.NodeChange{changed("/a", "1"), changed("/b", "1")},
+			output:  []kv.NodeChange{changed("/a", "1")},
+			pending: []kv.NodeChange{changed("/b", "1")},
+		},
+		{
+			name:    "coalesce keeps the latest for each key",
+			policy:  OVERFLOW_COALESCE,
+			size:    1,
+			events:  []kv.NodeChange{changed("/a", "1"), changed("/b", "1"), changed("/a", "2"), changed("/c", "1"), changed("/b", "2")},
+			output:  []kv.NodeChange{changed("/a", "1")},
+			pending: []kv.NodeChange{changed("/a", "2"), changed("/c", "1"), changed("/b", "2")},
+		},
+		{
+			name:    "coalesce never merges a resync with a change to the prefix",
+			policy:  OVERFLOW_COALESCE,
+			size:    1,
+			events:  []kv.NodeChange{changed("/a", "1"), resync("/"), changed("/", "1"), resync("/")},
+			output:  []kv.NodeChange{changed("/a", "1")},
+			pending: []kv.NodeChange{changed("/", "1"), resync("/")},
+		},
+		{
+			name:    "drop discards the overflow",
+			policy:  OVERFLOW_DROP,
+			size:    1,
+			events:  []kv.NodeChange{changed("/a", "1"), changed("/b", "1"), changed("/a", "2")},
+			output:  []kv.NodeChange{changed("/a", "1")},
+			dropped: true,
+		},
+	}
+	for _, test := range tests {
+		queue := newTestQueue(test.size, test.policy)
+		for _, event := range test.events {
+			queue.Add(event)
+		}
+		output := make([]kv.NodeChange, 0)
+		for len(queue.output) > 0 {
+			output = append(output, <-queue.output)
+		}
+		if !reflect.DeepEqual(output, test.output) {
+			t.Errorf("%s: expected the channel to hold: %v, got: %v", test.name, test.output, output)
+		}
+		pending := make([]kv.NodeChange, 0)
+		for _, key := range queue.order {
+			pending = append(pending, queue.pending[key])
+		}
+		if test.pending == nil {
+			test.pending = []kv.NodeChange{}
+		}
+		if !reflect.DeepEqual(pending, test.pending) {
+			t.Errorf("%s: expected the events pending: %v, got: %v", test.name, test.pending, pending)
+		}
+		if len(queue.pending) != len(queue.order) {
+			t.Errorf("%s: the events pending: %d don't match the keys ordered: %d", test.name, len(queue.pending), len(queue.order))
+		}
+		if dropped := queue.Dropped(); dropped != test.dropped {
+			t.Errorf("%s: expected dropped to be: %t, got: %t", test.name, test.dropped, dropped)
+		}
+		if queue.Dropped() {
+			t.Errorf("%s: dropped should be reset once asked", test.name)
+		}
+	}
+}
+
+func TestEventQueueClose(t *testing.T) {
+	queue := NewEventQueue(1, OVERFLOW_COALESCE)
+	for _, event := range []kv.NodeChange{changed("/a", "1"), changed("/b", "1"), changed("/a", "2")} {
+		queue.input <- event
+	}
+	received := make(chan []kv.NodeChange)
+	go func() {
+		list := make([]kv.NodeChange, 0)
+		for event := range queue.output {
+			list = append(list, event)
+		}
+		received <- list
+	}()
+	queue.Close()
+	queue.Close()
+	close(queue.output)
+	list := <-received
+	if len(list) == 0 || list[len(list)-1] != changed("/a", "2") {
+		t.Errorf("expected the latest event to be flushed on close, got: %v", list)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+var QuotaExceededErr = errors.New("The write would exceed the quota of the mount point")
+
+/*
+	Tracks the bytes written under the mount point, refusing any write which would take the total over
+	the limit, so a runaway key import cannot fill the filesystem. The files are accounted by their path
+	relative to the mount point, so the generations of the atomic swap (hard links) are only counted once
+*/
+type DiskQuota struct {
+	sync.Mutex
+	/* the maximum number of bytes */
+	limit int64
+	/* the number of bytes presently used */
+	used int64
+	/* the size of the files, relative path => bytes */
+	usage map[string]int64
+	/* the mount point */
+	directory string
+	/* indicates the mount point holds the generations of the atomic swap */
+	generations bool
+}
+
+/* Create a quota of limit bytes for the mount point */
+func NewDiskQuota(limit int64, directory string, generations bool) *DiskQuota {
+	return &DiskQuota{
+		limit:       limit,
+		usage:       make(map[string]int64, 0),
+		directory:   directory,
+		generations: generations,
+	}
+}
+
+/* Maps a file under the mount point (or a generation directory) to the path relative to the mount point */
+func (r *DiskQuota) RelativePath(full_path string) string {
+	path, found := DiskKey(r.directory, full_path)
+	if !found {
+		return filepath.ToSlash(full_path)
+	}
+	if r.generations && strings.HasPrefix(path, "/"+GENERATION_PREFIX) {
+		if index := strings.Index(path[1:], "/"); index >= 0 {
+			return path[index+1:]
+		}
+		return "/"
+	}
+	return path
+}
+
+/* Record the size of the files already present under the path, i.e. from a previous run */
+func (r *DiskQuota) Scan(base string) error {
+	return filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		/* step: the backups, trash and any temporary files left behind are not accounted, the hidden keys are */
+		internal := IsInternalPath(r.directory, path)
+		if info.IsDir() && path != base && internal {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && !internal {
+			r.Lock()
+			relative := r.RelativePath(path)
+			r.used += info.Size() - r.usage[relative]
+			r.usage[relative] = info.Size()
+			r.Unlock()
+		}
+		return nil
+	})
+}
+
+func (r *DiskQuota) Allowance(path string) int64 {
+	r.Lock()
+	defer r.Unlock()
+	allowance := r.limit - r.used + r.usage[r.RelativePath(path)]
+	if allowance < 0 {
+		return 0
+	}
+	return allowance
+}
+
+func (r *DiskQuota) Reserve(path string, size int64) error {
+	r.Lock()
+	defer r.Unlock()
+	relative := r.RelativePath(path)
+	used := r.used - r.usage[relative] + size
+	if used > r.limit {
+		logger.Errorf("Refusing the write to file: %s, the mount point would exceed the quota: %d bytes, used: %d bytes",
+			path, r.limit, r.used)
+		metrics.Increment(metrics.QUOTA_EXCEEDED)
+		return QuotaExceededErr
+	}
+	r.used, r.usage[relative] = used, size
+	metrics.Set(metrics.QUOTA_USED, r.used)
+	return nil
+}
+
+func (r *DiskQuota) Release(path string) {
+	r.Lock()
+	defer r.Unlock()
+	relative := r.RelativePath(path)
+	for item, size := range r.usage {
+		if item == relative || relative == "/" || strings.HasPrefix(item, relative+"/") {
+			r.used -= size
+			delete(r.usage, item)
+		}
+	}
+	metrics.Set(metrics.QUOTA_USED, r.used)
+}
+
+/* Retrieve the number of bytes presently used */
+func (r *DiskQuota) Used() int64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.used
+}
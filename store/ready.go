@@ -0,0 +1,172 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+	The mount point is ready once the initial build, and every render of the templates, has succeeded; the .ready
+	file is then written at the top of the mount point and the readiness flipped, so an orchestrator or a dependent
+	service can wait on the configuration being complete. A mount point whose initial sync is skipped (i.e. frozen
+	or pinned) or left files failed becomes ready on the first full reconciliation which succeeds in full. Once
+	ready, a mount point stays so; a .ready left behind by a previous run is removed on startup
+*/
+const (
+	READY_FILE = ".ready"
+	READY_NAME = "config_fs_ready"
+)
+
+/* the readiness of the mount points, published as an expvar */
+var readiness = struct {
+	sync.RWMutex
+	mounts map[string]*Readiness
+}{mounts: make(map[string]*Readiness, 0)}
+
+func init() {
+	expvar.Publish(READY_NAME, expvar.Func(func() interface{} {
+		readiness.RLock()
+		defer readiness.RUnlock()
+		mounts := make(map[string]bool, len(readiness.mounts))
+		for mount, ready := range readiness.mounts {
+			mounts[mount] = ready.IsReady()
+		}
+		return mounts
+	}))
+}
+
+/* The readiness of a mount point */
+type Readiness struct {
+	/* a lock for the error of the templates and the start of the sync */
+	sync.RWMutex
+	/* the mount point */
+	mount string
+	/* closed once ready */
+	ready chan struct{}
+	/* closes the above the once */
+	once sync.Once
+	/* the error of the last render of the templates, if any failed */
+	rendered error
+	/* the time the sync started, the files failed before are of a previous run */
+	since time.Time
+}
+
+/* Create the readiness of the mount point, published along with those of the other mount points */
+func NewReadiness(mount string) *Readiness {
+	ready := &Readiness{mount: mount, ready: make(chan struct{})}
+	readiness.Lock()
+	defer readiness.Unlock()
+	readiness.mounts[mount] = ready
+	return ready
+}
+
+/* A channel closed once the mount point is ready */
+func (r *Readiness) Ready() <-chan struct{} {
+	return r.ready
+}
+
+/* Checks if the mount point is ready */
+func (r *Readiness) IsReady() bool {
+	select {
+	case <-r.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+/* Record the outcome of the last render of the templates */
+func (r *Readiness) SetRendered(err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.rendered = err
+}
+
+/* The error of the last render of the templates, if any failed */
+func (r *Readiness) Rendered() error {
+	r.RLock()
+	defer r.RUnlock()
+	return r.rendered
+}
+
+/* Flip the readiness, returning true if it wasn't already */
+func (r *Readiness) Flip() bool {
+	flipped := false
+	r.once.Do(func() {
+		close(r.ready)
+		flipped = true
+	})
+	return flipped
+}
+
+/* A channel closed once the mount point is ready, i.e. the initial sync and renders have succeeded */
+func (r *ConfigurationStore) Ready() <-chan struct{} {
+	return r.readiness.Ready()
+}
+
+/* The path of the file written once the mount point is ready */
+func (r *ConfigurationStore) ReadyPath() string {
+	return filepath.Join(r.options.cfg_directory, READY_FILE)
+}
+
+/* Remove the .ready file left by a previous run, the mount point is no longer known to be complete */
+func (r *ConfigurationStore) ResetReady() {
+	r.readiness.Lock()
+	r.readiness.since = time.Now().UTC()
+	r.readiness.Unlock()
+	if r.options.dry_run {
+		return
+	}
+	if err := os.Remove(r.ReadyPath()); err != nil && !os.IsNotExist(err) {
+		logger.Errorf("Failed to remove the stale ready file: %s, error: %s", r.ReadyPath(), err)
+	}
+}
+
+/*
+	Flips the readiness once the mount point has been synchronized in full, i.e. none of the files written since
+	the sync started have failed and the templates have all rendered; the .ready file is written beforehand, so
+	it's in place by the time anyone waiting on the readiness looks for it
+*/
+func (r *ConfigurationStore) CheckReady() {
+	if r.readiness.IsReady() {
+		return
+	}
+	r.readiness.RLock()
+	since := r.readiness.since
+	r.readiness.RUnlock()
+	if failed := states.FailedSince(r.options.cfg_directory, since); len(failed) > 0 {
+		logger.Warningf("The mount point: %s is not yet ready, %d files failed to be written", r.options.cfg_directory, len(failed))
+		return
+	}
+	if err := r.readiness.Rendered(); err != nil {
+		logger.Warningf("The mount point: %s is not yet ready, the templates failed to render, error: %s", r.options.cfg_directory, err)
+		return
+	}
+	if !r.options.dry_run {
+		if err := ioutil.WriteFile(r.ReadyPath(), []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), os.FileMode(r.options.file_mode)); err != nil {
+			logger.Errorf("Failed to write the ready file: %s, error: %s", r.ReadyPath(), err)
+			return
+		}
+	}
+	if r.readiness.Flip() {
+		logger.Infof("The mount point: %s has been synchronized in full and is ready", r.options.cfg_directory)
+		r.UpdateStatus()
+	}
+}
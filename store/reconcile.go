@@ -0,0 +1,335 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"github.com/gambol99/config-fs/store/kv"
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+/* A summary of the drift corrected by a reconciliation */
+type Reconciliation struct {
+	/* the files created, i.e. a missed creation or a file removed locally */
+	Created int
+	/* the files whose content or attributes were corrected */
+	Updated int
+	/* the files of the keys no longer in the store, i.e. a missed deletion */
+	Deleted int
+	/* the files under the mount point none of the keys produce, when pruning */
+	Orphans int
+	/* the files left as they were, only counted by the startup report */
+	Unchanged int
+	/* the keys which failed to be reconciled, so are left outstanding in the journal */
+	failed map[string]bool
+}
+
+/* Record the key as having failed to be reconciled */
+func (r *Reconciliation) Failed(path string) {
+	if r.failed == nil {
+		r.failed = make(map[string]bool, 0)
+	}
+	r.failed[path] = true
+}
+
+/* The number of files corrected */
+func (r *Reconciliation) Total() int {
+	return r.Created + r.Updated + r.Deleted
+}
+
+/* Request the event loop reconciles the mount point now, as on the refresh interval; ignored if the loop isn't running */
+func (r *ConfigurationStore) Resync() {
+	r.RequestResync("")
+}
+
+/*
+	Request the event loop reconciles the keys beneath the prefix now, in full should the prefix hold the root of the
+	mount point; the error is UnknownPrefixErr if none of the keys of the mount point are beneath it
+*/
+func (r *ConfigurationStore) ResyncPrefix(prefix string) error {
+	prefix = CleanKey(prefix)
+	root := CleanKey(r.options.root_key)
+	switch {
+	case prefix == root || IsBeneathKey(prefix, root):
+		r.RequestResync("")
+	case IsBeneathKey(root, prefix):
+		r.RequestResync(prefix)
+	default:
+		return UnknownPrefixErr
+	}
+	return nil
+}
+
+/* Hand the prefix to be reconciled (empty for the whole of the mount point) to the event loop, if it's running */
+func (r *ConfigurationStore) RequestResync(prefix string) {
+	if r.done == nil {
+		return
+	}
+	select {
+	case r.resyncChannel <- prefix:
+	case <-r.done:
+	}
+}
+
+/* Reconcile the keys beneath the prefix against the store, as requested */
+func (r *ConfigurationStore) HandleResyncEvent(ctx context.Context, prefix string) {
+	sequence := r.journal.Sequence()
+	var summary *Reconciliation
+	published := r.Transaction(func() {
+		var err error
+		if summary, err = r.ReconcilePrefix(ctx, prefix); err != nil {
+			logger.Errorf("Failed to reconcile the keys beneath: %s against the store, error: %s", prefix, err)
+			return
+		}
+		logger.Infof("Reconciled the keys beneath: %s against the store, created: %d, updated: %d, deleted: %d files",
+			prefix, summary.Created, summary.Updated, summary.Deleted)
+	})
+	r.CompleteReconciled(prefix, sequence, published, summary)
+	r.SaveSyncState()
+	r.SaveHashIndex()
+}
+
+/*
+	Performs a full reconciliation of the mount point against the store; each key is compared against the content
+	on disk and created or updated as required, the files computed by the templates are restored from their rendered
+	content and the files of any keys we've materialized which are no longer in the store are removed; when pruning,
+	the files none of the keys produce are then reported or removed
+*/
+func (r *ConfigurationStore) Reconcile(ctx context.Context) (*Reconciliation, error) {
+	return r.ReconcilePrefix(ctx, r.options.root_key)
+}
+
+/*
+	Reconciles the keys beneath the prefix (a directory or a key beneath the root) as above; the orphans are only
+	pruned by a reconciliation of the whole of the mount point, the keys elsewhere being unseen
+*/
+func (r *ConfigurationStore) ReconcilePrefix(ctx context.Context, prefix string) (*Reconciliation, error) {
+	summary := new(Reconciliation)
+	keys := make(map[string]bool, 0)
+	full := CleanKey(prefix) == CleanKey(r.options.root_key)
+	beneath := func(key string) bool {
+		return full || key == prefix || IsBeneathKey(prefix, key)
+	}
+	r.progress.Start(PROGRESS_RECONCILE, r.options.progress_interval)
+	defer r.progress.Finish()
+	/* step: the content rejected by the verifications is given another chance */
+	r.verifying.Forget()
+	if err := r.ReconcileKey(ctx, prefix, full, keys, summary); err != nil {
+		return nil, err
+	}
+	/* check: a cancelled reconciliation stops short, the keys unseen must not be taken as deleted */
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	/* step: the files computed by the templates */
+	r.RLock()
+	destinations := make([]string, 0)
+	for _, computed := range r.destinations {
+		for destination, _ := range computed {
+			if beneath(destination) {
+				destinations = append(destinations, destination)
+			}
+		}
+	}
+	r.RUnlock()
+	for _, destination := range destinations {
+		r.ReconcileFile(destination, r.DestinationPath(destination), summary, func() error {
+			return r.RevertLocalChange(ctx, destination)
+		})
+	}
+	/* step: the keys we've materialized which have since been deleted from the store */
+	r.RLock()
+	materialized := make([]string, 0)
+	for path, _ := range r.attributes {
+		if !keys[path] && beneath(path) {
+			materialized = append(materialized, path)
+		}
+	}
+	r.RUnlock()
+	for _, path := range materialized {
+		/* check: the key may have been created since we listed the store */
+		if _, err := r.kv.Get(ctx, path); err == nil {
+			continue
+		} else if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		full_path := r.FullPath(path)
+		logger.V(VERBOSE_INFO).Infof("The key: %s is no longer in the store, removing the file: %s", path, full_path)
+		/* note: the file may have been removed locally as well, in which case we only forget the key */
+		existed := r.fs.Exists(full_path)
+		if err := r.RemoveStoreConfigFile(path, full_path); err != nil {
+			summary.Failed(path)
+			continue
+		}
+		r.PruneDirectory(r.fs.Dirname(full_path))
+		if existed {
+			summary.Deleted++
+		}
+	}
+	/* step: the files under the mount point none of the keys produce */
+	if r.options.prune != "" && full {
+		orphans, err := r.PruneOrphans(keys)
+		if err != nil {
+			return nil, err
+		}
+		summary.Orphans = orphans
+		if r.options.prune == PRUNE_DELETE {
+			summary.Deleted += orphans
+		}
+	}
+	metrics.Add(metrics.DRIFT_RECONCILED, int64(summary.Total()))
+	r.status.Drifted(int64(summary.Total()))
+	return summary, nil
+}
+
+/* Reconciles the key, or the keys beneath it should it be a directory (as the root always is), recording the keys seen */
+func (r *ConfigurationStore) ReconcileKey(ctx context.Context, path string, directory bool, keys map[string]bool, summary *Reconciliation) error {
+	if !directory {
+		node, err := r.kv.Get(ctx, path)
+		if err != nil {
+			return err
+		}
+		if node.IsFile() {
+			if ValidateKey(node.Path) == nil && !IsMetadataKey(node.Path) && r.filter.IsIncluded(node.Path) {
+				keys[node.Path] = true
+				r.ReconcileNode(ctx, node, summary)
+			}
+			return nil
+		}
+	}
+	return r.ReconcileDirectory(ctx, path, keys, summary)
+}
+
+/* Reconciles the keys beneath the directory, a pass for each of the priorities beneath it, recording the keys seen */
+func (r *ConfigurationStore) ReconcileDirectory(ctx context.Context, directory string, keys map[string]bool, summary *Reconciliation) error {
+	for index, level := range r.options.priorities.Levels(directory) {
+		if index > 0 {
+			r.progress.Relisted()
+		}
+		if err := r.ReconcilePass(ctx, directory, level, keys, summary); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Reconciles the keys of the priority beneath the directory, recording the keys seen */
+func (r *ConfigurationStore) ReconcilePass(ctx context.Context, directory string, level int, keys map[string]bool, summary *Reconciliation) error {
+	listing, err := r.kv.List(ctx, directory)
+	if err != nil {
+		logger.Errorf("Failed to get listing from directory: %s, error: %s", directory, err)
+		return err
+	}
+	/* step: the metadata of the directory must be in place before anything beneath it */
+	metadata := ""
+	for _, node := range listing {
+		if node.IsFile() && IsMetadataKey(node.Path) {
+			metadata = node.Value
+		}
+	}
+	r.SetMetadata(CleanKey(directory), metadata)
+	listing = r.PassListing(listing, level)
+	r.progress.Listed(r.CountListing(listing))
+	for _, node := range listing {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if ValidateKey(node.Path) != nil || IsMetadataKey(node.Path) {
+			continue
+		}
+		switch {
+		case node.IsFile():
+			if !r.filter.IsIncluded(node.Path) {
+				continue
+			}
+			keys[node.Path] = true
+			r.ReconcileNode(ctx, node, summary)
+			r.progress.Processed(len(node.Value))
+		case node.IsDir() && r.IsAggregate(node.Path) && r.filter.IsTraversable(node.Path):
+			/* step: the directory is materialized as a single file of its keys */
+			keys[node.Path] = true
+			r.ReconcileFile(node.Path, r.FilePath(node.Path), summary, func() error {
+				return r.UpdateAggregate(ctx, node.Path)
+			})
+			r.progress.Processed(0)
+		case node.IsDir():
+			if !r.filter.IsTraversable(node.Path) {
+				continue
+			}
+			if err := r.ReconcilePass(ctx, node.Path, level, keys, summary); err != nil {
+				return err
+			}
+		}
+		/* step: the document of the directory, as well as the files of its keys */
+		if node.IsDir() && r.IsDocument(node.Path) && r.filter.IsTraversable(node.Path) && r.options.priorities.Of(node.Path) == level {
+			directory, document := node.Path, DocumentKey(node.Path)
+			keys[document] = true
+			r.ReconcileFile(document, r.FilePath(document), summary, func() error {
+				return r.UpdateDocument(ctx, directory)
+			})
+		}
+	}
+	return nil
+}
+
+/* Reconciles the file of the key; the templates are restored from their rendered content rather than recreated */
+func (r *ConfigurationStore) ReconcileNode(ctx context.Context, node *kv.Node, summary *Reconciliation) {
+	if _, found := r.dynamic.IsDynamic(node.Path); found {
+		r.ReconcileFile(node.Path, r.FullPath(node.Path), summary, func() error {
+			return r.RevertLocalChange(ctx, node.Path)
+		})
+		return
+	}
+	if r.IsExplodedValue(node) {
+		r.ReconcileFile(node.Path, r.ExplodedPath(node.Path), summary, func() error {
+			return r.UpdateExploded(ctx, node)
+		})
+		return
+	}
+	r.ReconcileFile(node.Path, r.FilePath(node.Path), summary, func() error {
+		return r.UpdateStoreConfigFile(ctx, node)
+	})
+}
+
+/*
+	Marks the changes in the journal beneath the prefix, received ahead of the reconciliation, as done once it has
+	been published, bar those of the keys it failed on; i.e. a change rejected by the validation, since applied
+*/
+func (r *ConfigurationStore) CompleteReconciled(prefix string, sequence uint64, published bool, summary *Reconciliation) {
+	if !published || summary == nil {
+		return
+	}
+	r.journal.CompleteBeneath(prefix, sequence, summary.failed)
+}
+
+/* Applies the update to the file, recording whether anything was corrected */
+func (r *ConfigurationStore) ReconcileFile(path, full_path string, summary *Reconciliation, update func() error) {
+	before := r.Fingerprint(full_path)
+	if err := update(); err != nil {
+		logger.Errorf("Failed to reconcile the file: %s, error: %s", full_path, err)
+		summary.Failed(path)
+		return
+	}
+	after := r.Fingerprint(full_path)
+	switch {
+	case before == after:
+	case before == "":
+		logger.V(VERBOSE_INFO).Infof("Reconciled the file: %s of key: %s, the file was missing", full_path, path)
+		summary.Created++
+	default:
+		logger.V(VERBOSE_INFO).Infof("Reconciled the file: %s of key: %s, the file had drifted", full_path, path)
+		summary.Updated++
+		r.NotifyWebhooks(WEBHOOK_DRIFT_REPAIRED, path, full_path)
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	The mount point is reconciled against the store on the -interval, unless a -reconcile_schedule is given; either
+	a cron expression (minute, hour, day of month, month and day of week, in local time) the full reconciliations
+	are run on, i.e. only during the off-peak hours, or never, in which case the mount point is only ever changed
+	by the events of the store (a reconciliation can still be requested, i.e. by a SIGHUP)
+*/
+const (
+	/* the mount point is never reconciled on a schedule */
+	SCHEDULE_NEVER = "never"
+	/* the furthest ahead we look for the next time of a schedule, beyond which it never fires, i.e. 30 2 31 2 * */
+	MAX_SCHEDULE_LOOKAHEAD = 5 * 366 * 24 * time.Hour
+)
+
+var InvalidScheduleErr = errors.New("Invalid reconcile schedule, must be never or a cron expression, i.e. 0 2 * * *")
+
+/* the shorthands of the cron expressions */
+var ScheduleShorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+/* A cron expression, each field the set of values it matches */
+type CronSchedule struct {
+	minutes  map[int]bool
+	hours    map[int]bool
+	days     map[int]bool
+	months   map[int]bool
+	weekdays map[int]bool
+	/* set when the day of month or week is restricted, either matching when both are, as with cron */
+	anyDay     bool
+	anyWeekday bool
+}
+
+/* Checks the schedule is one we can parse, empty uses the interval */
+func ValidateSchedule(schedule string) error {
+	if schedule == "" || schedule == SCHEDULE_NEVER {
+		return nil
+	}
+	_, err := ParseCronSchedule(schedule)
+	return err
+}
+
+/* Parse the cron expression, i.e. 0 2 * * 1-5, 0,30 0-6 * * * or @daily */
+func ParseCronSchedule(expression string) (*CronSchedule, error) {
+	expression = strings.TrimSpace(expression)
+	if shorthand, found := ScheduleShorthands[expression]; found {
+		expression = shorthand
+	}
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, InvalidScheduleErr
+	}
+	schedule := new(CronSchedule)
+	var err error
+	if schedule.minutes, err = ParseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if schedule.hours, err = ParseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if schedule.days, err = ParseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if schedule.months, err = ParseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if schedule.weekdays, err = ParseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	/* note: sunday is either 0 or 7 */
+	if schedule.weekdays[7] {
+		schedule.weekdays[0] = true
+	}
+	schedule.anyDay, schedule.anyWeekday = fields[2] == "*", fields[4] == "*"
+	return schedule, nil
+}
+
+/* Parse a field of the expression, a comma separated list of *, a value or a range, each with an optional /step */
+func ParseCronField(field string, minimum, maximum int) (map[int]bool, error) {
+	values := make(map[int]bool, 0)
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if index := strings.Index(item, "/"); index >= 0 {
+			var err error
+			if step, err = strconv.Atoi(item[index+1:]); err != nil || step <= 0 {
+				return nil, InvalidScheduleErr
+			}
+			item = item[:index]
+		}
+		low, high := minimum, maximum
+		switch {
+		case item == "*":
+		case strings.Contains(item, "-"):
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, InvalidScheduleErr
+			}
+			if high, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, InvalidScheduleErr
+			}
+		default:
+			value, err := strconv.Atoi(item)
+			if err != nil {
+				return nil, InvalidScheduleErr
+			}
+			low, high = value, value
+			/* note: a value with a step runs from the value to the maximum, i.e. 5/15 */
+			if step > 1 {
+				high = maximum
+			}
+		}
+		if low < minimum || high > maximum || low > high {
+			return nil, InvalidScheduleErr
+		}
+		for value := low; value <= high; value += step {
+			values[value] = true
+		}
+	}
+	return values, nil
+}
+
+/* Checks if the day matches the day of month and week; when both are restricted, either matching will do */
+func (r *CronSchedule) matchesDay(t time.Time) bool {
+	day, weekday := r.days[t.Day()], r.weekdays[int(t.Weekday())]
+	if !r.anyDay && !r.anyWeekday {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+/*
+	The next time after the one given the schedule fires, or the zero time if it never does. As with cron, a time the
+	clocks go forward over fires as they change, and a fixed hour the clocks go back over fires the once, though a
+	schedule firing every hour still fires in the hour repeated
+*/
+func (r *CronSchedule) Next(after time.Time) time.Time {
+	next := after.Truncate(time.Minute).Add(time.Minute)
+	limit := after.Add(MAX_SCHEDULE_LOOKAHEAD)
+	for next.Before(limit) {
+		var following time.Time
+		switch {
+		case !r.months[int(next.Month())] || !r.matchesDay(next):
+			following = wallClock(next, next.Day()+1, 0)
+		case !r.hours[next.Hour()] || r.isRepeated(next):
+			following = wallClock(next, next.Day(), next.Hour()+1)
+		case !r.minutes[next.Minute()]:
+			following = next.Add(time.Minute)
+		default:
+			return next
+		}
+		if r.isSkipped(next, following) {
+			return following
+		}
+		next = following
+	}
+	return time.Time{}
+}
+
+/* Checks if the clocks went back over the hour, which has already fired, unless the schedule fires every hour */
+func (r *CronSchedule) isRepeated(t time.Time) bool {
+	return len(r.hours) < 24 && t.Add(-time.Hour).Hour() == t.Hour()
+}
+
+/*
+	Checks if the clocks went forward between the times, over a time the schedule fires at; the next time is always
+	when the clocks changed, or on a day the schedule doesn't fire
+*/
+func (r *CronSchedule) isSkipped(from, to time.Time) bool {
+	_, before := from.Zone()
+	_, after := to.Zone()
+	if after <= before {
+		return false
+	}
+	changed := time.Date(to.Year(), to.Month(), to.Day(), to.Hour(), to.Minute(), 0, 0, time.UTC)
+	for wall := changed.Add(-time.Duration(after-before) * time.Second); wall.Before(changed); wall = wall.Add(time.Minute) {
+		if r.months[int(wall.Month())] && r.matchesDay(wall) && r.hours[wall.Hour()] && r.minutes[wall.Minute()] {
+			return true
+		}
+	}
+	return false
+}
+
+/* The time the wall clock reaches the hour of the day, or if the clocks went forward over it, the time they changed */
+func wallClock(t time.Time, day, hour int) time.Time {
+	wall := time.Date(t.Year(), t.Month(), day, hour, 0, 0, 0, t.Location())
+	expected := time.Date(t.Year(), t.Month(), day, hour, 0, 0, 0, time.UTC)
+	if wall.Day() == expected.Day() && wall.Hour() == expected.Hour() {
+		return wall
+	}
+	/* note: the hour doesn't exist, the time given lies before the change, so the change is the hour in its offset */
+	_, offset := wall.Zone()
+	return expected.Add(-time.Duration(offset) * time.Second).In(t.Location())
+}
+
+/* The timer of the reconciliations, firing on the interval, the cron schedule, or never */
+type ReconcileTimer struct {
+	/* the channel the reconciliations are due on */
+	C <-chan time.Time
+	/* the ticker of the interval, if any */
+	ticker *time.Ticker
+	/* closed to stop the schedule */
+	stop chan struct{}
+	/* closes the above the once */
+	stopper sync.Once
+}
+
+/* Create the timer of the reconciliations, on the schedule if given, otherwise the interval */
+func NewReconcileTimer(schedule string, interval time.Duration) (*ReconcileTimer, error) {
+	switch schedule {
+	case "":
+		ticker := time.NewTicker(interval)
+		return &ReconcileTimer{C: ticker.C, ticker: ticker}, nil
+	case SCHEDULE_NEVER:
+		return &ReconcileTimer{}, nil
+	}
+	cron, err := ParseCronSchedule(schedule)
+	if err != nil {
+		return nil, err
+	}
+	channel := make(chan time.Time, 1)
+	timer := &ReconcileTimer{C: channel, stop: make(chan struct{})}
+	go func() {
+		for {
+			next := cron.Next(time.Now())
+			if next.IsZero() {
+				logger.Warningf("The reconcile schedule: %s never fires, the mount point is never reconciled on it", schedule)
+				return
+			}
+			logger.V(VERBOSE_LEVEL).Infof("The next reconciliation is scheduled for: %s", next)
+			wait := time.NewTimer(time.Until(next))
+			select {
+			case <-timer.stop:
+				wait.Stop()
+				return
+			case now := <-wait.C:
+				/* note: as with a ticker, a reconciliation still pending isn't queued again */
+				select {
+				case channel <- now:
+				default:
+				}
+			}
+		}
+	}()
+	return timer, nil
+}
+
+/* Checks if the reconciliations are on a cron schedule, each being a full reconciliation */
+func (r *ReconcileTimer) IsScheduled() bool {
+	return r.stop != nil
+}
+
+/* Stop the timer, no more reconciliations are due */
+func (r *ReconcileTimer) Stop() {
+	if r.ticker != nil {
+		r.ticker.Stop()
+	}
+	if r.stop != nil {
+		r.stopper.Do(func() { close(r.stop) })
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+const scheduleLayout = "2006-01-02 15:04 MST"
+
+func TestValidateSchedule(t *testing.T) {
+	tests := map[string]bool{
+		"":                 true,
+		"never":            true,
+		"@daily":           true,
+		"0 2 * * *":        true,
+		"*/15 0-6 * * 1-5": true,
+		"0,30 0-6 * * *":   true,
+		"5/15 * * * *":     true,
+		"0 0 * * 7":        true,
+		"0 2 * *":          false,
+		"0 2 * * * *":      false,
+		"60 2 * * *":       false,
+		"0 24 * * *":       false,
+		"0 0 0 * *":        false,
+		"0 0 * 13 *":       false,
+		"0 0 * * 8":        false,
+		"0 6-2 * * *":      false,
+		"*/0 * * * *":      false,
+		"a * * * *":        false,
+		"@fortnightly":     false,
+		"0 2 * * monday":   false,
+	}
+	for schedule, valid := range tests {
+		if err := ValidateSchedule(schedule); (err == nil) != valid {
+			t.Errorf("the schedule: %q, expected valid: %t, got error: %v", schedule, valid, err)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("the time zone database is not available, error: %s", err)
+	}
+	tests := []struct {
+		schedule string
+		after    string
+		next     string
+	}{
+		{"0 2 * * *", "2026-01-10 01:00 EST", "2026-01-10 02:00 EST"},
+		{"0 2 * * *", "2026-01-10 02:00 EST", "2026-01-11 02:00 EST"},
+		{"*/15 * * * *", "2026-01-10 01:07 EST", "2026-01-10 01:15 EST"},
+		{"5/15 * * * *", "2026-01-10 01:51 EST", "2026-01-10 02:05 EST"},
+		/* the month ends, the short months and the leap years */
+		{"0 0 31 * *", "2026-01-31 00:00 EST", "2026-03-31 00:00 EDT"},
+		{"0 0 30 * *", "2026-01-30 12:00 EST", "2026-03-30 00:00 EDT"},
+		{"0 0 29 2 *", "2026-01-01 00:00 EST", "2028-02-29 00:00 EST"},
+		{"59 23 * * *", "2026-12-31 23:59 EST", "2027-01-01 23:59 EST"},
+		{"@monthly", "2026-04-30 23:59 EDT", "2026-05-01 00:00 EDT"},
+		{"@yearly", "2026-06-15 12:00 EDT", "2027-01-01 00:00 EST"},
+		/* the day of month and week both restricted, either matching will do (2026-01-01 being a thursday) */
+		{"0 0 13 * 5", "2026-01-01 00:00 EST", "2026-01-02 00:00 EST"},
+		{"0 0 13 * 5", "2026-01-09 00:00 EST", "2026-01-13 00:00 EST"},
+		/* only the one restricted, both must match */
+		{"0 0 * 1 5", "2026-01-30 00:00 EST", "2027-01-01 00:00 EST"},
+		{"0 0 13 * *", "2026-01-01 00:00 EST", "2026-01-13 00:00 EST"},
+		{"0 0 * * 7", "2026-01-01 00:00 EST", "2026-01-04 00:00 EST"},
+		/* the clocks going forward, the time skipped fires as the clocks change, the once */
+		{"30 2 * * *", "2026-03-07 02:30 EST", "2026-03-08 03:00 EDT"},
+		{"30 2 * * *", "2026-03-08 03:00 EDT", "2026-03-09 02:30 EDT"},
+		{"0 3 * * *", "2026-03-08 00:00 EST", "2026-03-08 03:00 EDT"},
+		{"0 * * * *", "2026-03-08 01:00 EST", "2026-03-08 03:00 EDT"},
+		{"30 2 * * 1", "2026-03-07 00:00 EST", "2026-03-09 02:30 EDT"},
+		/* the clocks going back, a fixed time repeated fires the once, though every hour still fires */
+		{"30 1 * * *", "2026-11-01 00:00 EDT", "2026-11-01 01:30 EDT"},
+		{"30 1 * * *", "2026-11-01 01:30 EDT", "2026-11-02 01:30 EST"},
+		{"0 * * * *", "2026-11-01 01:00 EDT", "2026-11-01 01:00 EST"},
+		{"0 2 * * *", "2026-10-31 02:00 EDT", "2026-11-01 02:00 EST"},
+	}
+	for _, test := range tests {
+		schedule, err := ParseCronSchedule(test.schedule)
+		if err != nil {
+			t.Fatalf("failed to parse the schedule: %s, error: %s", test.schedule, err)
+		}
+		after, err := time.ParseInLocation(scheduleLayout, test.after, location)
+		if err != nil {
+			t.Fatalf("failed to parse the time: %s, error: %s", test.after, err)
+		}
+		if next := schedule.Next(after).In(location).Format(scheduleLayout); next != test.next {
+			t.Errorf("the schedule: %s, after: %s, expected: %s, got: %s", test.schedule, test.after, test.next, next)
+		}
+	}
+}
+
+func TestScheduleNever(t *testing.T) {
+	for _, expression := range []string{"0 0 30 2 *", "0 0 31 4,6,9,11 *"} {
+		schedule, err := ParseCronSchedule(expression)
+		if err != nil {
+			t.Fatalf("failed to parse the schedule: %s, error: %s", expression, err)
+		}
+		if next := schedule.Next(time.Now()); !next.IsZero() {
+			t.Errorf("the schedule: %s should never fire, got: %s", expression, next)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+	A flag value for the selinux contexts applied to the files and directories created; the flag can be
+	given multiple times, either as a context for everything or as DIRECTORY=CONTEXT, i.e.
+
+	-selinux_context=system_u:object_r:etc_t:s0 -selinux_context=/nginx=system_u:object_r:httpd_config_t:s0
+*/
+type SelinuxContexts map[string]string
+
+func (r *SelinuxContexts) String() string {
+	items := make([]string, 0)
+	for directory, context := range *r {
+		items = append(items, fmt.Sprintf("%s=%s", directory, context))
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (r *SelinuxContexts) Set(value string) error {
+	if *r == nil {
+		*r = make(SelinuxContexts, 0)
+	}
+	directory, context := "/", value
+	if strings.HasPrefix(value, "/") {
+		items := strings.SplitN(value, "=", 2)
+		if len(items) != 2 || items[1] == "" {
+			return fmt.Errorf("invalid selinux context: %s, should be CONTEXT or DIRECTORY=CONTEXT", value)
+		}
+		directory, context = filepath.Clean(items[0]), items[1]
+	}
+	(*r)[directory] = context
+	return nil
+}
+
+/* Resolves the selinux context for the key, the context of the longest matching directory wins */
+func (r *ConfigurationStore) SelinuxContext(path string) string {
+	context, matched := "", -1
+	for directory, item := range r.options.selinux_contexts {
+		if directory == "/" || path == directory || strings.HasPrefix(path, directory+"/") {
+			if len(directory) > matched {
+				context, matched = item, len(directory)
+			}
+		}
+	}
+	return context
+}
@@ -0,0 +1,416 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gambol99/config-fs/store/fs"
+	"github.com/gambol99/config-fs/store/metrics"
+	"github.com/go-fsnotify/fsnotify"
+)
+
+/*
+	The versioned snapshots of the rendered tree under the mount point; each snapshot is a directory beneath the
+	snapshot directory named by the time it was taken, holding the files as seen under the mount point. With a
+	read only mount point the files are only ever replaced by a rename, so they're hard linked, otherwise copied.
+	A snapshot is taken periodically and before a bulk change (the initial sync or a large batch), though only if
+	the tree has changed since the last, and the latest are kept. The rollback command pins the mount point to a
+	snapshot, recording its name in the pin file; the instance synchronizing the mount point restores it and pauses,
+	the changes from the store being tracked until the pin is released
+*/
+const (
+	/* the timestamp format the snapshots are named by */
+	SNAPSHOT_TIMESTAMP = "2006-01-02T15-04-05.000"
+	/* the file in the snapshot directory holding the name of the snapshot the mount point is pinned to */
+	SNAPSHOT_PIN = ".pinned"
+	/* the number of changes which make a batch a bulk change, a snapshot being taken beforehand */
+	SNAPSHOT_BULK_CHANGES = 10
+)
+
+var (
+	SnapshotDirErr      = errors.New("No snapshot directory has been specified, i.e. -snapshot_dir")
+	SnapshotNotFoundErr = errors.New("The snapshot does not exist")
+	InvalidSnapshotErr  = errors.New("The snapshot directory must be outside the mount point and at least one snapshot kept")
+	PinnedErr           = errors.New("The mount point is pinned to a snapshot, the synchronization is suspended until released")
+)
+
+/* The snapshots in the directory, oldest first */
+func ListSnapshots(directory string) ([]string, error) {
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	snapshots := make([]string, 0)
+	for _, entry := range entries {
+		/* note: a snapshot being taken is hidden until complete */
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			snapshots = append(snapshots, entry.Name())
+		}
+	}
+	sort.Strings(snapshots)
+	return snapshots, nil
+}
+
+/* The snapshot the mount point is pinned to, if any */
+func PinnedSnapshot(directory string) (string, bool) {
+	content, err := ioutil.ReadFile(filepath.Join(directory, SNAPSHOT_PIN))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(content)), true
+}
+
+/* Prints the snapshots taken, marking the one the mount point is pinned to */
+func PrintSnapshots(settings Config, writer io.Writer) error {
+	if settings.snapshot_dir == "" {
+		return SnapshotDirErr
+	}
+	snapshots, err := ListSnapshots(settings.snapshot_dir)
+	if err != nil {
+		return err
+	}
+	pinned, _ := PinnedSnapshot(settings.snapshot_dir)
+	for _, name := range snapshots {
+		if name == pinned {
+			fmt.Fprintf(writer, "%s (pinned)\n", name)
+			continue
+		}
+		fmt.Fprintf(writer, "%s\n", name)
+	}
+	return nil
+}
+
+/*
+	Pins the mount point to the snapshot, the latest if none is given, returning the name; the instance synchronizing
+	the mount point restores the snapshot, or on the next start if it isn't running
+*/
+func RollbackMountPoint(settings Config, name string) (string, error) {
+	if settings.snapshot_dir == "" {
+		return "", SnapshotDirErr
+	}
+	snapshots, err := ListSnapshots(settings.snapshot_dir)
+	if err != nil {
+		return "", err
+	}
+	if name == "" && len(snapshots) > 0 {
+		name = snapshots[len(snapshots)-1]
+	}
+	if index := sort.SearchStrings(snapshots, name); index >= len(snapshots) || snapshots[index] != name {
+		return "", SnapshotNotFoundErr
+	}
+	/* step: the pin is renamed into place, so it's never read half written */
+	path := filepath.Join(settings.snapshot_dir, SNAPSHOT_PIN)
+	if err := ioutil.WriteFile(path+".tmp", []byte(name+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return name, os.Rename(path+".tmp", path)
+}
+
+/* Releases the pin, the instance synchronizing the mount point resumes and brings it back in line with the store */
+func ReleaseMountPoint(settings Config) error {
+	if settings.snapshot_dir == "" {
+		return SnapshotDirErr
+	}
+	if err := os.Remove(filepath.Join(settings.snapshot_dir, SNAPSHOT_PIN)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/* Checks if the mount point is pinned to a snapshot */
+func (r *ConfigurationStore) IsPinned() bool {
+	if r.options.snapshot_dir == "" {
+		return false
+	}
+	_, found := PinnedSnapshot(r.options.snapshot_dir)
+	return found
+}
+
+/*
+	Takes a snapshot of the mount point, unless pinned to a snapshot or nothing has changed since the last; the
+	snapshot is taken within a transaction, so a change is never captured half applied
+*/
+func (r *ConfigurationStore) TakeSnapshot(reason string) {
+	if r.options.snapshot_dir == "" || r.IsPinned() {
+		return
+	}
+	r.snapshotLock.Lock()
+	defer r.snapshotLock.Unlock()
+	r.Transaction(func() {
+		files := r.SnapshotFiles()
+		if len(files) <= 0 {
+			return
+		}
+		digest := SnapshotDigest(files)
+		if digest == r.snapshotted {
+			logger.V(VERBOSE_LEVEL).Infof("The mount point is unchanged since the last snapshot, skipping the %s snapshot", reason)
+			return
+		}
+		name := time.Now().UTC().Format(SNAPSHOT_TIMESTAMP)
+		if err := r.WriteSnapshot(name, files); err != nil {
+			logger.Errorf("Failed to take the %s snapshot: %s of the mount point, error: %s", reason, name, err)
+			return
+		}
+		logger.Infof("Taken the %s snapshot: %s of the mount point: %s, %d files", reason, name, r.options.cfg_directory, len(files))
+		r.snapshotted = digest
+		metrics.Increment(metrics.SNAPSHOTS_TAKEN)
+	})
+	r.PruneSnapshots()
+}
+
+/* The files under the mount point, keyed by the path beneath the mount point (as seen via any links), i.e. /app/config */
+func (r *ConfigurationStore) SnapshotFiles() map[string]string {
+	snapshot := make(map[string]string, 0)
+	base := r.BasePath()
+	if base == "" || !r.fs.IsDirectory(base) {
+		return snapshot
+	}
+	files, err := r.fs.Files(base)
+	if err != nil {
+		logger.Errorf("Failed to list the files under the mount point: %s, error: %s", base, err)
+		return snapshot
+	}
+	for _, file := range files {
+		if unstaged := r.UnstagedPath(file); r.IsAtomicLink(unstaged) || r.IsInternalFile(unstaged) {
+			continue
+		}
+		if key, found := DiskKey(r.options.cfg_directory, r.StatePath(file)); found {
+			snapshot[key] = file
+		}
+	}
+	return snapshot
+}
+
+/* A digest of the files (their paths, permissions, sizes and times modified), used to skip a snapshot when nothing has changed */
+func SnapshotDigest(files map[string]string) string {
+	paths := make([]string, 0)
+	for path, _ := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	hash := sha256.New()
+	for _, path := range paths {
+		fingerprint := ""
+		if stat, err := os.Lstat(files[path]); err == nil {
+			fingerprint = fmt.Sprintf("%s:%d:%d", stat.Mode(), stat.Size(), stat.ModTime().UnixNano())
+		}
+		fmt.Fprintf(hash, "%s=%s\n", path, fingerprint)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+/* Writes the snapshot of the files, via a hidden directory renamed into place once complete */
+func (r *ConfigurationStore) WriteSnapshot(name string, files map[string]string) error {
+	if err := os.MkdirAll(r.options.snapshot_dir, 0700); err != nil {
+		return err
+	}
+	temporary := filepath.Join(r.options.snapshot_dir, "."+name)
+	defer os.RemoveAll(temporary)
+	if err := os.Mkdir(temporary, 0700); err != nil {
+		return err
+	}
+	for key, path := range files {
+		destination := DiskPath(temporary, key)
+		if err := os.MkdirAll(filepath.Dir(destination), 0700); err != nil {
+			return err
+		}
+		if err := SnapshotFile(path, destination, r.options.read_only); err != nil {
+			/* step: the file may have been removed as we walked */
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+	}
+	return os.Rename(temporary, filepath.Join(r.options.snapshot_dir, name))
+}
+
+/* Captures the file in the snapshot; a link is recreated, a file hard linked if requested (and possible) else copied */
+func SnapshotFile(path, destination string, link bool) error {
+	stat, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if stat.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, destination)
+	}
+	/* note: the hard link fails should the snapshots be on another filesystem */
+	if link && os.Link(path, destination) == nil {
+		return nil
+	}
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	file, err := os.OpenFile(destination, os.O_CREATE|os.O_WRONLY|os.O_EXCL, stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	/* step: the owner is kept, it's restored along with the content */
+	if uid, gid, found := fs.FileOwner(stat); found {
+		file.Chown(uid, gid)
+	}
+	if _, err := io.Copy(file, source); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+/* Removes the oldest snapshots beyond those kept, never the one pinned */
+func (r *ConfigurationStore) PruneSnapshots() {
+	snapshots, err := ListSnapshots(r.options.snapshot_dir)
+	if err != nil {
+		logger.Errorf("Failed to list the snapshots in: %s, error: %s", r.options.snapshot_dir, err)
+		return
+	}
+	pinned, _ := PinnedSnapshot(r.options.snapshot_dir)
+	for index := 0; index < len(snapshots)-r.options.snapshot_keep; index++ {
+		if snapshots[index] == pinned {
+			continue
+		}
+		logger.V(VERBOSE_INFO).Infof("Removing the snapshot: %s, beyond the %d kept", snapshots[index], r.options.snapshot_keep)
+		if err := os.RemoveAll(filepath.Join(r.options.snapshot_dir, snapshots[index])); err != nil {
+			logger.Errorf("Failed to remove the snapshot: %s, error: %s", snapshots[index], err)
+		}
+	}
+}
+
+/*
+	Restores the mount point to the snapshot; the files of the snapshot are written as any other (so staged with the
+	atomic swap, encrypted at rest and so on) and the files not in the snapshot removed
+*/
+func (r *ConfigurationStore) RestoreSnapshot(name string) error {
+	directory := filepath.Join(r.options.snapshot_dir, name)
+	if name == "" || strings.HasPrefix(name, ".") || filepath.Base(name) != name || !r.fs.IsDirectory(directory) {
+		return SnapshotNotFoundErr
+	}
+	logger.Warningf("Rolling back the mount point: %s to the snapshot: %s", r.options.cfg_directory, name)
+	var err error
+	r.Transaction(func() {
+		restored := make(map[string]bool, 0)
+		err = filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			relative, _ := filepath.Rel(directory, path)
+			key := "/" + filepath.ToSlash(relative)
+			full_path := r.DestinationPath(key)
+			restored[key] = true
+			if info.Mode()&os.ModeSymlink != 0 {
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				return r.fs.Symlink(target, full_path)
+			}
+			content, err := r.fs.Read(path)
+			if err != nil {
+				return err
+			}
+			/* note: the owner is that of the file when snapshot, i.e. as set by the attributes of the key */
+			attributes := fs.Attributes{Mode: info.Mode().Perm(), UID: r.uid, GID: r.gid, Context: r.SelinuxContext(key)}
+			if uid, gid, found := fs.FileOwner(info); found {
+				attributes.UID, attributes.GID = uid, gid
+			}
+			return r.WriteFile(full_path, content, attributes)
+		})
+		if err != nil {
+			return
+		}
+		/* step: remove the files created since the snapshot was taken */
+		for key, _ := range r.SnapshotFiles() {
+			if !restored[key] {
+				full_path := r.DestinationPath(key)
+				logger.V(VERBOSE_INFO).Infof("Removing the file: %s, not in the snapshot: %s", full_path, name)
+				if err := r.RemovePath(full_path, false); err != nil {
+					logger.Errorf("Failed to remove the file: %s, error: %s", full_path, err)
+					continue
+				}
+				r.PruneDirectory(r.fs.Dirname(full_path))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	r.pinned = name
+	metrics.Increment(metrics.SNAPSHOTS_RESTORED)
+	return nil
+}
+
+/*
+	Applies the pin, restoring the snapshot and pausing the synchronization; once the pin is released the
+	synchronization is resumed. The pin is applied on startup and whenever the pin file changes
+*/
+func (r *ConfigurationStore) ApplyPin() {
+	name, found := PinnedSnapshot(r.options.snapshot_dir)
+	switch {
+	case !found && r.pinned != "":
+		logger.Infof("The pin on the snapshot: %s has been released", r.pinned)
+		r.pinned = ""
+		r.SetPaused(PAUSE_PINNED, false)
+	case found && name != r.pinned:
+		/* step: pause beforehand, so the restored files aren't reverted as drift */
+		r.SetPaused(PAUSE_PINNED, true)
+		if err := r.RestoreSnapshot(name); err != nil {
+			logger.Errorf("Failed to roll back the mount point to the snapshot: %s, error: %s", name, err)
+		}
+	}
+}
+
+/* Watches the snapshot directory for the pin file being written or removed, until the context is cancelled */
+func (r *ConfigurationStore) WatchPin(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(r.options.snapshot_dir)
+	}
+	if err != nil {
+		logger.Errorf("Failed to watch the snapshot directory: %s, a rollback is applied on the next start, error: %s", r.options.snapshot_dir, err)
+		return
+	}
+	defer watcher.Close()
+	pin := filepath.Join(r.options.snapshot_dir, SNAPSHOT_PIN)
+	for {
+		select {
+		case event := <-watcher.Events:
+			if event.Name == pin {
+				r.ApplyPin()
+			}
+		case err := <-watcher.Errors:
+			logger.Errorf("Failed to watch the snapshot directory: %s, error: %s", r.options.snapshot_dir, err)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
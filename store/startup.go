@@ -0,0 +1,91 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"sort"
+
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+/*
+	The fingerprint of each file under the mount point, keyed by the path as seen under the mount point (i.e. via
+	the links of the atomic directories); our own files are left out
+*/
+func (r *ConfigurationStore) MountSnapshot() map[string]string {
+	snapshot := make(map[string]string, 0)
+	base := r.BasePath()
+	if base == "" || !r.fs.IsDirectory(base) {
+		return snapshot
+	}
+	files, err := r.fs.Files(base)
+	if err != nil {
+		logger.Errorf("Failed to list the files under the mount point: %s, error: %s", base, err)
+		return snapshot
+	}
+	for _, file := range files {
+		if unstaged := r.UnstagedPath(file); r.IsAtomicLink(unstaged) || r.IsInternalFile(unstaged) {
+			continue
+		}
+		/* note: the files as we left them are taken from the hash index, rather than read */
+		fingerprint, found := r.hashes.Fingerprint(file)
+		if !found {
+			fingerprint = r.Fingerprint(file)
+		}
+		snapshot[r.StatePath(file)] = fingerprint
+	}
+	return snapshot
+}
+
+/*
+	Compares the snapshots of the mount point taken before and after the initial sync, logging and counting the
+	files created, updated, deleted and left unchanged, so the effect of bringing the host in line is visible
+*/
+func (r *ConfigurationStore) ReportStartup(before, after map[string]string) *Reconciliation {
+	summary := new(Reconciliation)
+	paths := make([]string, 0)
+	for path, _ := range after {
+		paths = append(paths, path)
+	}
+	for path, _ := range before {
+		if _, found := after[path]; !found {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		previous, existed := before[path]
+		current, exists := after[path]
+		switch {
+		case !existed:
+			logger.V(VERBOSE_INFO).Infof("The initial sync created the file: %s", path)
+			summary.Created++
+		case !exists:
+			logger.V(VERBOSE_INFO).Infof("The initial sync deleted the file: %s", path)
+			summary.Deleted++
+		case previous != current:
+			logger.V(VERBOSE_INFO).Infof("The initial sync updated the file: %s", path)
+			summary.Updated++
+		default:
+			summary.Unchanged++
+		}
+	}
+	logger.Infof("The initial sync of the mount point: %s created: %d, updated: %d, deleted: %d, unchanged: %d files",
+		r.options.cfg_directory, summary.Created, summary.Updated, summary.Deleted, summary.Unchanged)
+	metrics.Add(metrics.STARTUP_CREATED, int64(summary.Created))
+	metrics.Add(metrics.STARTUP_UPDATED, int64(summary.Updated))
+	metrics.Add(metrics.STARTUP_DELETED, int64(summary.Deleted))
+	metrics.Add(metrics.STARTUP_UNCHANGED, int64(summary.Unchanged))
+	return summary
+}
@@ -0,0 +1,267 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* the name the sync state is published under, alongside the counters */
+const STATE_NAME = "config_fs_state"
+
+var NoStateFileErr = errors.New("No state file has been specified, i.e. -state_file")
+
+/* The state of a file under the mount point, i.e. is it up to date with the store */
+type SyncState struct {
+	/* the key (or template) the file is materialized from */
+	Key string `json:"key"`
+	/* the index of the store revision last applied to the file */
+	Index uint64 `json:"index"`
+	/* the time the revision was last applied to (or verified against) the file */
+	Updated time.Time `json:"updated"`
+	/* the error of the last attempt to write the file, if it failed */
+	Error string `json:"error,omitempty"`
+	/* the time of the last failure */
+	Failed *time.Time `json:"failed,omitempty"`
+}
+
+/*
+	The state of every file managed, shared by all the mounts and keyed by the path of the file as seen under the
+	mount point (i.e. beneath the ..data link rather than the generation, when using the atomic swap)
+*/
+type SyncStates struct {
+	sync.RWMutex
+	/* the state of the files, path => state */
+	paths map[string]SyncState
+	/* loads the persisted state the once */
+	loaded sync.Once
+}
+
+/* the state of the files managed by the process */
+var states = &SyncStates{paths: make(map[string]SyncState, 0)}
+
+func init() {
+	expvar.Publish(STATE_NAME, expvar.Func(func() interface{} { return states.Snapshot() }))
+}
+
+/* Retrieve a copy of the state of all the files */
+func (r *SyncStates) Snapshot() map[string]SyncState {
+	r.RLock()
+	defer r.RUnlock()
+	snapshot := make(map[string]SyncState, len(r.paths))
+	for path, state := range r.paths {
+		snapshot[path] = state
+	}
+	return snapshot
+}
+
+/* Retrieve the state of the file */
+func (r *SyncStates) Get(path string) (SyncState, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	state, found := r.paths[path]
+	return state, found
+}
+
+/* Record the outcome of a write to the file, the index is only moved on when the write succeeded */
+func (r *SyncStates) Set(path, key string, index uint64, err error) {
+	r.Lock()
+	defer r.Unlock()
+	state := r.paths[path]
+	state.Key = key
+	if err != nil {
+		now := time.Now().UTC()
+		state.Error, state.Failed = err.Error(), &now
+	} else {
+		state.Index, state.Updated, state.Error, state.Failed = index, time.Now().UTC(), "", nil
+	}
+	r.paths[path] = state
+}
+
+/* The states of the path and anything beneath it */
+func (r *SyncStates) Beneath(path string) map[string]SyncState {
+	r.RLock()
+	defer r.RUnlock()
+	saved := make(map[string]SyncState, 0)
+	for item, state := range r.paths {
+		if item == path || strings.HasPrefix(item, path+string(os.PathSeparator)) {
+			saved[item] = state
+		}
+	}
+	return saved
+}
+
+/* Replace the states of the path and anything beneath it with those given, i.e. as saved by Beneath */
+func (r *SyncStates) Replace(path string, saved map[string]SyncState) {
+	r.Lock()
+	defer r.Unlock()
+	for item, _ := range r.paths {
+		if item == path || strings.HasPrefix(item, path+string(os.PathSeparator)) {
+			delete(r.paths, item)
+		}
+	}
+	for item, state := range saved {
+		r.paths[item] = state
+	}
+}
+
+/* Forget the state of the path and anything beneath it, i.e. once removed */
+func (r *SyncStates) Forget(path string) {
+	r.Lock()
+	defer r.Unlock()
+	for item, _ := range r.paths {
+		if item == path || strings.HasPrefix(item, path+string(os.PathSeparator)) {
+			delete(r.paths, item)
+		}
+	}
+}
+
+/* The files beneath the directory whose last write failed since the time given, sorted */
+func (r *SyncStates) FailedSince(directory string, since time.Time) []string {
+	r.RLock()
+	defer r.RUnlock()
+	failed := make([]string, 0)
+	for path, state := range r.paths {
+		if state.Failed != nil && !state.Failed.Before(since) && IsBeneath(directory, path) {
+			failed = append(failed, path)
+		}
+	}
+	sort.Strings(failed)
+	return failed
+}
+
+/* Load the persisted state, if any, the once; the state of a previous run is kept until the files are written again */
+func (r *SyncStates) Load(filename string) error {
+	var err error
+	r.loaded.Do(func() {
+		content, failed := ioutil.ReadFile(filename)
+		if failed != nil {
+			if !os.IsNotExist(failed) {
+				err = failed
+			}
+			return
+		}
+		r.Lock()
+		defer r.Unlock()
+		err = json.Unmarshal(content, &r.paths)
+	})
+	return err
+}
+
+/* Persist the state to the file, written to a temporary file and renamed into place */
+func (r *SyncStates) Save(filename string) error {
+	content, err := json.MarshalIndent(r.Snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(append(content, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+/* The path of the file as seen under the mount point, rather than within the generation */
+func (r *ConfigurationStore) StatePath(full_path string) string {
+	if relative, found := DiskKey(r.BasePath(), r.UnstagedPath(full_path)); found {
+		return DiskPath(r.options.cfg_directory, relative)
+	}
+	return full_path
+}
+
+/* Record the outcome of a write to the file of the key (or template), at the revision of its attributes */
+func (r *ConfigurationStore) SetSyncState(path, full_path string, err error) {
+	if r.options.dry_run {
+		return
+	}
+	r.SaveSyncStates(r.StatePath(full_path))
+	states.Set(r.StatePath(full_path), path, r.GetAttributes(path).Index, err)
+	if err != nil {
+		r.RecordHistory(HistoryEvent{Type: HISTORY_WRITE_FAILED, Key: path, Path: r.StatePath(full_path), Error: err.Error()})
+	}
+}
+
+/* Forget the state of the path, and anything beneath it */
+func (r *ConfigurationStore) ForgetSyncState(full_path string) {
+	r.SaveSyncStates(r.StatePath(full_path))
+	states.Forget(r.StatePath(full_path))
+}
+
+/* Persist the state of the files, if requested */
+func (r *ConfigurationStore) SaveSyncState() {
+	if r.options.state_file == "" || r.options.dry_run {
+		return
+	}
+	if err := states.Save(r.options.state_file); err != nil {
+		logger.Errorf("Failed to persist the sync state to: %s, error: %s", r.options.state_file, err)
+	}
+}
+
+/*
+	Reads the persisted state and writes the state of each of the paths given (or every file if none are), a line
+	per file; returns false if any of them are unknown or their last write failed
+*/
+func PrintSyncState(settings Config, writer io.Writer, paths []string) (bool, error) {
+	if settings.state_file == "" {
+		return false, NoStateFileErr
+	}
+	if err := states.Load(settings.state_file); err != nil {
+		return false, err
+	}
+	snapshot := states.Snapshot()
+	if len(paths) <= 0 {
+		for path, _ := range snapshot {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+	}
+	healthy := true
+	for _, path := range paths {
+		if absolute, err := filepath.Abs(path); err == nil {
+			path = absolute
+		}
+		state, found := snapshot[path]
+		switch {
+		case !found:
+			fmt.Fprintf(writer, "%s unknown\n", path)
+			healthy = false
+		case state.Error != "":
+			fmt.Fprintf(writer, "%s failed key=%s index=%d updated=%s error=%q\n", path, state.Key, state.Index,
+				state.Updated.Format(time.RFC3339), state.Error)
+			healthy = false
+		default:
+			fmt.Fprintf(writer, "%s ok key=%s index=%d updated=%s\n", path, state.Key, state.Index, state.Updated.Format(time.RFC3339))
+		}
+	}
+	return healthy, nil
+}
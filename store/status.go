@@ -0,0 +1,178 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	The status of the mount point is kept in .configfs-status.json at the top of it, so the tooling of the host can
+	check how fresh the configuration is without talking to the process; it's rewritten once a change has been
+	applied, the mount point synchronized or become ready. Being a hidden file, it's never taken for the file of a
+	key, and it's replaced via a rename so it's never read half written
+*/
+const STATUS_FILE = ".configfs-status.json"
+
+/* the content of the status file */
+type StatusFile struct {
+	/* the mount point, the root of the keys and the url of the store */
+	Mount string `json:"mount"`
+	Root  string `json:"root"`
+	Store string `json:"store"`
+	/* set once the mount point has been synchronized in full */
+	Ready bool `json:"ready"`
+	/* when the mount point was last synchronized against the store, in full or incrementally */
+	LastSync *time.Time `json:"last_sync,omitempty"`
+	/* when a file was last changed, by a change from the store or a synchronization */
+	LastChange *time.Time `json:"last_change,omitempty"`
+	/* the highest index of the store applied to the mount point */
+	Index uint64 `json:"index"`
+	/* the files found to have drifted from the store (and corrected) since the start */
+	Drift int64 `json:"drift"`
+	/* the files whose last write failed */
+	FailedFiles []string `json:"failed_files,omitempty"`
+	/* the templates which failed to render, path => error */
+	TemplateErrors map[string]string `json:"template_errors,omitempty"`
+	/* when the status was written */
+	Updated time.Time `json:"updated"`
+}
+
+/* the status of the synchronization of a mount point */
+type SyncStatus struct {
+	/* the files corrected as they had drifted */
+	drift int64
+	/* a lock for the below */
+	sync.RWMutex
+	/* the index of the store last synchronized to */
+	index uint64
+	/* when the mount point was last synchronized, and a file last changed */
+	synced  time.Time
+	changed time.Time
+	/* serializes the writes of the status file */
+	writes sync.Mutex
+}
+
+/* Record a synchronization of the mount point up to the index */
+func (r *SyncStatus) Synced(index uint64) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.synced = time.Now().UTC()
+	if index > r.index {
+		r.index = index
+	}
+}
+
+/* Record a change to the files under the mount point */
+func (r *SyncStatus) Changed() {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.changed = time.Now().UTC()
+}
+
+/* Record the number of files corrected as they had drifted from the store */
+func (r *SyncStatus) Drifted(files int64) {
+	if r == nil {
+		return
+	}
+	atomic.AddInt64(&r.drift, files)
+}
+
+/* The path of the status file */
+func (r *ConfigurationStore) StatusPath() string {
+	return filepath.Join(r.options.cfg_directory, STATUS_FILE)
+}
+
+/* The status of the mount point, as written to the status file */
+func (r *ConfigurationStore) StatusFile() StatusFile {
+	r.status.RLock()
+	status := StatusFile{
+		Mount:          r.options.cfg_directory,
+		Root:           r.options.root_key,
+		Store:          r.kv.URL(),
+		Ready:          r.readiness.IsReady(),
+		Index:          r.status.index,
+		Drift:          atomic.LoadInt64(&r.status.drift),
+		FailedFiles:    states.FailedSince(r.options.cfg_directory, time.Time{}),
+		TemplateErrors: r.dynamic.Errors(),
+		Updated:        time.Now().UTC(),
+	}
+	if !r.status.synced.IsZero() {
+		synced := r.status.synced
+		status.LastSync = &synced
+	}
+	if !r.status.changed.IsZero() {
+		changed := r.status.changed
+		status.LastChange = &changed
+	}
+	r.status.RUnlock()
+	/* step: the files may well have been written at a later revision than the store was last synchronized to */
+	for path, state := range states.Snapshot() {
+		if state.Index > status.Index && IsBeneath(r.options.cfg_directory, path) {
+			status.Index = state.Index
+		}
+	}
+	return status
+}
+
+/* Record the mount point has been synchronized against the store, up to the index if known, and rewrite the status */
+func (r *ConfigurationStore) RecordSync(index uint64) {
+	r.status.Synced(index)
+	r.UpdateStatus()
+}
+
+/* Rewrite the status file, via a temporary file renamed into place */
+func (r *ConfigurationStore) UpdateStatus() {
+	if r.status == nil || !r.options.write_status || r.options.dry_run || r.options.observe || !r.fs.IsDirectory(r.options.cfg_directory) {
+		return
+	}
+	r.status.writes.Lock()
+	defer r.status.writes.Unlock()
+	content, err := json.MarshalIndent(r.StatusFile(), "", "  ")
+	if err != nil {
+		logger.Errorf("Failed to encode the status of the mount point: %s, error: %s", r.options.cfg_directory, err)
+		return
+	}
+	file, err := ioutil.TempFile(r.options.cfg_directory, STATUS_FILE+".")
+	if err != nil {
+		logger.Errorf("Failed to create the status file: %s, error: %s", r.StatusPath(), err)
+		return
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(append(content, '\n'))
+	if err == nil {
+		err = file.Chmod(os.FileMode(r.options.file_mode))
+	}
+	if closed := file.Close(); err == nil {
+		err = closed
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), r.StatusPath())
+	}
+	if err != nil {
+		logger.Errorf("Failed to write the status file: %s, error: %s", r.StatusPath(), err)
+	}
+}
@@ -14,17 +14,23 @@ limitations under the License.
 package store
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"time"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gambol99/config-fs/store/dynamic"
 	"github.com/gambol99/config-fs/store/fs"
 	"github.com/gambol99/config-fs/store/kv"
+	"github.com/gambol99/config-fs/store/logging"
+	"github.com/gambol99/config-fs/store/metrics"
 	"github.com/go-fsnotify/fsnotify"
-	"github.com/golang/glog"
 )
 
 const (
@@ -36,17 +42,34 @@ const (
 	DEFAULT_DELETE_STALE   = false
 	DEFAULT_INTERVAL       = 900
 	DEFAULT_DYNAMIC_PREFIX = "$TEMPLATE$"
+	DEFAULT_FILE_MODE      = 0644
+	DEFAULT_DIR_MODE       = 0755
+	LINK_PREFIX            = "$LINK$"
 	VERBOSE_LEVEL          = 5
 	VERBOSE_INFO           = 3
 )
 
-var options struct {
+var (
+	DeleteOnExitErr     = errors.New("The configuration directory could not be deleted in full")
+	InvalidWritebackErr = errors.New("The writeback requires a writable mount point, i.e. -read_only=false, and can't be used with the atomic swap")
+	InvalidIntervalErr  = errors.New("The refresh interval must be at least a second")
+)
+
+/* the log of the store */
+var logger = logging.For(logging.SUBSYSTEM_STORE)
+
+/* The configuration of a store, the command line flags being bound to it by RegisterFlags */
+type Config struct {
 	/* the mount point of the config directory */
 	cfg_directory string
+	/* how the keys are exposed under the mount point, materialized as files or served through a fuse filesystem */
+	mode string
 	/* should we delete on exit */
 	delete_on_exit bool
 	/* the refresh interval */
 	refresh_interval int
+	/* the cron schedule of the full reconciliations, or never, in place of the interval */
+	reconcile_schedule string
 	/* a read only config directory, i.e. do not syncs changes back */
 	read_only bool
 	/* should be perform a sync on startup */
@@ -55,102 +78,1112 @@ var options struct {
 	delete_stale_files bool
 	/* the root for the configuration store */
 	root_key string
+	/* the default permissions for the files */
+	file_mode FileMode
+	/* the permissions for the directories */
+	dir_mode FileMode
+	/* the default owner of the files and directories */
+	file_owner string
+	/* the default group of the files and directories */
+	file_group string
+	/* mount a tmpfs at the mount point */
+	tmpfs bool
+	/* the size of the tmpfs */
+	tmpfs_size string
+	/* the path to the host key used to encrypt the files at rest */
+	encryption_key string
+	/* the glob patterns for the keys to materialize */
+	include string
+	/* the glob patterns for the keys not to materialize */
+	exclude string
+	/* the regular expressions for the keys to materialize, and not to */
+	include_regexp Expressions
+	exclude_regexp Expressions
+	/* the prefixes of the path segments marking the keys never materialized */
+	ignore_markers string
+	/* materialize into a generation directory and flip the ..data link */
+	atomic_swap bool
+	/* the selinux contexts applied to the files, by directory */
+	selinux_contexts SelinuxContexts
+	/* remove the directories left empty by a deletion */
+	prune_empty_dirs bool
+	/* the directory the diffs of any local changes are captured in */
+	quarantine_dir string
+	/* the maximum number of bytes written under the mount point */
+	quota int64
+	/* the rules mapping the keys onto the file names */
+	key_mapping MappingRules
+	/* the path of a tarball of the mount point maintained as the changes are applied */
+	archive string
+	/* the period the files of the keys removed are kept in the trash, zero deletes them */
+	trash_retention time.Duration
+	/* the glob patterns of the keys whose local changes are written back to the store */
+	writeback string
+	/* the prefixes of the keys materialized under each of the mount points, if more than the one */
+	mounts MountMappings
+	/* log the changes which would be made under the mount point, without making them */
+	dry_run bool
+	/* the window the changes are coalesced over and applied together, zero applies each as received */
+	coalesce time.Duration
+	/* the priorities of the directories, applied highest first on a full sync or batch */
+	priorities SyncPriorities
+	/* the policies applied when a file has been changed locally and differs from the store, prefix => policy */
+	conflict_policies ConflictPolicies
+	/* the number of times the directories which failed to build on startup are retried */
+	sync_retries int
+	/* the initial delay between the retries, doubled on each attempt */
+	sync_backoff time.Duration
+	/* what becomes of the initial sync when the store can't be reached, fail, retry, block or snapshot */
+	startup_policy string
+	/* the longest the initial sync is blocked on the store, with the block policy, zero waits forever */
+	startup_timeout time.Duration
+	/* persist the sync state of the files managed to this file */
+	state_file string
+	/* the address the health endpoints are served on, i.e. :8080, empty disables */
+	health_address string
+	/* maintain the status file at the top of the mount point */
+	write_status bool
+	/* on the refresh interval, apply only the keys modified since the last sync rather than reconciling in full */
+	incremental_sync bool
+	/* the interval the progress of the build and full reconciliations is logged on, zero disables */
+	progress_interval time.Duration
+	/* the path of a JSON file of the commands verifying the files once written */
+	verify string
+	/* persist the content hashes of the files written to this file, so the presync can skip those unchanged */
+	hash_index string
+	/* report or delete the files under the mount point none of the keys produce */
+	prune string
+	/* the directories whose changes are staged and published together, via a link flipped to a new generation */
+	atomic_dirs AtomicDirectories
+	/* the number of workers applying the changes, those to the same key being applied in order */
+	workers int
+	/* the number of events queued for the event loop, and the policy once full */
+	queue_size int
+	overflow   string
+	/* perform a single sync of the mount point and exit */
+	onetime bool
+	/* the directories materialized as a single file, directory => format */
+	aggregates AggregateDirectories
+	/* the directories materialized as a JSON document of their subtree as well */
+	documents DocumentDirectories
+	/* the path of the journal of the changes received from the store, replayed if left outstanding */
+	journal string
+	/* the key in the store held by the instance elected to write the mount point, if shared */
+	leader_key string
+	/* the ttl of the leader key, renewed at a third of it */
+	leader_ttl time.Duration
+	/* only observe and report the drift of the mount point from the store, never writing */
+	observe bool
+	/* the key which, while it exists, suspends the changes to the mount point */
+	freeze_key string
+	/* the command validating the staged changes before they're promoted */
+	validate string
+	/* the time the validation command is given to complete */
+	validate_timeout time.Duration
+	/* the directory the snapshots of the mount point are kept in */
+	snapshot_dir string
+	/* the number of snapshots kept */
+	snapshot_keep int
+	/* the interval the snapshots are taken at, zero only taking them before a bulk change */
+	snapshot_interval time.Duration
+	/* the command run after the files under the mount point have changed */
+	on_change string
+	/* the period the changes must settle for before the command (and hooks) are run */
+	on_change_delay time.Duration
+	/* the path of the file of the hooks run when the files matching their paths have changed */
+	hooks string
+	/* the address the admin api is served on, empty disables */
+	admin_address string
+	/* the file holding the bearer token of the admin api */
+	admin_token_file string
+	/* the path of the file of the webhooks posted the files changed, the templates failing and the drift repaired */
+	webhooks string
+	/* the window the events are batched over before being posted to the webhooks */
+	webhook_batch time.Duration
+	/* the number of the last events handled kept in memory, zero disables */
+	history_size int
+	/* the hooks run around the writes to the files, registered programmatically */
+	pre_write_hooks  []PreWriteHook
+	post_write_hooks []PostWriteHook
+	/* the comma separated paths of the Go plugins exporting the hooks run around the writes */
+	write_plugins string
+	/* the configuration of the k/v agent, shared by the templates */
+	kv kv.Config
+	/* the configuration of the file store */
+	fs fs.Config
+	/* the configuration of the templated resources */
+	dynamic dynamic.Config
+	/* the configuration of the logging, shared by the subsystems */
+	logging logging.Config
+	/* the configuration of the push of the metrics, shared by the stores */
+	metrics metrics.Config
+}
+
+/* The default configuration of a store, as given by the command line flags when none are */
+func DefaultConfig() Config {
+	return Config{
+		root_key:           DEFAULT_ROOT_KEY,
+		cfg_directory:      DEFAULT_MOUNT_POINT,
+		mode:               MODE_FILES,
+		delete_on_exit:     DEFAULT_DELETE_ON_EXIT,
+		refresh_interval:   DEFAULT_INTERVAL,
+		read_only:          DEFAULT_READ_ONLY,
+		sync_on_startup:    DEFAULT_PRE_SYNC,
+		delete_stale_files: DEFAULT_DELETE_STALE,
+		file_mode:          DEFAULT_FILE_MODE,
+		dir_mode:           DEFAULT_DIR_MODE,
+		ignore_markers:     DEFAULT_IGNORE_MARKERS,
+		queue_size:         DEFAULT_QUEUE_SIZE,
+		overflow:           OVERFLOW_BLOCK,
+		workers:            8,
+		sync_retries:       5,
+		sync_backoff:       time.Second,
+		startup_policy:     STARTUP_RETRY,
+		leader_ttl:         15 * time.Second,
+		freeze_key:         DEFAULT_FREEZE_KEY,
+		validate_timeout:   30 * time.Second,
+		snapshot_keep:      5,
+		snapshot_interval:  time.Hour,
+		on_change_delay:    time.Second,
+		webhook_batch:      5 * time.Second,
+		history_size:       1000,
+		progress_interval:  10 * time.Second,
+		prune_empty_dirs:   true,
+		write_status:       true,
+		kv:                 kv.DefaultConfig(),
+		fs:                 fs.DefaultConfig(),
+		dynamic:            dynamic.DefaultConfig(),
+		logging:            logging.DefaultConfig(),
+		metrics:            metrics.DefaultConfig(),
+	}
+}
+
+/*
+	Binds the configuration (along with that of the store, file store and templates) to the flags, the current
+	values being the defaults; the caller parses them, i.e. RegisterFlags(flag.CommandLine, &config)
+*/
+func RegisterFlags(flags *flag.FlagSet, config *Config) {
+	flags.StringVar(&config.root_key, "root", config.root_key, "the root within the k/v store to base the config on")
+	flags.StringVar(&config.cfg_directory, "mount", config.cfg_directory, "the mount point for the K/V store")
+	flags.StringVar(&config.mode, "mode", config.mode, "how the keys are exposed under the mount point, files (materialized on disk) or fuse (a read only filesystem serving the keys from the store as they're read, nothing persisted on disk), fuse being linux only")
+	flags.BoolVar(&config.delete_on_exit, "delete_on_exit", config.delete_on_exit, "delete all configuration on exit")
+	flags.IntVar(&config.refresh_interval, "interval", config.refresh_interval, "the default interval for performed a forced resync")
+	flags.StringVar(&config.reconcile_schedule, "reconcile_schedule", config.reconcile_schedule, "a cron expression (i.e. 0 2 * * *, in local time) the full reconciliations are run on in place of the -interval, or never to only apply the changes from the store as they happen")
+	flags.BoolVar(&config.read_only, "read_only", config.read_only, "wheather or not the config store of read-only")
+	flags.BoolVar(&config.sync_on_startup, "pre_sync", config.sync_on_startup, "wheather or not to perform a initial config sync against the backend")
+	flags.BoolVar(&config.delete_stale_files, "delete_stale", config.delete_stale_files, "delete stale files, i.e files which do not exists in the backend k/v store")
+	flags.Var(&config.file_mode, "file_mode", "the default permissions (in octal) for the files created, keys can override with an attributes header")
+	flags.Var(&config.dir_mode, "dir_mode", "the permissions (in octal) for the directories created, applied regardless of the umask")
+	flags.BoolVar(&config.tmpfs, "tmpfs", config.tmpfs, "mount a tmpfs at the mount point on startup (and unmount on exit), so the files never touch a persistent disk")
+	flags.StringVar(&config.tmpfs_size, "tmpfs_size", config.tmpfs_size, "the size of the tmpfs, i.e. 64m, defaults to half of the memory")
+	flags.StringVar(&config.encryption_key, "encryption_key", config.encryption_key, "the path to a host key (32 bytes, raw, hex or base64) used to encrypt the files at rest")
+	flags.StringVar(&config.include, "include", config.include, "a comma separated list of glob patterns, only keys matching are materialized, i.e. /app/**")
+	flags.StringVar(&config.exclude, "exclude", config.exclude, "a comma separated list of glob patterns, keys matching are not materialized, i.e. /secrets/**")
+	flags.Var(&config.include_regexp, "include_regexp", "a regular expression matched against the full key path, only keys matching (this or an -include) are materialized, can be given multiple times")
+	flags.Var(&config.exclude_regexp, "exclude_regexp", "a regular expression matched against the full key path, keys matching are not materialized, can be given multiple times")
+	flags.StringVar(&config.ignore_markers, "ignore_markers", config.ignore_markers, "a comma separated list of prefixes, a key with any path segment beginning with one is never materialized, i.e. coordination keys kept alongside the config")
+	flags.BoolVar(&config.onetime, "onetime", config.onetime, "perform a single sync of the mount point (templates included) and exit, the exit code is 0 if synchronized, 1 if any files couldn't be written and 2 if the sync failed")
+	flags.BoolVar(&config.observe, "observe", config.observe, "never write to the mount point, only watch the store and the mount point and report the files which have drifted from the store, with -onetime the exit code is 1 if any have")
+	flags.BoolVar(&config.dry_run, "dry_run", config.dry_run, "log the files which would be created, updated or deleted (with a diff of the content) without writing anything, i.e. to preview a new store or root")
+	flags.DurationVar(&config.coalesce, "coalesce", config.coalesce, "coalesce the changes received within this window (i.e. 200ms) and apply them together, keeping the latest for each key and rendering each template once, zero applies each as received")
+	flags.IntVar(&config.queue_size, "queue_size", config.queue_size, "the number of events from the store, templates and mount point queued for the event loop")
+	flags.Var(&config.priorities, "priority", "the priority of the keys beneath a directory, DIRECTORY=PRIORITY, the higher applied first on a full sync or a batch of changes (zero by default), can be given multiple times")
+	flags.StringVar(&config.overflow, "overflow", config.overflow, "what happens to the changes from the store once the event queue is full, block (holding up the watch), coalesce (the latest for each key) or drop (reconciling the mount point to recover)")
+	flags.IntVar(&config.workers, "workers", config.workers, "the number of workers applying the changes from the store, the changes to a key are always applied in the order received")
+	flags.IntVar(&config.sync_retries, "sync_retries", config.sync_retries, "the number of times the directories of the store which failed to list are retried on the initial sync, before giving up")
+	flags.DurationVar(&config.sync_backoff, "sync_backoff", config.sync_backoff, "the initial delay between the retries of the initial sync, doubled on each attempt up to a minute")
+	flags.StringVar(&config.startup_policy, "startup_policy", config.startup_policy, "what becomes of the initial sync when the store can't be reached; fail at once, retry (-sync_retries times), block until reachable (up to -startup_timeout) or snapshot, serving the last snapshot (or the files in place) and retrying in the background")
+	flags.DurationVar(&config.startup_timeout, "startup_timeout", config.startup_timeout, "the longest the initial sync waits on the store with -startup_policy=block, zero waits forever")
+	flags.StringVar(&config.leader_key, "leader_key", config.leader_key, "a key in the store (ideally outside the root) held by the single instance writing the mount point, when shared by a number of instances, the others standing by to take over")
+	flags.DurationVar(&config.leader_ttl, "leader_ttl", config.leader_ttl, "the ttl of the leader key, a standby takes over once it expires without being renewed")
+	flags.StringVar(&config.freeze_key, "freeze_key", config.freeze_key, "a key in the store which, while it exists, suspends the changes to the mount point on every instance, an empty key disables")
+	flags.StringVar(&config.journal, "journal", config.journal, "record each change received from the store in this journal until applied, replaying those left outstanding by a crash on the next start, should be outside the mount point")
+	flags.StringVar(&config.validate, "validate", config.validate, "a command validating the changes staged by -atomic_swap or -atomic_dir (given the directory in CONFIG_FS_STAGING) before they're promoted, a failure leaves the live configuration untouched")
+	flags.DurationVar(&config.validate_timeout, "validate_timeout", config.validate_timeout, "the time the validation command is given to complete, before it's killed and the validation failed")
+	flags.StringVar(&config.snapshot_dir, "snapshot_dir", config.snapshot_dir, "keep versioned snapshots of the mount point in this directory, taken periodically and before a bulk change, the rollback command restoring one, should be outside the mount point")
+	flags.IntVar(&config.snapshot_keep, "snapshot_keep", config.snapshot_keep, "the number of snapshots of the mount point kept, the oldest being removed")
+	flags.DurationVar(&config.snapshot_interval, "snapshot_interval", config.snapshot_interval, "the interval the snapshots of the mount point are taken at (if changed), zero only taking them before a bulk change")
+	flags.StringVar(&config.on_change, "on_change", config.on_change, "a command run (via sh -c) once the files under the mount point have changed and settled, i.e. to reload a service, given the paths changed on the stdin and in CONFIG_FS_CHANGED")
+	flags.DurationVar(&config.on_change_delay, "on_change_delay", config.on_change_delay, "the period the changes must settle for before the on change command and hooks are run, so a batch of changes runs them the once (deferred by ten times the delay at most)")
+	flags.StringVar(&config.hooks, "hooks", config.hooks, "the path of a JSON file of hooks, each running a command or signalling a process when the files matching its path glob have changed, in order")
+	flags.StringVar(&config.webhooks, "webhooks", config.webhooks, "the path of a JSON file of webhooks, each posted a JSON payload of the paths affected when the files change, a template fails to render or drift is repaired, filtered by the events and path glob it subscribes to")
+	flags.DurationVar(&config.webhook_batch, "webhook_batch", config.webhook_batch, "the window the events are batched over before being posted to the webhooks, starting from the first event")
+	flags.DurationVar(&config.progress_interval, "progress_interval", config.progress_interval, "the interval the progress of the initial build and full reconciliations (keys processed, bytes applied and an estimate of the time remaining) is logged on while they run, zero disables")
+	flags.StringVar(&config.verify, "verify", config.verify, "the path of a JSON file of verifications, each a command run against the files matching its path glob once written, a failure restoring the previous content and running its alert command")
+	flags.StringVar(&config.health_address, "health_address", config.health_address, "serve the health endpoints, /healthz (alive), /readyz (synchronized and the store reachable) and /status (a summary as JSON), on this address, i.e. :8080, empty disables")
+	flags.StringVar(&config.admin_address, "admin_address", config.admin_address, "serve the admin api (the files and templates managed, and requests to resync a prefix, pause and resume) on this address, i.e. 127.0.0.1:8081, empty disables")
+	flags.IntVar(&config.history_size, "history_size", config.history_size, "the number of the last events handled (the changes to the keys, the files written, the templates rendered and failures) kept in memory per mount point for the admin api, zero disables")
+	flags.StringVar(&config.admin_token_file, "admin_token_file", config.admin_token_file, "the file holding the bearer token every request to the admin api must carry, required by -admin_address")
+	flags.BoolVar(&config.write_status, "write_status", config.write_status, "maintain .configfs-status.json at the top of the mount point, the time of the last sync and change, the store, the index applied, the drift and the errors of the templates, so the tooling of the host can check the config is fresh")
+	flags.StringVar(&config.state_file, "state_file", config.state_file, "persist the state of each file managed (the revision last applied, when and the last error) to this file, should be outside the mount point")
+	flags.BoolVar(&config.incremental_sync, "incremental_sync", config.incremental_sync, "on the refresh interval, apply only the keys modified since the last sync (replayed from the history of the store) rather than reconciling the whole of the mount point, falling back to a full reconciliation if they can't be had")
+	flags.StringVar(&config.hash_index, "hash_index", config.hash_index, "persist the content hashes of the files written to this file, so on a restart the presync skips the files unchanged since without reading them, should be outside the mount point")
+	flags.StringVar(&config.prune, "prune", config.prune, "on a full synchronization, report or delete the files under the mount point none of the keys produce, i.e. left over from a missed deletion, either report or delete")
+	flags.StringVar(&config.quarantine_dir, "quarantine_dir", config.quarantine_dir, "capture a unified diff of any local change in this directory before it's reverted, should be outside the mount point")
+	flags.Int64Var(&config.quota, "quota", config.quota, "the maximum number of bytes written under the mount point, writes which would exceed it are refused, zero disables")
+	flags.DurationVar(&config.trash_retention, "trash_retention", config.trash_retention, "move the files of the keys removed into the .trash directory under the mount point, keeping them for this period (i.e. 24h), zero deletes them")
+	flags.BoolVar(&config.prune_empty_dirs, "prune_empty_dirs", config.prune_empty_dirs, "remove the directories left empty (up to the mount point) after a deletion")
+	flags.StringVar(&config.archive, "archive", config.archive, "maintain a tarball (compressed if ending in .gz or .tgz) of the mount point at this path, rewritten as changes are applied, should be outside the mount point")
+	flags.StringVar(&config.writeback, "writeback", config.writeback, "a comma separated list of glob patterns, local changes to the files of the keys matching are written back to the store, requires -read_only=false")
+	flags.Var(&config.mounts, "mounts", "a comma separated list of PREFIX=DIRECTORY, the keys beneath each prefix are materialized under the directory (in place of -root and -mount), can be given multiple times")
+	flags.Var(&config.aggregates, "aggregate", "a directory (key) materialized as a single file of its keys rather than a file per key, either DIRECTORY or DIRECTORY=FORMAT (env, properties or ini), can be given multiple times")
+	flags.Var(&config.documents, "json_document", "a directory (key) additionally materialized as DIRECTORY.json, the whole of its subtree as a single JSON document, can be given multiple times")
+	flags.Var(&config.atomic_dirs, "atomic_dir", "a directory (key) whose changes are staged and published together by flipping a link, so readers never see a mix of old and new files, can be given multiple times")
+	flags.BoolVar(&config.atomic_swap, "atomic_swap", config.atomic_swap, "materialize each change into a new directory and atomically flip the ..data link, so readers never observe a partial update")
+	flags.Var(&config.key_mapping, "key_mapping", "a rule mapping the keys onto the file names, strip_prefix=PREFIX, extension=EXT, lowercase or replace=CHARS=REPLACEMENT, can be given multiple times and applied in order")
+	flags.Var(&config.conflict_policies, "conflict_policy", "the policy when a file changed locally differs from the store, store-wins, local-wins or abort, either POLICY or PREFIX=POLICY, can be given multiple times")
+	flags.Var(&config.selinux_contexts, "selinux_context", "the selinux context applied to the files created, either CONTEXT or DIRECTORY=CONTEXT, can be given multiple times")
+	flags.StringVar(&config.file_owner, "file_owner", config.file_owner, "the default owner (name or uid) of the files and directories created")
+	flags.StringVar(&config.file_group, "file_group", config.file_group, "the default group (name or gid) of the files and directories created")
+	flags.StringVar(&config.write_plugins, "write_plugins", config.write_plugins, "a comma separated list of Go plugins (.so) exporting a PreWriteHook, vetoing or altering the content of the files before they're written, and/or a PostWriteHook observing the writes")
+	kv.RegisterFlags(flags, &config.kv)
+	fs.RegisterFlags(flags, &config.fs)
+	dynamic.RegisterFlags(flags, &config.dynamic)
+	logging.RegisterFlags(flags, &config.logging)
+	metrics.RegisterFlags(flags, &config.metrics)
+}
+
+/* An option applied to the configuration of a store */
+type Option func(*Config) error
+
+/* Applies the options to the configuration, in order */
+func (r *Config) Apply(options ...Option) error {
+	for _, option := range options {
+		if err := option(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* The root within the k/v store the mount point is based on */
+func WithRoot(root string) Option {
+	return func(config *Config) error {
+		if err := ValidateKey(root); err != nil {
+			return err
+		}
+		config.root_key = root
+		return nil
+	}
+}
+
+/* The mount point the keys are materialized under */
+func WithMount(directory string) Option {
+	return func(config *Config) error {
+		config.cfg_directory = directory
+		return nil
+	}
+}
+
+/* The interval the mount point is reconciled against the store on */
+func WithInterval(interval time.Duration) Option {
+	return func(config *Config) error {
+		if interval < time.Second {
+			return InvalidIntervalErr
+		}
+		config.refresh_interval = int(interval / time.Second)
+		return nil
+	}
+}
+
+/* The cron schedule the mount point is reconciled against the store on, or never, in place of the interval */
+func WithReconcileSchedule(schedule string) Option {
+	return func(config *Config) error {
+		if err := ValidateSchedule(schedule); err != nil {
+			return err
+		}
+		config.reconcile_schedule = schedule
+		return nil
+	}
+}
+
+/* Whether the local changes to the files are reverted, rather than left in place */
+func WithReadOnly(read_only bool) Option {
+	return func(config *Config) error {
+		config.read_only = read_only
+		return nil
+	}
+}
+
+/* Applies the options to the configuration of the k/v agent, i.e. WithStore(kv.WithURL("etcd://10.0.0.1:4001")) */
+func WithStore(options ...kv.Option) Option {
+	return func(config *Config) error {
+		return config.kv.Apply(options...)
+	}
+}
+
+/* Applies the options to the configuration of the file store */
+func WithFileStore(options ...fs.Option) Option {
+	return func(config *Config) error {
+		return config.fs.Apply(options...)
+	}
+}
+
+/* Applies the options to the configuration of the templated resources */
+func WithTemplates(options ...dynamic.Option) Option {
+	return func(config *Config) error {
+		return config.dynamic.Apply(options...)
+	}
+}
+
+/* Applies the options to the configuration of the logging, i.e. WithLogging(logging.WithLogger(logger)) */
+func WithLogging(options ...logging.Option) Option {
+	return func(config *Config) error {
+		return config.logging.Apply(options...)
+	}
+}
+
+/* Applies the options to the configuration of the metrics, i.e. WithMetrics(metrics.WithStatsd("127.0.0.1:8125")) */
+func WithMetrics(options ...metrics.Option) Option {
+	return func(config *Config) error {
+		return config.metrics.Apply(options...)
+	}
+}
+
+/*
+	Sets any of the configuration by the name of its command line flag, i.e. WithSetting("atomic_swap", "true"),
+	the settings of the flags given multiple times are added to
+*/
+func WithSetting(name, value string) Option {
+	return func(config *Config) error {
+		flags := flag.NewFlagSet(name, flag.ContinueOnError)
+		RegisterFlags(flags, config)
+		return flags.Set(name, value)
 	}
+}
+
+/* Checks if we are only observing the drift of the mount point, never writing */
+func (r Config) IsObserving() bool {
+	return r.observe
+}
+
+/* Applies the configuration of the logging to every subsystem, the logging being shared by the stores */
+func (r Config) ConfigureLogging() error {
+	return logging.Configure(r.logging)
+}
+
+/*
+	Push the metrics to statsd, if configured, until the context is cancelled; the host and the mount points are
+	added to the tags unless given, the metrics being those of the process rather than a mount point
+*/
+func (r Config) PushMetrics(ctx context.Context) error {
+	tags := make([]string, 0)
+	if !r.metrics.HasTag("host") {
+		if hostname, err := os.Hostname(); err == nil {
+			tags = append(tags, "host:"+hostname)
+		}
+	}
+	if !r.metrics.HasTag("mount") {
+		if len(r.mounts) <= 0 {
+			tags = append(tags, "mount:"+r.cfg_directory)
+		}
+		for _, mount := range r.mounts {
+			tags = append(tags, "mount:"+mount.Directory)
+		}
+	}
+	return metrics.Push(ctx, r.metrics, tags...)
+}
 
-func init() {
-	flag.StringVar(&options.root_key,"root", DEFAULT_ROOT_KEY, "the root within the k/v store to base the config on")
-	flag.StringVar(&options.cfg_directory, "mount", DEFAULT_MOUNT_POINT, "the mount point for the K/V store")
-	flag.BoolVar(&options.delete_on_exit, "delete_on_exit", DEFAULT_DELETE_ON_EXIT, "delete all configuration on exit")
-	flag.IntVar(&options.refresh_interval, "interval", DEFAULT_INTERVAL, "the default interval for performed a forced resync")
-	flag.BoolVar(&options.read_only, "read_only", DEFAULT_READ_ONLY, "wheather or not the config store of read-only")
-	flag.BoolVar(&options.sync_on_startup, "pre_sync", DEFAULT_PRE_SYNC, "wheather or not to perform a initial config sync against the backend")
-	flag.BoolVar(&options.delete_stale_files, "delete_stale", DEFAULT_DELETE_STALE, "delete stale files, i.e files which do not exists in the backend k/v store")
+/* Checks if we are performing a single sync and exiting, rather than running as a daemon */
+func (r Config) IsOnetime() bool {
+	return r.onetime
 }
 
 /* The interface to the config-fs */
 type Store interface {
-	/* perform synchronization between the mount point and the kv store */
-	Synchronize() error
-	/* shutdown the resources */
+	/* perform synchronization between the mount point and the kv store, until the context is cancelled */
+	Synchronize(ctx context.Context) error
+	/* shutdown the resources, blocking until the changes in flight have been applied */
 	Close()
 	/* delete the configuration directory */
 	Delete() error
+	/* register a handler for the changes made to the mount point, returning a function which unsubscribes it */
+	Subscribe(handler func(ChangeEvent)) func()
+	/* a channel closed once the mount point has been synchronized in full, i.e. the initial sync and renders */
+	Ready() <-chan struct{}
+	/* the status of the mount points, the store being probed for its reachability */
+	Status(ctx context.Context) []MountStatus
+	/* pause the application of changes, tracking them until resumed */
+	Pause()
+	/* resume the application of changes, applying those tracked while paused */
+	Resume()
+	/* reconcile the mount point against the store now, rather than waiting on the interval */
+	Resync()
+	/* reconcile the keys beneath the prefix now, UnknownPrefixErr if none of the mount points hold any */
+	ResyncPrefix(prefix string) error
+	/* the files managed, those of the keys beneath the prefix if given */
+	Files(prefix string) []FileStatus
+	/* the templates, along with their destinations and errors */
+	Templates() []TemplateStatus
+	/* the content last rendered by the template of the key, TemplateNotFoundErr if it isn't one */
+	Template(key string) (string, error)
+	/* the last events handled matching the query, oldest first */
+	History(query HistoryQuery) []HistoryEvent
 }
 
 /* The implementation of the above */
 type ConfigurationStore struct {
+	/* a lock for the destinations and attributes maps */
+	sync.RWMutex
+	/* the configuration of the store */
+	options Config
 	/* the file system implementation */
 	fs fs.FileStore
 	/* the k/v agent for the store */
 	kv kv.KVStore
 	/* the templated resources */
 	dynamic dynamic.DynamicStore
+	/* the watcher for changes under the mount point */
+	watcher WatchService
 
-	/* the shutdown signal */
-	shutdownChannel chan bool
+	/* cancels the event loop */
+	cancel context.CancelFunc
+	/* closed once the event loop has exited */
+	done chan struct{}
+	/* the handlers in flight */
+	handlers sync.WaitGroup
+	/* the workers applying the changes from the store and templates */
+	workers *WorkerPool
+	/* requests to pause or resume the synchronization */
+	pauseChannel chan PauseRequest
+	/* requests to reconcile the mount point now, i.e. on a SIGHUP */
+	resyncChannel chan string
+	/* set to 1 while the synchronization is paused */
+	paused int32
 	/* updates and changes to templated resourcs channel */
 	dynamicEventChannel dynamic.DynamicUpdateChannel
 	/* changes and updates to the file system channel */
 	filesystemEventChannel WatchServiceChannel
 	/* changes and uydates to the k/v store */
 	nodeEventChannel kv.NodeUpdateChannel
+	/* the bounded queue of the changes from the store, feeding the above */
+	events *EventQueue
 	/* a timer channel */
-	timerEventChannel *time.Ticker
+	timerEventChannel *ReconcileTimer
+	/* the destinations computed by the templated resources, resource path => destination paths */
+	destinations map[string]map[string]bool
+	/* the attributes of the files, i.e. the permissions */
+	attributes map[string]fs.Attributes
+	/* the default owner and group of the files, -1 if not set */
+	uid int
+	gid int
+	/* indicates we have mounted a tmpfs at the mount point */
+	tmpfsMounted bool
+	/* the include and exclude filters for the keys */
+	filter *Filter
+	/* serializes the changes when using the atomic swap */
+	swap sync.Mutex
+	/* the generation directory the changes are applied to, when using the atomic swap */
+	generation atomic.Value
+	/* the generation the ..data link points to */
+	published atomic.Value
+	/* the state changed by the transaction in progress, saved should the changes staged be rejected */
+	transaction atomic.Value
+	/* the previous generation kept to stage the next change in, and the directories it differs in from the current */
+	spare string
+	stale map[string]bool
+	/* the directories modified by the writes, and those changed beneath the generations as seen by the watcher */
+	staged  *GenerationFS
+	drifted ModifiedDirectories
+	/* the generations of the atomic directories staged by the transaction in progress, link => generation */
+	staging map[string]*StagedDirectory
+	/* a lock for the above */
+	atomicLock sync.Mutex
+	/* serializes the repairs of local changes, so a burst of events is only repaired once */
+	repairs sync.Mutex
+	/* the quota of the mount point, if any */
+	quota *DiskQuota
+	/* the default attributes defined by the directories, directory => attribute fields */
+	metadata map[string]string
+	/* a lock for the metadata, as it's consulted while holding the above */
+	metadataLock sync.RWMutex
+	/* the mapping between the keys and the file names */
+	mapping *KeyMapping
+	/* serializes the writes of the index of the hashed files */
+	hashedLock sync.Mutex
+	/* serializes the writes of the archive */
+	archiveLock sync.Mutex
+	/* the digest of the archive last written */
+	archived string
+	/* the keys whose local changes are written back to the store, if any */
+	writeback *Filter
+	/* the content last written to the files of the keys, for the writeback */
+	written map[string]WrittenContent
+	/* the values of the keys last applied to their files, so an unchanged value is skipped */
+	applied map[string]AppliedValue
+	/* the files exploded from the JSON value of the keys, key => relative paths */
+	exploded map[string]map[string]bool
+	/* serializes the writebacks, as a single save can raise a number of events */
+	writebackLock sync.Mutex
+	/* the journal of the changes received from the store, if any */
+	journal *WriteJournal
+	/* the election of the instance writing the mount point, if shared */
+	election *LeaderElection
+	/* serializes the snapshots of the mount point */
+	snapshotLock sync.Mutex
+	/* the digest of the files of the last snapshot taken */
+	snapshotted string
+	/* the snapshot the mount point has been rolled back to, while pinned */
+	pinned string
+	/* records the files changed, for the hooks and subscribers */
+	recorder *ChangeRecorderFS
+	/* the hooks run around the writes, the verifications, and the changes planned by a dry run */
+	writehooks *WriteHooksFS
+	verifying  *VerifyingFS
+	planned    *DryRunFS
+	/* the subscribers of the changes made to the mount point */
+	subscribers *Subscribers
+	/* runs the command and hooks once the changes have settled, if any */
+	hooks *ChangeHooks
+	/* posts the events to the webhooks, if any */
+	webhooks *Webhooks
+	/* the templates whose failures have been reported */
+	failures *TemplateFailures
+	/* the last events handled, if kept */
+	history *History
+	/* the index of the content written to the files, if persisted */
+	hashes *HashIndex
+	/* set to 1 while the initial presync is in progress */
+	presync int32
+	/* the index of the store the mount point was last synchronized to, when syncing incrementally */
+	synced uint64
+	/* the progress of the build and full reconciliations */
+	progress *SyncProgress
+	/* flipped once the mount point has been synchronized in full */
+	readiness *Readiness
+	/* the status of the synchronization, written to the status file */
+	status *SyncStatus
 }
 
-/* Create a new configuration store */
-func NewConfigurationStore() (Store, error) {
-	glog.Infof("Creating a new configuration store, mountpoint: '%s'", options.cfg_directory)
-	/* step: we create the kv store */
+/*
+	Create a configuration store from the configuration, the options applied over it, or with -mounts one for each of
+	the mount points, i.e. New(DefaultConfig(), WithRoot("/prod/app"), WithMount("/config"))
+*/
+func New(config Config, options ...Option) (Store, error) {
+	if err := config.Apply(options...); err != nil {
+		return nil, err
+	}
+	if err := config.ConfigureLogging(); err != nil {
+		return nil, err
+	}
+	if err := ValidateMode(config.mode); err != nil {
+		logger.Errorf("Invalid mode: %s specified", config.mode)
+		return nil, err
+	}
+	if config.mode == MODE_FUSE {
+		return NewFuseStore(config)
+	}
+	/* note: the write rate applies across the mount points, so they share the limiter */
+	writes := config.fs.NewWriteLimiter()
+	if len(config.mounts) > 0 {
+		return NewMountStores(config, writes)
+	}
+	return NewMountStore(config, writes)
+}
+
+/* Create the store of a mount point, from its own copy of the configuration, the files written throttled by the limiter */
+func NewMountStore(settings Config, writes *fs.RateLimiter) (Store, error) {
 	service := new(ConfigurationStore)
+	service.options = settings
+	/* step: normalize the mount point, i.e. C:/config => C:\config on windows */
+	service.options.cfg_directory = filepath.Clean(service.options.cfg_directory)
+	logger.Infof("Creating a new configuration store, root: '%s', mountpoint: '%s'", service.options.root_key, service.options.cfg_directory)
+	/* step: we create the kv store */
 	/* create the channel for k/v notifications */
-	service.nodeEventChannel = make(kv.NodeUpdateChannel, 10)
+	if service.options.queue_size <= 0 {
+		logger.Errorf("Invalid size of the event queue: %d specified", service.options.queue_size)
+		return nil, InvalidQueueSizeErr
+	}
+	if err := ValidateOverflow(service.options.overflow); err != nil {
+		logger.Errorf("Invalid overflow policy: %s specified", service.options.overflow)
+		return nil, err
+	}
+	service.events = NewEventQueue(service.options.queue_size, service.options.overflow)
+	service.nodeEventChannel = service.events.output
+	/* note: should the store fail to be created, the queue and whatever else has been opened are released */
+	created := false
+	defer func() {
+		if !created {
+			service.Release()
+		}
+	}()
 
-	if kvstore, err := kv.NewKVStore(service.nodeEventChannel); err != nil {
-		glog.Fatalf("Failed to create the K/V Store, error: %s", err)
+	if kvstore, err := kv.New(service.options.kv, service.events.input); err != nil {
+		logger.Errorf("Failed to create the K/V Store, error: %s", err)
 		return nil, err
 	} else {
-		service.fs = fs.NewStoreFS()
 		service.kv = kvstore
-		service.dynamic = dynamic.NewDynamicStore(DEFAULT_DYNAMIC_PREFIX, kvstore)
-		service.shutdownChannel = make(chan bool, 1)
-		service.dynamicEventChannel = make(dynamic.DynamicUpdateChannel, 10)
-		service.filesystemEventChannel = make(WatchServiceChannel, 10)
-		service.timerEventChannel = time.NewTicker(time.Duration(options.refresh_interval) * time.Second)
+		if service.fs, err = NewFileStore(service.options, writes); err != nil {
+			return nil, err
+		}
+		/* note: the directories modified are recorded beneath the other layers, so every write is seen */
+		if service.options.atomic_swap {
+			service.staged = NewGenerationFS(service.fs)
+			service.fs = service.staged
+		}
+		/* note: the files are verified beneath the recorder, so a write which is reverted isn't a change */
+		if service.options.verify != "" {
+			verifications, err := LoadVerifications(service.options.verify)
+			if err != nil {
+				logger.Errorf("Failed to load the verifications from: %s, error: %s", service.options.verify, err)
+				return nil, err
+			}
+			service.verifying = NewVerifyingFS(service.fs, verifications, service.options.cfg_directory, service.StatePath)
+			service.fs = service.verifying
+		}
+		/* note: the dry run plans the writes beneath the hooks, so the changes are planned with the content the hooks
+		return, though the verifications are never run */
+		if service.options.dry_run {
+			if service.options.atomic_swap || service.options.tmpfs || service.options.archive != "" || service.options.writeback != "" {
+				logger.Errorf("The dry run can't be used with the atomic swap, tmpfs, archive or writeback")
+				return nil, InvalidDryRunErr
+			}
+			logger.Infof("Performing a dry run, the changes to the mount point: %s are logged but not made", service.options.cfg_directory)
+			service.planned = NewDryRunFS(service.fs)
+			service.fs = service.planned
+		}
+		/* note: the hooks run above the verifications, which are given the content the hooks return */
+		pre, post := service.options.pre_write_hooks, service.options.post_write_hooks
+		if service.options.write_plugins != "" {
+			loaded_pre, loaded_post, err := LoadWritePlugins(service.options.write_plugins)
+			if err != nil {
+				logger.Errorf("Failed to load the write plugins: %s, error: %s", service.options.write_plugins, err)
+				return nil, err
+			}
+			pre, post = append(append([]PreWriteHook{}, pre...), loaded_pre...), append(append([]PostWriteHook{}, post...), loaded_post...)
+		}
+		if service.options.dry_run {
+			post = nil
+		}
+		if len(pre) > 0 || len(post) > 0 {
+			service.writehooks = NewWriteHooksFS(service.fs, pre, post, service.StatePath)
+			service.fs = service.writehooks
+		}
+		/* note: on a dry run nothing changes, so the post-write hooks are never run nor the changes published */
+		service.subscribers = NewSubscribers()
+		if !service.options.dry_run {
+			service.recorder = NewChangeRecorderFS(service.fs)
+			service.fs = service.recorder
+		}
+		if (service.options.on_change != "" || service.options.hooks != "") && !service.options.dry_run {
+			hooks := make([]*Hook, 0)
+			if service.options.hooks != "" {
+				if hooks, err = LoadHooks(service.options.hooks); err != nil {
+					logger.Errorf("Failed to load the hooks from: %s, error: %s", service.options.hooks, err)
+					return nil, err
+				}
+			}
+			/* step: the on change command runs for every change, after the hooks */
+			if service.options.on_change != "" {
+				hook := &Hook{Command: service.options.on_change}
+				if err := hook.Compile(); err != nil {
+					return nil, err
+				}
+				hooks = append(hooks, hook)
+			}
+			service.hooks = NewChangeHooks(hooks, service.options.cfg_directory, service.options.on_change_delay)
+		}
+		if service.options.webhooks != "" && !service.options.dry_run {
+			webhooks, err := LoadWebhooks(service.options.webhooks)
+			if err != nil {
+				logger.Errorf("Failed to load the webhooks from: %s, error: %s", service.options.webhooks, err)
+				return nil, err
+			}
+			service.webhooks = NewWebhooks(webhooks, service.options.cfg_directory, service.options.webhook_batch)
+		}
+		service.failures = NewTemplateFailures()
+		service.history = NewHistory(service.options.history_size)
+		if service.watcher, err = NewWatchService(); err != nil {
+			logger.Errorf("Failed to create the watch service, error: %s", err)
+			return nil, err
+		}
+		/* note: the templates retrieve their keys from the same store, each with an agent of its own */
+		templates := service.options.dynamic
+		if err := templates.Apply(dynamic.WithStore(service.options.kv)); err != nil {
+			return nil, err
+		}
+		service.dynamic = dynamic.NewDynamicStore(DEFAULT_DYNAMIC_PREFIX, kvstore, templates)
+		service.destinations = make(map[string]map[string]bool, 0)
+		service.exploded = make(map[string]map[string]bool, 0)
+		service.attributes = make(map[string]fs.Attributes, 0)
+		service.applied = make(map[string]AppliedValue, 0)
+		service.progress = NewSyncProgress(service.options.cfg_directory)
+		service.readiness = NewReadiness(service.options.cfg_directory)
+		service.status = new(SyncStatus)
+		service.metadata = make(map[string]string, 0)
+		service.mapping = NewKeyMapping(service.options.key_mapping)
+		/* note: the leader and freeze keys are never materialized, should they be beneath the root */
+		excludes := service.options.exclude
+		for _, key := range []string{service.options.leader_key, service.options.freeze_key} {
+			if key != "" {
+				excludes = strings.Join([]string{excludes, CleanKey(key)}, ",")
+			}
+		}
+		if service.filter, err = NewFilter(service.options.include, excludes); err != nil {
+			return nil, err
+		}
+		if err := service.filter.AddExpressions(service.options.include_regexp, service.options.exclude_regexp); err != nil {
+			return nil, err
+		}
+		service.filter.SetMarkers(service.options.ignore_markers)
+		if service.options.writeback != "" {
+			if service.options.read_only || service.options.atomic_swap {
+				logger.Errorf("The writeback requires a writable mount point and can't be used with the atomic swap")
+				return nil, InvalidWritebackErr
+			}
+			if service.writeback, err = NewFilter(service.options.writeback, ""); err != nil {
+				return nil, err
+			}
+		}
+		/* step: the writeback and the conflicts both work from the content we last wrote */
+		if service.writeback != nil || service.options.conflict_policies.IsDetecting() {
+			service.written = make(map[string]WrittenContent, 0)
+		}
+		if len(service.options.atomic_dirs) > 0 {
+			if service.options.atomic_swap {
+				logger.Errorf("The atomic directories can't be used with the atomic swap")
+				return nil, InvalidAtomicDirErr
+			}
+			/* step: the changes are staged over a window, so those of a batch are published together */
+			if service.options.coalesce <= 0 {
+				service.options.coalesce = DEFAULT_ATOMIC_WINDOW
+			}
+		}
+		if service.options.hash_index != "" && service.options.atomic_swap {
+			logger.Errorf("The hash index can't be used with the atomic swap")
+			return nil, InvalidHashIndexErr
+		}
+		for _, directory := range service.options.documents {
+			if aggregate, found := service.AggregateOf(directory); found && aggregate != directory {
+				logger.Errorf("The document directory: %s is beneath the aggregated directory: %s", directory, aggregate)
+				return nil, InvalidDocumentErr
+			}
+		}
+		if service.options.validate != "" && !service.options.atomic_swap && len(service.options.atomic_dirs) <= 0 && !service.options.dry_run {
+			logger.Errorf("The validation requires the changes to be staged, via the atomic swap or atomic directories")
+			return nil, InvalidValidateErr
+		}
+		if service.options.snapshot_dir != "" {
+			if service.options.snapshot_keep <= 0 || filepath.Clean(service.options.snapshot_dir) == service.options.cfg_directory ||
+				IsBeneath(service.options.cfg_directory, filepath.Clean(service.options.snapshot_dir)) {
+				logger.Errorf("Invalid snapshot directory: %s, or number of snapshots kept: %d", service.options.snapshot_dir, service.options.snapshot_keep)
+				return nil, InvalidSnapshotErr
+			}
+		}
+		if service.options.leader_key != "" {
+			if service.options.leader_ttl < time.Second {
+				logger.Errorf("Invalid leader ttl: %s specified", service.options.leader_ttl)
+				return nil, InvalidLeaderTTLErr
+			}
+			service.election = NewLeaderElection(kvstore, CleanKey(service.options.leader_key), service.options.leader_ttl)
+		}
+		if service.options.onetime && (service.options.tmpfs || service.options.delete_on_exit) {
+			logger.Errorf("The onetime sync can't be used with tmpfs or delete on exit")
+			return nil, InvalidOnetimeErr
+		}
+		if err := ValidatePrune(service.options.prune); err != nil {
+			logger.Errorf("Invalid prune: %s specified", service.options.prune)
+			return nil, err
+		}
+		if (service.options.delete_on_exit || service.options.prune == PRUNE_DELETE) && IsDangerousMountPoint(service.options.cfg_directory) {
+			logger.Errorf("The mount point: %s is a system or home directory, it can't be used with delete on exit or prune=delete",
+				service.options.cfg_directory)
+			return nil, DangerousMountErr
+		}
+		if err := ValidateStartupPolicy(service.options.startup_policy); err != nil {
+			logger.Errorf("Invalid startup policy: %s specified", service.options.startup_policy)
+			return nil, err
+		}
+		if service.options.onetime && service.options.startup_policy == STARTUP_SNAPSHOT {
+			logger.Errorf("The onetime sync can't serve a snapshot, as there's no retrying in the background")
+			return nil, InvalidOnetimeErr
+		}
+		if service.options.workers <= 0 {
+			logger.Errorf("Invalid number of workers: %d specified", service.options.workers)
+			return nil, InvalidWorkersErr
+		}
+		/* note: on a dry run nothing is applied, so there's nothing to journal */
+		if service.options.journal != "" && !service.options.dry_run {
+			if service.journal, err = OpenJournal(service.options.journal); err != nil {
+				logger.Errorf("Failed to open the journal: %s, error: %s", service.options.journal, err)
+				return nil, err
+			}
+		}
+		service.uid, service.gid = -1, -1
+		if service.options.file_owner != "" {
+			if service.uid, err = LookupUser(service.options.file_owner); err != nil {
+				logger.Errorf("Failed to resolve the file owner: %s, error: %s", service.options.file_owner, err)
+				return nil, err
+			}
+		}
+		if service.options.file_group != "" {
+			if service.gid, err = LookupGroup(service.options.file_group); err != nil {
+				logger.Errorf("Failed to resolve the file group: %s, error: %s", service.options.file_group, err)
+				return nil, err
+			}
+		}
+		service.dynamicEventChannel = make(dynamic.DynamicUpdateChannel, service.options.queue_size)
+		service.filesystemEventChannel = make(WatchServiceChannel, service.options.queue_size)
+		service.watcher.AddWatchListener(service.filesystemEventChannel)
+		if service.timerEventChannel, err = NewReconcileTimer(service.options.reconcile_schedule, time.Duration(service.options.refresh_interval)*time.Second); err != nil {
+			logger.Errorf("Invalid reconcile schedule: %s specified", service.options.reconcile_schedule)
+			return nil, err
+		}
+		created = true
 		return service, nil
 	}
 }
 
+/* Releases the store, the queue of the events, the watch and the journal of a store which failed to be created */
+func (r *ConfigurationStore) Release() {
+	if r.kv != nil {
+		r.kv.Close()
+	}
+	r.events.Close()
+	if r.watcher != nil {
+		r.watcher.Close()
+	}
+	r.journal.Close()
+}
+
+/* Create the file store, encrypting the content at rest if a key has been given */
+func NewFileStore(settings Config, writes *fs.RateLimiter) (fs.FileStore, error) {
+	if settings.encryption_key == "" {
+		return fs.NewStoreFS(settings.fs, writes), nil
+	}
+	logger.Infof("Encrypting the files at rest using the key: %s", settings.encryption_key)
+	key, err := fs.LoadEncryptionKey(settings.encryption_key)
+	if err != nil {
+		logger.Errorf("Failed to load the encryption key: %s, error: %s", settings.encryption_key, err)
+		return nil, err
+	}
+	return fs.NewEncryptedStoreFS(settings.fs, writes, key)
+}
+
+/* Decrypts a file materialized under the mount point, using the encryption key */
+func DecryptFile(settings Config, path string) (string, error) {
+	if settings.encryption_key == "" {
+		return "", errors.New("No encryption key has been specified")
+	}
+	storefs, err := NewFileStore(settings, nil)
+	if err != nil {
+		return "", err
+	}
+	return storefs.Read(path)
+}
+
 func (r *ConfigurationStore) Close() {
-	glog.Infof("Request to shutdown and release the resources")
-	r.shutdownChannel <- true
+	logger.Infof("Request to shutdown and release the resources")
+	/* step: stop the event loop and wait for the changes in flight */
+	if r.cancel != nil {
+		r.cancel()
+		<-r.done
+		r.handlers.Wait()
+		logger.Infof("The event loop has exited and the changes in flight have been applied")
+		r.SaveSyncState()
+		r.SaveHashIndex()
+		if err := r.journal.Close(); err != nil {
+			logger.Errorf("Failed to close the journal: %s, error: %s", r.options.journal, err)
+		}
+	} else {
+		/* step: the event loop never ran (i.e. the sync failed, or we were never elected), though the watches
+		on the store, the mount point and the templates may well have been */
+		<-r.CloseSources()
+	}
+	/* step: run the hooks for the last of the changes, post the webhooks, and wait on the subscribers to handle theirs */
+	r.hooks.Flush()
+	r.webhooks.Flush()
+	r.subscribers.Close()
+	/* step: hand over to a standby; a shared mount point is only ours to delete while we're the leader */
+	owner := r.election == nil || r.election.IsLeader()
+	r.election.Release()
+	/* step: if we mounted a tmpfs, we tear it down first, the content goes with it and the mount point is free to remove */
+	if r.tmpfsMounted {
+		if err := UnmountTmpfs(r.options.cfg_directory); err == nil {
+			r.tmpfsMounted = false
+		}
+	}
 	/* step: if requested, delete the configuration directory */
-	if options.delete_on_exit {
-		r.Delete()
+	if r.options.delete_on_exit {
+		if owner {
+			r.Delete()
+		} else {
+			logger.Warningf("Leaving the mount point: %s in place, it's written by the leader", r.options.cfg_directory)
+		}
 	}
 }
 
 /* Synchronize the key/value store with the configuration directory */
-func (r *ConfigurationStore) Synchronize() error {
-	glog.Infof("Starting the sychronization between root: %s, mount: %s, store: %s", options.root_key,
-		options.cfg_directory, r.kv.URL())
+func (r *ConfigurationStore) Synchronize(ctx context.Context) error {
+	logger.Infof("Starting the sychronization between root: %s, mount: %s, store: %s", r.options.root_key,
+		r.options.cfg_directory, r.kv.URL())
+	/* step: with a shared mount point nothing is written until we're elected the leader */
+	if r.election != nil {
+		logger.Infof("Standing by until elected the leader, via the key: %s", r.options.leader_key)
+		if !r.AwaitLeadership(ctx) {
+			logger.Infof("Shutdown while standing by, the mount point: %s was never synchronized", r.options.cfg_directory)
+			return nil
+		}
+	}
 
 	/* step: if the base directory does not exists, we try and create it */
-	if r.fs.IsDirectory(options.cfg_directory) == false {
-		glog.Infof("Creating the base directory: %s for you", options.cfg_directory)
-		if err := r.fs.Mkdirp(options.cfg_directory); err != nil {
-			glog.Errorf("Failed to create the base directory: %s, error: %s", options.cfg_directory, err)
+	created := false
+	if r.fs.IsDirectory(r.options.cfg_directory) == false {
+		logger.Infof("Creating the base directory: %s for you", r.options.cfg_directory)
+		if err := r.MakeDirectory(r.options.cfg_directory); err != nil {
+			logger.Errorf("Failed to create the base directory: %s, error: %s", r.options.cfg_directory, err)
+			return err
+		}
+		created = true
+	}
+	/* step: if requested, mount a tmpfs at the mount point */
+	if r.options.tmpfs {
+		mounted, err := MountTmpfs(r.options.cfg_directory, r.options.tmpfs_size, os.FileMode(r.options.dir_mode), r.uid, r.gid)
+		if err != nil {
+			return err
+		}
+		/* note: a tmpfs mounted by someone else is neither claimed as empty nor unmounted on close */
+		if mounted {
+			r.tmpfsMounted, created = true, true
+		}
+	}
+	/* step: mark the mount point as ours, before anything is written to it */
+	r.ClaimMountPoint(created)
+	r.ResetReady()
+	/* step: run the hooks as the files change */
+	if r.hooks != nil {
+		go r.hooks.Run(ctx)
+	}
+	if r.webhooks != nil {
+		go r.webhooks.Run(ctx)
+	}
+	/* step: with the atomic swap we carry on from the current generation */
+	if r.options.atomic_swap {
+		r.published.Store(r.CurrentGeneration())
+		r.SetGeneration(r.Published())
+	}
+	/* step: account for the files already under the mount point against the quota */
+	if r.options.quota > 0 {
+		r.quota = NewDiskQuota(r.options.quota, r.options.cfg_directory, r.options.atomic_swap)
+		if base := r.FullPath(""); base != "" {
+			if err := r.quota.Scan(base); err != nil {
+				logger.Errorf("Failed to scan the mount point: %s for the quota, error: %s", base, err)
+				return err
+			}
+		}
+		logger.Infof("Applying a quota of %d bytes to the mount point, presently used: %d bytes", r.options.quota, r.quota.Used())
+		r.fs.SetQuota(r.quota)
+	}
+	r.PurgeTrash()
+	/* step: carry on from the persisted state of the files, until they are written again */
+	if r.options.state_file != "" {
+		if err := states.Load(r.options.state_file); err != nil {
+			logger.Errorf("Failed to load the sync state from: %s, error: %s", r.options.state_file, err)
+		}
+	}
+	/* step: the files written by a previous run, so the presync can skip those unchanged */
+	if r.options.hash_index != "" && !r.options.dry_run {
+		var err error
+		if r.hashes, err = LoadHashIndex(r.options.hash_index); err != nil {
+			logger.Errorf("Failed to load the hash index from: %s, rebuilding it, error: %s", r.options.hash_index, err)
+		}
+	}
+	/* step: while the store is frozen nothing is written, the changes are tracked until it's thawed */
+	frozen := r.IsFrozen(ctx)
+	if frozen {
+		if r.options.onetime {
+			return FrozenErr
+		}
+		logger.Warningf("The store is frozen by the key: %s, the changes are tracked until it's removed", r.options.freeze_key)
+	}
+	/* step: a mount point pinned to a snapshot is rolled back, the changes are tracked until the pin is released */
+	if r.options.snapshot_dir != "" {
+		if err := os.MkdirAll(r.options.snapshot_dir, 0700); err != nil {
+			logger.Errorf("Failed to create the snapshot directory: %s, error: %s", r.options.snapshot_dir, err)
 			return err
 		}
 	}
+	pinned := r.IsPinned()
+	if pinned {
+		r.ApplyPin()
+		if r.options.onetime {
+			return PinnedErr
+		}
+		logger.Warningf("The mount point is pinned to the snapshot: %s, the changes are tracked until released", r.pinned)
+	}
 	/* step: perform a one-time build of the configuration store */
-	if options.sync_on_startup {
-		glog.Infof("Perform a initial presync of the confiuration directory")
-		if err := r.BuildFileSystem(); err != nil {
-			glog.Errorf("Failed to build the initial filesystem, error: %s", err)
+	started := time.Now().UTC()
+	degraded := false
+	if (r.options.sync_on_startup || r.options.onetime) && !frozen && !pinned {
+		logger.Infof("Perform a initial presync of the confiuration directory")
+		r.TakeSnapshot("startup")
+		var err error
+		/* step: take note of the mount point beforehand, so we can report what the sync changed */
+		before := r.MountSnapshot()
+		index := r.SyncIndex(ctx)
+		r.Transaction(func() {
+			atomic.StoreInt32(&r.presync, 1)
+			err = r.BuildFileSystem(ctx)
+			atomic.StoreInt32(&r.presync, 0)
+			if err != nil {
+				return
+			}
+			/* step: the orphans are only found against a complete listing of the store */
+			if r.options.prune != "" {
+				if _, err := r.Reconcile(ctx); err != nil {
+					logger.Errorf("Failed to prune the mount point: %s, error: %s", r.options.cfg_directory, err)
+				}
+			}
+		})
+		if err != nil {
+			logger.Errorf("Failed to perform the initial sync of the mount point: %s, error: %s", r.options.cfg_directory, err)
+			/* step: with the snapshot policy we carry on from the last snapshot, the sync retried in the background */
+			if r.options.startup_policy != STARTUP_SNAPSHOT || ctx.Err() != nil {
+				return err
+			}
+			r.ServeSnapshot()
+			degraded = true
+		} else {
+			/* note: on a dry run nothing was written, the changes planned have already been logged */
+			if !r.options.dry_run {
+				r.ReportStartup(before, r.MountSnapshot())
+			}
+			r.SetSynced(index)
+			r.SaveHashIndex()
+			r.RecordSync(index)
+			r.CheckReady()
+		}
+	}
+	/* step: apply the changes a previous run received but never finished applying */
+	if !frozen && !pinned {
+		if err := r.ReplayJournal(ctx); err != nil {
 			return err
 		}
 	}
+	/* step: in read only mode we protect the files in the mount point */
+	if r.options.read_only {
+		r.ProtectMountPoint()
+	}
+	/* step: with a onetime sync we're done, the files which couldn't be written are returned */
+	if r.options.onetime {
+		<-r.CloseSources()
+		r.SaveSyncState()
+		r.SaveHashIndex()
+		r.hooks.Flush()
+		r.webhooks.Flush()
+		r.election.Release()
+		if failed := states.FailedSince(r.options.cfg_directory, started); len(failed) > 0 {
+			return FailedFilesErr(failed)
+		}
+		return nil
+	}
+	/* step: watch the mount point for local changes, on a dry run it may not exist */
+	if r.options.dry_run && !r.fs.IsDirectory(r.options.cfg_directory) {
+		logger.Infof("[dry-run] the mount point: %s does not exist, not watching for local changes", r.options.cfg_directory)
+	} else if err := r.watcher.AddDirectoryWatch(r.options.cfg_directory); err != nil {
+		logger.Errorf("Failed to add a watch on the mount point: %s, error: %s", r.options.cfg_directory, err)
+		return err
+	}
 
 	/*
 		Jump into the event loop; we wait for
@@ -159,87 +1192,660 @@ func (r *ConfigurationStore) Synchronize() error {
 		- a timer event to occur and enforce a refresh of the config
 		- a notification of file changes on the config directory
 		- a template resource has changed and we need to update the config store
-		- a shutdown signal to occur
+		- a request to pause or resume the synchronization
+		- a request to reconcile the mount point now
+		- the periodic snapshot of the mount point
+		- the context to be cancelled, i.e. a shutdown signal
 
 	*/
+	ctx, r.cancel = context.WithCancel(ctx)
+	/* note: the changes received are applied in full, those received ahead of a shutdown included, while a
+	reconciliation in flight is cancelled by it */
+	applying := context.WithoutCancel(ctx)
+	r.pauseChannel = make(chan PauseRequest)
+	r.resyncChannel = make(chan string)
+	r.done = make(chan struct{})
 	go func() {
+		defer close(r.done)
+		/* step: the workers are stopped once the loop exits, after the changes queued have been applied */
+		r.workers = NewWorkerPool(r.options.workers, &r.handlers)
+		defer r.workers.Close()
 		/* step: add a watch on the K/V store for the root directory - i.e. watch for ALL changes */
-		r.kv.Watch(options.root_key)
+		r.kv.Watch(r.options.root_key)
+		if r.options.freeze_key != "" {
+			r.kv.Watch(CleanKey(r.options.freeze_key))
+		}
+		/* step: watch for a rollback, and take the periodic snapshots */
+		var snapshots <-chan time.Time
+		if r.options.snapshot_dir != "" {
+			go r.WatchPin(ctx)
+			if r.options.snapshot_interval > 0 {
+				ticker := time.NewTicker(r.options.snapshot_interval)
+				defer ticker.Stop()
+				snapshots = ticker.C
+			}
+		}
+
+		/* note: closed once the sources of events have been shutdown, until then nil and never selected */
+		var closed chan struct{}
+		shutdown := ctx.Done()
+		/* note: when coalescing, the events pending, the end of the window and the batch being applied */
+		batch := NewEventBatch()
+		var flush <-chan time.Time
+		var applied chan struct{}
+		/* note: the reasons the synchronization is paused, it's resumed once there are none */
+		reasons := make(map[string]bool, 0)
+		pause := func(request PauseRequest) {
+			if request.Paused {
+				reasons[request.Reason] = true
+			} else {
+				delete(reasons, request.Reason)
+			}
+			if paused := len(reasons) > 0; paused == r.IsPaused() {
+				logger.V(VERBOSE_INFO).Infof("The synchronization remains paused: %t, by: %s", paused, PauseReasons(reasons))
+				return
+			} else if paused {
+				logger.Warningf("Pausing the synchronization of the mount point: %s, by: %s, the changes are tracked until resumed",
+					r.options.cfg_directory, request.Reason)
+				atomic.StoreInt32(&r.paused, 1)
+				/* step: the events of an open coalescing window join the backlog */
+				flush = nil
+				return
+			}
+			logger.Infof("Resuming the synchronization of the mount point: %s, by: %s, applying %d changes received while paused",
+				r.options.cfg_directory, request.Reason, batch.Size())
+			atomic.StoreInt32(&r.paused, 0)
+			if applied == nil && !batch.IsEmpty() {
+				applied, batch = r.ApplyBatch(applying, batch), NewEventBatch()
+			}
+			/* step: correct any local drift left unrepaired while paused */
+			r.Dispatch(func() { r.HandleTimerEvent(ctx) })
+		}
+		if frozen {
+			pause(PauseRequest{Reason: PAUSE_FREEZE, Paused: true})
+		}
+		if pinned {
+			pause(PauseRequest{Reason: PAUSE_PINNED, Paused: true})
+		}
+		/* step: serving a snapshot, the sync is retried until the store can be reached */
+		if degraded {
+			r.Dispatch(func() { r.RetryStartup(ctx) })
+		}
 
 		/* step: enter into the main event loop */
 		for {
 			select {
 			case event := <-r.nodeEventChannel:
-				/* change to the k/v */
-				go r.HandleNodeEvent(event)
+				/* step: once the queue has drained, we reconcile to recover any changes dropped while it was full,
+				while paused the resume reconciles */
+				if len(r.nodeEventChannel) <= 0 && r.events.Dropped() && !r.IsPaused() {
+					logger.Warningf("Changes from the store were dropped as the event queue was full, reconciling the mount point: %s",
+						r.options.cfg_directory)
+					r.Dispatch(func() { r.HandleTimerEvent(ctx) })
+				}
+				/* the watch lost its place in the history of the store, the changes missed are recovered by a
+				reconciliation (while paused, the resume reconciles) */
+				if event.Operation == kv.RESYNC {
+					if !r.IsPaused() {
+						logger.Warningf("The watch on the store missed changes beneath: %s, reconciling the mount point: %s",
+							event.Node.Path, r.options.cfg_directory)
+						r.Dispatch(func() { r.HandleTimerEvent(ctx) })
+					}
+					break
+				}
+				/* the freeze key has been set or removed */
+				if r.IsFreezeKey(event.Node.Path) {
+					pause(PauseRequest{Reason: PAUSE_FREEZE, Paused: event.Operation != kv.DELETED})
+					break
+				}
+				/* change to the k/v, recorded in the journal until applied */
+				sequence := r.journal.Begin(event)
+				if r.IsPaused() {
+					metrics.Increment(metrics.EVENTS_DEFERRED)
+					batch.AddNode(event, sequence)
+				} else if r.options.coalesce <= 0 {
+					r.SubmitNodeEvent(event, func() {
+						if r.Transaction(func() { r.HandleNodeEvent(applying, event) }) {
+							r.journal.Complete(event.Node.Path, sequence)
+						}
+					})
+				} else {
+					batch.AddNode(event, sequence)
+					if flush == nil && applied == nil {
+						flush = time.After(r.options.coalesce)
+					}
+				}
 			case event := <-r.dynamicEventChannel:
 				/* a template has changed */
-				go r.HandleTemplateEvent(event)
+				if r.IsPaused() {
+					metrics.Increment(metrics.EVENTS_DEFERRED)
+					batch.AddTemplate(event)
+				} else if r.options.coalesce <= 0 {
+					r.SubmitTemplateEvent(event, func() { r.Transaction(func() { r.HandleTemplateEvent(event) }) })
+				} else {
+					batch.AddTemplate(event)
+					if flush == nil && applied == nil {
+						flush = time.After(r.options.coalesce)
+					}
+				}
+			case <-flush:
+				/* the coalescing window has closed */
+				flush, applied, batch = nil, r.ApplyBatch(applying, batch), NewEventBatch()
+			case <-applied:
+				/* step: the events received while the batch was applied have waited long enough */
+				applied = nil
+				if !batch.IsEmpty() && !r.IsPaused() {
+					applied, batch = r.ApplyBatch(applying, batch), NewEventBatch()
+				}
 			case event := <-r.filesystemEventChannel:
-				/* the file system in the configuration directory has changed */
-				go r.HandleFileNotificationEvent(event)
+				/* the file system in the configuration directory has changed, queued behind any changes to the file */
+				if !r.FilterGenerationEvent(event) {
+					break
+				}
+				r.SubmitFileEvent(event, func() { r.HandleFileNotificationEvent(applying, event) })
+
 			case <-r.timerEventChannel.C:
-				/* a timer has kicked off */
-				go r.HandleTimerEvent()
-			case <-r.shutdownChannel:
-				/* we have received a request to shutdown */
-				glog.Infof("Recieved the shutdown signal ... shutting down now")
-				break
+				/* a timer has kicked off, the reconciliation waits on a resume while paused; on a schedule
+				the reconciliation is always in full */
+				if r.IsPaused() {
+					break
+				}
+				if r.timerEventChannel.IsScheduled() {
+					logger.Infof("Reconciling the mount point: %s against the store, as scheduled", r.options.cfg_directory)
+					r.Dispatch(func() { r.HandleTimerEvent(ctx) })
+				} else {
+					r.Dispatch(func() { r.HandleRefreshEvent(ctx) })
+				}
+			case prefix := <-r.resyncChannel:
+				/* a reconciliation has been requested, of the keys beneath a prefix or in full, while paused it waits on the resume */
+				switch {
+				case r.IsPaused():
+					logger.Warningf("Skipping the reconciliation requested, the synchronization is paused, it's reconciled on resume")
+				case prefix != "":
+					logger.Infof("Reconciling the keys beneath: %s against the store, as requested", prefix)
+					r.Dispatch(func() { r.HandleResyncEvent(ctx, prefix) })
+				default:
+					logger.Infof("Reconciling the mount point: %s against the store, as requested", r.options.cfg_directory)
+					r.Dispatch(func() { r.HandleTimerEvent(ctx) })
+				}
+			case <-snapshots:
+				/* the periodic snapshot of the mount point is due */
+				r.Dispatch(func() { r.TakeSnapshot("periodic") })
+			case request := <-r.pauseChannel:
+				/* the synchronization has been paused or resumed */
+				pause(request)
+			case <-shutdown:
+				/* we have received a request to shutdown; we keep consuming the events while the sources are
+				shutdown, so none of them are left blocked on a send */
+				logger.Infof("Recieved the shutdown signal ... shutting down now")
+				shutdown, closed = nil, r.CloseSources()
+			case <-closed:
+				/* step: apply the changes to the store we've already received, after any batch in flight */
+				if applied != nil {
+					<-applied
+				}
+				if r.IsPaused() {
+					logger.Warningf("Shutting down while paused, %d changes received were not applied to the mount point: %s",
+						batch.Size(), r.options.cfg_directory)
+					if r.journal != nil {
+						logger.Warningf("The changes remain outstanding in the journal: %s, they are replayed on the next start", r.options.journal)
+					}
+					return
+				}
+				for {
+					select {
+					case event := <-r.nodeEventChannel:
+						batch.AddNode(event, r.journal.Begin(event))
+					default:
+						if !batch.IsEmpty() {
+							r.ApplyBatch(applying, batch)
+						}
+						return
+					}
+				}
 			}
 		}
 	}()
+	/* step: the leadership may have been lost before the event loop was running */
+	if r.election != nil && !r.election.IsLeader() {
+		r.SetPaused(PAUSE_LEADER, true)
+	}
 	return nil
 }
 
-/* we delete all the configuration files */
+/* Runs the handler in the background, tracking it so the shutdown can wait for it to complete */
+func (r *ConfigurationStore) Dispatch(handler func()) {
+	r.handlers.Add(1)
+	go func() {
+		defer r.handlers.Done()
+		handler()
+	}()
+}
+
+/* Shuts down the sources of events, the timer, watches and templated resources, returning a channel closed when done */
+func (r *ConfigurationStore) CloseSources() chan struct{} {
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		r.timerEventChannel.Stop()
+		r.kv.Close()
+		r.events.Close()
+		if err := r.watcher.Close(); err != nil {
+			logger.Errorf("Failed to close the watch on the mount point, error: %s", err)
+		}
+		for path, _ := range r.dynamic.List() {
+			r.dynamic.Delete(path)
+		}
+	}()
+	return closed
+}
+
+/* we delete all the configuration files, checking nothing was left behind */
 func (r *ConfigurationStore) Delete() error {
-	glog.Infof("Deleting the entire configuration directory: %s as requested", options.cfg_directory)
-	if err := r.fs.Rmdir(options.cfg_directory); err != nil {
-		glog.Errorf("Failed to removing the configuration directory: %s, error: %s", options.cfg_directory, err)
+	if !r.fs.Exists(r.options.cfg_directory) {
+		logger.Infof("The configuration directory: %s does not exist, nothing to delete", r.options.cfg_directory)
+		return nil
+	}
+	if err := r.GuardDeletion(); err != nil {
+		return err
+	}
+	logger.Infof("Deleting the entire configuration directory: %s as requested", r.options.cfg_directory)
+	if err := r.fs.Rmdir(r.options.cfg_directory); err != nil {
+		logger.Errorf("Failed to removing the configuration directory: %s, error: %s", r.options.cfg_directory, err)
 		return err
 	}
+	/* check: the removal can be partial, i.e. a file beneath a directory we lack the permissions on */
+	if !r.options.dry_run && r.fs.Exists(r.options.cfg_directory) {
+		logger.Errorf("The configuration directory: %s is still present after the deletion", r.options.cfg_directory)
+		return DeleteOnExitErr
+	}
+	logger.Infof("The configuration directory: %s has been deleted", r.options.cfg_directory)
 	return nil
 }
 
 /* ============== EVENT HANDLING ================= */
-func (r *ConfigurationStore) HandleFileNotificationEvent(event *fsnotify.Event) {
-	glog.V(VERBOSE_LEVEL).Infof("HandleFileNotificationEvent() event: %s", event)
+func (r *ConfigurationStore) HandleFileNotificationEvent(ctx context.Context, event *fsnotify.Event) {
+	logger.V(VERBOSE_LEVEL).Infof("HandleFileNotificationEvent() event: %s", event)
+	/* step: we ignore anything outside the mount and our own temporary files */
+	path, found := r.KeyPath(event.Name)
+	if !found {
+		return
+	}
+	/* step: an editor may save by renaming a new file into place, hence we need the creations */
+	if r.writeback != nil && event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+		r.WriteBack(ctx, path)
+		return
+	}
+	if event.Op&(fsnotify.Write|fsnotify.Remove|fsnotify.Rename|fsnotify.Chmod) == 0 {
+		return
+	}
+	/* step: in read only mode, any local modification is reverted */
+	if !r.options.read_only {
+		logger.V(VERBOSE_INFO).Infof("Local change to: %s, not restoring as the mount point is writable", path)
+		return
+	}
+	if r.IsPaused() {
+		logger.V(VERBOSE_INFO).Infof("Local change to: %s, not restoring while the synchronization is paused", path)
+		return
+	}
+	r.Transaction(func() { r.RepairDrift(ctx, path) })
+}
+
+/* Restore the path from the store, logging the drift if the local copy had been changed */
+func (r *ConfigurationStore) RepairDrift(ctx context.Context, path string) {
+	r.repairs.Lock()
+	defer r.repairs.Unlock()
+	full_path := r.LocalPath(path)
+	before := r.Fingerprint(full_path)
+	/* step: capture the local copy, so we can report what was changed */
+	local := ""
+	if r.options.quarantine_dir != "" && !r.options.dry_run && r.fs.IsFile(full_path) && !r.fs.IsSymlink(full_path) {
+		local, _ = r.fs.Read(full_path)
+	}
+	if err := r.RevertLocalChange(ctx, path); err != nil {
+		logger.Errorf("Failed to restore the path: %s from the store, error: %s", full_path, err)
+		return
+	}
+	if after := r.Fingerprint(full_path); after != before {
+		logger.Infof("Drift detected on: %s, the local copy had been changed, restored from the store", path)
+		metrics.Increment(metrics.DRIFT_REPAIRED)
+		r.status.Drifted(1)
+		r.NotifyWebhooks(WEBHOOK_DRIFT_REPAIRED, path, full_path)
+		if r.options.quarantine_dir != "" {
+			r.Quarantine(path, local)
+		}
+	}
+}
+
+/* A fingerprint of the path on disk, i.e. the content and permissions, an empty string if it doesn't exist */
+func (r *ConfigurationStore) Fingerprint(full_path string) string {
+	if !r.fs.Exists(full_path) {
+		return ""
+	}
+	if r.fs.IsSymlink(full_path) {
+		target, _ := os.Readlink(full_path)
+		return "link:" + target
+	}
+	stat, err := r.fs.Stat(full_path)
+	if err != nil {
+		return ""
+	}
+	if stat.IsDir() {
+		return "directory:" + stat.Mode().String()
+	}
+	hash, _ := r.fs.Hash(full_path)
+	return fmt.Sprintf("%s:%x", stat.Mode(), hash)
+}
+
+/* Restore the file from the store, the write is skipped if the content is unchanged, i.e. our own changes */
+func (r *ConfigurationStore) RevertLocalChange(ctx context.Context, path string) error {
+	full_path := r.LocalPath(path)
+	/* step: if the file is a templated resource we restore the rendered content */
+	if resource, found := r.dynamic.IsDynamic(path); found {
+		return r.WriteFile(full_path, resource.Rendered(), r.GetAttributes(path))
+	}
+	/* step: or a file computed by a templated resource */
+	if owner, found := r.DestinationOwner(path); found {
+		if resource, found := r.dynamic.IsDynamic(owner); found {
+			if content, found := resource.Destinations()[path]; found {
+				return r.WriteFile(full_path, content, r.GetAttributes(owner))
+			}
+		}
+	}
+	/* step: or a file exploded from the value of a key */
+	if owner, found := r.ExplodedOwner(path); found {
+		node, err := r.kv.Get(ctx, owner)
+		if err != nil {
+			logger.V(VERBOSE_LEVEL).Infof("The key: %s is not in the store, nothing to revert", owner)
+			return nil
+		}
+		return r.UpdateStoreConfigFile(ctx, node)
+	}
+	/* step: or the document of a directory */
+	if directory, found := r.DocumentOf(path); found {
+		if _, err := r.kv.Get(ctx, directory); err != nil {
+			logger.V(VERBOSE_LEVEL).Infof("The document directory: %s is not in the store, nothing to revert", directory)
+			return nil
+		}
+		return r.UpdateDocument(ctx, directory)
+	}
+	/* step: or the file of an aggregated directory */
+	if directory, found := r.AggregateOf(path); found {
+		if _, err := r.kv.Get(ctx, directory); err != nil {
+			logger.V(VERBOSE_LEVEL).Infof("The aggregated directory: %s is not in the store, nothing to revert", directory)
+			return nil
+		}
+		return r.UpdateAggregate(ctx, directory)
+	}
+	if !r.filter.IsIncluded(path) || IsMetadataKey(path) {
+		return nil
+	}
+	node, err := r.kv.Get(ctx, path)
+	if err != nil {
+		logger.V(VERBOSE_LEVEL).Infof("The path: %s is not in the store, nothing to revert", path)
+		return nil
+	}
+	if node.IsDir() {
+		/* step: the store keeps empty directories, we may have pruned it */
+		if r.options.prune_empty_dirs && !r.HasFiles(ctx, path) {
+			return nil
+		}
+		return r.MakeDirectory(full_path)
+	}
+	logger.V(VERBOSE_LEVEL).Infof("Ensuring the content of file: %s matches the store", full_path)
+	return r.UpdateStoreConfigFile(ctx, node)
+}
 
+/* Checks if there are any keys (other than directories) beneath the directory in the store */
+func (r *ConfigurationStore) HasFiles(ctx context.Context, directory string) bool {
+	listing, err := r.kv.List(ctx, directory)
+	if err != nil {
+		return false
+	}
+	for _, node := range listing {
+		if (node.IsFile() && !IsMetadataKey(node.Path)) || r.HasFiles(ctx, node.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Strip the write permissions from all the files under the mount point */
+func (r *ConfigurationStore) ProtectMountPoint() error {
+	files, err := r.fs.Files(r.options.cfg_directory)
+	if err != nil {
+		logger.Errorf("Failed to get a list of files under: %s, error: %s", r.options.cfg_directory, err)
+		return err
+	}
+	for _, path := range files {
+		if r.fs.IsSymlink(path) {
+			continue
+		}
+		if stat, err := r.fs.Stat(path); err == nil {
+			r.fs.Chmod(path, r.ProtectMode(stat.Mode().Perm()))
+		}
+	}
+	return nil
 }
 
 /* Handle a change to the templated resource */
 func (r *ConfigurationStore) HandleTemplateEvent(path string) {
 	if resource, found := r.dynamic.IsDynamic(path); !found {
-		glog.Errorf("The resource for path: %s no longer exists, internal error", path)
+		logger.Errorf("The resource for path: %s no longer exists, internal error", path)
 		return
 	} else {
-		glog.V(VERBOSE_INFO).Infof("Dynamic config file: %s has changed, regenerating content", path)
+		logger.V(VERBOSE_INFO).Infof("Dynamic config file: %s has changed, regenerating content", path)
 		/* step: we get the content of the template */
 		if content, err := resource.Content(false); err != nil {
-			glog.Errorf("Failed to generate the content from template: %s, error: %s", path, err)
+			logger.Errorf("Failed to generate the content from template: %s, error: %s", path, err)
+			r.dynamic.SetError(path, err)
 			return
 		} else {
 			/* step: get the file system path */
 			full_path := r.FullPath(path)
 			/* step: update the content of the file */
-			glog.V(VERBOSE_LEVEL).Infof("Updating the content for template: %s", path)
-			if err := r.fs.Update(full_path, content); err != nil {
-				glog.Errorf("Failed to update the template: %s, error: %s", full_path, err)
+			logger.V(VERBOSE_LEVEL).Infof("Updating the content for template: %s", path)
+			err := r.fs.Update(full_path, content, r.GetAttributes(path))
+			r.SetSyncState(path, full_path, err)
+			if err != nil {
+				logger.Errorf("Failed to update the template: %s, error: %s", full_path, err)
 				return
 			}
+			r.recorder.Rendered(full_path, path)
+			r.UpdateDestinations(path, resource)
+			/* step: other templates may be consuming this one */
+			r.ConvergeTemplates()
 		}
 	}
 }
 
-/* We have a timer event, let force re-sync the configuration */
-func (r *ConfigurationStore) HandleTimerEvent() {
-	glog.V(VERBOSE_LEVEL).Infof("HandleTimerEvent() recieved ticker event , kicking off a synchronization")
+/* Re-render the templates until they settle and update any files whose content has changed */
+func (r *ConfigurationStore) ConvergeTemplates() error {
+	changed, err := r.dynamic.Converge()
+	r.readiness.SetRendered(err)
+	for _, path := range changed {
+		if resource, found := r.dynamic.IsDynamic(path); found {
+			full_path := r.FullPath(path)
+			logger.V(VERBOSE_INFO).Infof("Dynamic config: %s changed while converging, updating the content", path)
+			err := r.fs.Update(full_path, resource.Rendered(), r.GetAttributes(path))
+			r.SetSyncState(path, full_path, err)
+			if err != nil {
+				logger.Errorf("Failed to update the template: %s, error: %s", full_path, err)
+			} else {
+				r.recorder.Rendered(full_path, path)
+			}
+			r.UpdateDestinations(path, resource)
+		}
+	}
+	if err != nil {
+		logger.Errorf("Failed to converge the dynamic configs, error: %s", err)
+		return err
+	}
+	return nil
+}
+
+/* Write the files computed by a templated resource and remove any it no longer produces */
+func (r *ConfigurationStore) UpdateDestinations(path string, resource dynamic.DynamicResource) {
+	destinations := resource.Destinations()
+	current := make(map[string]bool, 0)
+	for destination, _ := range destinations {
+		if err := ValidateKey(destination); err != nil {
+			logger.Errorf("Dynamic config: %s has an invalid destination: %q, error: %s", path, destination, err)
+			delete(destinations, destination)
+			continue
+		}
+		current[destination] = true
+	}
+	r.Lock()
+	r.SaveKeyState(path)
+	previous := r.destinations[path]
+	r.destinations[path] = current
+	r.Unlock()
+
+	/* step: write the content for each of the destinations */
+	for destination, content := range destinations {
+		if destination == path {
+			logger.Errorf("Dynamic config: %s cannot use itself as a destination, skipping", path)
+			continue
+		}
+		logger.V(VERBOSE_LEVEL).Infof("Updating the destination: %s for dynamic config: %s", destination, path)
+		err := r.WriteFile(r.DestinationPath(destination), content, r.GetAttributes(path))
+		r.SetSyncState(path, r.DestinationPath(destination), err)
+		if err != nil {
+			logger.Errorf("Failed to write the destination: %s for dynamic config: %s, error: %s", destination, path, err)
+		}
+	}
+	/* step: remove any destinations which have disappeared */
+	for destination, _ := range previous {
+		if _, found := current[destination]; !found {
+			r.RemoveDestination(path, destination)
+		}
+	}
+}
+
+/* Find the templated resource which computes the destination, if any */
+func (r *ConfigurationStore) DestinationOwner(destination string) (string, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	for path, destinations := range r.destinations {
+		if _, found := destinations[destination]; found {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+/* Remove all the files computed by a templated resource, i.e. when the resource is deleted */
+func (r *ConfigurationStore) DeleteDestinations(path string) {
+	r.Lock()
+	r.SaveKeyState(path)
+	previous := r.destinations[path]
+	delete(r.destinations, path)
+	r.Unlock()
+	for destination, _ := range previous {
+		r.RemoveDestination(path, destination)
+	}
+}
+
+func (r *ConfigurationStore) RemoveDestination(path, destination string) {
+	full_path := r.DestinationPath(destination)
+	logger.V(VERBOSE_INFO).Infof("Removing the destination: %s, no longer produced by dynamic config: %s", destination, path)
+	if r.fs.Exists(full_path) {
+		if err := r.RemovePath(full_path, false); err != nil {
+			logger.Errorf("Failed to remove the destination: %s, error: %s", full_path, err)
+		}
+		r.PruneDirectory(r.fs.Dirname(full_path))
+	}
+}
+
+/* Remove the directory and any parents if the deletion has left them empty */
+func (r *ConfigurationStore) PruneDirectory(full_path string) {
+	if !r.options.prune_empty_dirs {
+		return
+	}
+	if err := r.fs.Rmdirp(full_path, r.FullPath("")); err != nil {
+		logger.Errorf("Failed to prune the empty directory: %s, error: %s", full_path, err)
+	}
+}
+
+/* Create or update the file, ensuring the directory structure exists */
+func (r *ConfigurationStore) WriteFile(full_path, content string, attributes fs.Attributes) error {
+	if err := r.MakeDirectory(r.fs.Dirname(full_path)); err != nil {
+		logger.Errorf("Failed to ensure the directory: %s, error: %s", r.fs.Dirname(full_path), err)
+		return err
+	}
+	/* check: on the presync, the files unchanged since written by a previous run are skipped */
+	if r.IsUnchanged(full_path, content, attributes) {
+		return nil
+	}
+	if r.fs.Exists(full_path) {
+		return r.RecordWrite(full_path, content, attributes, r.fs.Update(full_path, content, attributes))
+	}
+	return r.RecordWrite(full_path, content, attributes, r.fs.Create(full_path, content, attributes))
+}
+
+/* We have a timer event, let force re-sync the configuration, returning true if reconciled in full */
+func (r *ConfigurationStore) HandleTimerEvent(ctx context.Context) bool {
+	logger.V(VERBOSE_LEVEL).Infof("HandleTimerEvent() recieved ticker event , kicking off a synchronization")
+	/* step: remove anything in the trash past the retention period */
+	r.PurgeTrash()
+	/* step: bring the mount point back in line with the store, correcting any drift or missed events */
+	index := r.SyncIndex(ctx)
+	reconciled := false
+	sequence := r.journal.Sequence()
+	var summary *Reconciliation
+	published := r.Transaction(func() {
+		var err error
+		if summary, err = r.Reconcile(ctx); err != nil {
+			logger.Errorf("Failed to reconcile the mount point against the store, error: %s", err)
+			index = 0
+			return
+		}
+		reconciled = true
+		if summary.Total() > 0 || summary.Orphans > 0 {
+			logger.Infof("Reconciled the mount point against the store, created: %d, updated: %d, deleted: %d, orphaned: %d files",
+				summary.Created, summary.Updated, summary.Deleted, summary.Orphans)
+		}
+	})
+	r.CompleteReconciled(r.options.root_key, sequence, published, summary)
+	r.SetSynced(index)
+	r.SaveSyncState()
+	r.SaveHashIndex()
+	/* step: a mount point not yet ready is once reconciled in full */
+	if reconciled {
+		r.RecordSync(index)
+		r.CheckReady()
+	}
+	return reconciled
 }
 
 /* Handle changes to the K/V store and reflect in the directory */
-func (r *ConfigurationStore) HandleNodeEvent(event kv.NodeChange) {
-	glog.V(VERBOSE_LEVEL).Infof("HandleNodeEvent() recieved node event: %s, synchronizing", event)
+func (r *ConfigurationStore) HandleNodeEvent(ctx context.Context, event kv.NodeChange) {
+	logger.V(VERBOSE_LEVEL).Infof("HandleNodeEvent() recieved node event: %v, synchronizing", event)
 	node := event.Node
+	/* check: is the key safe to materialize */
+	if err := ValidateKey(node.Path); err != nil {
+		logger.Errorf("Skipping the event on key: %q, error: %s", node.Path, err)
+		return
+	}
+	r.RecordKeyEvent(event)
+	/* step: the documents of the directories the key is beneath follow the change */
+	defer r.HandleDocumentEvent(ctx, event)
+	/* check: is the key the metadata of a directory */
+	if _, found := r.AggregateOf(node.Path); IsMetadataKey(node.Path) && !found {
+		r.HandleMetadataEvent(ctx, event)
+		return
+	}
+	/* check: is the key beneath a directory aggregated into a single file */
+	if directory, found := r.AggregateOf(node.Path); found {
+		r.HandleAggregateEvent(ctx, directory, event)
+		return
+	}
+	/* check: is the key one we materialize */
+	if !r.filter.IsIncluded(node.Path) {
+		logger.V(VERBOSE_LEVEL).Infof("The key: %s is filtered, skipping the event", node.Path)
+		return
+	}
 	/* check: an update or deletion */
 	switch event.Operation {
 	case kv.DELETED:
@@ -250,12 +1856,16 @@ func (r *ConfigurationStore) HandleNodeEvent(event kv.NodeChange) {
 		}
 	case kv.CHANGED:
 		if node.IsDir() {
-			r.UpdateStoreConfigDirectory(node.Path)
+			r.UpdateStoreConfigDirectory(ctx, node.Path)
 		} else {
-			r.UpdateStoreConfigFile(node.Path, node.Value)
+			r.UpdateStoreConfigFile(ctx, &node)
+			/* step: other templates may be consuming this one */
+			if _, found := r.dynamic.IsDynamic(node.Path); found {
+				r.ConvergeTemplates()
+			}
 		}
 	default:
-		glog.Errorf("HandleNodeEvent() unknown operation, skipping the event: %s", event)
+		logger.Errorf("HandleNodeEvent() unknown operation, skipping the event: %v", event)
 	}
 }
 
@@ -265,122 +1875,299 @@ func (r *ConfigurationStore) HandleNodeEvent(event kv.NodeChange) {
 */
 
 func (r *ConfigurationStore) DeleteStoreConfigFile(path string) error {
+	if r.IsExploded(path) {
+		return r.RemoveExploded(path)
+	}
 	full_path := r.FullPath(path)
-	glog.V(VERBOSE_INFO).Infof("Deleting the config file: %s from the store", full_path)
+	logger.V(VERBOSE_INFO).Infof("Deleting the config file: %s from the store", full_path)
 
 	/* step: check it exists and is a file */
-	if !r.fs.Exists(full_path) || !r.fs.IsFile(full_path) {
-		glog.Errorf("Failed to delete file: %s, either it doesnt exists or is not a file", full_path)
+	if !r.fs.Exists(full_path) || (!r.fs.IsFile(full_path) && !r.fs.IsSymlink(full_path)) {
+		/* step: a file never written (i.e. the template failed to render) leaves only its state and error behind */
+		if !r.fs.Exists(full_path) {
+			r.dynamic.Delete(path)
+			r.ForgetSyncState(full_path)
+		}
+		logger.Errorf("Failed to delete file: %s, either it doesnt exists or is not a file", full_path)
 		return errors.New("Failed to delete, either it doesnt exists or is not a file")
 	}
+	if err := r.RemoveStoreConfigFile(path, full_path); err != nil {
+		return err
+	}
+	r.PruneDirectory(r.fs.Dirname(full_path))
+	return nil
+}
+
+/* Removes the file of the key, freeing up any resources held for it */
+func (r *ConfigurationStore) RemoveStoreConfigFile(path, full_path string) error {
+	if r.IsExploded(path) {
+		return r.RemoveExploded(path)
+	}
 	/* check: is the file a templated resource */
 	if _, found := r.dynamic.IsDynamic(path); found {
 		/* step: free up the resources */
 		r.dynamic.Delete(path)
+		r.DeleteDestinations(path)
 	}
+	r.DeleteAttributes(path)
 
 	/* step: delete the actual file */
-	if err := r.fs.Delete(full_path); err != nil {
-		glog.Errorf("Failed to delete the file: %s, error: %s", full_path, err)
-		return err
+	if r.fs.Exists(full_path) {
+		if err := r.RemovePath(full_path, false); err != nil {
+			logger.Errorf("Failed to delete the file: %s, error: %s", full_path, err)
+			return err
+		}
+	}
+	if r.mapping.Forget(path) {
+		r.WriteHashedIndex()
 	}
 	return nil
 }
 
 func (r *ConfigurationStore) DeleteStoreConfigDirectory(path string) error {
 	full_path := r.FullPath(path)
-	glog.V(VERBOSE_INFO).Infof("Deleting config directory: %s from the store", full_path)
+	logger.V(VERBOSE_INFO).Infof("Deleting config directory: %s from the store", full_path)
 
 	/* step: check it is a actual directory */
 	if _, err := r.CheckDirectory(full_path); err != nil {
-		glog.Errorf("Failed to remove the directory: %s, error: %s", full_path, err)
+		logger.Errorf("Failed to remove the directory: %s, error: %s", full_path, err)
 		return err
 	}
 	/* step: we need to find any templates that we're in the directory and delete them, freeing up the resources */
 	for resource_path, _ := range r.dynamic.List() {
-		if strings.HasPrefix(resource_path, path) {
-			glog.V(3).Infof("Deleting the dynamic config: %s, config was inside deleted directory: %s", resource_path, path)
+		/* note: only those beneath the directory, i.e. not /application when /app is deleted */
+		if resource_path == path || strings.HasPrefix(resource_path, path+"/") {
+			logger.V(3).Infof("Deleting the dynamic config: %s, config was inside deleted directory: %s", resource_path, path)
 			r.dynamic.Delete(resource_path)
+			r.DeleteDestinations(resource_path)
 		}
 	}
+	r.DeleteAttributes(path)
+	r.DeleteMetadata(path)
 
 	/* step: delete the directory and all the children */
-	if err := r.fs.Rmdir(full_path); err != nil {
-		glog.Errorf("Failed to delete the directory: %s, error: %s", full_path, err)
+	if err := r.RemovePath(full_path, true); err != nil {
+		logger.Errorf("Failed to delete the directory: %s, error: %s", full_path, err)
 		return err
 	}
+	if r.mapping.Delete(path) {
+		r.WriteHashedIndex()
+	}
+	r.PruneDirectory(r.fs.Dirname(full_path))
 	return nil
 }
 
-func (r *ConfigurationStore) UpdateStoreConfigDirectory(path string) error {
+func (r *ConfigurationStore) UpdateStoreConfigDirectory(ctx context.Context, path string) error {
 
 	full_path := r.FullPath(path)
-	glog.V(VERBOSE_INFO).Infof("Creating config directory: %s", full_path)
+	logger.V(VERBOSE_INFO).Infof("Creating config directory: %s", full_path)
 
 	/* step: we need to make sure the directory structure exists */
-	if err := r.fs.Mkdirp(full_path); err != nil {
-		glog.Errorf("Failed to ensure the directory: %s, error: %s", full_path, err)
+	if err := r.MakeDirectory(full_path); err != nil {
+		logger.Errorf("Failed to ensure the directory: %s, error: %s", full_path, err)
 		return err
 	}
 	return nil
 }
 
-func (r *ConfigurationStore) UpdateStoreConfigFile(path string, value string) error {
+func (r *ConfigurationStore) UpdateStoreConfigFile(ctx context.Context, node *kv.Node) (err error) {
+	/* step: a JSON object is exploded into a tree of files beneath the key */
+	if r.IsExplodedValue(node) {
+		return r.UpdateExploded(ctx, node)
+	}
+	/* step: record the outcome in the sync state of the file, the local copy being kept isn't a failure */
+	defer func() {
+		r.SetSyncState(node.Path, r.FilePath(node.Path), err)
+		if err == nil {
+			r.SetApplied(node, r.FilePath(node.Path))
+		}
+		if err == LocalCopyKeptErr {
+			err = nil
+		}
+	}()
+
+	path, value := node.Path, node.Value
+	/* check: the key was previously exploded into a tree of files */
+	if r.IsExploded(path) {
+		if err := r.RemoveExploded(path); err != nil {
+			return err
+		}
+	}
+	full_path := r.FilePath(path)
+	/* check: the value has already been applied and the file is as we left it, i.e. the echo of a change */
+	if r.IsApplied(node, full_path) {
+		logger.V(VERBOSE_LEVEL).Infof("The value of key: %s is unchanged since applied at index: %d, skipping the update", path, node.Index)
+		metrics.Increment(metrics.UPDATES_SKIPPED)
+		return nil
+	}
+	logger.V(VERBOSE_INFO).Infof("Update to config directory, file: %s", full_path)
 
-	full_path := r.FullPath(path)
-	glog.V(VERBOSE_INFO).Infof("Update to config directory, file: %s", full_path)
+	/* check: has the key changed from a directory to a file, i.e. while we weren't watching */
+	if r.fs.Exists(full_path) && !r.fs.IsSymlink(full_path) && r.fs.IsDirectory(full_path) {
+		logger.Warningf("The key: %s has changed from a directory to a file, removing the directory: %s", path, full_path)
+		if err := r.DeleteStoreConfigDirectory(path); err != nil {
+			return err
+		}
+		full_path = r.FilePath(path)
+	}
 
 	/* step: we need to ensure the directory structure exists before anything */
-	if err := r.fs.Mkdirp(r.fs.Dirname(full_path)); err != nil {
-		glog.Errorf("Failed to ensure the directory: %s, error: %s", r.fs.Dirname(full_path), err)
+	if err := r.MakeDirectory(r.fs.Dirname(full_path)); err != nil {
+		logger.Errorf("Failed to ensure the directory: %s, error: %s", r.fs.Dirname(full_path), err)
 		return err
 	}
 
+	/* step: extract any attributes for the file from the value */
+	attributes, value := r.ParseAttributes(path, value)
+	attributes.Source, attributes.Index = path, node.Index
+	r.SetAttributes(path, attributes)
+
+	/* step: encoded (binary) content is decoded as it's streamed to the file */
+	if r.IsEncoded(value) {
+		if _, found := r.dynamic.IsDynamic(path); found {
+			r.dynamic.Delete(path)
+			r.DeleteDestinations(path)
+		}
+		if err := r.fs.Stream(full_path, r.DecodeReader(value), attributes); err != nil {
+			logger.Errorf("Failed to stream the content to file: %s, error: %s", full_path, err)
+			return err
+		}
+		return nil
+	}
+
+	/* step: check if the key is a link to another key */
+	if strings.HasPrefix(value, LINK_PREFIX) {
+		if _, found := r.dynamic.IsDynamic(path); found {
+			r.dynamic.Delete(path)
+			r.DeleteDestinations(path)
+		}
+		return r.UpdateStoreConfigLink(path, value[len(LINK_PREFIX):])
+	}
+
 	/* step: we check if the file is a dynamic config */
 	if _, found := r.dynamic.IsDynamic(path); found {
-		glog.V(VERBOSE_INFO).Infof("Dyanmic config: %s has changed, updating content now", path)
+		logger.V(VERBOSE_INFO).Infof("Dyanmic config: %s has changed, updating content now", path)
 
-		/* step: we don't update the dynamic config directly, we simple delete the current one and
-		recreate a new resource */
-		r.dynamic.Delete(path)
-
-		/* step: recreate the dynamic config passing our update channel  */
-		if content, err := r.dynamic.Create(path, value, r.dynamicEventChannel); err != nil {
-			glog.Errorf("Failed to update the template for path: %s, error: %s", path, err)
+		/* step: we don't update the dynamic config directly, we replace the current one with a new resource,
+		the current one (and the file rendered from it) being left in place should the new one fail */
+		if content, err := r.dynamic.Replace(path, value, r.dynamicEventChannel); err != nil {
+			logger.Errorf("Failed to update the template for path: %s, keeping the previous content, error: %s", path, err)
 			return err
 		} else {
-			glog.V(VERBOSE_LEVEL).Infof("Updated the template for resource: %s", path)
-			if err := r.fs.Create(full_path, content); err != nil {
-				glog.Errorf("Failed to create the file: %s, error: %s", full_path, err)
+			logger.V(VERBOSE_LEVEL).Infof("Updated the template for resource: %s", path)
+			if err := r.fs.Create(full_path, content, attributes); err != nil {
+				logger.Errorf("Failed to create the file: %s, error: %s", full_path, err)
 				return err
 			}
+			r.recorder.Rendered(full_path, path)
+			if resource, found := r.dynamic.IsDynamic(path); found {
+				r.UpdateDestinations(path, resource)
+			}
 		}
 		/* step: we check if the content of the file is dynamic and we need to create a new dynamic config from it */
 	} else if r.dynamic.IsDynamicContent(path, value) {
-		glog.V(VERBOSE_INFO).Infof("Creating a new dynamic resource templated resource: %s", path)
+		logger.V(VERBOSE_INFO).Infof("Creating a new dynamic resource templated resource: %s", path)
 		if content, err := r.dynamic.Create(path, value, r.dynamicEventChannel); err != nil {
-			glog.Errorf("Failed to create the template for path: %s, error: %s", path, err)
+			logger.Errorf("Failed to create the template for path: %s, error: %s", path, err)
 			return err
 		} else {
-			if err := r.fs.Create(full_path, content); err != nil {
-				glog.Errorf("Failed to create the file: %s, error: %s", full_path, err)
+			if err := r.fs.Create(full_path, content, attributes); err != nil {
+				logger.Errorf("Failed to create the file: %s, error: %s", full_path, err)
 				return err
 			}
+			r.recorder.Rendered(full_path, path)
+			if resource, found := r.dynamic.IsDynamic(path); found {
+				r.UpdateDestinations(path, resource)
+			}
 		}
+		/* step: the revision is one we've already written back, or superseded by a local change since */
+	} else if r.IsWrittenBack(path, full_path, node.Index) {
+		logger.V(VERBOSE_LEVEL).Infof("Skipping the revision: %d of key: %s, the local content is newer", node.Index, path)
+		/* step: the file may have been changed locally, in which case the conflict policy decides */
+	} else if overwrite, err := r.ResolveConflict(ctx, node, full_path, value); !overwrite {
+		return err
 		/* step: we can assume it's a regular k/v and can create a standard file from its value */
 	} else {
-		/* step: create a normal file from the content */
-		if err := r.fs.Create(full_path, value); err != nil {
-			glog.Errorf("Failed to create the file: %s, error: %s", full_path, err)
-			return err
+		/* step: create a normal file from the content, unless unchanged since written by a previous run; what
+		we record as written is the content on disk, as rewritten by any write hooks */
+		written := value
+		if !r.IsUnchanged(full_path, value, attributes) {
+			if err := r.RecordWrite(full_path, value, attributes, r.fs.Create(full_path, value, attributes)); err != nil {
+				logger.Errorf("Failed to create the file: %s, error: %s", full_path, err)
+				return err
+			}
+			written = r.writehooks.Rewritten(full_path, value)
+		} else if r.writehooks != nil {
+			written, _ = r.fs.Read(full_path)
 		}
+		r.SetWritten(path, strings.TrimSuffix(node.Value, value), written, node.Index)
+	}
+	return nil
+}
+
+/* Materializes the key as a relative symbolic link to the file of the target key */
+func (r *ConfigurationStore) UpdateStoreConfigLink(path, target string) error {
+	full_path := r.FilePath(path)
+	if err := ValidateKey("/" + strings.TrimPrefix(strings.TrimSpace(target), "/")); err != nil {
+		logger.Errorf("Failed to link the config file: %s to key: %q, error: %s", full_path, target, err)
+		return err
+	}
+	target = CleanKey(strings.TrimSpace(target))
+	/* step: we use a relative link so it remains valid if the mount is moved or bind mounted */
+	link, err := filepath.Rel(r.fs.Dirname(full_path), r.FullPath(target))
+	if err != nil {
+		logger.Errorf("Failed to compute the link from: %s to key: %s, error: %s", full_path, target, err)
+		return err
+	}
+	logger.V(VERBOSE_INFO).Infof("Linking the config file: %s to key: %s", full_path, target)
+	if err := r.fs.Symlink(link, full_path); err != nil {
+		logger.Errorf("Failed to create the link: %s, error: %s", full_path, err)
+		return err
 	}
 	return nil
 }
 
-/* Converts the k/v path to the full path on disk - essentially mount_point + node_path */
+/*
+	Converts the k/v path to the full path on disk - essentially mount_point + node_path; the path is
+	normalized as an absolute path first, so whatever the key it can never resolve outside the mount
+*/
 func (r *ConfigurationStore) FullPath(path string) string {
-	return fmt.Sprintf("%s%s", options.cfg_directory, path)
+	return r.MappedPath(path, r.mapping.IsFile(path))
+}
+
+/* Converts the key of a file to the full path on disk, as above, though the mapping rules for files apply */
+func (r *ConfigurationStore) FilePath(path string) string {
+	return r.MappedPath(path, true)
+}
+
+/* Maps the key onto the path on disk, falling back to the hashed layout for files whose path is too long */
+func (r *ConfigurationStore) MappedPath(path string, file bool) string {
+	full_path := DiskPath(r.BasePath(), r.mapping.Map(path, file))
+	if file && IsTooLong(full_path) {
+		return DiskPath(r.BasePath(), r.HashedPath(path))
+	}
+	return r.StagedPath(full_path)
+}
+
+/* Converts a destination computed by a template to the full path on disk, the destinations are never mapped */
+func (r *ConfigurationStore) DestinationPath(destination string) string {
+	return r.StagedPath(DiskPath(r.BasePath(), destination))
+}
+
+/* The full path on disk of a key, or a destination computed by a template */
+func (r *ConfigurationStore) LocalPath(path string) string {
+	if _, found := r.DestinationOwner(path); found {
+		return r.DestinationPath(path)
+	}
+	return r.FullPath(path)
+}
+
+/* The directory the keys are materialized under, the generation when using the atomic swap */
+func (r *ConfigurationStore) BasePath() string {
+	if r.options.atomic_swap {
+		return r.Generation()
+	}
+	return r.options.cfg_directory
 }
 
 func (r *ConfigurationStore) CheckDirectory(path string) (bool, error) {
@@ -393,50 +2180,122 @@ func (r *ConfigurationStore) CheckDirectory(path string) (bool, error) {
 	return true, nil
 }
 
-func (r *ConfigurationStore) BuildFileSystem() error {
-	glog.Infof("Building the file system from k/v stote at: %s", options.cfg_directory)
-	r.BuildDirectory(options.root_key)
+func (r *ConfigurationStore) BuildFileSystem(ctx context.Context) error {
+	logger.Infof("Building the file system from k/v stote at: %s", r.options.cfg_directory)
+	r.progress.Start(PROGRESS_BUILD, r.options.progress_interval)
+	defer r.progress.Finish()
+	err := r.BuildWithRetry(ctx)
+	/* step: the templates may depend on each other, so we render until they settle */
+	r.ConvergeTemplates()
+	return err
+}
+
+/*
+	Builds the directory from the store, making a pass for each of the priorities beneath it, highest first; returns
+	a BuildErr of the directories beneath which couldn't be listed
+*/
+func (r *ConfigurationStore) BuildDirectory(ctx context.Context, directory string) error {
+	var failures BuildErr
+	for index, level := range r.options.priorities.Levels(directory) {
+		/* note: the directory is listed again on each pass */
+		if index > 0 {
+			r.progress.Relisted()
+		}
+		if err := r.BuildPass(ctx, directory, level); err != nil {
+			failures = failures.Add(err)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if failures != nil {
+		return failures
+	}
 	return nil
 }
 
-func (r *ConfigurationStore) BuildDirectory(directory string) error {
+/* Builds the keys of the priority beneath the directory, returning a BuildErr of the directories which couldn't be listed */
+func (r *ConfigurationStore) BuildPass(ctx context.Context, directory string, level int) error {
+	var failures BuildErr
+	own := r.options.priorities.Of(directory) == level
+	/* step: the document of the directory is written once the directory has been built */
+	if r.IsDocument(directory) && own {
+		defer r.UpdateDocument(ctx, CleanKey(directory))
+	}
+	/* check: the directory is (or is beneath) a directory aggregated into a single file */
+	if aggregate, found := r.AggregateOf(directory); found {
+		if !own {
+			return nil
+		}
+		if err := r.UpdateAggregate(ctx, aggregate); err != nil {
+			return BuildErr{aggregate: err}
+		}
+		r.progress.Processed(0)
+		return nil
+	}
 	/* step: we get a listing of the files under the directory */
-	listing, err := r.kv.List(directory)
+	listing, err := r.kv.List(ctx, directory)
 	if err != nil {
-		glog.Errorf("Failed to get listing from directory: %s, error: %s", directory, err)
-		return err
+		logger.Errorf("Failed to get listing from directory: %s, error: %s", directory, err)
+		return BuildErr{directory: err}
 	} else {
-		glog.V(VERBOSE_LEVEL).Infof("BuildDiectory() processing directory: %s", directory)
+		logger.V(VERBOSE_LEVEL).Infof("BuildDiectory() processing directory: %s", directory)
+		/* step: the metadata of the directory must be in place before anything beneath it */
+		metadata := ""
 		for _, node := range listing {
+			if node.IsFile() && IsMetadataKey(node.Path) {
+				metadata = node.Value
+			}
+		}
+		r.SetMetadata(CleanKey(directory), metadata)
+		listing = r.PassListing(listing, level)
+		r.progress.Listed(r.CountListing(listing))
+		for _, node := range listing {
+			/* check: the build has been cancelled, the rest of the directory is left for a retry */
+			if ctx.Err() != nil {
+				return BuildErr{directory: ctx.Err()}
+			}
+			if err := ValidateKey(node.Path); err != nil {
+				logger.Errorf("BuildDirectory() skipping the key: %q, error: %s", node.Path, err)
+				continue
+			}
+			if IsMetadataKey(node.Path) {
+				continue
+			}
 			full_path := r.FullPath(node.Path)
-			glog.V(5).Infof("BuildDirectory() directory: %s, full path: %s", directory, full_path)
+			logger.V(5).Infof("BuildDirectory() directory: %s, full path: %s", directory, full_path)
 			switch {
 			case node.IsFile():
-				content := node.Value
-				/* step: if the file does not exist, create it */
-				glog.V(VERBOSE_LEVEL).Infof("BuildDirectory() Creating the file: %s", full_path)
-				/* step: check if the content is templated */
-				if r.dynamic.IsDynamicContent(node.Path, node.Value) {
-					content, err = r.dynamic.Create(node.Path, node.Value, r.dynamicEventChannel)
-					if err != nil {
-						glog.Errorf("Failed to create the templated file: %s, error: %s", full_path, err)
-						continue
-					}
+				if !r.filter.IsIncluded(node.Path) {
+					logger.V(VERBOSE_LEVEL).Infof("BuildDirectory() the key: %s is filtered, skipping", node.Path)
+					continue
 				}
-				if err := r.fs.Create(full_path, content); err != nil {
-					glog.Errorf("Failed to create the file: %s, error: %s", full_path, err)
+				/* step: if the file does not exist, create it */
+				logger.V(VERBOSE_LEVEL).Infof("BuildDirectory() Creating the file: %s", full_path)
+				if err := r.UpdateStoreConfigFile(ctx, node); err != nil {
+					logger.Errorf("Failed to create the file: %s, error: %s", full_path, err)
 				}
+				r.progress.Processed(len(node.Value))
 			case node.IsDir():
-				if r.fs.Exists(full_path) == false {
-					glog.V(VERBOSE_LEVEL).Infof("BuildDiectory() creating directory item: %s", full_path)
-					r.fs.Mkdirp(full_path)
+				if !r.filter.IsTraversable(node.Path) {
+					logger.V(VERBOSE_LEVEL).Infof("BuildDirectory() the directory: %s is excluded, skipping", node.Path)
+					continue
+				}
+				/* step: directories are created as required by the files beneath them if not included, or we're pruning empty ones */
+				if r.fs.Exists(full_path) == false && r.filter.IsIncluded(node.Path) && !r.options.prune_empty_dirs && !r.IsAggregate(node.Path) {
+					logger.V(VERBOSE_LEVEL).Infof("BuildDiectory() creating directory item: %s", full_path)
+					r.MakeDirectory(full_path)
 				}
 				/* go recursive and build the contents of that directory */
-				if err := r.BuildDirectory(node.Path); err != nil {
-					glog.Errorf("Failed to build the item directory: %s, error: %s", full_path, err)
+				if err := r.BuildPass(ctx, node.Path, level); err != nil {
+					logger.Errorf("Failed to build the item directory: %s, error: %s", full_path, err)
+					failures = failures.Add(err)
 				}
 			}
 		}
 	}
+	if failures != nil {
+		return failures
+	}
 	return nil
 }
@@ -0,0 +1,169 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+/*
+	The changes made to the mount point are published to the subscribers, i.e. a program embedding the store
+	reloading its configuration in process; the events of a transaction are published once it has been applied
+	(with the atomic swap, once the generation has been published), those of a generation discarded never are.
+	Each subscriber has a goroutine and queue of its own, so a slow handler only holds up its own events
+*/
+
+/* the number of events queued for a subscriber, further events are dropped until it catches up */
+const SUBSCRIBER_QUEUE_SIZE = 1024
+
+/* the type of a change made to the mount point */
+type ChangeType string
+
+const (
+	/* a file has been created under the mount point */
+	FILE_CREATED ChangeType = "file_created"
+	/* the content, permissions or link of a file has changed */
+	FILE_UPDATED ChangeType = "file_updated"
+	/* a file has been removed, or moved into the trash */
+	FILE_DELETED ChangeType = "file_deleted"
+	/* a template has been rendered into its file, whether or not the content changed */
+	TEMPLATE_RENDERED ChangeType = "template_rendered"
+)
+
+/* A change made to the mount point */
+type ChangeEvent struct {
+	/* the type of change */
+	Type ChangeType
+	/* the path of the file, as seen under the mount point */
+	Path string
+	/* the key the file was materialized from (the template, if rendered by one), if known */
+	Key string
+	/* the time the change was published */
+	Time time.Time
+}
+
+/* A handler registered for the change events, called in order on a goroutine of its own */
+type Subscriber struct {
+	/* the handler of the events */
+	handler func(ChangeEvent)
+	/* the events awaiting the handler */
+	queue chan ChangeEvent
+	/* closed once the handler has been called for the events queued */
+	done chan struct{}
+	/* closes the queue the once */
+	closer sync.Once
+}
+
+/* The subscribers of a store */
+type Subscribers struct {
+	/* a lock for the subscribers */
+	sync.RWMutex
+	/* the subscribers, by the order subscribed */
+	subscribers map[int]*Subscriber
+	/* the identifier of the next subscriber */
+	next int
+}
+
+/* Create an empty set of subscribers */
+func NewSubscribers() *Subscribers {
+	return &Subscribers{subscribers: make(map[int]*Subscriber, 0)}
+}
+
+/* Registers the handler for the events published, returning a function which unsubscribes it */
+func (r *Subscribers) Subscribe(handler func(ChangeEvent)) func() {
+	subscriber := &Subscriber{
+		handler: handler,
+		queue:   make(chan ChangeEvent, SUBSCRIBER_QUEUE_SIZE),
+		done:    make(chan struct{}),
+	}
+	go subscriber.Run()
+	r.Lock()
+	id := r.next
+	r.next++
+	r.subscribers[id] = subscriber
+	r.Unlock()
+	return func() {
+		r.Lock()
+		delete(r.subscribers, id)
+		r.Unlock()
+		subscriber.Close()
+	}
+}
+
+/* Checks if anyone has subscribed, a nil set has no subscribers */
+func (r *Subscribers) HasSubscribers() bool {
+	if r == nil {
+		return false
+	}
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.subscribers) > 0
+}
+
+/* Queues the events for each of the subscribers, dropping those of a subscriber whose queue is full */
+func (r *Subscribers) Publish(events []ChangeEvent) {
+	if r == nil || len(events) <= 0 {
+		return
+	}
+	r.RLock()
+	defer r.RUnlock()
+	for _, subscriber := range r.subscribers {
+		for _, event := range events {
+			select {
+			case subscriber.queue <- event:
+			default:
+				logger.Warningf("Dropping the %s event of the file: %s, the queue of the subscriber is full", event.Type, event.Path)
+				metrics.Increment(metrics.SUBSCRIBER_EVENTS_DROPPED)
+			}
+		}
+	}
+}
+
+/* Unsubscribes each of the subscribers, waiting on the handlers for the events already queued */
+func (r *Subscribers) Close() {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	subscribers := r.subscribers
+	r.subscribers = make(map[int]*Subscriber, 0)
+	r.Unlock()
+	for _, subscriber := range subscribers {
+		subscriber.Close()
+	}
+}
+
+/* Calls the handler for each of the events, until the queue is closed */
+func (r *Subscriber) Run() {
+	defer close(r.done)
+	for event := range r.queue {
+		r.handler(event)
+	}
+}
+
+/* Closes the queue, waiting on the handler for the events already queued */
+func (r *Subscriber) Close() {
+	r.closer.Do(func() {
+		close(r.queue)
+	})
+	<-r.done
+}
+
+/* Registers the handler for the changes made to the mount point, returning a function which unsubscribes it */
+func (r *ConfigurationStore) Subscribe(handler func(ChangeEvent)) func() {
+	return r.subscribers.Subscribe(handler)
+}
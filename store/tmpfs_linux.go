@@ -0,0 +1,77 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+/*
+	Mounts a tmpfs at the mount point, so the files never touch a persistent disk; returns false should a tmpfs
+	already be mounted there, i.e. a memory backed volume, which is left to whoever mounted it
+*/
+func MountTmpfs(directory, size string, mode os.FileMode, uid, gid int) (bool, error) {
+	if IsTmpfsMounted(directory) {
+		logger.Infof("A tmpfs is already mounted at: %s, skipping the mount", directory)
+		return false, nil
+	}
+	/* step: build the mount options */
+	arguments := []string{fmt.Sprintf("mode=%#o", mode.Perm())}
+	if size != "" {
+		arguments = append(arguments, "size="+size)
+	}
+	if uid >= 0 {
+		arguments = append(arguments, fmt.Sprintf("uid=%d", uid))
+	}
+	if gid >= 0 {
+		arguments = append(arguments, fmt.Sprintf("gid=%d", gid))
+	}
+	logger.Infof("Mounting a tmpfs at: %s, options: %s", directory, strings.Join(arguments, ","))
+	if err := syscall.Mount("tmpfs", directory, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, strings.Join(arguments, ",")); err != nil {
+		logger.Errorf("Failed to mount a tmpfs at: %s, error: %s", directory, err)
+		return false, err
+	}
+	return true, nil
+}
+
+/* Unmounts the tmpfs from the mount point */
+func UnmountTmpfs(directory string) error {
+	logger.Infof("Unmounting the tmpfs at: %s", directory)
+	if err := syscall.Unmount(directory, 0); err != nil {
+		logger.Errorf("Failed to unmount the tmpfs at: %s, error: %s", directory, err)
+		return err
+	}
+	return nil
+}
+
+/* Checks the mount table to see if a tmpfs is already mounted at the directory */
+func IsTmpfsMounted(directory string) bool {
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && fields[1] == directory && fields[2] == "tmpfs" {
+			return true
+		}
+	}
+	return false
+}
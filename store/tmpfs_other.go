@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"os"
+)
+
+var TmpfsUnsupportedErr = errors.New("Mounting a tmpfs is only supported on linux")
+
+func MountTmpfs(directory, size string, mode os.FileMode, uid, gid int) (bool, error) {
+	return false, TmpfsUnsupportedErr
+}
+
+func UnmountTmpfs(directory string) error {
+	return TmpfsUnsupportedErr
+}
+
+func IsTmpfsMounted(directory string) bool {
+	return false
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+	Rather than deleting the files of the keys removed, they can be moved into the trash under the mount point
+	and kept for the retention period, protecting the services from an accidental mass deletion in the store;
+	each removal is kept under the time it was made, i.e.
+
+	/config/.trash/2015-01-02T15-04-05.000000000/app/db/password
+*/
+const (
+	TRASH_DIRECTORY = ".trash"
+	TRASH_TIMESTAMP = "2006-01-02T15-04-05.000000000"
+)
+
+/* The directory the removed files are moved into */
+func (r *ConfigurationStore) TrashDirectory() string {
+	return filepath.Join(r.options.cfg_directory, TRASH_DIRECTORY)
+}
+
+/* Removes the file or directory, moving it into the trash if requested */
+func (r *ConfigurationStore) RemovePath(full_path string, directory bool) error {
+	defer r.ForgetSyncState(full_path)
+	if r.options.trash_retention <= 0 {
+		if directory {
+			return r.fs.Rmdir(full_path)
+		}
+		return r.fs.Delete(full_path)
+	}
+	relative, found := DiskKey(r.BasePath(), r.UnstagedPath(full_path))
+	if !found {
+		return InvalidKeyErr
+	}
+	destination := DiskPath(filepath.Join(r.TrashDirectory(), time.Now().UTC().Format(TRASH_TIMESTAMP)), relative)
+	logger.V(VERBOSE_INFO).Infof("Moving the removed path: %s into the trash: %s", full_path, destination)
+	return r.fs.Move(full_path, destination)
+}
+
+/* Removes anything in the trash older than the retention period */
+func (r *ConfigurationStore) PurgeTrash() {
+	if r.options.trash_retention <= 0 {
+		return
+	}
+	entries, err := ioutil.ReadDir(r.TrashDirectory())
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		removed, err := time.Parse(TRASH_TIMESTAMP, entry.Name())
+		if err != nil {
+			logger.V(VERBOSE_LEVEL).Infof("Skipping the unknown entry: %s in the trash", entry.Name())
+			continue
+		}
+		if time.Since(removed) < r.options.trash_retention {
+			continue
+		}
+		path := filepath.Join(r.TrashDirectory(), entry.Name())
+		if r.options.dry_run {
+			logger.Infof("[dry-run] would purge the trash: %s, older than the retention: %s", path, r.options.trash_retention)
+			continue
+		}
+		logger.V(VERBOSE_INFO).Infof("Purging the trash: %s, older than the retention: %s", path, r.options.trash_retention)
+		if err := os.RemoveAll(path); err != nil {
+			logger.Errorf("Failed to purge the trash: %s, error: %s", path, err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+/*
+	The changes staged by the atomic swap (or an atomic directory) can be validated before they're promoted; the
+	command is run against the staged generation, the path given in CONFIG_FS_STAGING (and as the working
+	directory), and a failure leaves the live configuration untouched, the staged generation being discarded
+*/
+const (
+	/* the environment variables given to the validation command */
+	ENV_STAGING = "CONFIG_FS_STAGING"
+	ENV_MOUNT   = "CONFIG_FS_MOUNT"
+)
+
+var InvalidValidateErr = errors.New("The validation requires the changes to be staged, i.e. -atomic_swap or -atomic_dir")
+
+/* Create the command to run the shell command line */
+func ShellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+/* Run the validation command against the staged generation, an error if it failed (or timed out) */
+func (r *ConfigurationStore) ValidateStaged(generation string) error {
+	if r.options.validate == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.options.validate_timeout)
+	defer cancel()
+	command := ShellCommand(ctx, r.options.validate)
+	command.Dir = generation
+	command.Env = append(os.Environ(), ENV_STAGING+"="+generation, ENV_MOUNT+"="+r.options.cfg_directory)
+	logger.V(VERBOSE_INFO).Infof("Validating the staged changes: %s, command: %s", generation, r.options.validate)
+	output, err := command.CombinedOutput()
+	if err != nil {
+		logger.Errorf("The validation of the staged changes: %s failed, the live configuration is untouched, error: %s, output: %s",
+			generation, err, strings.TrimSpace(string(output)))
+		metrics.Increment(metrics.VALIDATIONS_FAILED)
+		now := time.Now().UTC()
+		r.webhooks.Notify(WebhookEvent{Type: WEBHOOK_VALIDATION_FAILED, Path: r.StatePath(generation), Error: err.Error(), Time: now})
+		r.RecordHistory(HistoryEvent{Type: HISTORY_VALIDATION_FAILED, Path: r.StatePath(generation), Error: err.Error(), Time: now})
+		return err
+	}
+	return nil
+}
+
+/*
+	The state moved on by the changes of a transaction, i.e. the attributes, the values applied and the content
+	written; should the generation staged be rejected, the state is restored, so the changes are applied (and
+	validated) again on the next reconciliation rather than taken as done. Only the entries the transaction changes
+	are saved, each the first time it's changed, rather than a copy of the whole of the state
+*/
+type TransactionState struct {
+	sync.Mutex
+	/* the entries saved, by the kind of state and the key */
+	saved map[string]bool
+	/* the functions restoring the entries saved, in the order saved */
+	restores []func()
+}
+
+/* Checks if the entry is yet to be saved, marking it as saved; always false for a nil state, nothing being validated */
+func (r *TransactionState) Saving(kind, key string) bool {
+	if r == nil {
+		return false
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.saved[kind+":"+key] {
+		return false
+	}
+	r.saved[kind+":"+key] = true
+	return true
+}
+
+/* Add the function restoring an entry saved */
+func (r *TransactionState) Add(restore func()) {
+	r.Lock()
+	defer r.Unlock()
+	r.restores = append(r.restores, restore)
+}
+
+/* Start saving the state changed by a transaction, nil unless the changes are validated */
+func (r *ConfigurationStore) SaveState() *TransactionState {
+	if r.options.validate == "" {
+		return nil
+	}
+	state := &TransactionState{saved: make(map[string]bool, 0)}
+	r.transaction.Store(state)
+	return state
+}
+
+/* The state of the transaction in progress, nil if there's none or the changes aren't validated */
+func (r *ConfigurationStore) TransactionState() *TransactionState {
+	state, _ := r.transaction.Load().(*TransactionState)
+	return state
+}
+
+/* Stop saving the state changed by the transaction */
+func (r *ConfigurationStore) EndState() {
+	if r.TransactionState() != nil {
+		r.transaction.Store((*TransactionState)(nil))
+	}
+}
+
+/* Restore the state taken ahead of the transaction, i.e. once the generation staged has been rejected */
+func (r *ConfigurationStore) RestoreState(state *TransactionState) {
+	r.EndState()
+	if state == nil {
+		return
+	}
+	logger.V(VERBOSE_INFO).Infof("Restoring the state of the mount point: %s, the changes staged were rejected", r.options.cfg_directory)
+	/* step: the latest saved first, so an entry saved twice (i.e. beneath a directory) is left as first saved */
+	for index := len(state.restores) - 1; index >= 0; index-- {
+		state.restores[index]()
+	}
+}
+
+/* Save the attributes, value applied, content written, files exploded and destinations of the key; the lock must be held */
+func (r *ConfigurationStore) SaveKeyState(path string) {
+	state := r.TransactionState()
+	if !state.Saving("key", path) {
+		return
+	}
+	attributes, hasAttributes := r.attributes[path]
+	applied, hasApplied := r.applied[path]
+	written, hasWritten := r.written[path]
+	exploded, hasExploded := r.exploded[path]
+	destinations, hasDestinations := r.destinations[path]
+	state.Add(func() {
+		r.Lock()
+		defer r.Unlock()
+		delete(r.attributes, path)
+		delete(r.applied, path)
+		delete(r.exploded, path)
+		delete(r.destinations, path)
+		if hasAttributes {
+			r.attributes[path] = attributes
+		}
+		if hasApplied {
+			r.applied[path] = applied
+		}
+		if hasExploded {
+			r.exploded[path] = exploded
+		}
+		if hasDestinations {
+			r.destinations[path] = destinations
+		}
+		if r.written != nil {
+			delete(r.written, path)
+			if hasWritten {
+				r.written[path] = written
+			}
+		}
+	})
+}
+
+/* Save the metadata of the directory; the metadata lock must be held */
+func (r *ConfigurationStore) SaveMetadataState(directory string) {
+	state := r.TransactionState()
+	if !state.Saving("metadata", directory) {
+		return
+	}
+	fields, found := r.metadata[directory]
+	state.Add(func() {
+		r.metadataLock.Lock()
+		defer r.metadataLock.Unlock()
+		delete(r.metadata, directory)
+		if found {
+			r.metadata[directory] = fields
+		}
+	})
+}
+
+/* Save the sync states of the file (as reported, i.e. under the mount point) and anything beneath it */
+func (r *ConfigurationStore) SaveSyncStates(state_path string) {
+	state := r.TransactionState()
+	if !state.Saving("state", state_path) {
+		return
+	}
+	saved := states.Beneath(state_path)
+	state.Add(func() { states.Replace(state_path, saved) })
+}
+
+/* Save the entry of the file in the hash index */
+func (r *ConfigurationStore) SaveHashEntry(full_path string) {
+	state := r.TransactionState()
+	if r.hashes == nil || !state.Saving("hash", full_path) {
+		return
+	}
+	entry, found := r.hashes.Entry(full_path)
+	state.Add(func() { r.hashes.Replace(full_path, entry, found) })
+}
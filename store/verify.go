@@ -0,0 +1,264 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gambol99/config-fs/store/fs"
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+/*
+	A file can be verified once written, by a command run for the files matching its path glob, i.e. that the JSON
+	parses or the certificate loads; should it fail the previous content is restored (or the file removed, if it
+	didn't exist), the write is failed and the alert command, if any, is run. The verifications are read from a
+	JSON file, a list of:
+
+		{"path": "/config/app/*.json", "command": "jq . \"$CONFIG_FS_FILE\""}
+		{"path": "/config/ssl/*.pem", "command": "openssl x509 -in \"$CONFIG_FS_FILE\" -noout", "alert": "logger -p crit \"$CONFIG_FS_ERROR\""}
+
+	The path of the file is given in CONFIG_FS_FILE, the command being run from its directory
+*/
+const (
+	/* the environment variables given to the verification and alert commands */
+	ENV_FILE  = "CONFIG_FS_FILE"
+	ENV_ERROR = "CONFIG_FS_ERROR"
+	/* the time a verification is given to complete by default */
+	VERIFY_TIMEOUT = 30 * time.Second
+)
+
+var InvalidVerificationErr = errors.New("Invalid verification, requires a path and a command")
+
+/* a command verifying the files matching its path once written */
+type Verification struct {
+	/* the glob of the paths under the mount point */
+	Path string `json:"path"`
+	/* the command run (via sh -c) */
+	Command string `json:"command"`
+	/* a command run (via sh -c) should the verification fail */
+	Alert string `json:"alert,omitempty"`
+	/* the time the command is given to complete */
+	Timeout string `json:"timeout,omitempty"`
+	/* the compiled path glob */
+	matcher *regexp.Regexp
+	/* the timeout parsed */
+	timeout time.Duration
+}
+
+/* Read the verifications from the file */
+func LoadVerifications(filename string) ([]*Verification, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	verifications := make([]*Verification, 0)
+	if err := json.Unmarshal(content, &verifications); err != nil {
+		return nil, err
+	}
+	for index, verification := range verifications {
+		if err := verification.Compile(); err != nil {
+			logger.Errorf("Invalid verification: %d in: %s, error: %s", index+1, filename, err)
+			return nil, err
+		}
+	}
+	return verifications, nil
+}
+
+/* Validates the verification, compiling the path glob and parsing the timeout */
+func (r *Verification) Compile() error {
+	if r.Path == "" || r.Command == "" {
+		return InvalidVerificationErr
+	}
+	var err error
+	r.timeout = VERIFY_TIMEOUT
+	if r.Timeout != "" {
+		if r.timeout, err = time.ParseDuration(r.Timeout); err != nil {
+			return err
+		}
+	}
+	r.matcher, err = CompileGlob(filepath.ToSlash(r.Path))
+	return err
+}
+
+/* Run the command against the file, an error (with the output) if it failed */
+func (r *Verification) Execute(path, mount string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	command := ShellCommand(ctx, r.Command)
+	command.Dir = filepath.Dir(path)
+	command.Env = append(os.Environ(), ENV_FILE+"="+path, ENV_MOUNT+"="+mount)
+	if output, err := command.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s, output: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+/* Run the alert command, if any, on the failure of the verification */
+func (r *Verification) Raise(path, mount string, failure error) {
+	if r.Alert == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	command := ShellCommand(ctx, r.Alert)
+	command.Env = append(os.Environ(), ENV_FILE+"="+path, ENV_MOUNT+"="+mount, ENV_ERROR+"="+failure.Error())
+	if output, err := command.CombinedOutput(); err != nil {
+		logger.Errorf("The alert command: %s for the file: %s failed, error: %s, output: %s", r.Alert, path, err, strings.TrimSpace(string(output)))
+	}
+}
+
+/* Wraps the file store, verifying the files written and restoring the previous content of any which fail */
+type VerifyingFS struct {
+	fs.FileStore
+	/* the verifications */
+	verifications []*Verification
+	/* the mount point, given to the commands */
+	mount string
+	/* maps the path written to that seen by the readers, i.e. beneath a generation => under the mount point */
+	visible func(string) string
+	/* a lock for the content rejected */
+	sync.Mutex
+	/* the digest of the content last rejected by a verification, by path, until the next reconciliation */
+	rejected map[string]string
+}
+
+/* Wrap the file store, verifying the files written */
+func NewVerifyingFS(store fs.FileStore, verifications []*Verification, mount string, visible func(string) string) *VerifyingFS {
+	return &VerifyingFS{
+		FileStore:     store,
+		verifications: verifications,
+		mount:         mount,
+		visible:       visible,
+		rejected:      make(map[string]string, 0),
+	}
+}
+
+/* The verifications of the path, the globs matched against the path seen by the readers rather than that staged */
+func (r *VerifyingFS) Matching(path string) []*Verification {
+	matching := make([]*Verification, 0)
+	for _, verification := range r.verifications {
+		if verification.matcher.MatchString(filepath.ToSlash(r.visible(path))) {
+			matching = append(matching, verification)
+		}
+	}
+	return matching
+}
+
+/* Checks if the path has any verifications */
+func (r *VerifyingFS) IsVerified(path string) bool {
+	return len(r.Matching(path)) > 0
+}
+
+/*
+	Applies the write of the content to the file, verifying the file afterwards and restoring the previous content
+	on a failure; the content rejected is refused outright should it be written again (i.e. the restore being seen
+	as a local change and reverted), so the verification fails the once rather than looping, until the next
+	reconciliation retries it (i.e. the failure was a timeout, or down to a file which had yet to arrive)
+*/
+func (r *VerifyingFS) Verify(path, content string, write func() error) error {
+	matching := r.Matching(path)
+	if len(matching) <= 0 {
+		return write()
+	}
+	digest := ValueDigest(content)
+	r.Lock()
+	rejected := r.rejected[path] == digest
+	r.Unlock()
+	if rejected {
+		return fmt.Errorf("the content of the file: %s has already failed verification", path)
+	}
+	/* step: keep the previous content, so it can be restored */
+	var previous string
+	var attributes fs.Attributes
+	existed := false
+	if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+		if previous, err = r.FileStore.Read(path); err == nil {
+			uid, gid, _ := fs.FileOwner(info)
+			attributes, existed = fs.Attributes{Mode: info.Mode().Perm(), UID: uid, GID: gid}, true
+		}
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	for _, verification := range matching {
+		failure := verification.Execute(path, r.mount)
+		if failure == nil {
+			continue
+		}
+		metrics.Increment(metrics.VERIFICATIONS_FAILED)
+		if existed {
+			logger.Errorf("The verification: %s of the file: %s failed, restoring the previous content, error: %s", verification.Command, path, failure)
+			if err := r.FileStore.Update(path, previous, attributes); err != nil {
+				logger.Errorf("Failed to restore the previous content of the file: %s, error: %s", path, err)
+			}
+		} else {
+			logger.Errorf("The verification: %s of the file: %s failed, removing the file, error: %s", verification.Command, path, failure)
+			if err := r.FileStore.Delete(path); err != nil {
+				logger.Errorf("Failed to remove the file: %s, error: %s", path, err)
+			}
+		}
+		r.Lock()
+		r.rejected[path] = digest
+		r.Unlock()
+		verification.Raise(path, r.mount, failure)
+		return fmt.Errorf("the verification of the file: %s failed, %s", path, failure)
+	}
+	r.Lock()
+	delete(r.rejected, path)
+	r.Unlock()
+	return nil
+}
+
+/* Forget the content rejected, so it's verified again when next written, i.e. by a reconciliation */
+func (r *VerifyingFS) Forget() {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.rejected = make(map[string]string, 0)
+}
+
+func (r *VerifyingFS) Create(path string, value string, attributes fs.Attributes) error {
+	return r.Verify(path, value, func() error { return r.FileStore.Create(path, value, attributes) })
+}
+
+func (r *VerifyingFS) Update(path string, value string, attributes fs.Attributes) error {
+	return r.Verify(path, value, func() error { return r.FileStore.Update(path, value, attributes) })
+}
+
+/* note: the content streamed to a file being verified is read up front, so it can be refused if rejected */
+func (r *VerifyingFS) Stream(path string, reader io.Reader, attributes fs.Attributes) error {
+	if !r.IsVerified(path) {
+		return r.FileStore.Stream(path, reader, attributes)
+	}
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return r.Verify(path, string(content), func() error { return r.FileStore.Stream(path, bytes.NewReader(content), attributes) })
+}
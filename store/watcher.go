@@ -20,7 +20,6 @@ import (
 
 	"github.com/gambol99/config-fs/store/fs"
 	"github.com/go-fsnotify/fsnotify"
-	"github.com/golang/glog"
 )
 
 /* the interface to the service */
@@ -31,6 +30,8 @@ type WatchService interface {
 	RemoveDirectoryWatch(path string) error
 	/* add a listener for changes in the file system */
 	AddWatchListener(listener WatchServiceChannel)
+	/* stop watching and release the resources */
+	Close() error
 }
 
 /* the implementation of the above */
@@ -50,42 +51,118 @@ type WatchServiceChannel chan *fsnotify.Event
 
 /* create an instance */
 func NewWatchService() (WatchService, error) {
-	glog.Infof("Creating a new Watch Service")
+	logger.Infof("Creating a new Watch Service")
 	/* step: create a watcher */
 	if watcher, err := fsnotify.NewWatcher(); err != nil {
-		glog.Errorf("Failed to create a watcher, error: %s", err)
+		logger.Errorf("Failed to create a watcher, error: %s", err)
 		return nil, err
 	} else {
 		service := new(Watcher)
 		service.listeners = make(map[WatchServiceChannel]bool, 0)
 		service.watcher = watcher
 		service.directories = make(map[string]bool, 0)
+		/* step: start forwarding the events to the listeners */
+		go service.ProcessEvents()
 		return service, nil
 	}
 }
 
+/* forward the events from the file system watcher to the listeners */
+func (r *Watcher) ProcessEvents() {
+	for {
+		select {
+		case event, ok := <-r.watcher.Events:
+			if !ok {
+				logger.V(VERBOSE_LEVEL).Infof("The file system watcher has been closed, exitting the event loop")
+				return
+			}
+			logger.V(VERBOSE_LEVEL).Infof("Recieved file system event: %s", event)
+			/* step: keep the watches in step with the tree as it grows and shrinks */
+			r.TrackDirectory(event)
+			r.RLock()
+			for listener, _ := range r.listeners {
+				notification := event
+				listener <- &notification
+			}
+			r.RUnlock()
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Errorf("Recieved an error from the file system watcher, error: %s", err)
+		}
+	}
+}
+
+/*
+	Add a watch on a directory created (or moved) beneath a watched directory, along with its subdirectories, and
+	drop the watches on a directory removed or moved away; our own directories (i.e. the generations of the
+	atomic swap) are left to those watching them
+*/
+func (r *Watcher) TrackDirectory(event fsnotify.Event) {
+	switch {
+	case event.Op&fsnotify.Create == fsnotify.Create:
+		if IsInternalName(filepath.Base(event.Name)) || !r.IsWatched(filepath.Dir(event.Name)) {
+			return
+		}
+		/* step: a symlink to a directory is not followed */
+		if stat, err := os.Lstat(event.Name); err != nil || !stat.IsDir() {
+			return
+		}
+		logger.V(VERBOSE_INFO).Infof("Adding a watch on the new directory: %s", event.Name)
+		if err := r.AddDirectoryWatch(event.Name); err != nil {
+			logger.Errorf("Failed to add a watch on the new directory: %s, error: %s", event.Name, err)
+		}
+	case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		if r.IsWatched(event.Name) {
+			r.RemoveDirectoryWatch(event.Name)
+		}
+	}
+}
+
+func (r *Watcher) Close() error {
+	logger.Infof("Closing the watches on the mount point")
+	return r.watcher.Close()
+}
+
+func (r *Watcher) IsWatched(path string) bool {
+	r.RLock()
+	defer r.RUnlock()
+	_, found := r.directories[path]
+	return found
+}
+
 func (r *Watcher) AddDirectoryWatched(path string) {
 	r.Lock()
 	defer r.Unlock()
 	r.directories[path] = true
 }
 
-/* remove the directory watch */
+/* remove the directory watch, along with the watches on any subdirectories */
 func (r *Watcher) RemoveDirectoryWatch(path string) error {
-
+	logger.V(VERBOSE_LEVEL).Infof("Removing the directory watch on directory: %s", path)
+	r.Lock()
+	defer r.Unlock()
+	for directory, _ := range r.directories {
+		if directory == path || IsBeneath(path, directory) {
+			/* step: the watch is dropped by the kernel if the directory has been removed */
+			r.watcher.Remove(directory)
+			delete(r.directories, directory)
+		}
+	}
 	return nil
 }
 
 /* add a listener for changes in the file system */
 func (r *Watcher) AddWatchListener(listener WatchServiceChannel) {
-	glog.V(VERBOSE_LEVEL).Infof("Adding the new event listener: %v", listener)
+	logger.V(VERBOSE_LEVEL).Infof("Adding the new event listener: %v", listener)
 	r.Lock()
 	defer r.Unlock()
 	r.listeners[listener] = true
 }
 
 func (r *Watcher) RemoveWatchLister(listener WatchServiceChannel) {
-	glog.V(VERBOSE_LEVEL).Infof("Removing the listen: %v from the list", listener)
+	logger.V(VERBOSE_LEVEL).Infof("Removing the listen: %v from the list", listener)
 	r.Lock()
 	defer r.Unlock()
 	for channel, _ := range r.listeners {
@@ -97,39 +174,40 @@ func (r *Watcher) RemoveWatchLister(listener WatchServiceChannel) {
 }
 
 func (r *Watcher) AddDirectoryWatch(path string) error {
-	glog.V(VERBOSE_LEVEL).Infof("Adding directory watch on directory: %s", path)
+	logger.V(VERBOSE_LEVEL).Infof("Adding directory watch on directory: %s", path)
 	/* step: check the directory actually exists */
 	if directory, err := r.IsDirectory(path); err != nil {
-		glog.Errorf("Failed to stat the directory: %s, error: %s", path, err)
+		logger.Errorf("Failed to stat the directory: %s, error: %s", path, err)
 		return err
 	} else {
 		if directory == false {
-			glog.Errorf("Failed to add directory watch on: %s, directory does not exist", path)
+			logger.Errorf("Failed to add directory watch on: %s, directory does not exist", path)
 			return fs.DirectoryDoesNotExistErr
 		}
 	}
 
 	/* check if the directory is already being watched */
-	if _, found := r.directories[path]; found {
-		glog.V(VERBOSE_LEVEL).Infof("The directory: %s is already being watched, skipping for now", path)
+	if r.IsWatched(path) {
+		logger.V(VERBOSE_LEVEL).Infof("The directory: %s is already being watched, skipping for now", path)
+		return nil
 	}
 
 	/* step: add the directory and all subdirectores to the watcher */
 	if err := r.watcher.Add(path); err != nil {
-		glog.Errorf("Failed to add a watcher on the directory: %s, error: %s", path, err)
+		logger.Errorf("Failed to add a watcher on the directory: %s, error: %s", path, err)
 		return err
 	} else {
 		/* step: add to the list of watcher directories */
-		r.AddDirectoryWatch(path)
+		r.AddDirectoryWatched(path)
 		/* step: we need to get a list of subdirectories */
 		if paths, err := r.ListDirectories(path); err != nil {
-			glog.Errorf("Failed to get a list of subdirectories from path: %s, error: %s", path, err)
+			logger.Errorf("Failed to get a list of subdirectories from path: %s, error: %s", path, err)
 			return err
 		} else {
 			/* step: we iterate the folder and add a watch on each directory */
 			for _, subdirectory := range paths {
 				if err := r.AddDirectoryWatch(subdirectory); err != nil {
-					glog.Errorf("Failed to add a watch on the subdirectory: %s", subdirectory)
+					logger.Errorf("Failed to add a watch on the subdirectory: %s", subdirectory)
 				}
 			}
 		}
@@ -149,7 +227,7 @@ func (r *Watcher) IsDirectory(path string) (bool, error) {
 		return false, nil
 	}
 	if stat, err := os.Stat(path); err != nil {
-		glog.Errorf("Failed to stat the path: %s, error: %s", path, err)
+		logger.Errorf("Failed to stat the path: %s, error: %s", path, err)
 		return false, err
 	} else {
 		return stat.IsDir(), nil
@@ -160,19 +238,15 @@ func (r *Watcher) ListDirectories(path string) ([]string, error) {
 	paths := make([]string, 0)
 	if err := filepath.Walk(path, (filepath.WalkFunc)(func(file_path string, info os.FileInfo, err error) error {
 		if err != nil {
-			glog.Errorf("Failed to walk the directory: %s", file_path)
+			logger.Errorf("Failed to walk the directory: %s", file_path)
 			return err
 		}
-		if info.IsDir() {
-			name := info.Name()
-			if name != "." && name != ".." {
-				return filepath.SkipDir
-			}
+		if info.IsDir() && file_path != path {
 			paths = append(paths, file_path)
 		}
 		return nil
 	})); err != nil {
-		glog.Errorf("Failed to walk the directory: %s, error: %s", path, err)
+		logger.Errorf("Failed to walk the directory: %s, error: %s", path, err)
 		return nil, err
 	}
 	return paths, nil
@@ -0,0 +1,342 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+/*
+	The webhooks are posted a JSON payload once files under the mount point have changed, a template has failed to
+	render, a file which had drifted from the store has been repaired or the changes staged failed the validation,
+	so a downstream system can react without polling the mount point. The events are batched; the first starts the
+	window (-webhook_batch) and everything happening within it is posted together, each webhook given the events of
+	the types it subscribes to and the paths matching its glob. The webhooks are read from a JSON file, a list of:
+
+		{"url": "https://deploy.example.com/reload", "events": ["changed"], "path": "/config/haproxy/**"}
+		{"url": "https://alerts.example.com/hook", "events": ["template_failed", "drift_repaired"], "headers": {"Authorization": "Bearer xyz"}, "retries": 3}
+*/
+const (
+	/* the types of event */
+	WEBHOOK_CHANGED         = "changed"
+	WEBHOOK_TEMPLATE_FAILED = "template_failed"
+	WEBHOOK_DRIFT_REPAIRED  = "drift_repaired"
+	/* the changes staged were rejected by the -validate command */
+	WEBHOOK_VALIDATION_FAILED = "validation_failed"
+	/* the time a webhook is given to answer by default */
+	WEBHOOK_TIMEOUT = 10 * time.Second
+	/* the delay between the attempts to post the payload */
+	WEBHOOK_RETRY_DELAY = time.Second
+)
+
+var InvalidWebhookErr = errors.New("Invalid webhook, requires a url, the events being changed, template_failed, drift_repaired or validation_failed")
+
+/* a webhook posted the events of the types it subscribes to */
+type Webhook struct {
+	/* the url the payload is posted to */
+	URL string `json:"url"`
+	/* the types of event, empty subscribes to every type */
+	Events []string `json:"events,omitempty"`
+	/* the glob of the paths under the mount point, empty matches every path */
+	Path string `json:"path,omitempty"`
+	/* the headers added to the request, i.e. an Authorization */
+	Headers map[string]string `json:"headers,omitempty"`
+	/* the time the webhook is given to answer */
+	Timeout string `json:"timeout,omitempty"`
+	/* the number of times the payload is posted again should it fail */
+	Retries int `json:"retries,omitempty"`
+	/* the compiled path glob */
+	matcher *regexp.Regexp
+	/* the types of event subscribed to */
+	events map[string]bool
+	/* the timeout parsed */
+	timeout time.Duration
+}
+
+/* an event posted to the webhooks */
+type WebhookEvent struct {
+	/* the type of event */
+	Type string `json:"type"`
+	/* the path of the file, as seen under the mount point */
+	Path string `json:"path"`
+	/* the key the file is materialized from, if known */
+	Key string `json:"key,omitempty"`
+	/* the error of a template which failed to render */
+	Error string `json:"error,omitempty"`
+	/* when the event happened */
+	Time time.Time `json:"time"`
+}
+
+/* the payload posted to a webhook, the events of the batch it subscribes to */
+type WebhookPayload struct {
+	/* the mount point and the host it's on */
+	Mount string `json:"mount"`
+	Host  string `json:"host"`
+	/* when the payload was posted */
+	Time time.Time `json:"time"`
+	/* the paths of the events, sorted and without duplicates */
+	Paths []string `json:"paths"`
+	/* the events, in the order they happened */
+	Events []WebhookEvent `json:"events"`
+}
+
+/* Read the webhooks from the file */
+func LoadWebhooks(filename string) ([]*Webhook, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	webhooks := make([]*Webhook, 0)
+	if err := json.Unmarshal(content, &webhooks); err != nil {
+		return nil, err
+	}
+	for index, webhook := range webhooks {
+		if err := webhook.Compile(); err != nil {
+			logger.Errorf("Invalid webhook: %d in: %s, error: %s", index+1, filename, err)
+			return nil, err
+		}
+	}
+	return webhooks, nil
+}
+
+/* Validates the webhook, compiling the path glob and parsing the events and timeout */
+func (r *Webhook) Compile() error {
+	if r.URL == "" || r.Retries < 0 {
+		return InvalidWebhookErr
+	}
+	r.events = make(map[string]bool, 0)
+	for _, event := range r.Events {
+		switch event {
+		case WEBHOOK_CHANGED, WEBHOOK_TEMPLATE_FAILED, WEBHOOK_DRIFT_REPAIRED, WEBHOOK_VALIDATION_FAILED:
+			r.events[event] = true
+		default:
+			return InvalidWebhookErr
+		}
+	}
+	var err error
+	r.timeout = WEBHOOK_TIMEOUT
+	if r.Timeout != "" {
+		if r.timeout, err = time.ParseDuration(r.Timeout); err != nil {
+			return err
+		}
+	}
+	if r.Path != "" {
+		if r.matcher, err = CompileGlob(filepath.ToSlash(r.Path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* The events of the types subscribed to whose path matches the glob of the webhook */
+func (r *Webhook) Matching(events []WebhookEvent) []WebhookEvent {
+	list := make([]WebhookEvent, 0)
+	for _, event := range events {
+		if len(r.events) > 0 && !r.events[event.Type] {
+			continue
+		}
+		if r.matcher != nil && !r.matcher.MatchString(filepath.ToSlash(event.Path)) {
+			continue
+		}
+		list = append(list, event)
+	}
+	return list
+}
+
+/* A description of the webhook, for the logs */
+func (r *Webhook) String() string {
+	return fmt.Sprintf("url: %s", r.URL)
+}
+
+/* Post the payload to the webhook, retrying on a failure; anything but a 2xx is a failure */
+func (r *Webhook) Send(content []byte) error {
+	client := &http.Client{Timeout: r.timeout}
+	var err error
+	for attempt := 0; attempt <= r.Retries; attempt++ {
+		if attempt > 0 {
+			logger.V(VERBOSE_INFO).Infof("Retrying the webhook, %s (%d of %d), error: %s", r, attempt, r.Retries, err)
+			time.Sleep(WEBHOOK_RETRY_DELAY)
+		}
+		if err = r.Post(client, content); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+/* Post the payload to the webhook the once */
+func (r *Webhook) Post(client *http.Client, content []byte) error {
+	request, err := http.NewRequest(http.MethodPost, r.URL, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range r.Headers {
+		request.Header.Set(name, value)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("the webhook answered with: %s", response.Status)
+	}
+	return nil
+}
+
+/* Posts the events to the webhooks, in batches */
+type Webhooks struct {
+	/* a lock for the events pending */
+	sync.Mutex
+	/* the webhooks */
+	webhooks []*Webhook
+	/* the mount point, given in the payload */
+	mount string
+	/* the window the events are batched over */
+	batch time.Duration
+	/* the events since the last batch was posted */
+	pending []WebhookEvent
+	/* signalled when an event is recorded */
+	notify chan struct{}
+	/* serializes the posts of the batches */
+	running sync.Mutex
+}
+
+/* Create the poster of the webhooks */
+func NewWebhooks(webhooks []*Webhook, mount string, batch time.Duration) *Webhooks {
+	return &Webhooks{
+		webhooks: webhooks,
+		mount:    mount,
+		batch:    batch,
+		pending:  make([]WebhookEvent, 0),
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+/* Record the events, they're posted with the batch; a nil poster records nothing */
+func (r *Webhooks) Notify(events ...WebhookEvent) {
+	if r == nil || len(events) <= 0 {
+		return
+	}
+	r.Lock()
+	r.pending = append(r.pending, events...)
+	r.Unlock()
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+/* Post the batches of events as they happen, until the context is cancelled */
+func (r *Webhooks) Run(ctx context.Context) {
+	var window <-chan time.Time
+	for {
+		select {
+		case <-r.notify:
+			/* note: unlike the hooks the window isn't extended by the events which follow, they're posted along */
+			if window == nil {
+				window = time.After(r.batch)
+			}
+		case <-window:
+			window = nil
+			r.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/*
+	Post the events pending, if any, to each of the webhooks subscribing to any of them; a failure is logged and
+	the batch is dropped for that webhook. A nil poster posts nothing
+*/
+func (r *Webhooks) Flush() {
+	if r == nil {
+		return
+	}
+	r.running.Lock()
+	defer r.running.Unlock()
+	r.Lock()
+	events := r.pending
+	r.pending = make([]WebhookEvent, 0)
+	r.Unlock()
+	if len(events) <= 0 {
+		return
+	}
+	hostname, _ := os.Hostname()
+	for _, webhook := range r.webhooks {
+		matching := webhook.Matching(events)
+		if len(matching) <= 0 {
+			continue
+		}
+		payload := WebhookPayload{
+			Mount:  r.mount,
+			Host:   hostname,
+			Time:   time.Now().UTC(),
+			Paths:  WebhookPaths(matching),
+			Events: matching,
+		}
+		content, err := json.Marshal(payload)
+		if err != nil {
+			logger.Errorf("Failed to encode the payload of the webhook, %s, error: %s", webhook, err)
+			continue
+		}
+		logger.V(VERBOSE_INFO).Infof("Posting the webhook, %s, %d events", webhook, len(matching))
+		if err := webhook.Send(content); err != nil {
+			logger.Errorf("The webhook, %s failed, %d events dropped, error: %s", webhook, len(matching), err)
+			metrics.Increment(metrics.WEBHOOKS_FAILED)
+			continue
+		}
+		metrics.Increment(metrics.WEBHOOKS_SENT)
+	}
+}
+
+/* The paths of the events, sorted and without duplicates */
+func WebhookPaths(events []WebhookEvent) []string {
+	seen := make(map[string]bool, 0)
+	paths := make([]string, 0)
+	for _, event := range events {
+		if !seen[event.Path] {
+			seen[event.Path] = true
+			paths = append(paths, event.Path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+/* Hand an event for the file of the key to the webhooks, the path as seen under the mount point */
+func (r *ConfigurationStore) NotifyWebhooks(event, path, full_path string) {
+	if r.webhooks == nil {
+		return
+	}
+	r.webhooks.Notify(WebhookEvent{Type: event, Path: r.StatePath(full_path), Key: path, Time: time.Now().UTC()})
+}
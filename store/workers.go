@@ -0,0 +1,146 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"hash/fnv"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gambol99/config-fs/store/kv"
+
+	"github.com/go-fsnotify/fsnotify"
+)
+
+/* the number of handlers queued for each worker, the event loop blocks once full */
+const WORKER_QUEUE_SIZE = 64
+
+var InvalidWorkersErr = errors.New("The number of workers must be greater than zero")
+
+/*
+	A bounded pool of workers handling the events; the handlers for the same path are always queued to the same
+	worker, so they're applied in the order received (i.e. a delete and a create of a key can't be reordered),
+	while the handlers for different paths are applied in parallel
+*/
+type WorkerPool struct {
+	/* the queue of each of the workers */
+	queues []chan func()
+	/* the handlers in flight */
+	handlers *sync.WaitGroup
+}
+
+/* Create and start the workers, the handlers queued being tracked in the wait group */
+func NewWorkerPool(workers int, handlers *sync.WaitGroup) *WorkerPool {
+	pool := &WorkerPool{
+		queues:   make([]chan func(), workers),
+		handlers: handlers,
+	}
+	for index := range pool.queues {
+		queue := make(chan func(), WORKER_QUEUE_SIZE)
+		pool.queues[index] = queue
+		go func() {
+			for handler := range queue {
+				handler()
+				pool.handlers.Done()
+			}
+		}()
+	}
+	return pool
+}
+
+/* Queue the handler of an event for the path, behind those already queued for it */
+func (r *WorkerPool) Submit(path string, handler func()) {
+	hash := fnv.New32a()
+	hash.Write([]byte(path))
+	r.handlers.Add(1)
+	r.queues[hash.Sum32()%uint32(len(r.queues))] <- handler
+}
+
+/*
+	Queue the handler as a barrier; it's applied once everything submitted before it has been applied, and before
+	anything submitted after it. The barrier is queued to each of the workers, the last to reach it applying the
+	handler and releasing the others, so the caller is never blocked waiting on it
+*/
+func (r *WorkerPool) Barrier(handler func()) {
+	waiting := int32(len(r.queues))
+	released := make(chan struct{})
+	r.handlers.Add(len(r.queues))
+	for _, queue := range r.queues {
+		queue <- func() {
+			if atomic.AddInt32(&waiting, -1) == 0 {
+				handler()
+				close(released)
+			}
+			<-released
+		}
+	}
+}
+
+/* Stop the workers once the handlers queued have been applied; nothing may be submitted after */
+func (r *WorkerPool) Close() {
+	for _, queue := range r.queues {
+		close(queue)
+	}
+}
+
+/*
+	Queue the handler of a change to the store; the changes to the files of a directory are applied in order by
+	the same worker, while a deletion or a change to a directory is applied alone, after everything received before
+	it and before anything after, so a key moved (deleted and created elsewhere) or a directory replaced by a file
+	is always applied as it happened, and a directory is never pruned under a file being written
+*/
+func (r *ConfigurationStore) SubmitNodeEvent(event kv.NodeChange, handler func()) {
+	if event.Operation == kv.DELETED || event.Node.IsDir() {
+		r.workers.Barrier(handler)
+		return
+	}
+	r.workers.Submit(r.WorkerKey(event.Node.Path, !event.Node.IsDir()), handler)
+}
+
+/* Queue the handler of a change to a template, behind the changes to the other files of its directory */
+func (r *ConfigurationStore) SubmitTemplateEvent(path string, handler func()) {
+	r.workers.Submit(r.WorkerKey(path, true), handler)
+}
+
+/* Queue the handler of a change on disk, behind the changes to the other files of its directory */
+func (r *ConfigurationStore) SubmitFileEvent(event *fsnotify.Event, handler func()) {
+	r.workers.Submit(r.DiskWorkerKey(event.Name), handler)
+}
+
+/*
+	The key the handlers of a change are queued under, the directory (relative to the mount point) of the file the
+	key is materialized as; so the changes to the files of a directory, whether from the store, a template or the
+	file system, are applied in order by the same worker
+*/
+func (r *ConfigurationStore) WorkerKey(key string, file bool) string {
+	return path.Dir(CleanKey(r.mapping.Map(key, file)))
+}
+
+/* The key the handlers of a change on disk are queued under, as above, the generations beneath the mount stripped */
+func (r *ConfigurationStore) DiskWorkerKey(full_path string) string {
+	key, found := DiskKey(r.options.cfg_directory, r.UnstagedPath(full_path))
+	if !found {
+		return full_path
+	}
+	if r.options.atomic_swap {
+		/* step: the path is taken relative to the generation it's beneath, i.e. /..2015_01_02_15_04_05/app/file */
+		if elements := strings.SplitN(strings.TrimPrefix(key, "/"), "/", 2); len(elements) == 2 && strings.HasPrefix(elements[0], "..") {
+			key = "/" + elements[1]
+		}
+	}
+	return path.Dir(key)
+}
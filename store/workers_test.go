@@ -0,0 +1,109 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+/* records the order the handlers were applied in */
+type appliedOrder struct {
+	sync.Mutex
+	items []string
+}
+
+func (r *appliedOrder) Handler(name string) func() {
+	return func() {
+		r.Lock()
+		defer r.Unlock()
+		r.items = append(r.items, name)
+	}
+}
+
+func (r *appliedOrder) Index(name string) int {
+	r.Lock()
+	defer r.Unlock()
+	for index, item := range r.items {
+		if item == name {
+			return index
+		}
+	}
+	return -1
+}
+
+func TestWorkerPoolSubmitOrder(t *testing.T) {
+	handlers := new(sync.WaitGroup)
+	pool := NewWorkerPool(4, handlers)
+	order := new(appliedOrder)
+	for index := 0; index < 50; index++ {
+		pool.Submit("/app", order.Handler(fmt.Sprintf("%d", index)))
+	}
+	handlers.Wait()
+	pool.Close()
+	for index := 0; index < 50; index++ {
+		if position := order.Index(fmt.Sprintf("%d", index)); position != index {
+			t.Errorf("the handler: %d for the same path was applied at: %d", index, position)
+		}
+	}
+}
+
+func TestWorkerPoolBarrier(t *testing.T) {
+	handlers := new(sync.WaitGroup)
+	pool := NewWorkerPool(4, handlers)
+	order := new(appliedOrder)
+	/* note: the workers are held up, so the barrier is queued behind the handlers rather than racing them */
+	gate := make(chan struct{})
+	for index := 0; index < 4; index++ {
+		pool.Submit(fmt.Sprintf("/held/%d", index), func() { <-gate })
+	}
+	for index := 0; index < 20; index++ {
+		pool.Submit(fmt.Sprintf("/before/%d", index), order.Handler(fmt.Sprintf("before-%d", index)))
+	}
+	pool.Barrier(order.Handler("barrier"))
+	for index := 0; index < 20; index++ {
+		pool.Submit(fmt.Sprintf("/after/%d", index), order.Handler(fmt.Sprintf("after-%d", index)))
+	}
+	close(gate)
+	handlers.Wait()
+	pool.Close()
+
+	barrier := order.Index("barrier")
+	if barrier < 0 {
+		t.Fatalf("the barrier was never applied")
+	}
+	for index := 0; index < 20; index++ {
+		if position := order.Index(fmt.Sprintf("before-%d", index)); position < 0 || position > barrier {
+			t.Errorf("the handler: before-%d was applied at: %d, after the barrier at: %d", index, position, barrier)
+		}
+		if position := order.Index(fmt.Sprintf("after-%d", index)); position < barrier {
+			t.Errorf("the handler: after-%d was applied at: %d, before the barrier at: %d", index, position, barrier)
+		}
+	}
+}
+
+func TestWorkerPoolBarriers(t *testing.T) {
+	handlers := new(sync.WaitGroup)
+	pool := NewWorkerPool(3, handlers)
+	order := new(appliedOrder)
+	pool.Barrier(order.Handler("first"))
+	pool.Submit("/app", order.Handler("between"))
+	pool.Barrier(order.Handler("second"))
+	handlers.Wait()
+	pool.Close()
+	if first, between, second := order.Index("first"), order.Index("between"), order.Index("second"); first != 0 || between != 1 || second != 2 {
+		t.Errorf("expected the barriers either side of the handler, got: %v", order.items)
+	}
+}
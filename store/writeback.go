@@ -0,0 +1,150 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/gambol99/config-fs/store/fs"
+	"github.com/gambol99/config-fs/store/kv"
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+/* The content last written to the file of a key */
+type WrittenContent struct {
+	/* the digest of the content */
+	Hash string
+	/* the attributes header of the value, if any, so it's preserved by the writeback */
+	Header string
+	/* the index of the store revision the content came from */
+	Index uint64
+}
+
+/* The digest of the content of a file */
+func ContentHash(content string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+}
+
+/* Records the content written to the file of the key, along with the attributes header of the value, if any */
+func (r *ConfigurationStore) SetWritten(path, header, content string, index uint64) {
+	if r.written == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.SaveKeyState(path)
+	r.written[path] = WrittenContent{
+		Hash:   ContentHash(content),
+		Header: header,
+		Index:  index,
+	}
+}
+
+/* Retrieve the content last written to the file of the key */
+func (r *ConfigurationStore) Written(path string) (WrittenContent, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	written, found := r.written[path]
+	return written, found
+}
+
+/*
+	Pushes a local change to the file of the key back to the store; an edit is written with a compare and swap
+	against the revision last materialized, so a change made in the store since is never clobbered (the store
+	wins and the file is updated from it as usual), while a new file is created only if the key doesn't exist.
+	The files computed by templates, links, encoded values and the local deletions are never written back
+*/
+func (r *ConfigurationStore) WriteBack(ctx context.Context, path string) {
+	if !r.writeback.IsIncluded(path) || !r.filter.IsIncluded(path) || IsMetadataKey(path) || ValidateKey(path) != nil {
+		return
+	}
+	if path == HASHED_DIRECTORY || strings.HasPrefix(path, HASHED_DIRECTORY+"/") {
+		return
+	}
+	if _, found := r.DestinationOwner(path); found {
+		return
+	}
+	if _, found := r.dynamic.IsDynamic(path); found {
+		return
+	}
+	/* step: the files generated from a key (or directory) can't be written back field by field */
+	if _, found := r.ExplodedOwner(path); found {
+		return
+	}
+	if _, found := r.AggregateOf(path); found {
+		return
+	}
+	if _, found := r.DocumentOf(path); found {
+		return
+	}
+	full_path := r.FullPath(path)
+	if strings.Contains(filepath.Base(full_path), fs.BACKUP_SUFFIX) || !r.fs.IsFile(full_path) || r.fs.IsSymlink(full_path) {
+		return
+	}
+	r.writebackLock.Lock()
+	defer r.writebackLock.Unlock()
+	/* step: we retrieve what we last wrote before reading the file, so the event of our own write (however
+	late it arrives) is never mistaken for a local change */
+	written, found := r.Written(path)
+	content, err := r.fs.Read(full_path)
+	if err != nil {
+		logger.Errorf("Failed to read the file: %s for the writeback, error: %s", full_path, err)
+		return
+	}
+	var node *kv.Node
+	switch {
+	case found && written.Hash == ContentHash(content):
+		return
+	case found:
+		logger.V(VERBOSE_INFO).Infof("Writing back the local change to: %s, revision: %d", path, written.Index)
+		node, err = r.kv.CompareAndSwap(ctx, path, written.Header+content, written.Index)
+	case r.HasAttributes(path):
+		/* note: the value is encoded or a link, or the key is being materialized as we speak */
+		logger.V(VERBOSE_LEVEL).Infof("Not writing back the local change to: %s, the key isn't plain content", path)
+		return
+	default:
+		logger.V(VERBOSE_INFO).Infof("Writing back the new file: %s as the key: %s", full_path, path)
+		node, err = r.kv.Create(ctx, path, content)
+	}
+	if err != nil {
+		/* check: the store may already hold the content, i.e. the event of a change we're materializing */
+		if current, failed := r.kv.Get(ctx, path); failed == nil {
+			if _, value := r.ParseAttributes(path, current.Value); value == content {
+				return
+			}
+		}
+		logger.Errorf("Failed to write back the local change to: %s, the store may have changed, error: %s", path, err)
+		metrics.Increment(metrics.WRITEBACK_CONFLICTS)
+		return
+	}
+	logger.Infof("Wrote back the local change to: %s, revision: %d", path, node.Index)
+	metrics.Increment(metrics.WRITEBACK_APPLIED)
+	r.SetWritten(path, strings.TrimSuffix(node.Value, content), content, node.Index)
+}
+
+/*
+	Checks if the file of the key already holds a revision at least as new, i.e. the event is for a change we
+	wrote back, or one superseded by a local change since; the file is restored if it's gone
+*/
+func (r *ConfigurationStore) IsWrittenBack(path, full_path string, index uint64) bool {
+	if r.writeback == nil {
+		return false
+	}
+	written, found := r.Written(path)
+	return found && index <= written.Index && r.fs.IsFile(full_path) && !r.fs.IsSymlink(full_path)
+}
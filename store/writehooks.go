@@ -0,0 +1,248 @@
+/*
+Copyright 2014 Rohith All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"plugin"
+	"strings"
+	"sync"
+
+	"github.com/gambol99/config-fs/store/fs"
+	"github.com/gambol99/config-fs/store/metrics"
+)
+
+/*
+	The writes to the files can be intercepted by hooks, registered via WithPreWriteHook and WithPostWriteHook or
+	loaded from Go plugins (-write_plugins); a pre-write hook is given the content about to be written and returns
+	the content to write in its place, or an error vetoing the write, i.e. enforcing a schema. The hooks are run in
+	the order registered, each given the content returned by the last, and the post-write hooks are then given the
+	content and the outcome of the write. A vetoed write fails as any other, the file keeping its previous content
+*/
+const (
+	/* the symbols a plugin exports the hooks as */
+	PRE_WRITE_SYMBOL  = "PreWriteHook"
+	POST_WRITE_SYMBOL = "PostWriteHook"
+)
+
+var InvalidWritePluginErr = errors.New("The plugin exports neither a PreWriteHook or PostWriteHook")
+
+/* A write about to be made, or made, to a file */
+type WriteRequest struct {
+	/* the path of the file, as seen under the mount point */
+	Path string
+	/* the key the file is materialized from, if known */
+	Key string
+	/* the content written */
+	Content string
+	/* the permissions of the file */
+	Mode os.FileMode
+}
+
+/* Inspects the writes before they're made */
+type PreWriteHook interface {
+	/* returns the content to write in place of that requested, or an error to veto the write */
+	PreWrite(request WriteRequest) (string, error)
+}
+
+/* Observes the writes once made */
+type PostWriteHook interface {
+	/* given the content written (as returned by the pre-write hooks) and the error of the write, if it failed */
+	PostWrite(request WriteRequest, err error)
+}
+
+/* Adapts a function to a PreWriteHook */
+type PreWriteFunc func(request WriteRequest) (string, error)
+
+func (r PreWriteFunc) PreWrite(request WriteRequest) (string, error) {
+	return r(request)
+}
+
+/* Adapts a function to a PostWriteHook */
+type PostWriteFunc func(request WriteRequest, err error)
+
+func (r PostWriteFunc) PostWrite(request WriteRequest, err error) {
+	r(request, err)
+}
+
+/* Registers the hooks run before each file is written */
+func WithPreWriteHook(hooks ...PreWriteHook) Option {
+	return func(config *Config) error {
+		config.pre_write_hooks = append(config.pre_write_hooks, hooks...)
+		return nil
+	}
+}
+
+/* Registers the hooks run after each file is written */
+func WithPostWriteHook(hooks ...PostWriteHook) Option {
+	return func(config *Config) error {
+		config.post_write_hooks = append(config.post_write_hooks, hooks...)
+		return nil
+	}
+}
+
+/*
+	Opens the plugins, each exporting a PreWriteHook and/or PostWriteHook; the symbol being either a variable of the
+	interface or a value implementing it
+*/
+func LoadWritePlugins(paths string) ([]PreWriteHook, []PostWriteHook, error) {
+	pre := make([]PreWriteHook, 0)
+	post := make([]PostWriteHook, 0)
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		loaded, err := plugin.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		found := false
+		if symbol, err := loaded.Lookup(PRE_WRITE_SYMBOL); err == nil {
+			if hook, ok := symbol.(*PreWriteHook); ok && *hook != nil {
+				pre, found = append(pre, *hook), true
+			} else if hook, ok := symbol.(PreWriteHook); ok {
+				pre, found = append(pre, hook), true
+			}
+		}
+		if symbol, err := loaded.Lookup(POST_WRITE_SYMBOL); err == nil {
+			if hook, ok := symbol.(*PostWriteHook); ok && *hook != nil {
+				post, found = append(post, *hook), true
+			} else if hook, ok := symbol.(PostWriteHook); ok {
+				post, found = append(post, hook), true
+			}
+		}
+		if !found {
+			logger.Errorf("The plugin: %s exports neither a %s or %s", path, PRE_WRITE_SYMBOL, POST_WRITE_SYMBOL)
+			return nil, nil, InvalidWritePluginErr
+		}
+		logger.Infof("Loaded the write hooks from the plugin: %s", path)
+	}
+	return pre, post, nil
+}
+
+/* Wraps the file store, running the hooks around the writes */
+type WriteHooksFS struct {
+	fs.FileStore
+	/* a lock for the content rewritten */
+	sync.Mutex
+	/* the hooks run before and after the writes */
+	pre  []PreWriteHook
+	post []PostWriteHook
+	/* maps the path written to that seen under the mount point, i.e. from a staged generation */
+	visible func(string) string
+	/* the files last written with content other than requested, path => the content */
+	rewritten map[string]RewrittenContent
+}
+
+/* The content written to a file in place of that requested, as returned by the hooks */
+type RewrittenContent struct {
+	/* the digest of the content requested */
+	Requested string
+	/* the content written */
+	Content string
+}
+
+/* Wrap the file store, running the hooks around the writes */
+func NewWriteHooksFS(store fs.FileStore, pre []PreWriteHook, post []PostWriteHook, visible func(string) string) *WriteHooksFS {
+	return &WriteHooksFS{
+		FileStore: store,
+		pre:       pre,
+		post:      post,
+		visible:   visible,
+		rewritten: make(map[string]RewrittenContent, 0),
+	}
+}
+
+/*
+	The content written to the file at the path for the content requested, i.e. as rewritten by the hooks; the
+	content requested if the hooks left it as is (or there are no hooks)
+*/
+func (r *WriteHooksFS) Rewritten(path, content string) string {
+	if r == nil {
+		return content
+	}
+	r.Lock()
+	defer r.Unlock()
+	if rewritten, found := r.rewritten[path]; found && rewritten.Requested == ContentHash(content) {
+		return rewritten.Content
+	}
+	return content
+}
+
+/* Record the content written to the file at the path, if other than requested */
+func (r *WriteHooksFS) SetRewritten(path, requested, content string) {
+	r.Lock()
+	defer r.Unlock()
+	if requested == content {
+		delete(r.rewritten, path)
+		return
+	}
+	r.rewritten[path] = RewrittenContent{Requested: ContentHash(requested), Content: content}
+}
+
+/* Runs the pre-write hooks, the write given the content they return, and the post-write hooks on its outcome */
+func (r *WriteHooksFS) Intercept(path, content string, attributes fs.Attributes, write func(string) error) error {
+	request := WriteRequest{Path: r.visible(path), Key: attributes.Source, Content: content, Mode: attributes.Mode}
+	for _, hook := range r.pre {
+		rewritten, err := hook.PreWrite(request)
+		if err != nil {
+			logger.Errorf("The write to the file: %s was vetoed by a hook, error: %s", request.Path, err)
+			metrics.Increment(metrics.WRITES_VETOED)
+			r.PostWrite(request, err)
+			return err
+		}
+		request.Content = rewritten
+	}
+	err := write(request.Content)
+	if err == nil {
+		r.SetRewritten(path, content, request.Content)
+	}
+	r.PostWrite(request, err)
+	return err
+}
+
+/* Hands the outcome of the write to the post-write hooks */
+func (r *WriteHooksFS) PostWrite(request WriteRequest, err error) {
+	for _, hook := range r.post {
+		hook.PostWrite(request, err)
+	}
+}
+
+func (r *WriteHooksFS) Create(path string, value string, attributes fs.Attributes) error {
+	return r.Intercept(path, value, attributes, func(content string) error { return r.FileStore.Create(path, content, attributes) })
+}
+
+func (r *WriteHooksFS) Update(path string, value string, attributes fs.Attributes) error {
+	return r.Intercept(path, value, attributes, func(content string) error { return r.FileStore.Update(path, content, attributes) })
+}
+
+/* note: the content streamed is read up front, as the hooks are given the content */
+func (r *WriteHooksFS) Stream(path string, reader io.Reader, attributes fs.Attributes) error {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return r.Intercept(path, string(content), attributes, func(content string) error {
+		return r.FileStore.Stream(path, bytes.NewReader([]byte(content)), attributes)
+	})
+}
+
+func (r *WriteHooksFS) Delete(path string) error {
+	r.SetRewritten(path, "", "")
+	return r.FileStore.Delete(path)
+}